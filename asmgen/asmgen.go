@@ -0,0 +1,790 @@
+// Package asmgen translates programs to GNU assembly for x86-64 Linux. The assembly is
+// linked with the runtime of the C backend (cgen.Runtime), e.g 'cc -o prog prog.s runtime.c -lm',
+// and the executable behaves like the one built from C.
+//
+// Programs come in the IR. Every value takes a slot of two words in the frame, at a fixed
+// offset from %rbp, and an instruction is carried out the way a stack machine does it:
+// operands are pushed onto the stack, popped by the instruction, which pushes its result,
+// which is then popped into the slot of the value. Words of a slot hold the payload
+// of ms_value, e.g a String takes both of them, an Int takes the first one, while a value
+// of type Any is a pointer to ms_value. Nothing is kept in registers across instructions,
+// which is what makes unwinding with longjmp safe.
+//
+// Functions of the program take their arguments on the stack, pushed in order, the position
+// of the call in %edi and %esi, and return the value in %rax and %rdx
+package asmgen
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/ir"
+	"math"
+	"strings"
+	"text/scanner"
+)
+
+// slotSize is the size of a value on the stack
+const slotSize = 16
+
+// handlerSize is the space a frame reserves for ms_handler, the runtime asserts it's enough
+const handlerSize = 256
+
+type (
+	generator struct {
+		// functions of the program by name, calls convert arguments to types of their parameters
+		funcs   map[string]*ir.Func
+		globals map[string]backing.ValueType
+		bss     strings.Builder
+		rodata  strings.Builder
+		// counter used to make up labels and names unique within the file
+		ids int
+		fn  *function
+		err error
+	}
+
+	// slot is where a value is kept, either in the frame or in a global
+	slot struct {
+		global string // empty for slots in the frame
+		offset int
+	}
+
+	// function is an assembly function being generated
+	function struct {
+		f *ir.Func
+		// function the init function calls once it's done, empty for the rest of them
+		entry string
+		body  strings.Builder
+		// bytes taken by the frame below %rbp
+		frame int
+		// position of the instruction being generated
+		pos    scanner.Position
+		slots  map[*ir.Value]slot
+		labels map[*ir.Block]string
+		// offset of ms_handler in the frame, pushed around instructions raising exceptions
+		// handled within the function
+		handler int
+	}
+)
+
+// word returns the operand addressing the word of the slot with the given index
+func (s slot) word(idx int) string {
+	if s.global != "" {
+		if idx == 0 {
+			return s.global + "(%rip)"
+		}
+		return fmt.Sprintf("%s+%d(%%rip)", s.global, idx*8)
+	}
+	return fmt.Sprintf("%d(%%rbp)", s.offset+idx*8)
+}
+
+// Generate translates the program to assembly. It fails on values the assembly backend
+// can't represent, which the typechecker rejects, e.g the ones of type Unit
+func Generate(program *ir.Program) ([]byte, error) {
+	g := &generator{
+		funcs:   make(map[string]*ir.Func),
+		globals: make(map[string]backing.ValueType),
+	}
+	for _, f := range program.Funcs {
+		g.funcs[f.Name] = f
+	}
+	for _, global := range program.Globals {
+		g.globals[global.Name] = global.Type
+		fmt.Fprintf(&g.bss, "%s:\n\t.zero %d\n", globalName(global.Name), slotSize)
+	}
+
+	var text strings.Builder
+	// top-level statements run first, then main
+	text.WriteString("\t.globl miniscala_main\n\t.type miniscala_main, @function\nminiscala_main:\n")
+	if program.Init != nil {
+		g.function(program.Init, "main", &text)
+	} else {
+		text.WriteString("\tpushq %rbp\n\tmovq %rsp, %rbp\n")
+		text.WriteString("\txorl %edi, %edi\n\txorl %esi, %esi\n")
+		fmt.Fprintf(&text, "\tcall %s\n", funcName("main"))
+		text.WriteString("\tleave\n\tret\n\n")
+	}
+	for _, f := range program.Funcs {
+		fmt.Fprintf(&text, "%s:\n", funcName(f.Name))
+		g.function(f, "", &text)
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	var out strings.Builder
+	out.WriteString("\t.text\n")
+	out.WriteString(text.String())
+	if g.rodata.Len() > 0 {
+		out.WriteString("\n\t.section .rodata\n")
+		out.WriteString(g.rodata.String())
+	}
+	if g.bss.Len() > 0 {
+		out.WriteString("\n\t.bss\n\t.align 16\n")
+		out.WriteString(g.bss.String())
+	}
+	// the stack isn't executable
+	out.WriteString("\n\t.section .note.GNU-stack,\"\",@progbits\n")
+	return []byte(out.String()), nil
+}
+
+// function writes the function out, wrapped in the prologue and the epilogue.
+// The init function calls entry once it's done
+func (g *generator) function(f *ir.Func, entry string, text *strings.Builder) {
+	g.fn = &function{
+		f:      f,
+		entry:  entry,
+		slots:  make(map[*ir.Value]slot),
+		labels: make(map[*ir.Block]string),
+	}
+	defer func() {
+		g.fn = nil
+	}()
+	// arguments are pushed in order, so the last one is the closest to the return address
+	for idx, param := range f.Params {
+		g.fn.slots[param] = slot{offset: 16 + (len(f.Params)-1-idx)*slotSize}
+	}
+	guarded := false
+	for _, b := range f.Blocks {
+		g.fn.labels[b] = g.label()
+		guarded = guarded || b.Catch != nil
+		for _, v := range b.Instrs {
+			if v.HasResult() && v.Op != ir.OpConst {
+				g.fn.slots[v] = slot{offset: g.alloc(slotSize)}
+			}
+		}
+	}
+	if guarded {
+		g.fn.handler = g.alloc(handlerSize)
+	}
+	if entry == "" {
+		g.emit("call ms_enter@PLT")
+	}
+	for idx, b := range f.Blocks {
+		var next *ir.Block
+		if idx+1 < len(f.Blocks) {
+			next = f.Blocks[idx+1]
+		}
+		g.block(b, next)
+	}
+
+	text.WriteString("\tpushq %rbp\n\tmovq %rsp, %rbp\n")
+	// the frame keeps the stack aligned to 16 bytes, as calls to C require
+	fmt.Fprintf(text, "\tsubq $%d, %%rsp\n", (g.fn.frame+15)/16*16)
+	text.WriteString(g.fn.body.String())
+	text.WriteString("\n")
+}
+
+// alloc reserves bytes in the frame and returns their offset from %rbp
+func (g *generator) alloc(size int) int {
+	g.fn.frame += size
+	return -g.fn.frame
+}
+
+func (g *generator) label() string {
+	g.ids++
+	return fmt.Sprintf(".L%d", g.ids)
+}
+
+func (g *generator) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if g.err == nil {
+		g.err = fmt.Errorf("[%d:%d] %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))
+	}
+}
+
+func (g *generator) emit(format string, args ...interface{}) {
+	g.fn.body.WriteString("\t")
+	fmt.Fprintf(&g.fn.body, format, args...)
+	g.fn.body.WriteString("\n")
+}
+
+func (g *generator) place(label string) {
+	fmt.Fprintf(&g.fn.body, "%s:\n", label)
+}
+
+// push pushes a slot made up of a pair of words
+func (g *generator) push(w0, w1 string) {
+	g.emit("pushq %s", w1)
+	g.emit("pushq %s", w0)
+}
+
+// pushWord pushes a slot holding a single word, e.g an Int
+func (g *generator) pushWord(w0 string) {
+	g.push(w0, "$0")
+}
+
+func (g *generator) pop(w0, w1 string) {
+	g.emit("popq %s", w0)
+	g.emit("popq %s", w1)
+}
+
+// popWord pops a slot holding a single word
+func (g *generator) popWord(w0 string) {
+	g.emit("popq %s", w0)
+	g.emit("addq $8, %%rsp")
+}
+
+// store pops the value on top of the stack into the slot
+func (g *generator) store(s slot) {
+	g.pop(s.word(0), s.word(1))
+}
+
+// position loads the position of the instruction being generated into a pair of registers,
+// which is how runtime functions that may throw are told where they're called from
+func (g *generator) position(line, col string) {
+	g.emit("movl $%d, %s", g.fn.pos.Line, line)
+	g.emit("movl $%d, %s", g.fn.pos.Column, col)
+}
+
+// funcName returns the symbol of the function defined by the program
+func funcName(name string) string {
+	return "f_" + mangle(name)
+}
+
+// globalName returns the symbol of the global variable
+func globalName(name string) string {
+	return "g_" + mangle(name)
+}
+
+// mangle turns a name into a symbol, names may contain characters such as - and $
+func mangle(name string) string {
+	var b strings.Builder
+	for idx := 0; idx < len(name); idx++ {
+		c := name[idx]
+		switch {
+		case c == '_':
+			b.WriteString("__")
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func (g *generator) block(b *ir.Block, next *ir.Block) {
+	g.place(g.fn.labels[b])
+	for _, v := range b.Instrs {
+		switch v.Op {
+		case ir.OpPhi, ir.OpConst, ir.OpCatch:
+			// phis and the exception a handler is entered with are stored on the way to the block,
+			// constants are loaded wherever they're used
+			continue
+		}
+		g.fn.pos = v.Pos
+		if b.Catch != nil && v.MayThrow() {
+			g.guard(b, func() { g.instr(v) }, true)
+		} else {
+			g.instr(v)
+		}
+	}
+
+	g.fn.pos = b.Pos
+	switch b.Kind {
+	case ir.BlockPlain:
+		g.jump(b, b.Succs[0], next)
+	case ir.BlockIf:
+		then, els := b.Succs[0], b.Succs[1]
+		g.operand(b.Control)
+		g.popWord("%rax")
+		g.emit("testq %%rax, %%rax")
+		if g.hasCopies(b, then) {
+			elseLabel := g.label()
+			g.emit("je %s", elseLabel)
+			g.jump(b, then, nil)
+			g.place(elseLabel)
+		} else {
+			g.emit("jne %s", g.fn.labels[then])
+		}
+		g.jump(b, els, next)
+	case ir.BlockReturn:
+		if g.fn.entry != "" {
+			g.emit("xorl %%edi, %%edi")
+			g.emit("xorl %%esi, %%esi")
+			g.emit("call %s", funcName(g.fn.entry))
+		} else {
+			g.emit("call ms_leave@PLT")
+			if b.Control != nil {
+				g.convert(b.Control, g.fn.f.ResultType)
+				g.pop("%rax", "%rdx")
+			}
+		}
+		g.emit("leave")
+		g.emit("ret")
+	case ir.BlockThrow:
+		raise := func() {
+			g.operand(b.Control)
+			g.popWord("%rdi")
+			g.position("%esi", "%edx")
+			g.emit("call ms_raise@PLT")
+		}
+		if b.Catch != nil {
+			g.guard(b, raise, false)
+		} else {
+			raise()
+		}
+	}
+}
+
+// guard generates code with the handler of the frame pushed, an exception it raises
+// returns from _setjmp once more and goes to the block handling exceptions raised by b.
+// The handler is popped once the code is done, unless it never is
+func (g *generator) guard(b *ir.Block, code func(), pop bool) {
+	caughtLabel, doneLabel := g.label(), g.label()
+	g.emit("leaq %d(%%rbp), %%rdi", g.fn.handler)
+	g.emit("call ms_push_handler@PLT")
+	// jmp_buf comes first in ms_handler
+	g.emit("leaq %d(%%rbp), %%rdi", g.fn.handler)
+	g.emit("call _setjmp@PLT")
+	g.emit("testl %%eax, %%eax")
+	g.emit("jne %s", caughtLabel)
+	code()
+	if pop {
+		g.emit("call ms_pop_handler@PLT")
+	}
+	g.emit("jmp %s", doneLabel)
+	g.place(caughtLabel)
+	for _, v := range b.Catch.Instrs {
+		if v.Op == ir.OpCatch {
+			g.emit("call ms_caught_exception@PLT")
+			g.emit("movq %%rax, %s", g.fn.slots[v].word(0))
+		}
+	}
+	g.jump(b, b.Catch, nil)
+	g.place(doneLabel)
+}
+
+// jump passes control from a block to its successor, which follows it unless it's next
+func (g *generator) jump(from, to *ir.Block, next *ir.Block) {
+	g.edge(from, to)
+	if to != next {
+		g.emit("jmp %s", g.fn.labels[to])
+	}
+}
+
+// phis returns phis of the block
+func phis(b *ir.Block) []*ir.Value {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == ir.OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// hasCopies reports whether the edge assigns phis
+func (g *generator) hasCopies(from, to *ir.Block) bool {
+	idx := to.PredIndex(from)
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			return true
+		}
+	}
+	return false
+}
+
+// edge assigns phis of the block control is passed to their arguments coming
+// from the block it's passed from. All of the arguments are pushed before any
+// of the phis is assigned, as a phi may be an argument of another one
+func (g *generator) edge(from, to *ir.Block) {
+	idx := to.PredIndex(from)
+	var assigned []*ir.Value
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			g.convert(phi.Args[idx], phi.Type)
+			assigned = append(assigned, phi)
+		}
+	}
+	for i := len(assigned) - 1; i >= 0; i-- {
+		g.store(g.fn.slots[assigned[i]])
+	}
+}
+
+// instr carries out the instruction, storing its result in its slot
+func (g *generator) instr(v *ir.Value) {
+	switch v.Op {
+	case ir.OpLoadGlobal:
+		global := slot{global: globalName(v.Aux.(string))}
+		g.push(global.word(0), global.word(1))
+	case ir.OpStoreGlobal:
+		name := v.Aux.(string)
+		g.convert(v.Args[0], g.globals[name])
+		g.store(slot{global: globalName(name)})
+		return
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpDiv, ir.OpMod, ir.OpNeg,
+		ir.OpEq, ir.OpNe, ir.OpLt, ir.OpLe, ir.OpGt, ir.OpGe, ir.OpAnd, ir.OpOr, ir.OpNot:
+		g.operation(v)
+	case ir.OpToFloat:
+		g.operand(v.Args[0])
+		g.popWord("%rax")
+		g.emit("cvtsi2sdq %%rax, %%xmm0")
+		g.emit("movq %%xmm0, %%rax")
+		g.pushWord("%rax")
+	case ir.OpCast:
+		castType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		switch {
+		case castType == operandType:
+			g.operand(v.Args[0])
+		case castType == backing.Any:
+			g.convert(v.Args[0], backing.Any)
+		default:
+			g.convert(v.Args[0], backing.Any)
+			g.popWord("%rdi")
+			g.emit("movl $%d, %%esi", castType)
+			g.position("%edx", "%ecx")
+			g.emit("call ms_cast_ref@PLT")
+			// the payload of ms_value follows its type
+			g.push("8(%rax)", "16(%rax)")
+		}
+	case ir.OpInstanceOf:
+		testType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		if operandType != backing.Any {
+			result := 0
+			if backing.IsAssignable(testType, operandType) {
+				result = 1
+			}
+			g.pushWord(fmt.Sprintf("$%d", result))
+			break
+		}
+		g.operand(v.Args[0])
+		g.popWord("%rdi")
+		g.emit("movl $%d, %%esi", testType)
+		g.emit("call ms_instance_of_ref@PLT")
+		g.emit("movzbl %%al, %%eax")
+		g.pushWord("%rax")
+	case ir.OpCall:
+		g.call(v)
+	default:
+		g.errorf(v.Pos, "instruction %s isn't supported by the assembly backend", v.Op)
+		return
+	}
+	if v.HasResult() {
+		g.store(g.fn.slots[v])
+	} else {
+		g.emit("addq $%d, %%rsp", slotSize)
+	}
+}
+
+// operand pushes the value
+func (g *generator) operand(v *ir.Value) {
+	if v.Op != ir.OpConst {
+		s := g.fn.slots[v]
+		g.push(s.word(0), s.word(1))
+		return
+	}
+	value := v.Aux.(backing.Value)
+	switch value.ValueType {
+	case backing.String:
+		g.stringLit(value.Value.(string), "%rax", "%rdx")
+		g.push("%rax", "%rdx")
+	case backing.Int:
+		g.emit("movabsq $%d, %%rax", value.Value.(int64))
+		g.pushWord("%rax")
+	case backing.Float:
+		g.emit("movabsq $%d, %%rax", int64(math.Float64bits(value.Value.(float64))))
+		g.pushWord("%rax")
+	case backing.Bool:
+		result := 0
+		if value.Value.(bool) {
+			result = 1
+		}
+		g.pushWord(fmt.Sprintf("$%d", result))
+	default:
+		g.errorf(v.Pos, "constants of type %s aren't supported by the assembly backend", backing.ValueTypeToStr(value.ValueType))
+		g.pushWord("$0")
+	}
+}
+
+// convert pushes the value converted to the target type,
+// a value is boxed if it's passed where a value of type Any is expected
+func (g *generator) convert(v *ir.Value, target backing.ValueType) {
+	g.operand(v)
+	if target == backing.Any && v.Type != backing.Any {
+		g.box(v.Type)
+	}
+}
+
+// box turns the value on top of the stack into a value of type Any
+func (g *generator) box(valueType backing.ValueType) {
+	g.pop("%rsi", "%rdx")
+	g.emit("movl $%d, %%edi", valueType)
+	g.emit("call ms_box_ref@PLT")
+	g.pushWord("%rax")
+}
+
+// stringLit loads the string, which is put into read-only data, into a pair of registers
+func (g *generator) stringLit(s string, data, length string) {
+	g.ids++
+	label := fmt.Sprintf(".LS%d", g.ids)
+	fmt.Fprintf(&g.rodata, "%s:\n\t.ascii \"", label)
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		switch {
+		case c == '"' || c == '\\':
+			g.rodata.WriteByte('\\')
+			g.rodata.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			g.rodata.WriteByte(c)
+		default:
+			fmt.Fprintf(&g.rodata, "\\%03o", c)
+		}
+	}
+	g.rodata.WriteString("\"\n")
+	g.emit("leaq %s(%%rip), %s", label, data)
+	g.emit("movq $%d, %s", len(s), length)
+}
+
+// setcc holds condition codes of comparisons, signed ones for Ints and unsigned ones
+// for Floats, which is how ucomisd sets the flags
+var setcc = map[ir.Op][2]string{
+	ir.OpGt: {"setg", "seta"},
+	ir.OpGe: {"setge", "setae"},
+	ir.OpLt: {"setl", "setb"},
+	ir.OpLe: {"setle", "setbe"},
+	ir.OpEq: {"sete", "sete"},
+	ir.OpNe: {"setne", "setne"},
+}
+
+// operation pushes the result of an arithmetic, comparison or logical instruction.
+// Operands of an instruction on Floats are Floats, the IR has promoted Ints already
+func (g *generator) operation(v *ir.Value) {
+	operandType := v.Args[0].Type
+	for _, arg := range v.Args {
+		g.operand(arg)
+	}
+	if len(v.Args) == 1 {
+		g.popWord("%rax")
+		switch {
+		case v.Op == ir.OpNot:
+			g.emit("xorq $1, %%rax")
+		case operandType == backing.Int:
+			g.emit("negq %%rax")
+		default:
+			// flipping the sign bit is multiplication by -1
+			g.emit("btcq $63, %%rax")
+		}
+		g.pushWord("%rax")
+		return
+	}
+
+	switch operandType {
+	case backing.String:
+		g.pop("%rdx", "%rcx")
+		g.pop("%rdi", "%rsi")
+		if v.Op == ir.OpAdd {
+			g.emit("call ms_concat@PLT")
+			g.push("%rax", "%rdx")
+			return
+		}
+		g.emit("call ms_compare_strings@PLT")
+		g.emit("cmpl $0, %%eax")
+		g.emit("%s %%al", setcc[v.Op][0])
+		g.emit("movzbl %%al, %%eax")
+		g.pushWord("%rax")
+		return
+	case backing.Bool:
+		g.popWord("%rcx")
+		g.popWord("%rax")
+		switch v.Op {
+		case ir.OpAnd:
+			g.emit("andq %%rcx, %%rax")
+		case ir.OpOr:
+			g.emit("orq %%rcx, %%rax")
+		default:
+			g.emit("cmpq %%rcx, %%rax")
+			g.emit("%s %%al", setcc[v.Op][0])
+			g.emit("movzbl %%al, %%eax")
+		}
+		g.pushWord("%rax")
+		return
+	case backing.Int:
+		g.intOperation(v.Op)
+		return
+	}
+
+	g.popWord("%rax")
+	g.emit("movq %%rax, %%xmm1")
+	g.popWord("%rax")
+	g.emit("movq %%rax, %%xmm0")
+	switch v.Op {
+	case ir.OpAdd:
+		g.emit("addsd %%xmm1, %%xmm0")
+	case ir.OpSub:
+		g.emit("subsd %%xmm1, %%xmm0")
+	case ir.OpMul:
+		g.emit("mulsd %%xmm1, %%xmm0")
+	case ir.OpDiv:
+		g.emit("divsd %%xmm1, %%xmm0")
+	case ir.OpMod:
+		g.emit("call fmod@PLT")
+	default:
+		g.floatComparison(v.Op)
+		g.pushWord("%rax")
+		return
+	}
+	g.emit("movq %%xmm0, %%rax")
+	g.pushWord("%rax")
+}
+
+func (g *generator) intOperation(op ir.Op) {
+	switch op {
+	case ir.OpDiv, ir.OpMod:
+		// division by zero throws, while the quotient of the smallest Int and -1 wraps around
+		g.popWord("%rsi")
+		g.popWord("%rdi")
+		g.position("%edx", "%ecx")
+		if op == ir.OpDiv {
+			g.emit("call ms_div_int@PLT")
+		} else {
+			g.emit("call ms_mod_int@PLT")
+		}
+		g.pushWord("%rax")
+		return
+	}
+	g.popWord("%rcx")
+	g.popWord("%rax")
+	switch op {
+	case ir.OpAdd:
+		g.emit("addq %%rcx, %%rax")
+	case ir.OpSub:
+		g.emit("subq %%rcx, %%rax")
+	case ir.OpMul:
+		g.emit("imulq %%rcx, %%rax")
+	default:
+		g.emit("cmpq %%rcx, %%rax")
+		g.emit("%s %%al", setcc[op][0])
+		g.emit("movzbl %%al, %%eax")
+	}
+	g.pushWord("%rax")
+}
+
+// floatComparison compares %xmm0 with %xmm1, leaving the result in %rax. Comparisons
+// involving NaN are false, except for !=, which ucomisd tells by the parity flag
+func (g *generator) floatComparison(op ir.Op) {
+	switch op {
+	case ir.OpLt, ir.OpLe:
+		// unordered operands set the carry flag, so below doesn't tell them apart,
+		// while above does
+		g.emit("ucomisd %%xmm0, %%xmm1")
+		g.emit("%s %%al", map[ir.Op]string{ir.OpLt: "seta", ir.OpLe: "setae"}[op])
+	case ir.OpEq:
+		g.emit("ucomisd %%xmm1, %%xmm0")
+		g.emit("sete %%al")
+		g.emit("setnp %%cl")
+		g.emit("andb %%cl, %%al")
+	case ir.OpNe:
+		g.emit("ucomisd %%xmm1, %%xmm0")
+		g.emit("setne %%al")
+		g.emit("setp %%cl")
+		g.emit("orb %%cl, %%al")
+	default:
+		g.emit("ucomisd %%xmm1, %%xmm0")
+		g.emit("%s %%al", setcc[op][1])
+	}
+	g.emit("movzbl %%al, %%eax")
+}
+
+// call pushes the result of the call, calls of functions returning Unit push a slot as well
+func (g *generator) call(v *ir.Value) {
+	name := v.Callee()
+	var paramTypes []backing.ValueType
+	runtimeCall := backing.IsRuntimeCall(name)
+	if runtimeCall {
+		paramTypes = backing.RuntimeFuncEntry(name).ParamTypes
+	} else {
+		f, ok := g.funcs[name]
+		if !ok {
+			g.errorf(v.Pos, "no function with name %s was found", name)
+			g.pushWord("$0")
+			return
+		}
+		for _, param := range f.Params {
+			paramTypes = append(paramTypes, param.Type)
+		}
+	}
+	for idx, arg := range v.Args {
+		g.convert(arg, paramTypes[idx])
+	}
+	if !runtimeCall {
+		g.position("%edi", "%esi")
+		g.emit("call %s", funcName(name))
+		if len(v.Args) > 0 {
+			g.emit("addq $%d, %%rsp", len(v.Args)*slotSize)
+		}
+		g.push("%rax", "%rdx")
+		return
+	}
+	g.runtimeCall(v, name)
+}
+
+// runtimeCall calls the runtime function with arguments pushed
+func (g *generator) runtimeCall(v *ir.Value, name string) {
+	switch name {
+	default:
+		g.errorf(v.Pos, "runtime function %s isn't supported by the assembly backend", name)
+	case "print":
+		g.pop("%rdi", "%rsi")
+		g.emit("call ms_print@PLT")
+		g.pushWord("$0")
+	case "to_string":
+		g.popWord("%rdi")
+		g.emit("call ms_to_string_ref@PLT")
+		g.push("%rax", "%rdx")
+	case "toInt":
+		g.popWord("%rax")
+		g.emit("movq %%rax, %%xmm0")
+		g.position("%edi", "%esi")
+		g.emit("call ms_to_int@PLT")
+		g.pushWord("%rax")
+	case "toFloat":
+		g.popWord("%rax")
+		g.emit("cvtsi2sdq %%rax, %%xmm0")
+		g.emit("movq %%xmm0, %%rax")
+		g.pushWord("%rax")
+	case "array_new":
+		g.pop("%rsi", "%rdx")
+		g.popWord("%rdi")
+		g.position("%ecx", "%r8d")
+		g.emit("call ms_array_new@PLT")
+		g.pushWord("%rax")
+	case "array_set":
+		g.popWord("%rdx")
+		g.popWord("%rsi")
+		g.popWord("%rdi")
+		g.position("%ecx", "%r8d")
+		g.emit("call ms_array_set_ref@PLT")
+		g.pushWord("$0")
+	case "array_get":
+		g.popWord("%rsi")
+		g.popWord("%rdi")
+		g.position("%edx", "%ecx")
+		g.emit("call ms_array_get_ref@PLT")
+		g.pushWord("%rax")
+	case "array_size":
+		// the length follows the type of elements in ms_array
+		g.popWord("%rax")
+		g.pushWord("8(%rax)")
+	case "exception_new":
+		g.pop("%rdx", "%rcx")
+		g.pop("%rdi", "%rsi")
+		g.emit("call ms_exception_new@PLT")
+		g.pushWord("%rax")
+	case "exception_kind":
+		g.popWord("%rax")
+		g.push("(%rax)", "8(%rax)")
+	case "exception_message":
+		g.popWord("%rax")
+		g.push("16(%rax)", "24(%rax)")
+	case "assert":
+		g.pop("%rsi", "%rdx")
+		g.popWord("%rdi")
+		g.position("%ecx", "%r8d")
+		g.emit("call ms_assert@PLT")
+		g.pushWord("$0")
+	case "assertEquals":
+		g.popWord("%rsi")
+		g.popWord("%rdi")
+		g.position("%edx", "%ecx")
+		g.emit("call ms_assert_equals_ref@PLT")
+		g.pushWord("$0")
+	}
+}
@@ -0,0 +1,59 @@
+package asmgen
+
+import (
+	"github.com/ThreadedStream/miniscala/backendtest"
+	"github.com/ThreadedStream/miniscala/cgen"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestDifferential checks that executables assembled from generated programs
+// behave like the interpreter running the same programs
+func TestDifferential(t *testing.T) {
+	backendtest.Differential(t, backend(t), 40)
+}
+
+// TestScopes checks that variables declared in blocks, sharing names with others, are kept apart
+func TestScopes(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.Scopes)
+}
+
+// TestTailCalls checks that functions calling themselves in tail position run as deep as loops
+func TestTailCalls(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.TailCalls)
+}
+
+// TestFloatFormat checks that the runtime renders floats the way Go's %v does
+func TestFloatFormat(t *testing.T) {
+	backendtest.FloatFormat(t, backend(t))
+}
+
+// backend assembles programs and links them with the runtime using the C compiler,
+// skipping the test if there's none or the assembly can't run here
+func backend(t *testing.T) backendtest.Backend {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skipf("assembly is for linux/amd64, not %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	cc := backendtest.CCompiler(t)
+	return backendtest.OneByOne("asm", func(t *testing.T, dir string, program backendtest.Program) backendtest.Output {
+		t.Helper()
+		asm, err := Generate(program.IR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asmPath, runtimePath, output := filepath.Join(dir, "prog.s"), filepath.Join(dir, "runtime.c"), filepath.Join(dir, "prog")
+		if err := os.WriteFile(asmPath, asm, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(runtimePath, []byte(cgen.Runtime), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(cc, "-O2", "-o", output, asmPath, runtimePath, "-lm").CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v\n%s", cc, err, out)
+		}
+		return backendtest.Exec(t, exec.Command(output))
+	})
+}
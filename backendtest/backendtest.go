@@ -0,0 +1,303 @@
+// Package backendtest tests backends which translate programs to code running outside of
+// the test process, be it executables, WebAssembly modules or Go packages. Whatever the
+// code is, it has to behave the way the tree-walking interpreter running the program does
+package backendtest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/interpreter"
+	"github.com/ThreadedStream/miniscala/ir"
+	"github.com/ThreadedStream/miniscala/progen"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+type (
+	// Program is a program checked by the typechecker, along with its translation to the IR
+	Program struct {
+		Src    string
+		Syntax *syntax.Program
+		Info   *typecheck.Result
+		IR     *ir.Program
+	}
+
+	// Output is what running a program writes
+	Output struct {
+		Stdout string
+		Stderr string
+	}
+
+	// Backend translates programs, runs the code and returns what every one of the
+	// programs writes. Files may be put into dir, which is removed once the test is over
+	Backend struct {
+		Name string
+		Run  func(t *testing.T, dir string, programs []Program) []Output
+	}
+)
+
+// Scopes are programs declaring names in nested blocks, which shadow names declared outside
+// or are declared again by the blocks following. A backend has to tell variables sharing
+// a name apart
+var Scopes = []string{
+	`def main(): Unit {
+    val x = 1
+    if (x > 0) {
+        val x = x + 1
+        print(to_string(x) + " ")
+    }
+    print(to_string(x) + "\n")
+}
+`,
+	`def main(): Unit {
+    var x = "outer"
+    if (x == "inner") {
+        val x = 2
+        print(to_string(x))
+    } else {
+        var x = 3.5
+        x = x * 2
+        print(to_string(x) + " ")
+    }
+    x = x + "!"
+    print(x + "\n")
+}
+`,
+	`def main(): Unit {
+    var i = 0
+    var sum = 0
+    while (i < 3) {
+        val sum = i * 10
+        print(to_string(sum) + " ")
+        i = i + 1
+    }
+    {
+        val i = "block"
+        print(i + " ")
+    }
+    {
+        val i = 7
+        print(to_string(i) + " ")
+    }
+    print(to_string(i) + " " + to_string(sum) + "\n")
+}
+`,
+	`def f(n: Int): Int {
+    if (n > 0) {
+        val n = -1
+        return n
+    }
+    try {
+        val n = 10 / n
+        return n
+    } catch {
+        case n: ArithmeticException =>
+            print(exception_message(n) + "\n")
+    }
+    return n
+}
+
+def main(): Unit {
+    print(to_string(f(1)) + " " + to_string(f(0)) + "\n")
+}
+`,
+}
+
+// TailCalls are programs whose functions call themselves in tail position far deeper than
+// calls may nest otherwise, which takes the backend turning the calls into loops
+var TailCalls = []string{
+	`def sum(n: Int, acc: Int): Int {
+    if (n == 0) {
+        return acc
+    }
+    return sum(n - 1, acc + n)
+}
+
+def countdown(n: Int): Unit {
+    if (n > 0) {
+        if (n % 25000 == 0) {
+            print(to_string(n) + " ")
+        }
+        countdown(n - 1)
+    } else {
+        print("liftoff\n")
+    }
+}
+
+def main(): Unit {
+    print(to_string(sum(100000, 0)) + "\n")
+    countdown(100000)
+}
+`,
+	`def gcd(a: Int, b: Int): Int {
+    if (b == 0) {
+        return a
+    }
+    return gcd(b, a % b)
+}
+
+def fib(n: Int, a: Float, b: Float): Float {
+    if (n == 0) {
+        return a
+    }
+    return fib(n - 1, b, a + b)
+}
+
+def find(s: String, n: Int, limit: Int): Int {
+    if (n == limit) {
+        throw exception_new("NotFound", s)
+    }
+    if (n * n > 123456789) {
+        return n
+    }
+    return find(s, n + 1, limit)
+}
+
+def main(): Unit {
+    print(to_string(gcd(1071, 462)) + " " + to_string(gcd(832040, 514229)) + "\n")
+    print(to_string(fib(90, 0.0, 1.0)) + "\n")
+    print(to_string(find("square", 0, 100000)) + "\n")
+    print(to_string(find("square", 0, 1000)) + "\n")
+}
+`,
+}
+
+// OneByOne returns a backend translating and running programs one at a time with run
+func OneByOne(name string, run func(t *testing.T, dir string, program Program) Output) Backend {
+	return Backend{
+		Name: name,
+		Run: func(t *testing.T, dir string, programs []Program) []Output {
+			outputs := make([]Output, len(programs))
+			for idx, program := range programs {
+				outputs[idx] = run(t, dir, program)
+			}
+			return outputs
+		},
+	}
+}
+
+// Check parses and typechecks src and builds the IR, failing the test if it isn't a valid program.
+// Tail calls are looped in the IR, as they're in programs the backends are given
+func Check(t *testing.T, src string) Program {
+	t.Helper()
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(src))
+	if len(syntaxErrors) > 0 {
+		t.Fatalf("syntax errors: %v\n%s", syntaxErrors, src)
+	}
+	info := typecheck.NewChecker().Check(program)
+	if info.HadErrors() {
+		t.Fatalf("type errors: %v\n%s", info.Errors, src)
+	}
+	irProgram, err := ir.Build(program, info)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+	irProgram.LoopTailCalls()
+	return Program{Src: src, Syntax: program, Info: info, IR: irProgram}
+}
+
+// Interpret runs the program on the interpreter and returns what the translated code is
+// expected to write. An exception stopping the program is reported to stderr the way
+// the runtimes of the backends report it
+func Interpret(program Program) Output {
+	var out bytes.Buffer
+	in := interpreter.New(program.Syntax, program.Info)
+	in.SetOutput(&out)
+	var output Output
+	if err := in.Run(); err != nil {
+		e := err.(*backing.ExceptionValue)
+		output.Stderr = fmt.Sprintf("[%d:%d] exception in main: %v\n", e.Pos.Line, e.Pos.Column, e)
+	}
+	output.Stdout = out.String()
+	return output
+}
+
+// Compare runs the programs given by their sources with the backend, failing the test
+// on the first one whose code doesn't behave like the interpreter
+func Compare(t *testing.T, backend Backend, sources []string) {
+	t.Helper()
+	programs := make([]Program, len(sources))
+	for idx, src := range sources {
+		programs[idx] = Check(t, src)
+	}
+	outputs := backend.Run(t, t.TempDir(), programs)
+	for idx, program := range programs {
+		expected, actual := Interpret(program), outputs[idx]
+		if actual != expected {
+			t.Fatalf("program %d: %s disagrees with the interpreter\n%s\nprogram:\n%s", idx, backend.Name,
+				diff.Unified("tree", backend.Name, expected.Stdout+expected.Stderr, actual.Stdout+actual.Stderr), program.Src)
+		}
+	}
+}
+
+// Differential is Compare running programs generated by progen from seeds 0 to n-1
+func Differential(t *testing.T, backend Backend, n int) {
+	t.Helper()
+	sources := make([]string, n)
+	for seed := range sources {
+		sources[seed] = progen.Generate(int64(seed))
+	}
+	Compare(t, backend, sources)
+}
+
+// FloatFormat checks that code made by the backend renders floats the way Go's %v does,
+// which is what to_string has to agree with
+func FloatFormat(t *testing.T, backend Backend) {
+	t.Helper()
+	values := []string{
+		"0.0", "1.0", "0.1", "0.5", "123456.0", "1234567.0", "0.0001", "0.00001", "0.000123",
+		"3.14159", "100000000000000000000.0", "123456789012345678.0", "99999.99", "0.30000000000000004",
+	}
+	var src, expected strings.Builder
+	src.WriteString("def main(): Unit {\n")
+	for _, value := range values {
+		fmt.Fprintf(&src, "    print(to_string(%s) + \"\\n\")\n", value)
+		fmt.Fprintf(&src, "    print(to_string(-%s / 3) + \"\\n\")\n", value)
+		var x float64
+		fmt.Sscan(value, &x)
+		fmt.Fprintf(&expected, "%v\n%v\n", x, -x/3)
+	}
+	src.WriteString("}\n")
+
+	program := Check(t, src.String())
+	output := backend.Run(t, t.TempDir(), []Program{program})[0]
+	if output.Stderr != "" {
+		t.Fatalf("unexpected stderr: %s", output.Stderr)
+	}
+	if d := diff.Unified("go", backend.Name, expected.String(), output.Stdout); d != "" {
+		t.Error(d)
+	}
+}
+
+// Exec runs the command and returns what it writes. A nonzero exit status doesn't fail
+// the test, since that's how an exception stopping the program ends it
+func Exec(t *testing.T, cmd *exec.Cmd) Output {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+	return Output{Stdout: stdout.String(), Stderr: stderr.String()}
+}
+
+// CCompiler returns the C compiler tests are run with, $CC or cc by default,
+// skipping the test if there's none
+func CCompiler(t *testing.T) string {
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if _, err := exec.LookPath(cc); err != nil {
+		t.Skipf("no C compiler: %v", err)
+	}
+	return cc
+}
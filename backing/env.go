@@ -1,5 +1,7 @@
 package backing
 
+import "github.com/ThreadedStream/miniscala/syntax"
+
 // This is an experimental environment implementation which is borrowed
 // from Andrew Appel's book entitled "Modern compiler implementation in C"
 //and adapted to the current project environment
@@ -12,7 +14,7 @@ const (
 )
 
 var (
-	outermostLevel *Level
+	outermostLevel = new(Level)
 )
 
 type Level struct {
@@ -27,13 +29,11 @@ type EnvEntry struct {
 	ParamTypes []ValueType
 	ResultType ValueType
 	Immutable  bool
+	// Decl is the node which introduced the entry, nil for runtime functions
+	Decl syntax.Node
 }
 
 func OutermostLevel() *Level {
-	if outermostLevel == nil {
-		outermostLevel = new(Level)
-		outermostLevel.Parent = nil
-	}
 	return outermostLevel
 }
 
@@ -75,6 +75,7 @@ func BaseTypeEnv() SymbolTable {
 	SEnter(symTable, SSymbol("Array"), Array)
 	SEnter(symTable, SSymbol("Null"), Null)
 	SEnter(symTable, SSymbol("Any"), Any)
+	SEnter(symTable, SSymbol("Exception"), Exception)
 	SEnter(symTable, SSymbol("Undefined"), Undefined)
 	return symTable
 }
@@ -125,6 +126,46 @@ func BaseValueEnv() SymbolTable {
 			Any,
 		),
 	)
+	// toInt(x: Float): Int
+	SEnter(
+		symTable, SSymbol("toInt"), MakeFunEntry(
+			"toInt",
+			[]ValueType{Float},
+			OutermostLevel(),
+			Int),
+	)
+	// toFloat(x: Int): Float
+	SEnter(
+		symTable, SSymbol("toFloat"), MakeFunEntry(
+			"toFloat",
+			[]ValueType{Int},
+			OutermostLevel(),
+			Float),
+	)
+	// exception_new(kind: String, message: String): Exception
+	SEnter(
+		symTable, SSymbol("exception_new"), MakeFunEntry(
+			"exception_new",
+			[]ValueType{String, String},
+			OutermostLevel(),
+			Exception),
+	)
+	// exception_kind(e: Exception): String
+	SEnter(
+		symTable, SSymbol("exception_kind"), MakeFunEntry(
+			"exception_kind",
+			[]ValueType{Exception},
+			OutermostLevel(),
+			String),
+	)
+	// exception_message(e: Exception): String
+	SEnter(
+		symTable, SSymbol("exception_message"), MakeFunEntry(
+			"exception_message",
+			[]ValueType{Exception},
+			OutermostLevel(),
+			String),
+	)
 	// array_size(arr_ptr: Array): Int
 	SEnter(
 		symTable, SSymbol("array_size"), MakeFunEntry(
@@ -133,5 +174,21 @@ func BaseValueEnv() SymbolTable {
 			OutermostLevel(),
 			Int),
 	)
+	// assert(cond: Bool, message: String)
+	SEnter(
+		symTable, SSymbol("assert"), MakeFunEntry(
+			"assert",
+			[]ValueType{Bool, String},
+			OutermostLevel(),
+			Unit),
+	)
+	// assertEquals(expected: Any, actual: Any)
+	SEnter(
+		symTable, SSymbol("assertEquals"), MakeFunEntry(
+			"assertEquals",
+			[]ValueType{Any, Any},
+			OutermostLevel(),
+			Unit),
+	)
 	return symTable
 }
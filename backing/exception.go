@@ -0,0 +1,50 @@
+package backing
+
+import (
+	"fmt"
+	"text/scanner"
+)
+
+// kinds of exceptions raised by the runtime
+const (
+	ClassCastException            = "ClassCastException"
+	ArithmeticException           = "ArithmeticException"
+	UnsupportedOperationException = "UnsupportedOperationException"
+	IndexOutOfBoundsException     = "IndexOutOfBoundsException"
+	NegativeArraySizeException    = "NegativeArraySizeException"
+	ArrayStoreException           = "ArrayStoreException"
+	IllegalArgumentException      = "IllegalArgumentException"
+	AssertionError                = "AssertionError"
+	StackOverflowError            = "StackOverflowError"
+)
+
+// MaxCallDepth is how deep calls may nest below main before StackOverflowError is raised
+const MaxCallDepth = 256
+
+// ExceptionValue is an error raised while running a program, either by the runtime
+// or by the program itself with throw. Its kind is what catch cases are matched against
+type ExceptionValue struct {
+	Kind    string
+	Message string
+	// Pos is where the exception was first raised, it's filled in by the backend
+	// while unwinding. Zero until then
+	Pos scanner.Position
+}
+
+func (e *ExceptionValue) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// Throw raises an exception of the given kind. It unwinds the Go stack by panicking,
+// so it's up to the backend executing the program to recover the *ExceptionValue
+func Throw(kind string, format string, args ...interface{}) {
+	Raise(&ExceptionValue{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Raise raises an existing exception, e.g. one which was thrown by the program
+func Raise(e *ExceptionValue) {
+	panic(e)
+}
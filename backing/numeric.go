@@ -0,0 +1,194 @@
+package backing
+
+import (
+	"github.com/ThreadedStream/miniscala/syntax"
+	"math"
+)
+
+// Numeric semantics of miniscala:
+//  - Int is a 64-bit two's complement integer, overflowing operations wrap around;
+//  - Float is an IEEE 754 double precision number;
+//  - whenever an Int meets a Float in a binary operation, the Int is promoted to Float,
+//    no other implicit conversions exist, toInt and toFloat have to be called instead;
+//  - division and remainder of Ints by zero raise ArithmeticException.
+
+// PromoteNumeric returns the type both operands of an arithmetic operation or
+// a comparison are converted to before the operation is carried out
+func PromoteNumeric(t1, t2 ValueType) (ValueType, bool) {
+	switch {
+	default:
+		return Undefined, false
+	case t1 == Int && t2 == Int:
+		return Int, true
+	case (t1 == Int || t1 == Float) && (t2 == Int || t2 == Float):
+		return Float, true
+	}
+}
+
+// asPromotedFloat returns the value of a numeric operand promoted to Float
+func asPromotedFloat(v Value) float64 {
+	if v.IsInt() {
+		return float64(v.AsInt())
+	}
+	return v.AsFloat()
+}
+
+// Arith applies an arithmetic operator to numeric operands, promoting them as needed
+func Arith(op syntax.Operator, v1, v2 Value) Value {
+	promotedType, ok := PromoteNumeric(v1.ValueType, v2.ValueType)
+	if !ok {
+		return Value{
+			Value:     nil,
+			ValueType: Undefined,
+		}
+	}
+	if promotedType == Int {
+		return Value{
+			Value:     arithInts(op, v1.AsInt(), v2.AsInt()),
+			ValueType: Int,
+		}
+	}
+	return Value{
+		Value:     arithFloats(op, asPromotedFloat(v1), asPromotedFloat(v2)),
+		ValueType: Float,
+	}
+}
+
+func arithInts(op syntax.Operator, x, y int64) int64 {
+	switch op {
+	default:
+		Throw(UnsupportedOperationException, "%s cannot be applied to Int", syntax.OperatorToString(op))
+		return 0
+	case syntax.Plus:
+		return x + y
+	case syntax.Minus:
+		return x - y
+	case syntax.Mul:
+		return x * y
+	case syntax.Div:
+		if y == 0 {
+			Throw(ArithmeticException, "/ by zero")
+		}
+		return x / y
+	case syntax.Mod:
+		if y == 0 {
+			Throw(ArithmeticException, "%% by zero")
+		}
+		return x % y
+	}
+}
+
+func arithFloats(op syntax.Operator, x, y float64) float64 {
+	switch op {
+	default:
+		Throw(UnsupportedOperationException, "%s cannot be applied to Float", syntax.OperatorToString(op))
+		return 0
+	case syntax.Plus:
+		return x + y
+	case syntax.Minus:
+		return x - y
+	case syntax.Mul:
+		return x * y
+	case syntax.Div:
+		return x / y
+	case syntax.Mod:
+		return math.Mod(x, y)
+	}
+}
+
+// Compare applies a comparison operator to a pair of values. Numbers are promoted
+// the same way as in arithmetic, strings are compared lexicographically, while
+// booleans may only be tested for (in)equality
+func Compare(op syntax.Operator, v1, v2 Value) Value {
+	var result bool
+	switch {
+	default:
+		Throw(UnsupportedOperationException, "%s cannot be applied to %s and %s",
+			syntax.OperatorToString(op), ValueTypeToStr(v1.ValueType), ValueTypeToStr(v2.ValueType))
+	case v1.IsString() && v2.IsString():
+		result = compareStrings(op, v1.AsString(), v2.AsString())
+	case v1.IsBool() && v2.IsBool():
+		switch op {
+		default:
+			Throw(UnsupportedOperationException, "%s cannot be applied to Bool", syntax.OperatorToString(op))
+		case syntax.Equal:
+			result = v1.AsBool() == v2.AsBool()
+		case syntax.NotEqual:
+			result = v1.AsBool() != v2.AsBool()
+		}
+	case v1.IsInt() && v2.IsInt():
+		result = compareInts(op, v1.AsInt(), v2.AsInt())
+	case (v1.IsInt() || v1.IsFloat()) && (v2.IsInt() || v2.IsFloat()):
+		result = compareFloats(op, asPromotedFloat(v1), asPromotedFloat(v2))
+	}
+	return Value{
+		Value:     result,
+		ValueType: Bool,
+	}
+}
+
+func compareInts(op syntax.Operator, x, y int64) bool {
+	switch op {
+	default:
+		return false
+	case syntax.GreaterThan:
+		return x > y
+	case syntax.GreaterThanOrEqual:
+		return x >= y
+	case syntax.LessThan:
+		return x < y
+	case syntax.LessThanOrEqual:
+		return x <= y
+	case syntax.Equal:
+		return x == y
+	case syntax.NotEqual:
+		return x != y
+	}
+}
+
+func compareFloats(op syntax.Operator, x, y float64) bool {
+	switch op {
+	default:
+		return false
+	case syntax.GreaterThan:
+		return x > y
+	case syntax.GreaterThanOrEqual:
+		return x >= y
+	case syntax.LessThan:
+		return x < y
+	case syntax.LessThanOrEqual:
+		return x <= y
+	case syntax.Equal:
+		return x == y
+	case syntax.NotEqual:
+		return x != y
+	}
+}
+
+func compareStrings(op syntax.Operator, x, y string) bool {
+	switch op {
+	default:
+		return false
+	case syntax.GreaterThan:
+		return x > y
+	case syntax.GreaterThanOrEqual:
+		return x >= y
+	case syntax.LessThan:
+		return x < y
+	case syntax.LessThanOrEqual:
+		return x <= y
+	case syntax.Equal:
+		return x == y
+	case syntax.NotEqual:
+		return x != y
+	}
+}
+
+// FloatToInt truncates x towards zero, raising ArithmeticException if
+// the result isn't representable as an Int
+func FloatToInt(x float64) int64 {
+	if math.IsNaN(x) || x >= math.MaxInt64 || x < math.MinInt64 {
+		Throw(ArithmeticException, "%v is out of Int range", x)
+	}
+	return int64(x)
+}
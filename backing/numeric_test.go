@@ -0,0 +1,193 @@
+package backing
+
+import (
+	"github.com/ThreadedStream/miniscala/syntax"
+	"math"
+	"testing"
+)
+
+func intValue(x int64) Value {
+	return Value{Value: x, ValueType: Int}
+}
+
+func floatValue(x float64) Value {
+	return Value{Value: x, ValueType: Float}
+}
+
+// raised calls f and returns the exception it raises, nil if there's none
+func raised(f func()) (e *ExceptionValue) {
+	defer func() {
+		if r := recover(); r != nil {
+			e = r.(*ExceptionValue)
+		}
+	}()
+	f()
+	return nil
+}
+
+// TestPromoteNumeric checks the type each pair of operand types is promoted to
+func TestPromoteNumeric(t *testing.T) {
+	for _, tc := range []struct {
+		t1, t2   ValueType
+		promoted ValueType
+		ok       bool
+	}{
+		{Int, Int, Int, true},
+		{Int, Float, Float, true},
+		{Float, Int, Float, true},
+		{Float, Float, Float, true},
+		{Int, String, Undefined, false},
+		{String, Float, Undefined, false},
+		{Bool, Int, Undefined, false},
+		{Any, Int, Undefined, false},
+		{Float, Any, Undefined, false},
+	} {
+		promoted, ok := PromoteNumeric(tc.t1, tc.t2)
+		if promoted != tc.promoted || ok != tc.ok {
+			t.Errorf("PromoteNumeric(%s, %s) = %s, %v, expected %s, %v",
+				ValueTypeToStr(tc.t1), ValueTypeToStr(tc.t2),
+				ValueTypeToStr(promoted), ok, ValueTypeToStr(tc.promoted), tc.ok)
+		}
+	}
+}
+
+// TestArith checks arithmetic on Ints, which wraps around, on Floats, and on both
+func TestArith(t *testing.T) {
+	for _, tc := range []struct {
+		op       syntax.Operator
+		v1, v2   Value
+		expected Value
+	}{
+		{syntax.Plus, intValue(2), intValue(3), intValue(5)},
+		{syntax.Minus, intValue(2), intValue(3), intValue(-1)},
+		{syntax.Mul, intValue(-4), intValue(3), intValue(-12)},
+		{syntax.Div, intValue(-7), intValue(2), intValue(-3)},
+		{syntax.Mod, intValue(-7), intValue(2), intValue(-1)},
+		{syntax.Plus, intValue(math.MaxInt64), intValue(1), intValue(math.MinInt64)},
+		{syntax.Minus, intValue(math.MinInt64), intValue(1), intValue(math.MaxInt64)},
+		{syntax.Mul, intValue(math.MaxInt64), intValue(2), intValue(-2)},
+		{syntax.Div, intValue(math.MinInt64), intValue(-1), intValue(math.MinInt64)},
+		{syntax.Mod, intValue(math.MinInt64), intValue(-1), intValue(0)},
+		{syntax.Div, floatValue(7), floatValue(2), floatValue(3.5)},
+		{syntax.Mod, floatValue(-7.5), floatValue(2), floatValue(-1.5)},
+		{syntax.Div, floatValue(1), floatValue(0), floatValue(math.Inf(1))},
+		{syntax.Div, intValue(7), floatValue(2), floatValue(3.5)},
+		{syntax.Plus, floatValue(0.5), intValue(1), floatValue(1.5)},
+	} {
+		result := Arith(tc.op, tc.v1, tc.v2)
+		if result != tc.expected {
+			t.Errorf("%v %s %v = %v (%s), expected %v (%s)", tc.v1.Value, syntax.OperatorToString(tc.op), tc.v2.Value,
+				result.Value, ValueTypeToStr(result.ValueType), tc.expected.Value, ValueTypeToStr(tc.expected.ValueType))
+		}
+	}
+
+	result := Arith(syntax.Mod, floatValue(1), floatValue(0))
+	if !result.IsFloat() || !math.IsNaN(result.AsFloat()) {
+		t.Errorf("1.0 %% 0.0 = %v, expected NaN", result.Value)
+	}
+	if result := Arith(syntax.Plus, intValue(1), Value{Value: "1", ValueType: String}); result.ValueType != Undefined {
+		t.Errorf("1 + \"1\" = %v, expected no value", result.Value)
+	}
+}
+
+// TestIntDivisionByZero checks that dividing an Int by zero raises ArithmeticException,
+// while dividing a Float doesn't
+func TestIntDivisionByZero(t *testing.T) {
+	for _, tc := range []struct {
+		op      syntax.Operator
+		v1, v2  Value
+		message string
+	}{
+		{syntax.Div, intValue(1), intValue(0), "/ by zero"},
+		{syntax.Mod, intValue(1), intValue(0), "% by zero"},
+		{syntax.Mod, intValue(0), intValue(0), "% by zero"},
+		{syntax.Div, floatValue(1), intValue(0), ""},
+		{syntax.Mod, intValue(1), floatValue(0), ""},
+	} {
+		e := raised(func() {
+			Arith(tc.op, tc.v1, tc.v2)
+		})
+		var message string
+		if e != nil {
+			if e.Kind != ArithmeticException {
+				t.Errorf("%v %s %v raised %v", tc.v1.Value, syntax.OperatorToString(tc.op), tc.v2.Value, e)
+			}
+			message = e.Message
+		}
+		if message != tc.message {
+			t.Errorf("%v %s %v raised %q, expected %q", tc.v1.Value, syntax.OperatorToString(tc.op), tc.v2.Value,
+				message, tc.message)
+		}
+	}
+}
+
+// TestCompare checks comparisons of numbers, promoted as in arithmetic, strings and booleans
+func TestCompare(t *testing.T) {
+	for _, tc := range []struct {
+		op       syntax.Operator
+		v1, v2   Value
+		expected bool
+	}{
+		{syntax.LessThan, intValue(1), intValue(2), true},
+		{syntax.GreaterThanOrEqual, intValue(math.MinInt64), intValue(math.MaxInt64), false},
+		{syntax.Equal, intValue(1), floatValue(1), true},
+		{syntax.LessThan, floatValue(0.5), intValue(1), true},
+		{syntax.GreaterThan, intValue(math.MaxInt64), floatValue(1e18), true},
+		{syntax.Equal, floatValue(math.NaN()), floatValue(math.NaN()), false},
+		{syntax.NotEqual, floatValue(math.NaN()), floatValue(math.NaN()), true},
+		{syntax.LessThan, floatValue(math.Inf(-1)), intValue(math.MinInt64), true},
+		{syntax.LessThan, Value{Value: "abc", ValueType: String}, Value{Value: "abd", ValueType: String}, true},
+		{syntax.Equal, Value{Value: true, ValueType: Bool}, Value{Value: false, ValueType: Bool}, false},
+		{syntax.NotEqual, Value{Value: true, ValueType: Bool}, Value{Value: false, ValueType: Bool}, true},
+	} {
+		result := Compare(tc.op, tc.v1, tc.v2)
+		if !result.IsBool() || result.AsBool() != tc.expected {
+			t.Errorf("%v %s %v = %v, expected %v", tc.v1.Value, syntax.OperatorToString(tc.op), tc.v2.Value,
+				result.Value, tc.expected)
+		}
+	}
+
+	for _, tc := range []struct {
+		op     syntax.Operator
+		v1, v2 Value
+	}{
+		{syntax.LessThan, Value{Value: true, ValueType: Bool}, Value{Value: false, ValueType: Bool}},
+		{syntax.Equal, intValue(1), Value{Value: "1", ValueType: String}},
+	} {
+		e := raised(func() {
+			Compare(tc.op, tc.v1, tc.v2)
+		})
+		if e == nil || e.Kind != UnsupportedOperationException {
+			t.Errorf("%v %s %v raised %v, expected %s", tc.v1.Value, syntax.OperatorToString(tc.op), tc.v2.Value,
+				e, UnsupportedOperationException)
+		}
+	}
+}
+
+// TestFloatToInt checks that Floats are truncated towards zero, and that the ones
+// out of Int range, NaN and infinities among them, raise ArithmeticException
+func TestFloatToInt(t *testing.T) {
+	for _, tc := range []struct {
+		x        float64
+		expected int64
+	}{
+		{0, 0},
+		{2.9, 2},
+		{-2.9, -2},
+		{-9223372036854775808, math.MinInt64},
+		{9223372036854774784, 9223372036854774784},
+	} {
+		if result := FloatToInt(tc.x); result != tc.expected {
+			t.Errorf("FloatToInt(%v) = %d, expected %d", tc.x, result, tc.expected)
+		}
+	}
+
+	for _, x := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 9223372036854775808, -9223372036854777856, 1e300} {
+		e := raised(func() {
+			FloatToInt(x)
+		})
+		if e == nil || e.Kind != ArithmeticException {
+			t.Errorf("FloatToInt(%v) raised %v, expected %s", x, e, ArithmeticException)
+		}
+	}
+}
@@ -2,22 +2,47 @@ package backing
 
 import (
 	"fmt"
-	"github.com/ThreadedStream/miniscala/assert"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"io"
+	"strconv"
+	"sync"
+)
+
+var (
+	runtimeEnv     SymbolTable
+	runtimeEnvOnce sync.Once
 )
 
 func IsRuntimeCall(name string) bool {
 	switch name {
 	default:
 		return false
-	case "print", "to_string", "array_new", "array_set", "array_get", "array_size":
+	case "print", "to_string", "array_new", "array_set", "array_get", "array_size", "toInt", "toFloat",
+		"exception_new", "exception_kind", "exception_message", "assert", "assertEquals":
 		return true
 	}
 }
 
-func DispatchRuntimeFuncCall(name string, args ...Value) Value {
+// RuntimeFuncEntry returns the signature of the runtime function with the given name,
+// or nil if there's no such function. Unlike a typechecker's value env, the table
+// behind it is built once and never mutated, so it may be shared by any number of VMs
+func RuntimeFuncEntry(name string) *EnvEntry {
+	runtimeEnvOnce.Do(func() {
+		runtimeEnv = BaseValueEnv()
+	})
+	entry := SLook(runtimeEnv, SSymbol(name))
+	if entry == nil {
+		return nil
+	}
+	return entry.(*EnvEntry)
+}
+
+// DispatchRuntimeFuncCall calls the runtime function with the given name,
+// anything printed by the program goes to out
+func DispatchRuntimeFuncCall(out io.Writer, name string, args ...Value) Value {
 	switch name {
 	case "print":
-		callPrint(args[0])
+		callPrint(out, args[0])
 	case "to_string":
 		return callToString(args[0])
 	case "array_new":
@@ -28,28 +53,78 @@ func DispatchRuntimeFuncCall(name string, args ...Value) Value {
 		return callArrayGet(args[0], args[1])
 	case "array_size":
 		return callArraySize(args[0])
+	case "toInt":
+		return callToInt(args[0])
+	case "toFloat":
+		return callToFloat(args[0])
+	case "exception_new":
+		return callExceptionNew(args[0], args[1])
+	case "exception_kind":
+		return callExceptionKind(args[0])
+	case "exception_message":
+		return callExceptionMessage(args[0])
+	case "assert":
+		callAssert(args[0], args[1])
+	case "assertEquals":
+		callAssertEquals(args[0], args[1])
 	}
 	return Value{
 		ValueType: Unit,
 	}
 }
 
-func callPrint(val Value) {
-	assert.Assert(val.ValueType == String, "print requires string type as an only argument")
-	fmt.Printf("%s", val.AsString())
+// runtime functions throw IllegalArgumentException on arguments of unexpected types,
+// which only happens when values of type Any reach them unchecked
+
+func callPrint(out io.Writer, val Value) {
+	if !val.IsString() {
+		Throw(IllegalArgumentException, "print requires string type as an only argument")
+	}
+	fmt.Fprint(out, val.AsString())
 }
 
 func callToString(val Value) Value {
-	strValue := fmt.Sprintf("%v", val.Value)
 	return Value{
-		Value:     strValue,
+		Value:     ToString(val),
 		ValueType: String,
 	}
 }
 
+// ToString renders the value the way to_string does
+func ToString(val Value) string {
+	if val.IsException() {
+		return val.AsException().Error()
+	}
+	return fmt.Sprintf("%v", val.Value)
+}
+
+func callToInt(val Value) Value {
+	if !val.IsFloat() {
+		Throw(IllegalArgumentException, "toInt requires float type as an only argument")
+	}
+	return Value{
+		Value:     FloatToInt(val.AsFloat()),
+		ValueType: Int,
+	}
+}
+
+func callToFloat(val Value) Value {
+	if !val.IsInt() {
+		Throw(IllegalArgumentException, "toFloat requires int type as an only argument")
+	}
+	return Value{
+		Value:     float64(val.AsInt()),
+		ValueType: Float,
+	}
+}
+
 func callArrayNew(numberOfElements, typeOfElements Value) Value {
-	assert.Assert(numberOfElements.IsInt(), "1st argument to array_new must be an integer")
-	assert.Assert(typeOfElements.IsString(), "2nd argument to array_new must be a string")
+	if !numberOfElements.IsInt() || !typeOfElements.IsString() {
+		Throw(IllegalArgumentException, "array_new requires an integer and a string as arguments")
+	}
+	if numberOfElements.AsInt() < 0 {
+		Throw(NegativeArraySizeException, "%d", numberOfElements.AsInt())
+	}
 	ty := MiniscalaTypeToValueType(typeOfElements.AsString())
 	arrValue := ArrayValue{
 		Arr:         ArrayOfValues(int(numberOfElements.AsInt()), ty),
@@ -62,7 +137,9 @@ func callArrayNew(numberOfElements, typeOfElements Value) Value {
 }
 
 func callArraySize(arrPtr Value) Value {
-	assert.Assert(arrPtr.IsArray(), "1st argument to array_size must be an array")
+	if !arrPtr.IsArray() {
+		Throw(IllegalArgumentException, "1st argument to array_size must be an array")
+	}
 	arrValue := arrPtr.Value.(ArrayValue)
 	return Value{
 		Value:     int64(len(arrValue.Arr)),
@@ -71,23 +148,114 @@ func callArraySize(arrPtr Value) Value {
 }
 
 func callArraySet(arrPtr, idx, value Value) {
-	assert.Assert(arrPtr.IsArray(), "1st argument to array_set must be an array")
-	assert.Assert(idx.IsInt(), "2nd argument to array_set must be an integer")
-	// TODO(threadedstream): do proper typechecking here, check accordance of type of the value in respect to
-	// the type mandated by arrPtr
-	arrValue := arrPtr.Value.(ArrayValue)
-	assert.Assert(
-		value.ValueType == arrValue.ElementType,
-		"array expected type %s, but got %s",
-		ValueTypeToStr(value.ValueType),
-		ValueTypeToStr(arrValue.ElementType),
-	)
+	arrValue := checkArrayIndex("array_set", arrPtr, idx)
+	if !IsAssignable(arrValue.ElementType, value.ValueType) {
+		Throw(ArrayStoreException, "array expected type %s, but got %s",
+			ValueTypeToStr(arrValue.ElementType), ValueTypeToStr(value.ValueType))
+	}
 	arrValue.Arr[idx.AsInt()] = value
 }
 
 func callArrayGet(arrPtr, idx Value) Value {
-	assert.Assert(arrPtr.IsArray(), "1st argument to array_get must be an array")
-	assert.Assert(idx.IsInt(), "2nd argument to array_get must be an integer")
-	arrValue := arrPtr.Value.(ArrayValue)
+	arrValue := checkArrayIndex("array_get", arrPtr, idx)
 	return arrValue.Arr[idx.AsInt()]
 }
+
+// checkArrayIndex validates arguments of array accesses, throwing IndexOutOfBoundsException
+// if idx doesn't point into the array
+func checkArrayIndex(funcName string, arrPtr, idx Value) ArrayValue {
+	if !arrPtr.IsArray() || !idx.IsInt() {
+		Throw(IllegalArgumentException, "%s requires an array and an integer as arguments", funcName)
+	}
+	arrValue := arrPtr.Value.(ArrayValue)
+	if idx.AsInt() < 0 || idx.AsInt() >= int64(len(arrValue.Arr)) {
+		Throw(IndexOutOfBoundsException, "index %d out of bounds for length %d", idx.AsInt(), len(arrValue.Arr))
+	}
+	return arrValue
+}
+
+func callExceptionNew(kind, message Value) Value {
+	if !kind.IsString() || !message.IsString() {
+		Throw(IllegalArgumentException, "exception_new requires two strings as arguments")
+	}
+	return Value{
+		Value: &ExceptionValue{
+			Kind:    kind.AsString(),
+			Message: message.AsString(),
+		},
+		ValueType: Exception,
+	}
+}
+
+func callExceptionKind(e Value) Value {
+	if !e.IsException() {
+		Throw(IllegalArgumentException, "exception_kind requires exception type as an only argument")
+	}
+	return Value{
+		Value:     e.AsException().Kind,
+		ValueType: String,
+	}
+}
+
+func callExceptionMessage(e Value) Value {
+	if !e.IsException() {
+		Throw(IllegalArgumentException, "exception_message requires exception type as an only argument")
+	}
+	return Value{
+		Value:     e.AsException().Message,
+		ValueType: String,
+	}
+}
+
+func callAssert(cond, message Value) {
+	if !cond.IsBool() || !message.IsString() {
+		Throw(IllegalArgumentException, "assert requires a boolean and a string as arguments")
+	}
+	if !cond.AsBool() {
+		Throw(AssertionError, "%s", message.AsString())
+	}
+}
+
+func callAssertEquals(expected, actual Value) {
+	if !Equals(expected, actual) {
+		Throw(AssertionError, "expected %s, but got %s", describe(expected), describe(actual))
+	}
+}
+
+// Equals reports whether a pair of values is equal the way assertEquals sees it. Numbers
+// are promoted as in comparisons, arrays are equal if their elements are, exceptions
+// if they're of the same kind and carry the same message
+func Equals(v1, v2 Value) bool {
+	switch {
+	case v1.IsNull() || v2.IsNull():
+		return v1.IsNull() && v2.IsNull()
+	case (v1.IsInt() || v1.IsFloat()) && (v2.IsInt() || v2.IsFloat()),
+		v1.IsString() && v2.IsString(),
+		v1.IsBool() && v2.IsBool():
+		return Compare(syntax.Equal, v1, v2).AsBool()
+	case v1.IsArray() && v2.IsArray():
+		arr1, arr2 := v1.Value.(ArrayValue).Arr, v2.Value.(ArrayValue).Arr
+		if len(arr1) != len(arr2) {
+			return false
+		}
+		for idx := range arr1 {
+			if !Equals(arr1[idx], arr2[idx]) {
+				return false
+			}
+		}
+		return true
+	case v1.IsException() && v2.IsException():
+		e1, e2 := v1.AsException(), v2.AsException()
+		return e1.Kind == e2.Kind && e1.Message == e2.Message
+	}
+	return false
+}
+
+// describe renders the value for a failure message, quoting strings so that
+// differences in whitespace stand out
+func describe(val Value) string {
+	if val.IsString() {
+		return strconv.Quote(val.AsString())
+	}
+	return ToString(val) + " (" + ValueTypeToStr(val.ValueType) + ")"
+}
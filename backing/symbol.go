@@ -1,15 +1,19 @@
 package backing
 
-import "unsafe"
+import (
+	"sync"
+	"unsafe"
+)
 
 const (
 	Size = 131
 )
 
 var (
-	Venv      SymbolTable
-	Tenv      SymbolTable
+	// symbols are interned process-wide, so that tables owned by different
+	// typecheckers still agree on the identity of a name
 	hashtable [Size]*Symbol
+	hashMu    sync.Mutex
 	markSym   = Symbol{"<mark>", nil}
 )
 
@@ -36,6 +40,8 @@ func hash(s string) uint {
 }
 
 func SSymbol(name string) *Symbol {
+	hashMu.Lock()
+	defer hashMu.Unlock()
 	index := hash(name) % Size
 	syms := hashtable[index]
 	var sym *Symbol
@@ -61,6 +67,18 @@ func SLook(table SymbolTable, sym *Symbol) interface{} {
 	return TabLook(table, unsafe.Pointer(sym))
 }
 
+// SDump calls show for every binding in the table, from the most recent one to the oldest.
+// Scope marks are skipped
+func SDump(table SymbolTable, show func(sym *Symbol, value interface{})) {
+	TabDump(table, func(key interface{}, value interface{}) {
+		sym := (*Symbol)(key.(unsafe.Pointer))
+		if sym == &markSym {
+			return
+		}
+		show(sym, value)
+	})
+}
+
 func SBeginScope(table SymbolTable) {
 	SEnter(table, &markSym, nil)
 }
@@ -68,6 +68,7 @@ func TabDump(table *TabTable, show func(interface{}, interface{})) {
 	if binder == nil {
 		return
 	}
+	table.Table[index] = binder.Next
 	table.Top = binder.PrevTop
 	show(binder.Key, binder.Value)
 	TabDump(table, show)
@@ -16,6 +16,7 @@ const (
 	Any
 	Null
 	Undefined
+	Exception
 )
 
 type TypeInfo struct {
@@ -40,6 +41,10 @@ func MiniscalaTypeToValueType(typ string) ValueType {
 		return Bool
 	case "Array":
 		return Array
+	case "Any":
+		return Any
+	case "Exception":
+		return Exception
 	}
 }
 
@@ -59,12 +64,14 @@ func LitKindToValueType(kind syntax.LitKind) ValueType {
 }
 
 func TypesEqual(t1, t2 ValueType) bool {
-	if t1 != Any && t2 != Any {
-		return t1 == t2
-	}
-	// ValueType::Any == (whatsoever ValueType was passed) evaluates to true
-	// Although I've got to make sure this scheme is suitable for each possible corner-case
-	return true
+	return t1 == t2
+}
+
+// IsAssignable reports whether a value of type source may be stored where a value of
+// type target is expected. Any accepts values of every type, but not the other way around:
+// a value of type Any has to be cast with asInstanceOf beforehand
+func IsAssignable(target, source ValueType) bool {
+	return target == Any || TypesEqual(target, source)
 }
 
 func ValueTypeToStr(valueType ValueType) string {
@@ -79,6 +86,8 @@ func ValueTypeToStr(valueType ValueType) string {
 		return "String"
 	case Bool:
 		return "Bool"
+	case Unit:
+		return "Unit"
 	case Function:
 		return "Function"
 	case Ref:
@@ -91,5 +100,7 @@ func ValueTypeToStr(valueType ValueType) string {
 		return "Any"
 	case Undefined:
 		return "Undefined"
+	case Exception:
+		return "Exception"
 	}
 }
@@ -37,12 +37,26 @@ func NullValue() Value {
 	}
 }
 
+// ZeroValue returns the value a variable of type ty holds until assigned
+func ZeroValue(ty ValueType) Value {
+	switch ty {
+	default:
+		return NullValue()
+	case Float:
+		return Value{Value: float64(0), ValueType: Float}
+	case Int:
+		return Value{Value: int64(0), ValueType: Int}
+	case String:
+		return Value{Value: "", ValueType: String}
+	case Bool:
+		return Value{Value: false, ValueType: Bool}
+	}
+}
+
 func ArrayOfValues(num int, ty ValueType) []Value {
 	var arr []Value
 	for i := 0; i < num; i++ {
-		arr = append(arr, Value{
-			ValueType: ty,
-		})
+		arr = append(arr, ZeroValue(ty))
 	}
 	return arr
 }
@@ -67,6 +81,11 @@ func (v Value) AsBool() bool {
 	return v.Value.(bool)
 }
 
+func (v Value) AsException() *ExceptionValue {
+	assert.Assert(v.IsException(), "cannot cast value type %s to exception", ValueTypeToStr(v.ValueType))
+	return v.Value.(*ExceptionValue)
+}
+
 func (v Value) AsFunction() *DefValue {
 	assert.Assert(v.IsFunction(), "cannot cast value type %s to function", ValueTypeToStr(v.ValueType))
 	return v.Value.(*DefValue)
@@ -90,7 +109,10 @@ func (v Value) IsArray() bool {
 
 // thought it might be worthwhile putting it here
 func (v Value) IsZero() bool {
-	assert.Assert(v.IsFloat(), "cannot call isZero() on something other than float")
+	assert.Assert(v.IsFloat() || v.IsInt(), "cannot call isZero() on something other than a number")
+	if v.IsInt() {
+		return v.AsInt() == 0
+	}
 	return v.AsFloat() == 0
 }
 
@@ -112,6 +134,10 @@ func (v Value) IsFunction() bool {
 	return v.ValueType == Function
 }
 
+func (v Value) IsException() bool {
+	return v.ValueType == Exception
+}
+
 func (v Value) IsNull() bool {
 	return v.ValueType == Null
 }
@@ -120,7 +146,9 @@ func (v Value) IsUndefined() bool {
 	return v.ValueType == Undefined
 }
 
-func Add(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
+// resolveRefs replaces references to names with values they're bound to, which is
+// only ever needed by the tree-walk interpreter
+func resolveRefs(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) (Value, Value) {
 	if ctx == TreeWalkInterpreter {
 		if v1.ValueType == Ref {
 			v1, _ = LookupValue(v1.AsString(), localEnv, true)
@@ -129,171 +157,41 @@ func Add(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
 			v2, _ = LookupValue(v2.AsString(), localEnv, true)
 		}
 	}
+	return v1, v2
+}
 
-	switch {
-	default:
-		return Value{
-			Value:     nil,
-			ValueType: Undefined,
-		}
-	case v1.IsFloat() && v2.IsFloat():
-		return Value{
-			Value:     v1.AsFloat() + v2.AsFloat(),
-			ValueType: Float,
-		}
-	case v1.IsString() && v2.IsString():
+func Add(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
+	v1, v2 = resolveRefs(v1, v2, localEnv, ctx)
+	if v1.IsString() && v2.IsString() {
 		return Value{
 			Value:     v1.AsString() + v2.AsString(),
 			ValueType: String,
 		}
-	case v1.IsInt() && v2.IsInt():
-		return Value{
-			Value:     v1.AsInt() + v2.AsInt(),
-			ValueType: Int,
-		}
-	case v1.IsFloat() && v2.IsInt():
-		return Value{
-			Value:     v1.AsFloat() + float64(v2.AsInt()),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsFloat():
-		return Value{
-			Value:     float64(v1.AsInt()) + v2.AsFloat(),
-			ValueType: Float,
-		}
 	}
+	return Arith(syntax.Plus, v1, v2)
 }
 
 func Sub(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
-	if ctx == TreeWalkInterpreter {
-		if v1.ValueType == Ref {
-			v1, _ = LookupValue(v1.AsString(), localEnv, true)
-		}
-		if v2.ValueType == Ref {
-			v2, _ = LookupValue(v2.AsString(), localEnv, true)
-		}
-	}
-
-	switch {
-	default:
-		return Value{
-			Value:     nil,
-			ValueType: Undefined,
-		}
-	case v1.IsFloat() && v2.IsFloat():
-		return Value{
-			Value:     v1.AsFloat() - v2.AsFloat(),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsInt():
-		return Value{
-			Value:     v1.AsInt() - v2.AsInt(),
-			ValueType: Int,
-		}
-	case v1.IsFloat() && v2.IsInt():
-		return Value{
-			Value:     v1.AsFloat() - float64(v2.AsInt()),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsFloat():
-		return Value{
-			Value:     float64(v1.AsInt()) - v2.AsFloat(),
-			ValueType: Float,
-		}
-	}
+	v1, v2 = resolveRefs(v1, v2, localEnv, ctx)
+	return Arith(syntax.Minus, v1, v2)
 }
 
 func Mul(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
-	if ctx == TreeWalkInterpreter {
-		if v1.ValueType == Ref {
-			v1, _ = LookupValue(v1.AsString(), localEnv, true)
-		}
-		if v2.ValueType == Ref {
-			v2, _ = LookupValue(v2.AsString(), localEnv, true)
-		}
-	}
-
-	switch {
-	default:
-		return Value{
-			Value:     nil,
-			ValueType: Undefined,
-		}
-	case v1.IsFloat() && v2.IsFloat():
-		return Value{
-			Value:     v1.AsFloat() * v2.AsFloat(),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsInt():
-		return Value{
-			Value:     v1.AsInt() * v2.AsInt(),
-			ValueType: Int,
-		}
-	case v1.IsFloat() && v2.IsInt():
-		return Value{
-			Value:     v1.AsFloat() * float64(v2.AsInt()),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsFloat():
-		return Value{
-			Value:     float64(v1.AsInt()) * v2.AsFloat(),
-			ValueType: Float,
-		}
-	}
+	v1, v2 = resolveRefs(v1, v2, localEnv, ctx)
+	return Arith(syntax.Mul, v1, v2)
 }
 
+// Div divides Ints with truncation towards zero, raising ArithmeticException if the divisor
+// is zero, while division of Floats obeys IEEE 754, i.e 1.0 / 0 evaluates to +Inf
 func Div(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
-	if ctx == TreeWalkInterpreter {
-		if v1.ValueType == Ref {
-			v1, _ = LookupValue(v1.AsString(), localEnv, true)
-		}
-		if v2.ValueType == Ref {
-			v2, _ = LookupValue(v2.AsString(), localEnv, true)
-		}
-	}
-
-	switch {
-	default:
-		return Value{
-			Value:     nil,
-			ValueType: Undefined,
-		}
-	case v1.IsFloat() && v2.IsFloat():
-		return Value{
-			Value:     v1.AsFloat() / v2.AsFloat(),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsInt():
-		return Value{
-			Value:     float64(v1.AsInt()) / float64(v2.AsInt()),
-			ValueType: Float,
-		}
-	case v1.IsFloat() && v2.IsInt():
-		return Value{
-			Value:     v1.AsFloat() / float64(v2.AsInt()),
-			ValueType: Float,
-		}
-	case v1.IsInt() && v2.IsFloat():
-		return Value{
-			Value:     float64(v1.AsInt()) / v2.AsFloat(),
-			ValueType: Float,
-		}
-	}
+	v1, v2 = resolveRefs(v1, v2, localEnv, ctx)
+	return Arith(syntax.Div, v1, v2)
 }
 
+// Mod computes the remainder, having the sign of the dividend, of the truncated division
 func Mod(v1, v2 Value, localEnv ValueEnv, ctx ExecutionContext) Value {
-	switch {
-	default:
-		return Value{
-			Value:     nil,
-			ValueType: Undefined,
-		}
-	case v1.IsInt() && v2.IsInt():
-		return Value{
-			Value:     v1.AsInt() % v2.AsInt(),
-			ValueType: Int,
-		}
-	}
+	v1, v2 = resolveRefs(v1, v2, localEnv, ctx)
+	return Arith(syntax.Mod, v1, v2)
 }
 
 func LogicalAnd(v1, v2 Value) Value {
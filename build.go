@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/asmgen"
+	"github.com/ThreadedStream/miniscala/cgen"
+	"github.com/ThreadedStream/miniscala/ir"
+	"github.com/ThreadedStream/miniscala/wasmgen"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// buildCmd implements 'miniscala build', returns the exit code
+func buildCmd(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := flags.String("o", "", "output file, named after the source file by default")
+	cc := flags.String("cc", defaultCC(), "C compiler the generated code is compiled with")
+	backendName := flags.String("backend", "c", "code generator, c, asm (x86-64 Linux only) or wasm")
+	emitSource := flags.Bool("S", false, "write the generated C, assembly or WAT instead of compiling it")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala build [-o file] [-cc compiler] [-backend c|asm|wasm] [-S] <file>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	ext, ok := generatedExts[*backendName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown backend %q, expected c, asm or wasm\n", *backendName)
+		return 2
+	}
+	path := flags.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(filepath.Base(path), sourceExt)
+		if *emitSource {
+			*output += ext
+		} else if *backendName == "wasm" {
+			*output += ".wasm"
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	return buildSource(path, file, *output, *cc, *backendName, *emitSource, os.Stderr)
+}
+
+// generatedExts maps names of code generators to extensions of files they write
+var generatedExts = map[string]string{
+	"c":    ".c",
+	"asm":  ".s",
+	"wasm": ".wat",
+}
+
+// defaultCC returns the C compiler named by $CC, or cc
+func defaultCC() string {
+	if cc := os.Getenv("CC"); cc != "" {
+		return cc
+	}
+	return "cc"
+}
+
+// buildSource translates the program read from src, which is named path in messages, to C,
+// to assembly or to WebAssembly, depending on backendName, and compiles it with cc to an
+// executable written to output, or assembles the module. If emitSource is set, the generated
+// code itself is written to output instead. Diagnostics go to stderr. It returns the exit code
+func buildSource(path string, src io.Reader, output, cc, backendName string, emitSource bool, stderr io.Writer) int {
+	program, result, ok := loadProgram(path, src, stderr)
+	if !ok {
+		return 1
+	}
+	irProgram, err := ir.Build(program, result)
+	var generated []byte
+	if err == nil {
+		irProgram.LoopTailCalls()
+	}
+	switch {
+	case err != nil:
+	case backendName == "asm":
+		generated, err = asmgen.Generate(irProgram)
+	case backendName == "wasm":
+		generated, err = wasmgen.Generate(irProgram)
+	default:
+		generated, err = cgen.Generate(irProgram)
+	}
+	if err == nil && backendName == "wasm" && !emitSource {
+		generated, err = wasmgen.Assemble(generated)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	// modules are assembled right away, there's no toolchain involved
+	if emitSource || backendName == "wasm" {
+		if err := os.WriteFile(output, generated, 0644); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	dir, err := os.MkdirTemp("", "miniscala-build")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	type file struct {
+		name    string
+		content []byte
+	}
+	files := []file{{strings.TrimSuffix(filepath.Base(path), sourceExt) + generatedExts[backendName], generated}}
+	// assembly calls into the runtime the C backend embeds into its output
+	if backendName == "asm" {
+		files = append(files, file{"runtime.c", []byte(cgen.Runtime)})
+	}
+	args := []string{"-O2", "-o", output}
+	for _, f := range files {
+		filePath := filepath.Join(dir, f.name)
+		if err := os.WriteFile(filePath, f.content, 0644); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		args = append(args, filePath)
+	}
+	// the runtime relies on math.h
+	compile := exec.Command(cc, append(args, "-lm")...)
+	compile.Stdout, compile.Stderr = stderr, stderr
+	if err := compile.Run(); err != nil {
+		fmt.Fprintf(stderr, "%s: %s failed: %v\n", path, cc, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,635 @@
+// Package cgen translates programs to C. The translation unit it produces holds the
+// runtime (runtime/runtime.c) followed by the program, so it compiles on its own with any C99
+// compiler, e.g 'cc -O2 -o prog prog.c -lm'. The executable behaves like the program
+// run by the vm: it prints the same output, and an exception escaping main is reported
+// to stderr the same way, with the exit status 1.
+//
+// Programs come in the IR. Every value is a local of the C function, blocks are labeled
+// and pass control on by goto, assigning phis of their successors on the way.
+// An instruction which may raise an exception handled within the function runs
+// with a handler pushed, the exception lands in the else branch of setjmp,
+// which goes on to the handling block
+package cgen
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/ir"
+	"math"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// Runtime is the C source of the runtime, programs compiled to assembly are linked with it
+//
+//go:embed runtime/runtime.c
+var Runtime string
+
+type (
+	generator struct {
+		// functions of the program by name, calls convert arguments to types of their parameters
+		funcs   map[string]*ir.Func
+		globals map[string]backing.ValueType
+		fn      *function
+		err     error
+	}
+
+	// function is a C function being generated
+	function struct {
+		f *ir.Func
+		// function the init function calls once it's done, empty for the rest of them
+		entry  string
+		body   strings.Builder
+		indent int
+		// blocks jumped to, the rest are only entered from the block preceding them
+		labeled map[*ir.Block]bool
+	}
+)
+
+// Generate translates the program to C. It fails on values the C backend can't represent,
+// which the typechecker rejects, e.g the ones of type Unit
+func Generate(program *ir.Program) ([]byte, error) {
+	g := &generator{
+		funcs:   make(map[string]*ir.Func),
+		globals: make(map[string]backing.ValueType),
+	}
+	for _, f := range program.Funcs {
+		g.funcs[f.Name] = f
+	}
+
+	var out strings.Builder
+	out.WriteString(Runtime)
+	out.WriteString("\n/* program */\n\n")
+	for _, global := range program.Globals {
+		g.globals[global.Name] = global.Type
+		fmt.Fprintf(&out, "static %s;\n", cdecl(g.ctype(scanner.Position{}, global.Type), globalName(global.Name)))
+	}
+	if len(program.Globals) > 0 {
+		out.WriteString("\n")
+	}
+	for _, f := range program.Funcs {
+		fmt.Fprintf(&out, "static %s;\n", g.signature(f))
+	}
+	out.WriteString("\n")
+	for _, f := range program.Funcs {
+		fmt.Fprintf(&out, "static %s {\n%s}\n\n", g.signature(f), g.function(f, ""))
+	}
+	// top-level statements run first, then main
+	mainBody := fmt.Sprintf("    %s(0, 0);\n", funcName("main"))
+	if program.Init != nil {
+		mainBody = g.function(program.Init, "main")
+	}
+	fmt.Fprintf(&out, "void miniscala_main(void) {\n%s}\n", mainBody)
+	if g.err != nil {
+		return nil, g.err
+	}
+	return []byte(out.String()), nil
+}
+
+func (g *generator) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if g.err == nil {
+		g.err = fmt.Errorf("[%d:%d] %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))
+	}
+}
+
+func (g *generator) line(format string, args ...interface{}) {
+	g.fn.body.WriteString(strings.Repeat("    ", g.fn.indent))
+	fmt.Fprintf(&g.fn.body, format, args...)
+	g.fn.body.WriteString("\n")
+}
+
+// signature returns the C declarator of the function, which takes the position
+// of the call first, as the position of a stack overflow is the one of the call
+func (g *generator) signature(f *ir.Func) string {
+	params := []string{"int ms_line", "int ms_col"}
+	for _, param := range f.Params {
+		params = append(params, cdecl(g.ctype(param.Pos, param.Type), valueName(param)))
+	}
+	returnType := "void"
+	if f.ResultType != backing.Unit {
+		returnType = g.ctype(scanner.Position{}, f.ResultType)
+	}
+	return fmt.Sprintf("%s %s(%s)", returnType, funcName(f.Name), strings.Join(params, ", "))
+}
+
+// function returns the body of the C function carrying out f, locals first. The init
+// function calls entry once it's done
+func (g *generator) function(f *ir.Func, entry string) string {
+	g.fn = &function{f: f, entry: entry, indent: 1, labeled: make(map[*ir.Block]bool)}
+	defer func() {
+		g.fn = nil
+	}()
+	var out strings.Builder
+	guarded := false
+	for _, b := range f.Blocks {
+		guarded = guarded || b.Catch != nil
+		for _, v := range b.Instrs {
+			if v.HasResult() && v.Op != ir.OpConst {
+				fmt.Fprintf(&out, "    %s;\n", cdecl(g.ctype(v.Pos, v.Type), valueName(v)))
+			}
+		}
+	}
+	if guarded {
+		out.WriteString("    ms_handler ms_h;\n")
+	}
+	if entry == "" {
+		out.WriteString("    ms_enter(ms_line, ms_col);\n")
+	}
+
+	// labels are known once every block is generated
+	blocks := make([]string, len(f.Blocks))
+	for idx, b := range f.Blocks {
+		var next *ir.Block
+		if idx+1 < len(f.Blocks) {
+			next = f.Blocks[idx+1]
+		}
+		g.fn.body.Reset()
+		g.block(b, next)
+		blocks[idx] = g.fn.body.String()
+	}
+	for idx, b := range f.Blocks {
+		if g.fn.labeled[b] {
+			fmt.Fprintf(&out, "%s:\n", blockName(b))
+		}
+		out.WriteString(blocks[idx])
+	}
+	return out.String()
+}
+
+func (g *generator) block(b *ir.Block, next *ir.Block) {
+	for _, v := range b.Instrs {
+		switch v.Op {
+		case ir.OpPhi, ir.OpConst:
+			// phis are assigned by edges leading to the block, constants are inlined where they're used
+			continue
+		case ir.OpCatch:
+			// assigned on the way to the handler
+			continue
+		}
+		stmt := g.expr(v) + ";"
+		if v.HasResult() {
+			stmt = valueName(v) + " = " + stmt
+		}
+		if b.Catch != nil && v.MayThrow() {
+			g.guard(b, stmt, true)
+		} else {
+			g.line("%s", stmt)
+		}
+	}
+
+	switch b.Kind {
+	case ir.BlockPlain:
+		g.jump(b, b.Succs[0], next)
+	case ir.BlockIf:
+		then, els := b.Succs[0], b.Succs[1]
+		cond := g.operand(b.Control)
+		if g.hasCopies(b, then) {
+			g.line("if (%s) {", cond)
+			g.fn.indent++
+			g.jump(b, then, nil)
+			g.fn.indent--
+			g.line("}")
+		} else {
+			g.line("if (%s) goto %s;", cond, g.label(then))
+		}
+		g.jump(b, els, next)
+	case ir.BlockReturn:
+		if g.fn.entry != "" {
+			g.line("%s(0, 0);", funcName(g.fn.entry))
+			g.line("return;")
+			break
+		}
+		g.line("ms_leave();")
+		if b.Control == nil {
+			g.line("return;")
+		} else {
+			g.line("return %s;", g.convert(b.Control, g.fn.f.ResultType))
+		}
+	case ir.BlockThrow:
+		raise := fmt.Sprintf("ms_raise(%s, %d, %d);", g.operand(b.Control), b.Pos.Line, b.Pos.Column)
+		if b.Catch != nil {
+			g.guard(b, raise, false)
+		} else {
+			g.line("%s", raise)
+		}
+	}
+}
+
+// guard runs stmt with a handler pushed, an exception it raises goes to the block handling
+// exceptions raised by b. The handler is popped once stmt is done, unless it never is
+func (g *generator) guard(b *ir.Block, stmt string, pop bool) {
+	g.line("ms_push_handler(&ms_h);")
+	g.line("if (setjmp(ms_h.env) == 0) {")
+	g.line("    %s", stmt)
+	if pop {
+		g.line("    ms_pop_handler();")
+	}
+	g.line("} else {")
+	g.fn.indent++
+	for _, v := range b.Catch.Instrs {
+		if v.Op == ir.OpCatch {
+			g.line("%s = ms_caught;", valueName(v))
+		}
+	}
+	g.jump(b, b.Catch, nil)
+	g.fn.indent--
+	g.line("}")
+}
+
+// jump passes control from a block to its successor, which follows it unless it's next
+func (g *generator) jump(from, to *ir.Block, next *ir.Block) {
+	g.edge(from, to)
+	if to != next {
+		g.line("goto %s;", g.label(to))
+	}
+}
+
+// label returns the label of the block, which is jumped to
+func (g *generator) label(b *ir.Block) string {
+	g.fn.labeled[b] = true
+	return blockName(b)
+}
+
+// phis returns phis of the block
+func phis(b *ir.Block) []*ir.Value {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == ir.OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// hasCopies reports whether the edge assigns phis
+func (g *generator) hasCopies(from, to *ir.Block) bool {
+	idx := to.PredIndex(from)
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			return true
+		}
+	}
+	return false
+}
+
+// edge assigns phis of the block control is passed to their arguments coming from the block
+// it's passed from. Arguments go through temporaries if one of the phis is an argument
+// of another one, so that every phi gets the value its argument had before the edge
+func (g *generator) edge(from, to *ir.Block) {
+	idx := to.PredIndex(from)
+	var assigned []*ir.Value
+	isAssigned := make(map[*ir.Value]bool)
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			assigned = append(assigned, phi)
+			isAssigned[phi] = true
+		}
+	}
+	parallel := false
+	for _, phi := range assigned {
+		parallel = parallel || isAssigned[phi.Args[idx]]
+	}
+	if !parallel {
+		for _, phi := range assigned {
+			g.line("%s = %s;", valueName(phi), g.convert(phi.Args[idx], phi.Type))
+		}
+		return
+	}
+	g.line("{")
+	for tmp, phi := range assigned {
+		g.line("    %s = %s;", cdecl(g.ctype(phi.Pos, phi.Type), fmt.Sprintf("t%d", tmp)), g.convert(phi.Args[idx], phi.Type))
+	}
+	for tmp, phi := range assigned {
+		g.line("    %s = t%d;", valueName(phi), tmp)
+	}
+	g.line("}")
+}
+
+// valueName returns the name of the C local holding the value
+func valueName(v *ir.Value) string {
+	return "v" + strconv.Itoa(v.ID)
+}
+
+func blockName(b *ir.Block) string {
+	return "b" + strconv.Itoa(b.ID)
+}
+
+// globalName returns the C name of the global variable
+func globalName(name string) string {
+	return "g_" + mangle(name)
+}
+
+// cdecl returns the declaration of a C variable of the given type
+func cdecl(ctype string, name string) string {
+	if strings.HasSuffix(ctype, "*") {
+		return ctype + name
+	}
+	return ctype + " " + name
+}
+
+// funcName returns the C name of the function defined by the program
+func funcName(name string) string {
+	return "f_" + mangle(name)
+}
+
+// mangle turns a name into a C identifier, names may contain characters
+// C doesn't allow in them, such as - and $
+func mangle(name string) string {
+	var b strings.Builder
+	for idx := 0; idx < len(name); idx++ {
+		c := name[idx]
+		switch {
+		case c == '_':
+			b.WriteString("__")
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func (g *generator) ctype(pos scanner.Position, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int:
+		return "int64_t"
+	case backing.Float:
+		return "double"
+	case backing.Bool:
+		return "bool"
+	case backing.String:
+		return "ms_string"
+	case backing.Array:
+		return "ms_array *"
+	case backing.Exception:
+		return "ms_exception *"
+	case backing.Any:
+		return "ms_value"
+	}
+	g.errorf(pos, "values of type %s aren't supported by the C backend", backing.ValueTypeToStr(valueType))
+	return "void"
+}
+
+// typeConst returns the ms_type constant standing for the type
+func typeConst(valueType backing.ValueType) string {
+	return "MS_" + strings.ToUpper(backing.ValueTypeToStr(valueType))
+}
+
+// operand returns a C expression evaluating to the value, constants are written out
+func (g *generator) operand(v *ir.Value) string {
+	if v.Op != ir.OpConst {
+		return valueName(v)
+	}
+	value := v.Aux.(backing.Value)
+	switch value.ValueType {
+	case backing.String:
+		return stringLit(value.Value.(string))
+	case backing.Int:
+		return fmt.Sprintf("INT64_C(%d)", value.Value.(int64))
+	case backing.Float:
+		return floatLit(value.Value.(float64))
+	case backing.Bool:
+		return strconv.FormatBool(value.Value.(bool))
+	}
+	g.errorf(v.Pos, "constants of type %s aren't supported by the C backend", backing.ValueTypeToStr(value.ValueType))
+	return "0"
+}
+
+// convert returns a C expression evaluating to the value converted to the target type,
+// a value is boxed if it's passed where a value of type Any is expected
+func (g *generator) convert(v *ir.Value, target backing.ValueType) string {
+	if target == backing.Any && v.Type != backing.Any {
+		return box(g.operand(v), v.Type)
+	}
+	return g.operand(v)
+}
+
+func box(value string, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int:
+		return "ms_box_int(" + value + ")"
+	case backing.Float:
+		return "ms_box_float(" + value + ")"
+	case backing.Bool:
+		return "ms_box_bool(" + value + ")"
+	case backing.String:
+		return "ms_box_string(" + value + ")"
+	case backing.Array:
+		return "ms_box_array(" + value + ")"
+	case backing.Exception:
+		return "ms_box_exception(" + value + ")"
+	}
+	return "ms_null()"
+}
+
+func unbox(value string, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int:
+		return value + ".as.i"
+	case backing.Float:
+		return value + ".as.f"
+	case backing.Bool:
+		return value + ".as.b"
+	case backing.String:
+		return value + ".as.s"
+	case backing.Array:
+		return value + ".as.a"
+	case backing.Exception:
+		return value + ".as.e"
+	}
+	return value
+}
+
+// stringLit returns a C expression of type ms_string holding s. Bytes other than printable
+// ASCII are escaped in octal, which unlike hex escapes never runs into the following digits
+func stringLit(s string) string {
+	var b strings.Builder
+	b.WriteString(`MS_STR("`)
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		switch {
+		case c == '"' || c == '\\' || c == '?':
+			// ? may start a trigraph
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	fmt.Fprintf(&b, `", %d)`, len(s))
+	return b.String()
+}
+
+// floatLit returns a C literal holding exactly the same double as x
+func floatLit(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "INFINITY"
+	case math.IsInf(x, -1):
+		return "(-INFINITY)"
+	case math.IsNaN(x):
+		return "NAN"
+	}
+	lit := strconv.FormatFloat(x, 'g', -1, 64)
+	if !strings.ContainsAny(lit, ".e") {
+		lit += ".0"
+	}
+	if x < 0 {
+		return "(" + lit + ")"
+	}
+	return lit
+}
+
+// comparisons maps comparison instructions to C operators
+var comparisons = map[ir.Op]string{
+	ir.OpEq: "==",
+	ir.OpNe: "!=",
+	ir.OpLt: "<",
+	ir.OpLe: "<=",
+	ir.OpGt: ">",
+	ir.OpGe: ">=",
+}
+
+// expr returns a C expression carrying out the instruction, positions of instructions
+// which may throw are passed on to the runtime, so that the exception is located
+// the way the vm does
+func (g *generator) expr(v *ir.Value) string {
+	args := make([]string, len(v.Args))
+	for idx, arg := range v.Args {
+		args[idx] = g.operand(arg)
+	}
+	pos := fmt.Sprintf("%d, %d", v.Pos.Line, v.Pos.Column)
+	switch v.Op {
+	case ir.OpLoadGlobal:
+		return globalName(v.Aux.(string))
+	case ir.OpStoreGlobal:
+		name := v.Aux.(string)
+		return globalName(name) + " = " + g.convert(v.Args[0], g.globals[name])
+	case ir.OpAdd:
+		switch v.Type {
+		case backing.String:
+			return "ms_concat(" + args[0] + ", " + args[1] + ")"
+		case backing.Int:
+			return "ms_add_int(" + args[0] + ", " + args[1] + ")"
+		}
+		return "(" + args[0] + " + " + args[1] + ")"
+	case ir.OpSub:
+		if v.Type == backing.Int {
+			return "ms_sub_int(" + args[0] + ", " + args[1] + ")"
+		}
+		return "(" + args[0] + " - " + args[1] + ")"
+	case ir.OpMul:
+		if v.Type == backing.Int {
+			return "ms_mul_int(" + args[0] + ", " + args[1] + ")"
+		}
+		return "(" + args[0] + " * " + args[1] + ")"
+	case ir.OpDiv:
+		if v.Type == backing.Int {
+			return fmt.Sprintf("ms_div_int(%s, %s, %s)", args[0], args[1], pos)
+		}
+		return "(" + args[0] + " / " + args[1] + ")"
+	case ir.OpMod:
+		if v.Type == backing.Int {
+			return fmt.Sprintf("ms_mod_int(%s, %s, %s)", args[0], args[1], pos)
+		}
+		return "fmod(" + args[0] + ", " + args[1] + ")"
+	case ir.OpNeg:
+		if v.Type == backing.Int {
+			// like in the other backends, negation is multiplication by -1, which wraps around
+			return "ms_mul_int(" + args[0] + ", -1)"
+		}
+		return "(" + args[0] + " * -1.0)"
+	case ir.OpEq, ir.OpNe, ir.OpLt, ir.OpLe, ir.OpGt, ir.OpGe:
+		if v.Args[0].Type == backing.String {
+			return "(ms_compare_strings(" + args[0] + ", " + args[1] + ") " + comparisons[v.Op] + " 0)"
+		}
+		return "(" + args[0] + " " + comparisons[v.Op] + " " + args[1] + ")"
+	case ir.OpAnd:
+		return "(" + args[0] + " && " + args[1] + ")"
+	case ir.OpOr:
+		return "(" + args[0] + " || " + args[1] + ")"
+	case ir.OpNot:
+		return "(!" + args[0] + ")"
+	case ir.OpToFloat:
+		return "(double)" + args[0]
+	case ir.OpCast:
+		castType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		switch {
+		case castType == operandType:
+			return args[0]
+		case castType == backing.Any:
+			return box(args[0], operandType)
+		}
+		return unbox(fmt.Sprintf("ms_cast(%s, %s, %s)", g.convert(v.Args[0], backing.Any), typeConst(castType), pos), castType)
+	case ir.OpInstanceOf:
+		testType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		if operandType != backing.Any {
+			return strconv.FormatBool(backing.IsAssignable(testType, operandType))
+		}
+		return fmt.Sprintf("ms_instance_of(%s, %s)", args[0], typeConst(testType))
+	case ir.OpCall:
+		return g.call(v, pos)
+	}
+	g.errorf(v.Pos, "instruction %s isn't supported by the C backend", v.Op)
+	return "0"
+}
+
+// call returns a C expression calling the function, arguments are converted to types of its parameters
+func (g *generator) call(v *ir.Value, pos string) string {
+	name := v.Callee()
+	var paramTypes []backing.ValueType
+	runtimeCall := backing.IsRuntimeCall(name)
+	if runtimeCall {
+		paramTypes = backing.RuntimeFuncEntry(name).ParamTypes
+	} else {
+		f, ok := g.funcs[name]
+		if !ok {
+			g.errorf(v.Pos, "no function with name %s was found", name)
+			return "0"
+		}
+		for _, param := range f.Params {
+			paramTypes = append(paramTypes, param.Type)
+		}
+	}
+	args := make([]string, len(v.Args))
+	for idx, arg := range v.Args {
+		args[idx] = g.convert(arg, paramTypes[idx])
+	}
+	if !runtimeCall {
+		return funcName(name) + "(" + strings.Join(append([]string{pos}, args...), ", ") + ")"
+	}
+
+	switch name {
+	case "print":
+		return "ms_print(" + args[0] + ")"
+	case "to_string":
+		return "ms_to_string(" + args[0] + ")"
+	case "toInt":
+		return fmt.Sprintf("ms_to_int(%s, %s)", args[0], pos)
+	case "toFloat":
+		return "(double)" + args[0]
+	case "array_new":
+		return fmt.Sprintf("ms_array_new(%s, %s, %s)", args[0], args[1], pos)
+	case "array_set":
+		return fmt.Sprintf("ms_array_set(%s, %s, %s, %s)", args[0], args[1], args[2], pos)
+	case "array_get":
+		return fmt.Sprintf("ms_array_get(%s, %s, %s)", args[0], args[1], pos)
+	case "array_size":
+		return args[0] + "->len"
+	case "exception_new":
+		return fmt.Sprintf("ms_exception_new(%s, %s)", args[0], args[1])
+	case "exception_kind":
+		return args[0] + "->kind"
+	case "exception_message":
+		return args[0] + "->message"
+	case "assert":
+		return fmt.Sprintf("ms_assert(%s, %s, %s)", args[0], args[1], pos)
+	case "assertEquals":
+		return fmt.Sprintf("ms_assert_equals(%s, %s, %s)", args[0], args[1], pos)
+	}
+	g.errorf(v.Pos, "runtime function %s isn't supported by the C backend", name)
+	return "0"
+}
@@ -0,0 +1,50 @@
+package cgen
+
+import (
+	"github.com/ThreadedStream/miniscala/backendtest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestDifferential checks that executables compiled from generated programs
+// behave like the interpreter running the same programs
+func TestDifferential(t *testing.T) {
+	backendtest.Differential(t, backend(t), 40)
+}
+
+// TestScopes checks that variables declared in blocks, sharing names with others, are kept apart
+func TestScopes(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.Scopes)
+}
+
+// TestTailCalls checks that functions calling themselves in tail position run as deep as loops
+func TestTailCalls(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.TailCalls)
+}
+
+// TestFloatFormat checks that the runtime renders floats the way Go's %v does
+func TestFloatFormat(t *testing.T) {
+	backendtest.FloatFormat(t, backend(t))
+}
+
+// backend compiles programs to executables with the C compiler, skipping the test if there's none
+func backend(t *testing.T) backendtest.Backend {
+	cc := backendtest.CCompiler(t)
+	return backendtest.OneByOne("c", func(t *testing.T, dir string, program backendtest.Program) backendtest.Output {
+		t.Helper()
+		csrc, err := Generate(program.IR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpath, output := filepath.Join(dir, "prog.c"), filepath.Join(dir, "prog")
+		if err := os.WriteFile(cpath, csrc, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(cc, "-O2", "-o", output, cpath, "-lm").CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v\n%s", cc, err, out)
+		}
+		return backendtest.Exec(t, exec.Command(output))
+	})
+}
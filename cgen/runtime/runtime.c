@@ -0,0 +1,683 @@
+/*
+ * Runtime of miniscala programs compiled to C or to assembly. It's put in front of every
+ * generated C translation unit, while assembly is linked with it. Either way, the program
+ * defines miniscala_main, called by main below.
+ *
+ * Values are represented with plain C types picked by the static types of expressions,
+ * only values of type Any carry their type along (ms_value). Exceptions unwind the C stack
+ * with longjmp to the innermost handler pushed by a try statement. Memory is never freed,
+ * it's given back to the system when the program exits.
+ */
+#include <math.h>
+#include <setjmp.h>
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+/* mirrors backing.ValueType */
+typedef enum {
+    MS_FLOAT,
+    MS_INT,
+    MS_STRING,
+    MS_UNIT,
+    MS_BOOL,
+    MS_ARRAY,
+    MS_FUNCTION,
+    MS_REF,
+    MS_ANY,
+    MS_NULL,
+    MS_UNDEFINED,
+    MS_EXCEPTION,
+} ms_type;
+
+/* strings are immutable and aren't terminated by zero */
+typedef struct {
+    const char *data;
+    int64_t len;
+} ms_string;
+
+typedef struct ms_array ms_array;
+
+typedef struct {
+    ms_string kind;
+    ms_string message;
+    /* where the exception was first raised, zero until then */
+    int line;
+    int col;
+} ms_exception;
+
+typedef struct {
+    ms_type type;
+    union {
+        int64_t i;
+        double f;
+        bool b;
+        ms_string s;
+        ms_array *a;
+        ms_exception *e;
+    } as;
+} ms_value;
+
+struct ms_array {
+    ms_type element_type;
+    int64_t len;
+    ms_value *items;
+};
+
+/* a handler is pushed around code raising exceptions which a try statement handles */
+typedef struct ms_handler {
+    jmp_buf env;
+    struct ms_handler *prev;
+    /* call depth at the time the handler was pushed */
+    int depth;
+} ms_handler;
+
+#define MS_MAX_CALL_DEPTH 256
+
+static ms_handler *ms_handlers;
+/* the exception being handled by the handler longjmp has just landed in */
+static ms_exception *ms_caught;
+static int ms_depth;
+
+#define MS_STR(lit, len) ((ms_string){(lit), (len)})
+
+void *ms_alloc(size_t size) {
+    void *p = calloc(1, size ? size : 1);
+    if (p == NULL) {
+        fputs("out of memory\n", stderr);
+        exit(2);
+    }
+    return p;
+}
+
+/* strings built at run time */
+
+typedef struct {
+    char *data;
+    int64_t len;
+    int64_t cap;
+} ms_builder;
+
+void ms_builder_write(ms_builder *b, const char *data, int64_t len) {
+    if (b->len + len > b->cap) {
+        int64_t cap = b->cap * 2 + len + 16;
+        char *grown = ms_alloc((size_t)cap);
+        if (b->len > 0) {
+            memcpy(grown, b->data, (size_t)b->len);
+        }
+        free(b->data);
+        b->data = grown;
+        b->cap = cap;
+    }
+    if (len > 0) {
+        memcpy(b->data + b->len, data, (size_t)len);
+    }
+    b->len += len;
+}
+
+void ms_builder_string(ms_builder *b, ms_string s) {
+    ms_builder_write(b, s.data, s.len);
+}
+
+void ms_builder_cstr(ms_builder *b, const char *s) {
+    ms_builder_write(b, s, (int64_t)strlen(s));
+}
+
+ms_string ms_builder_done(ms_builder *b) {
+    return MS_STR(b->data ? b->data : "", b->len);
+}
+
+ms_string ms_cstr(const char *s) {
+    ms_builder b = {0};
+    ms_builder_cstr(&b, s);
+    return ms_builder_done(&b);
+}
+
+ms_string ms_concat(ms_string x, ms_string y) {
+    ms_builder b = {0};
+    ms_builder_string(&b, x);
+    ms_builder_string(&b, y);
+    return ms_builder_done(&b);
+}
+
+int ms_compare_strings(ms_string x, ms_string y) {
+    int64_t n = x.len < y.len ? x.len : y.len;
+    int res = n > 0 ? memcmp(x.data, y.data, (size_t)n) : 0;
+    if (res != 0) {
+        return res;
+    }
+    return (x.len > y.len) - (x.len < y.len);
+}
+
+bool ms_strings_equal(ms_string x, ms_string y) {
+    return ms_compare_strings(x, y) == 0;
+}
+
+const char *ms_type_name(ms_type type) {
+    switch (type) {
+    case MS_FLOAT: return "Float";
+    case MS_INT: return "Int";
+    case MS_STRING: return "String";
+    case MS_BOOL: return "Bool";
+    case MS_UNIT: return "Unit";
+    case MS_FUNCTION: return "Function";
+    case MS_REF: return "Ref";
+    case MS_NULL: return "Null";
+    case MS_ARRAY: return "Array";
+    case MS_ANY: return "Any";
+    case MS_UNDEFINED: return "Undefined";
+    case MS_EXCEPTION: return "Exception";
+    }
+    return "Unknown";
+}
+
+ms_type ms_type_of_name(ms_string name) {
+    static const ms_type types[] = {MS_FLOAT, MS_INT, MS_STRING, MS_UNIT, MS_BOOL, MS_ARRAY, MS_ANY, MS_EXCEPTION};
+    for (size_t i = 0; i < sizeof(types) / sizeof(types[0]); i++) {
+        if (ms_strings_equal(name, ms_cstr(ms_type_name(types[i])))) {
+            return types[i];
+        }
+    }
+    return MS_UNDEFINED;
+}
+
+/* exceptions */
+
+ms_exception *ms_exception_new(ms_string kind, ms_string message) {
+    ms_exception *e = ms_alloc(sizeof(ms_exception));
+    e->kind = kind;
+    e->message = message;
+    return e;
+}
+
+void ms_push_handler(ms_handler *h) {
+    h->prev = ms_handlers;
+    h->depth = ms_depth;
+    ms_handlers = h;
+}
+
+void ms_pop_handler(void) {
+    ms_handlers = ms_handlers->prev;
+}
+
+/* ms_raise hands the exception over to the innermost handler, an exception
+   no handler is left for ends the program */
+void ms_raise(ms_exception *e, int line, int col) {
+    if (e->line == 0) {
+        e->line = line;
+        e->col = col;
+    }
+    ms_handler *h = ms_handlers;
+    if (h == NULL) {
+        fflush(stdout);
+        fprintf(stderr, "[%d:%d] exception in main: %.*s: %.*s\n", e->line, e->col,
+                (int)e->kind.len, e->kind.data, (int)e->message.len, e->message.data);
+        exit(1);
+    }
+    ms_handlers = h->prev;
+    ms_depth = h->depth;
+    ms_caught = e;
+    longjmp(h->env, 1);
+}
+
+void ms_throw(const char *kind, ms_string message, int line, int col) {
+    ms_raise(ms_exception_new(ms_cstr(kind), message), line, col);
+}
+
+ms_string ms_sprintf(const char *format, ...);
+
+void ms_enter(int line, int col) {
+    if (ms_depth > MS_MAX_CALL_DEPTH) {
+        ms_throw("StackOverflowError", ms_sprintf("calls nested deeper than %d", MS_MAX_CALL_DEPTH), line, col);
+    }
+    ms_depth++;
+}
+
+void ms_leave(void) {
+    ms_depth--;
+}
+
+/* formatting, the same way the other backends do it */
+
+#include <stdarg.h>
+
+ms_string ms_sprintf(const char *format, ...) {
+    va_list args;
+    va_start(args, format);
+    int len = vsnprintf(NULL, 0, format, args);
+    va_end(args);
+    char *data = ms_alloc((size_t)len + 1);
+    va_start(args, format);
+    vsnprintf(data, (size_t)len + 1, format, args);
+    va_end(args);
+    return MS_STR(data, len);
+}
+
+/* ms_format_float renders x like Go's %v: the shortest representation which reads back
+   as x, in exponent form if the exponent is less than -4 or at least 6 */
+void ms_format_float(ms_builder *b, double x) {
+    if (isnan(x)) {
+        ms_builder_cstr(b, "NaN");
+        return;
+    }
+    if (isinf(x)) {
+        ms_builder_cstr(b, x > 0 ? "+Inf" : "-Inf");
+        return;
+    }
+    if (signbit(x)) {
+        ms_builder_cstr(b, "-");
+        x = -x;
+    }
+    if (x == 0) {
+        ms_builder_cstr(b, "0");
+        return;
+    }
+    char buf[64];
+    for (int prec = 0; prec < 17; prec++) {
+        snprintf(buf, sizeof(buf), "%.*e", prec, x);
+        if (strtod(buf, NULL) == x) {
+            break;
+        }
+    }
+    /* buf holds d.ddde±xx, split it into digits and the exponent */
+    char digits[32];
+    int ndigits = 0;
+    char *p = buf;
+    for (; *p != 'e'; p++) {
+        if (*p != '.') {
+            digits[ndigits++] = *p;
+        }
+    }
+    while (ndigits > 1 && digits[ndigits - 1] == '0') {
+        ndigits--;
+    }
+    int exp = atoi(p + 1);
+    if (exp < -4 || exp >= 6) {
+        ms_builder_write(b, digits, 1);
+        if (ndigits > 1) {
+            ms_builder_cstr(b, ".");
+            ms_builder_write(b, digits + 1, ndigits - 1);
+        }
+        snprintf(buf, sizeof(buf), "e%c%02d", exp < 0 ? '-' : '+', exp < 0 ? -exp : exp);
+        ms_builder_cstr(b, buf);
+        return;
+    }
+    if (exp < 0) {
+        ms_builder_cstr(b, "0.");
+        for (int i = 0; i < -exp - 1; i++) {
+            ms_builder_cstr(b, "0");
+        }
+        ms_builder_write(b, digits, ndigits);
+        return;
+    }
+    for (int i = 0; i <= exp || i < ndigits; i++) {
+        if (i == exp + 1) {
+            ms_builder_cstr(b, ".");
+        }
+        ms_builder_write(b, i < ndigits ? &digits[i] : "0", 1);
+    }
+}
+
+void ms_format_value(ms_builder *b, ms_value v);
+
+void ms_format_array(ms_builder *b, ms_array *a) {
+    /* the layout of backing.ArrayValue printed with %v */
+    ms_builder_cstr(b, "{[");
+    for (int64_t i = 0; i < a->len; i++) {
+        if (i > 0) {
+            ms_builder_cstr(b, " ");
+        }
+        ms_builder_cstr(b, "{");
+        ms_format_value(b, a->items[i]);
+        char buf[32];
+        snprintf(buf, sizeof(buf), " %d false}", (int)a->items[i].type);
+        ms_builder_cstr(b, buf);
+    }
+    char buf[32];
+    snprintf(buf, sizeof(buf), "] %d}", (int)a->element_type);
+    ms_builder_cstr(b, buf);
+}
+
+void ms_format_value(ms_builder *b, ms_value v) {
+    char buf[32];
+    switch (v.type) {
+    case MS_INT:
+        snprintf(buf, sizeof(buf), "%lld", (long long)v.as.i);
+        ms_builder_cstr(b, buf);
+        break;
+    case MS_FLOAT:
+        ms_format_float(b, v.as.f);
+        break;
+    case MS_BOOL:
+        ms_builder_cstr(b, v.as.b ? "true" : "false");
+        break;
+    case MS_STRING:
+        ms_builder_string(b, v.as.s);
+        break;
+    case MS_ARRAY:
+        ms_format_array(b, v.as.a);
+        break;
+    case MS_EXCEPTION:
+        ms_builder_string(b, v.as.e->kind);
+        ms_builder_cstr(b, ": ");
+        ms_builder_string(b, v.as.e->message);
+        break;
+    default:
+        ms_builder_cstr(b, "<nil>");
+        break;
+    }
+}
+
+/* boxing into values of type Any */
+
+ms_value ms_box_int(int64_t x) {
+    ms_value v = {MS_INT, {0}};
+    v.as.i = x;
+    return v;
+}
+
+ms_value ms_box_float(double x) {
+    ms_value v = {MS_FLOAT, {0}};
+    v.as.f = x;
+    return v;
+}
+
+ms_value ms_box_bool(bool x) {
+    ms_value v = {MS_BOOL, {0}};
+    v.as.b = x;
+    return v;
+}
+
+ms_value ms_box_string(ms_string x) {
+    ms_value v = {MS_STRING, {0}};
+    v.as.s = x;
+    return v;
+}
+
+ms_value ms_box_array(ms_array *x) {
+    ms_value v = {MS_ARRAY, {0}};
+    v.as.a = x;
+    return v;
+}
+
+ms_value ms_box_exception(ms_exception *x) {
+    ms_value v = {MS_EXCEPTION, {0}};
+    v.as.e = x;
+    return v;
+}
+
+ms_value ms_null(void) {
+    ms_value v = {MS_NULL, {0}};
+    return v;
+}
+
+/* ms_cast checks that a value of type Any holds a value of the given type */
+ms_value ms_cast(ms_value v, ms_type type, int line, int col) {
+    if (type != MS_ANY && v.type != type) {
+        ms_throw("ClassCastException", ms_sprintf("%s cannot be cast to %s", ms_type_name(v.type), ms_type_name(type)),
+                 line, col);
+    }
+    return v;
+}
+
+bool ms_instance_of(ms_value v, ms_type type) {
+    return type == MS_ANY || v.type == type;
+}
+
+/* arithmetic, Ints wrap around on overflow */
+
+int64_t ms_add_int(int64_t x, int64_t y) {
+    return (int64_t)((uint64_t)x + (uint64_t)y);
+}
+
+int64_t ms_sub_int(int64_t x, int64_t y) {
+    return (int64_t)((uint64_t)x - (uint64_t)y);
+}
+
+int64_t ms_mul_int(int64_t x, int64_t y) {
+    return (int64_t)((uint64_t)x * (uint64_t)y);
+}
+
+int64_t ms_div_int(int64_t x, int64_t y, int line, int col) {
+    if (y == 0) {
+        ms_throw("ArithmeticException", ms_cstr("/ by zero"), line, col);
+    }
+    if (y == -1) {
+        return ms_mul_int(x, -1);
+    }
+    return x / y;
+}
+
+int64_t ms_mod_int(int64_t x, int64_t y, int line, int col) {
+    if (y == 0) {
+        ms_throw("ArithmeticException", ms_cstr("% by zero"), line, col);
+    }
+    if (y == -1) {
+        return 0;
+    }
+    return x % y;
+}
+
+/* runtime functions callable by programs */
+
+void ms_print(ms_string s) {
+    fwrite(s.data, 1, (size_t)s.len, stdout);
+}
+
+ms_string ms_to_string(ms_value v) {
+    ms_builder b = {0};
+    ms_format_value(&b, v);
+    return ms_builder_done(&b);
+}
+
+int64_t ms_to_int(double x, int line, int col) {
+    if (isnan(x) || x >= 9223372036854775808.0 || x < -9223372036854775808.0) {
+        ms_builder b = {0};
+        ms_format_float(&b, x);
+        ms_builder_cstr(&b, " is out of Int range");
+        ms_throw("ArithmeticException", ms_builder_done(&b), line, col);
+    }
+    return (int64_t)x;
+}
+
+ms_value ms_zero_value(ms_type type) {
+    switch (type) {
+    case MS_FLOAT:
+        return ms_box_float(0);
+    case MS_INT:
+        return ms_box_int(0);
+    case MS_STRING:
+        return ms_box_string(MS_STR("", 0));
+    case MS_BOOL:
+        return ms_box_bool(false);
+    default:
+        return ms_null();
+    }
+}
+
+ms_array *ms_array_new(int64_t len, ms_string element_type, int line, int col) {
+    if (len < 0) {
+        ms_throw("NegativeArraySizeException", ms_sprintf("%lld", (long long)len), line, col);
+    }
+    ms_array *a = ms_alloc(sizeof(ms_array));
+    a->element_type = ms_type_of_name(element_type);
+    a->len = len;
+    a->items = ms_alloc(sizeof(ms_value) * (size_t)len);
+    for (int64_t i = 0; i < len; i++) {
+        a->items[i] = ms_zero_value(a->element_type);
+    }
+    return a;
+}
+
+void ms_check_index(ms_array *a, int64_t idx, int line, int col) {
+    if (idx < 0 || idx >= a->len) {
+        ms_throw("IndexOutOfBoundsException",
+                 ms_sprintf("index %lld out of bounds for length %lld", (long long)idx, (long long)a->len), line, col);
+    }
+}
+
+void ms_array_set(ms_array *a, int64_t idx, ms_value v, int line, int col) {
+    ms_check_index(a, idx, line, col);
+    if (a->element_type != MS_ANY && a->element_type != v.type) {
+        ms_throw("ArrayStoreException",
+                 ms_sprintf("array expected type %s, but got %s", ms_type_name(a->element_type), ms_type_name(v.type)),
+                 line, col);
+    }
+    a->items[idx] = v;
+}
+
+ms_value ms_array_get(ms_array *a, int64_t idx, int line, int col) {
+    ms_check_index(a, idx, line, col);
+    return a->items[idx];
+}
+
+bool ms_equals(ms_value x, ms_value y) {
+    bool x_numeric = x.type == MS_INT || x.type == MS_FLOAT;
+    bool y_numeric = y.type == MS_INT || y.type == MS_FLOAT;
+    if (x.type == MS_NULL || y.type == MS_NULL) {
+        return x.type == y.type;
+    }
+    if (x_numeric && y_numeric) {
+        if (x.type == MS_INT && y.type == MS_INT) {
+            return x.as.i == y.as.i;
+        }
+        double fx = x.type == MS_INT ? (double)x.as.i : x.as.f;
+        double fy = y.type == MS_INT ? (double)y.as.i : y.as.f;
+        return fx == fy;
+    }
+    if (x.type != y.type) {
+        return false;
+    }
+    switch (x.type) {
+    case MS_STRING:
+        return ms_strings_equal(x.as.s, y.as.s);
+    case MS_BOOL:
+        return x.as.b == y.as.b;
+    case MS_ARRAY:
+        if (x.as.a->len != y.as.a->len) {
+            return false;
+        }
+        for (int64_t i = 0; i < x.as.a->len; i++) {
+            if (!ms_equals(x.as.a->items[i], y.as.a->items[i])) {
+                return false;
+            }
+        }
+        return true;
+    case MS_EXCEPTION:
+        return ms_strings_equal(x.as.e->kind, y.as.e->kind) && ms_strings_equal(x.as.e->message, y.as.e->message);
+    default:
+        return false;
+    }
+}
+
+/* ms_describe renders the value for a failure message, quoting strings like Go's strconv.Quote */
+void ms_describe(ms_builder *b, ms_value v) {
+    if (v.type != MS_STRING) {
+        ms_format_value(b, v);
+        ms_builder_cstr(b, " (");
+        ms_builder_cstr(b, ms_type_name(v.type));
+        ms_builder_cstr(b, ")");
+        return;
+    }
+    ms_builder_cstr(b, "\"");
+    for (int64_t i = 0; i < v.as.s.len; i++) {
+        unsigned char c = (unsigned char)v.as.s.data[i];
+        char buf[8];
+        switch (c) {
+        case '\a': ms_builder_cstr(b, "\\a"); break;
+        case '\b': ms_builder_cstr(b, "\\b"); break;
+        case '\f': ms_builder_cstr(b, "\\f"); break;
+        case '\n': ms_builder_cstr(b, "\\n"); break;
+        case '\r': ms_builder_cstr(b, "\\r"); break;
+        case '\t': ms_builder_cstr(b, "\\t"); break;
+        case '\v': ms_builder_cstr(b, "\\v"); break;
+        case '\\': ms_builder_cstr(b, "\\\\"); break;
+        case '"': ms_builder_cstr(b, "\\\""); break;
+        default:
+            if (c < 0x20 || c == 0x7f) {
+                snprintf(buf, sizeof(buf), "\\x%02x", c);
+                ms_builder_cstr(b, buf);
+            } else {
+                ms_builder_write(b, (const char *)&c, 1);
+            }
+        }
+    }
+    ms_builder_cstr(b, "\"");
+}
+
+void ms_assert(bool cond, ms_string message, int line, int col) {
+    if (!cond) {
+        ms_throw("AssertionError", message, line, col);
+    }
+}
+
+void ms_assert_equals(ms_value expected, ms_value actual, int line, int col) {
+    if (!ms_equals(expected, actual)) {
+        ms_builder b = {0};
+        ms_builder_cstr(&b, "expected ");
+        ms_describe(&b, expected);
+        ms_builder_cstr(&b, ", but got ");
+        ms_describe(&b, actual);
+        ms_throw("AssertionError", ms_builder_done(&b), line, col);
+    }
+}
+
+/*
+ * entry points of the assembly backend, which passes values of type Any by pointer,
+ * and any other value as a pair of words, i.e as the payload of ms_value
+ */
+
+/* a handler is kept in a frame of the assembly backend, which reserves this much for it */
+_Static_assert(sizeof(ms_handler) <= 256, "ms_handler doesn't fit into its frame slot");
+_Static_assert(offsetof(ms_value, as) == 8, "payload of ms_value is expected to follow its type");
+
+ms_value *ms_box_ref(ms_type type, uint64_t w0, uint64_t w1) {
+    ms_value *v = ms_alloc(sizeof(ms_value));
+    uint64_t words[2] = {w0, w1};
+    v->type = type;
+    memcpy(&v->as, words, sizeof(v->as));
+    return v;
+}
+
+ms_string ms_to_string_ref(ms_value *v) {
+    return ms_to_string(*v);
+}
+
+ms_value *ms_cast_ref(ms_value *v, ms_type type, int line, int col) {
+    ms_cast(*v, type, line, col);
+    return v;
+}
+
+bool ms_instance_of_ref(ms_value *v, ms_type type) {
+    return ms_instance_of(*v, type);
+}
+
+void ms_array_set_ref(ms_array *a, int64_t idx, ms_value *v, int line, int col) {
+    ms_array_set(a, idx, *v, line, col);
+}
+
+ms_value *ms_array_get_ref(ms_array *a, int64_t idx, int line, int col) {
+    ms_value *v = ms_alloc(sizeof(ms_value));
+    *v = ms_array_get(a, idx, line, col);
+    return v;
+}
+
+void ms_assert_equals_ref(ms_value *expected, ms_value *actual, int line, int col) {
+    ms_assert_equals(*expected, *actual, line, col);
+}
+
+ms_exception *ms_caught_exception(void) {
+    return ms_caught;
+}
+
+/* defined by the generated code, runs top-level statements, then the main function */
+void miniscala_main(void);
+
+int main(void) {
+    miniscala_main();
+    fflush(stdout);
+    return 0;
+}
@@ -0,0 +1,179 @@
+// Package diff computes line-based differences between two texts
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around changes
+const context = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type op struct {
+	kind opKind
+	line string
+}
+
+// Unified returns differences between a and b in the unified format, labelling them
+// with names aName and bName. It returns an empty string if the texts are equal
+func Unified(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := lineOps(splitLines(a), splitLines(b))
+
+	var res strings.Builder
+	fmt.Fprintf(&res, "--- %s\n+++ %s\n", aName, bName)
+	// positions in a and b of the op at the given index, 1-based
+	aLine, bLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	aLine[0], bLine[0] = 1, 1
+	for idx, o := range ops {
+		aLine[idx+1], bLine[idx+1] = aLine[idx], bLine[idx]
+		if o.kind != opInsert {
+			aLine[idx+1]++
+		}
+		if o.kind != opDelete {
+			bLine[idx+1]++
+		}
+	}
+
+	for start := 0; start < len(ops); {
+		if ops[start].kind == opEqual {
+			start++
+			continue
+		}
+		// extend the hunk until there are more than 2*context unchanged lines in a row
+		hunkStart := max(start-context, 0)
+		end := start
+		for end < len(ops) {
+			if ops[end].kind != opEqual {
+				end++
+				continue
+			}
+			equalRun := end
+			for equalRun < len(ops) && ops[equalRun].kind == opEqual {
+				equalRun++
+			}
+			if equalRun == len(ops) || equalRun-end > 2*context {
+				break
+			}
+			end = equalRun
+		}
+		hunkEnd := min(end+context, len(ops))
+
+		aCount, bCount := 0, 0
+		for _, o := range ops[hunkStart:hunkEnd] {
+			if o.kind != opInsert {
+				aCount++
+			}
+			if o.kind != opDelete {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&res, "@@ -%s +%s @@\n", hunkRange(aLine[hunkStart], aCount), hunkRange(bLine[hunkStart], bCount))
+		for _, o := range ops[hunkStart:hunkEnd] {
+			switch o.kind {
+			case opEqual:
+				res.WriteString(" ")
+			case opDelete:
+				res.WriteString("-")
+			case opInsert:
+				res.WriteString("+")
+			}
+			res.WriteString(o.line)
+			res.WriteString("\n")
+		}
+		start = hunkEnd
+	}
+	return res.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range refers to the line preceding it
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for idx, line := range lines {
+		if strings.HasSuffix(line, "\n") {
+			lines[idx] = line[:len(line)-1]
+		} else {
+			lines[idx] = line + "\n\\ No newline at end of file"
+		}
+	}
+	return lines
+}
+
+// lineOps turns a into b by means of the longest common subsequence of their lines
+func lineOps(a, b []string) []op {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{opEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, op{opDelete, a[i]})
+			i++
+		default:
+			ops = append(ops, op{opInsert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{opDelete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{opInsert, b[j]})
+	}
+	return ops
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
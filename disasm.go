@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/optimize"
+	"io"
+	"os"
+	"strings"
+)
+
+// disasmCmd implements 'miniscala disasm', returns the exit code
+func disasmCmd(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	optimized := flags.Bool("O", false, "optimize the program and inline small functions before compiling it")
+	showDiff := flags.Bool("d", false, "display the diff of the bytecode before and after optimization")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala disasm [-O] [-d] <file>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*showDiff {
+		listing, ok := disassemble(path, src, *optimized, os.Stderr)
+		if !ok {
+			return 1
+		}
+		fmt.Print(listing)
+		return 0
+	}
+	before, ok := disassemble(path, src, false, os.Stderr)
+	if !ok {
+		return 1
+	}
+	// diagnostics are the same the second time around
+	after, _ := disassemble(path, src, true, io.Discard)
+	fmt.Print(diff.Unified(path, path+" (optimized)", before, after))
+	return 0
+}
+
+// disassemble compiles the program read from src, which is named path in messages,
+// to bytecode the way 'run' does and returns the listing of its functions in alphabetical
+// order. Diagnostics go to stderr, ok is false if there were errors
+func disassemble(path string, src []byte, optimized bool, stderr io.Writer) (listing string, ok bool) {
+	program, result, ok := loadProgram(path, bytes.NewReader(src), stderr)
+	if !ok {
+		return "", false
+	}
+	if optimized {
+		optimize.Program(program, result)
+	}
+	machine, err := newVM(program, result, optimized, optimized)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return "", false
+	}
+	var b strings.Builder
+	for idx, name := range machine.FuncNames() {
+		if idx > 0 {
+			b.WriteString("\n")
+		}
+		machine.Disassemble(name, &b)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestDisassembleInlines checks that the bytecode 'run -O' runs on the vm has small
+// functions inlined, while the bytecode run without -O calls them
+func TestDisassembleInlines(t *testing.T) {
+	src := `def twice(n: Int): Int {
+    return n * 2
+}
+
+def main(): Unit {
+    print(to_string(twice(21)))
+}
+`
+	for _, optimized := range []bool{false, true} {
+		listing, ok := disassemble("twice.miniscala", []byte(src), optimized, io.Discard)
+		if !ok {
+			t.Fatalf("-O=%v: the program doesn't compile", optimized)
+		}
+		calls := strings.Contains(listing, "Call twice")
+		if optimized && calls {
+			t.Errorf("-O: twice isn't inlined\n%s", listing)
+		}
+		if !optimized && !calls {
+			t.Errorf("twice isn't called\n%s", listing)
+		}
+	}
+}
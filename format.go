@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/format"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sourceExt = ".miniscala"
+
+// formatCmd implements 'miniscala fmt', returns the exit code
+func formatCmd(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the source file instead of stdout")
+	showDiff := flags.Bool("d", false, "display diffs instead of rewriting files, exit with 1 if there are any")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala fmt [-w] [-d] [path ...]\n\n")
+		fmt.Fprintf(os.Stderr, "Paths may be files or directories, the latter are searched for %s files.\n", sourceExt)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	for _, path := range flags.Args() {
+		files, err := sourceFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+			continue
+		}
+		for _, file := range files {
+			changed, err := formatFile(file, *write, *showDiff)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				exitCode = 1
+				continue
+			}
+			if changed && *showDiff {
+				exitCode = 1
+			}
+		}
+	}
+	return exitCode
+}
+
+// sourceFiles returns path itself if it's a file, or miniscala files found under path
+func sourceFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(path, sourceExt) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// formatFile formats a single file, returns whether its formatting differs from the canonical one
+func formatFile(path string, write, showDiff bool) (bool, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	res, err := format.Source(src)
+	if err != nil {
+		return false, fmt.Errorf("%s:\n%v", path, err)
+	}
+	changed := !bytes.Equal(src, res)
+	switch {
+	case showDiff:
+		fmt.Print(diff.Unified(path+".orig", path, string(src), string(res)))
+	case write:
+		if changed {
+			return changed, os.WriteFile(path, res, 0644)
+		}
+	default:
+		os.Stdout.Write(res)
+	}
+	return changed, nil
+}
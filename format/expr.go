@@ -0,0 +1,79 @@
+package format
+
+import (
+	"github.com/ThreadedStream/miniscala/syntax"
+	"strings"
+)
+
+// expr renders the expression on a single line
+func expr(e syntax.Expr) string {
+	switch e.(type) {
+	case *syntax.Name:
+		return e.(*syntax.Name).Value
+	case *syntax.BasicLit:
+		basicLit := e.(*syntax.BasicLit)
+		if basicLit.Kind == syntax.StringLit {
+			return quote(basicLit.Value)
+		}
+		return basicLit.Value
+	case *syntax.Call:
+		call := e.(*syntax.Call)
+		var args []string
+		for _, arg := range call.ArgList {
+			args = append(args, expr(arg))
+		}
+		return call.CalleeName.Value + "(" + strings.Join(args, ", ") + ")"
+	case *syntax.Cast:
+		cast := e.(*syntax.Cast)
+		return postfixOperand(cast.X) + ".asInstanceOf[" + expr(cast.Type) + "]"
+	case *syntax.TypeTest:
+		typeTest := e.(*syntax.TypeTest)
+		return postfixOperand(typeTest.X) + ".isInstanceOf[" + expr(typeTest.Type) + "]"
+	case *syntax.Operation:
+		operation := e.(*syntax.Operation)
+		if operation.Rhs == nil {
+			return syntax.OperatorToString(operation.Op) + postfixOperand(operation.Lhs)
+		}
+		return operand(operation.Lhs, operation.Op, false) + " " +
+			syntax.OperatorToString(operation.Op) + " " +
+			operand(operation.Rhs, operation.Op, true)
+	}
+	return ""
+}
+
+// postfixOperand renders the operand of a unary operator, a cast or a type test,
+// which binds tighter than any operation
+func postfixOperand(e syntax.Expr) string {
+	if _, ok := e.(*syntax.Operation); ok {
+		return "(" + expr(e) + ")"
+	}
+	return expr(e)
+}
+
+// operand renders the operand of the binary operator op, parenthesized if the parser
+// would otherwise group it differently
+func operand(e syntax.Expr, op syntax.Operator, isRhs bool) string {
+	operation, ok := e.(*syntax.Operation)
+	if !ok || operation.Rhs == nil {
+		return expr(e)
+	}
+	prec, parentPrec := syntax.Precedence(operation.Op), syntax.Precedence(op)
+	needsParens := prec < parentPrec
+	if prec == parentPrec {
+		if isRhs {
+			needsParens = syntax.IsLeftAssociative(op)
+		} else {
+			needsParens = !syntax.IsLeftAssociative(operation.Op)
+		}
+	}
+	if needsParens {
+		return "(" + expr(e) + ")"
+	}
+	return expr(e)
+}
+
+// quote turns the value of a string literal back into its source form
+func quote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
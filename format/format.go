@@ -0,0 +1,335 @@
+// Package format implements canonical formatting of miniscala source code
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"strings"
+	"text/scanner"
+)
+
+const indentation = "    "
+
+// Source parses src and returns it formatted canonically.
+// Syntax errors are returned as a single error, one per line
+func Source(src []byte) ([]byte, error) {
+	var syntaxErrors bytes.Buffer
+	program, hadErrors := syntax.ParseSource(bytes.NewReader(src), &syntaxErrors)
+	if hadErrors {
+		return nil, errors.New(strings.TrimRight(syntaxErrors.String(), "\n"))
+	}
+	return Program(program), nil
+}
+
+// Program prints the program canonically, along with its comments:
+//
+//   - statements are indented by four spaces per block, opening braces stay
+//     on the line of the statement they belong to
+//   - top-level definitions are separated by a blank line, elsewhere
+//     runs of blank lines are squeezed into a single one
+//   - binary operators are surrounded by spaces, parentheses are kept
+//     only where they're needed to preserve the meaning
+//   - annotations of declarations go on lines of their own
+func Program(program *syntax.Program) []byte {
+	p := &printer{
+		comments: program.Comments,
+	}
+	var prev syntax.Stmt
+	for idx, stmt := range program.StmtList {
+		// keep definitions visually apart from their surroundings
+		if prev != nil && (isDef(prev) || isDef(stmt)) {
+			p.forceBlankLine = true
+		}
+		next := program.EOF
+		if idx+1 < len(program.StmtList) {
+			next = program.StmtList[idx+1].Pos()
+		}
+		p.stmt(stmt, next)
+		prev = stmt
+	}
+	p.commentsBefore(program.EOF.Line + 1)
+	return p.buf.Bytes()
+}
+
+func isDef(stmt syntax.Stmt) bool {
+	_, ok := stmt.(*syntax.DefDeclStmt)
+	return ok
+}
+
+type printer struct {
+	buf    bytes.Buffer
+	indent int
+	// comments yet to be printed
+	comments []*syntax.Comment
+	// source line of whatever was printed last, zero at the start of a block
+	lastLine int
+	// whether the next line is to be preceded by a blank line anyway
+	forceBlankLine bool
+}
+
+// startLine begins a new line, holding the item at the given source line. A blank line
+// comes first if there was one in the source, unless the item opens a block
+func (p *printer) startLine(srcLine int) {
+	if p.lastLine != 0 && (p.forceBlankLine || srcLine > p.lastLine+1) {
+		p.buf.WriteString("\n")
+	}
+	p.forceBlankLine = false
+	p.buf.WriteString(strings.Repeat(indentation, p.indent))
+	p.lastLine = srcLine
+}
+
+func (p *printer) endLine() {
+	p.buf.WriteString("\n")
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&p.buf, format, args...)
+}
+
+// commentsBefore prints comments which precede the given source line, each one on its own
+func (p *printer) commentsBefore(srcLine int) {
+	for len(p.comments) > 0 && p.comments[0].Pos().Line < srcLine {
+		comment := p.comments[0]
+		p.comments = p.comments[1:]
+		p.startLine(comment.Pos().Line)
+		p.printf("%s", comment.Text)
+		p.endLine()
+	}
+}
+
+// trailingComments appends comments located on the given source line to the current line,
+// as long as they precede next, the source position of what is printed on the following
+// line. Comments following next on the same source line come after the last thing printed
+// from that line, e.g. after the closing brace of a block written on a single line
+func (p *printer) trailingComments(srcLine int, next scanner.Position) {
+	for len(p.comments) > 0 && p.comments[0].Pos().Line == srcLine && before(p.comments[0].Pos(), next) {
+		p.printf(" %s", p.comments[0].Text)
+		p.comments = p.comments[1:]
+	}
+}
+
+// openBlock ends the current line with an opening brace, next is the source position
+// of what follows it
+func (p *printer) openBlock(srcLine int, next scanner.Position) {
+	p.printf(" {")
+	p.trailingComments(srcLine, next)
+	p.endLine()
+	p.indent++
+	p.lastLine = 0
+}
+
+// block prints the block on the current line, starting with the opening brace. The line
+// of the closing brace is left open for whatever comes after it, e.g. an else branch
+func (p *printer) block(block *syntax.BlockStmt) {
+	p.openBlock(block.Pos().Line, first(block))
+	p.stmts(block)
+	p.indent--
+	p.lastLine = 0
+	p.startLine(block.End.Line)
+	p.printf("}")
+}
+
+func (p *printer) stmts(block *syntax.BlockStmt) {
+	for idx, stmt := range block.Stmts {
+		next := block.End
+		if idx+1 < len(block.Stmts) {
+			next = block.Stmts[idx+1].Pos()
+		}
+		p.stmt(stmt, next)
+	}
+	p.commentsBefore(block.End.Line)
+}
+
+// stmt prints the statement on lines of its own, next is the source position of what follows it
+func (p *printer) stmt(stmt syntax.Stmt, next scanner.Position) {
+	p.commentsBefore(stmt.Pos().Line)
+	switch stmt.(type) {
+	case *syntax.DefDeclStmt:
+		defDeclStmt := stmt.(*syntax.DefDeclStmt)
+		p.annotations(defDeclStmt.Annotations)
+		p.startLine(defDeclStmt.Pos().Line)
+		var params []string
+		for _, param := range defDeclStmt.ParamList {
+			params = append(params, inlineAnnotations(param.Annotations)+param.Name.Value+": "+expr(param.Type))
+		}
+		p.printf("def %s(%s): %s", defDeclStmt.Name.Value, strings.Join(params, ", "), expr(defDeclStmt.ReturnType))
+		p.block(defDeclStmt.Body)
+	case *syntax.ValDeclStmt:
+		valDeclStmt := stmt.(*syntax.ValDeclStmt)
+		p.annotations(valDeclStmt.Annotations)
+		p.startLine(valDeclStmt.Pos().Line)
+		p.printf("val %s%s = %s", valDeclStmt.Name.Value, typeAnnotation(valDeclStmt.Type), expr(valDeclStmt.Rhs))
+	case *syntax.VarDeclStmt:
+		varDeclStmt := stmt.(*syntax.VarDeclStmt)
+		p.annotations(varDeclStmt.Annotations)
+		p.startLine(varDeclStmt.Pos().Line)
+		p.printf("var %s%s = %s", varDeclStmt.Name.Value, typeAnnotation(varDeclStmt.Type), expr(varDeclStmt.Rhs))
+	case *syntax.Assignment:
+		assignment := stmt.(*syntax.Assignment)
+		p.startLine(assignment.Pos().Line)
+		p.printf("%s = %s", expr(assignment.Lhs), expr(assignment.Rhs))
+	case *syntax.ReturnStmt:
+		returnStmt := stmt.(*syntax.ReturnStmt)
+		p.startLine(returnStmt.Pos().Line)
+		p.printf("return %s", expr(returnStmt.Value))
+	case *syntax.ThrowStmt:
+		throwStmt := stmt.(*syntax.ThrowStmt)
+		p.startLine(throwStmt.Pos().Line)
+		p.printf("throw %s", expr(throwStmt.Value))
+	case *syntax.BlockStmt:
+		blockStmt := stmt.(*syntax.BlockStmt)
+		p.startLine(blockStmt.Pos().Line)
+		p.printf("{")
+		p.trailingComments(blockStmt.Pos().Line, first(blockStmt))
+		p.endLine()
+		p.indent++
+		p.lastLine = 0
+		p.stmts(blockStmt)
+		p.indent--
+		p.lastLine = 0
+		p.startLine(blockStmt.End.Line)
+		p.printf("}")
+	case *syntax.WhileStmt:
+		whileStmt := stmt.(*syntax.WhileStmt)
+		p.startLine(whileStmt.Pos().Line)
+		p.printf("while (%s)", expr(whileStmt.Cond))
+		p.block(whileStmt.Body)
+	case *syntax.IfStmt:
+		p.startLine(stmt.Pos().Line)
+		p.ifStmt(stmt.(*syntax.IfStmt), next)
+	case *syntax.TryStmt:
+		p.tryStmt(stmt.(*syntax.TryStmt))
+	default:
+		// calls, as well as any other expressions
+		p.startLine(stmt.Pos().Line)
+		p.printf("%s", expr(stmt))
+	}
+	p.lastLine = endLine(stmt)
+	p.trailingComments(p.lastLine, next)
+	p.endLine()
+}
+
+// ifStmt prints the if statement on the current line, chaining else ifs
+func (p *printer) ifStmt(ifStmt *syntax.IfStmt, next scanner.Position) {
+	p.printf("if (%s)", expr(ifStmt.Cond))
+	p.block(ifStmt.Body)
+	switch ifStmt.ElseBody.(type) {
+	case nil:
+	case *syntax.IfStmt:
+		p.printf(" else ")
+		p.ifStmt(ifStmt.ElseBody.(*syntax.IfStmt), next)
+	case *syntax.BlockStmt:
+		p.printf(" else")
+		p.block(ifStmt.ElseBody.(*syntax.BlockStmt))
+	default:
+		// a single statement gets braces of its own
+		elseBody := ifStmt.ElseBody
+		p.printf(" else {")
+		p.endLine()
+		p.indent++
+		p.lastLine = 0
+		p.stmt(elseBody, next)
+		p.indent--
+		p.lastLine = 0
+		p.startLine(endLine(elseBody))
+		p.printf("}")
+	}
+}
+
+func (p *printer) tryStmt(tryStmt *syntax.TryStmt) {
+	p.startLine(tryStmt.Pos().Line)
+	p.printf("try")
+	p.block(tryStmt.Body)
+	if len(tryStmt.Cases) > 0 {
+		p.printf(" catch")
+		p.openBlock(tryStmt.Body.End.Line, tryStmt.Cases[0].Pos())
+		for _, catchClause := range tryStmt.Cases {
+			p.commentsBefore(catchClause.Pos().Line)
+			p.startLine(catchClause.Pos().Line)
+			p.printf("case %s", catchClause.Name.Value)
+			if catchClause.Type != nil {
+				p.printf(": %s", catchClause.Type.Value)
+			}
+			p.printf(" =>")
+			p.trailingComments(catchClause.Pos().Line, first(catchClause.Body))
+			p.endLine()
+			p.indent++
+			p.lastLine = 0
+			p.stmts(catchClause.Body)
+			p.indent--
+		}
+		p.indent--
+		p.lastLine = 0
+		catchEnd := tryStmt.End
+		if tryStmt.Finally != nil {
+			catchEnd = tryStmt.Finally.Pos()
+		}
+		p.startLine(catchEnd.Line)
+		p.printf("}")
+	}
+	if tryStmt.Finally != nil {
+		p.printf(" finally")
+		p.block(tryStmt.Finally)
+	}
+}
+
+func (p *printer) annotations(annotations []*syntax.Annotation) {
+	for _, annotation := range annotations {
+		p.startLine(annotation.Pos().Line)
+		p.printf("@%s", annotation.Name.Value)
+		p.endLine()
+	}
+}
+
+func inlineAnnotations(annotations []*syntax.Annotation) string {
+	var res string
+	for _, annotation := range annotations {
+		res += "@" + annotation.Name.Value + " "
+	}
+	return res
+}
+
+func typeAnnotation(typeExpr syntax.Expr) string {
+	if typeExpr == nil {
+		return ""
+	}
+	return ": " + expr(typeExpr)
+}
+
+// first returns the source position of the first statement of the block,
+// or of its end if it's empty
+func first(block *syntax.BlockStmt) scanner.Position {
+	if len(block.Stmts) > 0 {
+		return block.Stmts[0].Pos()
+	}
+	return block.End
+}
+
+// before reports whether a precedes b
+func before(a, b scanner.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// endLine returns the source line the statement ends at. Statements without
+// blocks are assumed to fit into the line they start at
+func endLine(stmt syntax.Stmt) int {
+	switch stmt.(type) {
+	case *syntax.BlockStmt:
+		return stmt.(*syntax.BlockStmt).End.Line
+	case *syntax.DefDeclStmt:
+		return stmt.(*syntax.DefDeclStmt).Body.End.Line
+	case *syntax.WhileStmt:
+		return stmt.(*syntax.WhileStmt).Body.End.Line
+	case *syntax.TryStmt:
+		return stmt.(*syntax.TryStmt).End.Line
+	case *syntax.IfStmt:
+		ifStmt := stmt.(*syntax.IfStmt)
+		if ifStmt.ElseBody != nil {
+			return endLine(ifStmt.ElseBody)
+		}
+		return ifStmt.Body.End.Line
+	}
+	return stmt.Pos().Line
+}
@@ -0,0 +1,188 @@
+package format
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var commentTests = []struct {
+	name, src, expected string
+}{
+	{
+		name: "own lines",
+		src: `// leading
+def f(): Int {
+    // before
+    val x = 1
+
+    // after a blank line
+    return x
+    // at the end
+}
+// trailing
+`,
+		expected: `// leading
+def f(): Int {
+    // before
+    val x = 1
+
+    // after a blank line
+    return x
+    // at the end
+}
+// trailing
+`,
+	},
+	{
+		name: "end of line",
+		src: `def f(n: Int): Int { // open
+    val x = n // decl
+    if (n > 0) { // if
+        return x // return
+    } else { // else
+        return -x
+    } // end of if
+    return 0
+}
+`,
+		expected: `def f(n: Int): Int { // open
+    val x = n // decl
+    if (n > 0) { // if
+        return x // return
+    } else { // else
+        return -x
+    } // end of if
+    return 0
+}
+`,
+	},
+	{
+		name: "else on a single line",
+		src: `def abs(n: Int): Int {
+    if (n > 0) {
+        return n
+    } else { return -n } // after if
+}
+`,
+		expected: `def abs(n: Int): Int {
+    if (n > 0) {
+        return n
+    } else {
+        return -n
+    } // after if
+}
+`,
+	},
+	{
+		name: "blocks on a single line",
+		src: `def f(): Int { return 1 } // f
+
+def main(): Unit {
+    { print("a") } // block
+    while (f() < 0) { print("b") } // while
+    if (f() > 0) { print("c") } else if (f() < 0) { print("d") } // if
+}
+`,
+		expected: `def f(): Int {
+    return 1
+} // f
+
+def main(): Unit {
+    {
+        print("a")
+    } // block
+    while (f() < 0) {
+        print("b")
+    } // while
+    if (f() > 0) {
+        print("c")
+    } else if (f() < 0) {
+        print("d")
+    } // if
+}
+`,
+	},
+	{
+		name: "catch cases",
+		src: `def main(): Unit {
+    try { print("a") } catch { case e: Oops => print("b") } // c1
+    try { // try
+        print("a")
+    } catch { // catch
+        case e: Oops => print("b") // c2
+        case e: Other => // case
+            print("c") // c3
+    } finally { print("d") } // finally
+}
+`,
+		expected: `def main(): Unit {
+    try {
+        print("a")
+    } catch {
+        case e: Oops =>
+            print("b")
+    } // c1
+    try { // try
+        print("a")
+    } catch { // catch
+        case e: Oops =>
+            print("b") // c2
+        case e: Other => // case
+            print("c") // c3
+    } finally {
+        print("d")
+    } // finally
+}
+`,
+	},
+}
+
+// TestComments checks that comments stay next to what they follow, be it on lines of their own
+// or at the end of a line, even if the line is broken up
+func TestComments(t *testing.T) {
+	for _, test := range commentTests {
+		formatted, err := Source([]byte(test.src))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if d := diff.Unified("expected", "formatted", test.expected, string(formatted)); d != "" {
+			t.Errorf("%s:\n%s", test.name, d)
+		}
+	}
+}
+
+// TestIdempotent checks that formatting formatted sources changes nothing
+func TestIdempotent(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "sources", "*.miniscala"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := make(map[string]string)
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs[path] = string(src)
+	}
+	for _, test := range commentTests {
+		srcs[test.name] = test.src
+	}
+	for name, src := range srcs {
+		once, err := Source([]byte(src))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		twice, err := Source(once)
+		if err != nil {
+			t.Errorf("%s: formatted source doesn't parse: %v", name, err)
+			continue
+		}
+		if d := diff.Unified("once", "twice", string(once), string(twice)); d != "" {
+			t.Errorf("%s:\n%s", name, d)
+		}
+	}
+}
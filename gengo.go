@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/gogen"
+	"github.com/ThreadedStream/miniscala/ir"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// genGoCmd implements 'miniscala gen-go', returns the exit code
+func genGoCmd(args []string) int {
+	flags := flag.NewFlagSet("gen-go", flag.ContinueOnError)
+	output := flags.String("o", "", "output file, named after the source file by default")
+	pkgName := flags.String("package", "main", "name of the generated package")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala gen-go [-o file] [-package name] <file>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if !token.IsIdentifier(*pkgName) {
+		fmt.Fprintf(os.Stderr, "invalid package name %q\n", *pkgName)
+		return 2
+	}
+	path := flags.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(filepath.Base(path), sourceExt) + ".go"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	return genGoSource(path, file, *output, *pkgName, os.Stderr)
+}
+
+// genGoSource translates the program read from src, which is named path in messages, to
+// a Go package with the given name, written to output. Diagnostics go to stderr.
+// It returns the exit code
+func genGoSource(path string, src io.Reader, output, pkgName string, stderr io.Writer) int {
+	program, result, ok := loadProgram(path, src, stderr)
+	if !ok {
+		return 1
+	}
+	irProgram, err := ir.Build(program, result)
+	var generated []byte
+	if err == nil {
+		irProgram.LoopTailCalls()
+		generated, err = gogen.Generate(irProgram, pkgName)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := os.WriteFile(output, generated, 0644); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
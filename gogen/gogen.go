@@ -0,0 +1,774 @@
+// Package gogen translates programs to Go. The package it produces imports the runtime,
+// package rt, and nothing of the compiler: functions of the program become Go functions,
+// Ints, Floats, Bools and Strings are int64, float64, bool and string, values of type Any
+// are rt.Value and arrays *rt.Array, holding a slice of them. Run runs the program,
+// top-level statements followed by main, and for package main, func main runs it and
+// exits the way the vm does if an exception escapes.
+//
+// Programs come in the IR. Every value a function reads is a variable of the Go function,
+// blocks are labeled and pass control on by goto, assigning phis of their successors
+// on the way. Exceptions are panics, an instruction raising an exception which a block
+// of the same function handles runs in a closure rt.Try recovers it from.
+// Functions of the program take the position of the statement calling them first, which
+// StackOverflowError is reported at once calls nest deeper than rt.MaxCallDepth
+package gogen
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/ir"
+	"go/format"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// RuntimePath is the import path of the runtime generated code depends on
+const RuntimePath = "github.com/ThreadedStream/miniscala/gogen/rt"
+
+// reserved holds names generated code can't give to functions and variables: Go's keywords
+// and predeclared identifiers, packages it imports and names it declares itself
+var reserved = make(map[string]bool)
+
+func init() {
+	for _, name := range strings.Fields(`
+		break case chan const continue default defer else fallthrough for func go goto if
+		import interface map package range return select struct switch type var
+		any bool byte comparable complex64 complex128 error float32 float64 int int8 int16
+		int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr true false iota nil
+		append cap clear close complex copy delete imag len make max min new panic print
+		println real recover
+		fmt math strconv rt main init Run msLine msCol`) {
+		reserved[name] = true
+	}
+}
+
+type (
+	generator struct {
+		// functions of the program by name, calls convert arguments to types of their parameters
+		funcs map[string]*ir.Func
+		// Go names of functions and globals of the program
+		funcNames   map[string]string
+		globalNames map[string]string
+		globals     map[string]backing.ValueType
+		// names taken at the package level
+		taken   map[string]bool
+		imports map[string]bool
+		fn      *function
+		err     error
+	}
+
+	// function is a Go function being generated
+	function struct {
+		f *ir.Func
+		// function the init function calls once it's done, empty for the rest of them
+		entry  string
+		body   strings.Builder
+		indent int
+		// names taken within the function, package-level ones included
+		taken map[string]bool
+		// Go names of values the function reads
+		names map[*ir.Value]string
+		// instructions generated, the rest of them have neither effects nor values read
+		live map[*ir.Value]bool
+		// blocks jumped to, the rest are only entered from the block preceding them
+		labeled map[*ir.Block]bool
+		// variable holding the exception rt.Try recovers, "" until needed
+		exc string
+	}
+)
+
+// Generate translates the program to the source of a Go package with the given name.
+// It fails on values the Go backend can't represent, which the typechecker rejects,
+// e.g the ones of type Unit
+func Generate(program *ir.Program, pkgName string) ([]byte, error) {
+	g := &generator{
+		funcs:       make(map[string]*ir.Func),
+		funcNames:   make(map[string]string),
+		globalNames: make(map[string]string),
+		globals:     make(map[string]backing.ValueType),
+		taken:       make(map[string]bool),
+		imports:     map[string]bool{RuntimePath: true},
+	}
+	// package-level names go first, functions may refer to any of them
+	for _, f := range program.Funcs {
+		g.funcs[f.Name] = f
+		g.funcNames[f.Name] = unique(g.taken, f.Name)
+	}
+	if _, ok := g.funcs["main"]; !ok {
+		return nil, fmt.Errorf("program has no main function")
+	}
+	var globals strings.Builder
+	for _, global := range program.Globals {
+		g.globals[global.Name] = global.Type
+		g.globalNames[global.Name] = unique(g.taken, global.Name)
+		fmt.Fprintf(&globals, "\t%s %s\n", g.globalNames[global.Name], g.goType(scanner.Position{}, global.Type))
+	}
+
+	var text strings.Builder
+	text.WriteString("// Run runs the program: its top-level statements, then main. It returns the exception\n")
+	text.WriteString("// escaping the program, if any\n")
+	text.WriteString("func Run() error {\n\treturn rt.Run(func() {\n")
+	if program.Init != nil {
+		g.begin(program.Init)
+		text.WriteString(g.function("main", 2))
+	} else {
+		fmt.Fprintf(&text, "\t\t%s(0, 0)\n", g.funcNames["main"])
+	}
+	text.WriteString("\t})\n}\n")
+	for _, f := range program.Funcs {
+		g.begin(f)
+		signature := g.signature()
+		fmt.Fprintf(&text, "\nfunc %s {\n%s}\n", signature, g.function("", 1))
+	}
+	if pkgName == "main" {
+		text.WriteString("\nfunc main() {\n\trt.Exit(Run())\n}\n")
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	var out strings.Builder
+	out.WriteString("// Code generated by miniscala gen-go. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\nimport (\n", pkgName)
+	var imports []string
+	for path := range g.imports {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	for _, path := range imports {
+		fmt.Fprintf(&out, "\t%q\n", path)
+	}
+	out.WriteString(")\n\n")
+	if globals.Len() > 0 {
+		fmt.Fprintf(&out, "var (\n%s)\n\n", globals.String())
+	}
+	out.WriteString(text.String())
+	src, err := format.Source([]byte(out.String()))
+	if err != nil {
+		return nil, fmt.Errorf("generated code doesn't parse: %v", err)
+	}
+	return src, nil
+}
+
+// unique returns a Go identifier for the name which isn't taken yet and takes it.
+// Names may contain characters such as - and $, which are replaced
+func unique(taken map[string]bool, name string) string {
+	base := []byte(name)
+	for idx, c := range base {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || idx > 0 && c >= '0' && c <= '9') {
+			base[idx] = '_'
+		}
+	}
+	ident := string(base)
+	if reserved[ident] {
+		ident += "_"
+	}
+	candidate := ident
+	for n := 2; taken[candidate]; n++ {
+		candidate = ident + strconv.Itoa(n)
+	}
+	taken[candidate] = true
+	return candidate
+}
+
+func (g *generator) line(format string, args ...interface{}) {
+	g.fn.body.WriteString(strings.Repeat("\t", g.fn.indent))
+	fmt.Fprintf(&g.fn.body, format, args...)
+	g.fn.body.WriteString("\n")
+}
+
+func (g *generator) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if g.err == nil {
+		g.err = fmt.Errorf("[%d:%d] %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))
+	}
+}
+
+// begin starts generating the function, naming its parameters after the ones of the program
+func (g *generator) begin(f *ir.Func) {
+	g.fn = &function{f: f, taken: make(map[string]bool), names: make(map[*ir.Value]string)}
+	for name := range g.taken {
+		g.fn.taken[name] = true
+	}
+	for _, param := range f.Params {
+		g.fn.names[param] = unique(g.fn.taken, param.Aux.(string))
+	}
+}
+
+// signature returns the name, parameters and the result of the Go function being generated
+func (g *generator) signature() string {
+	f := g.fn.f
+	params := []string{"msLine, msCol int"}
+	for _, param := range f.Params {
+		params = append(params, g.fn.names[param]+" "+g.goType(param.Pos, param.Type))
+	}
+	result := ""
+	if f.ResultType != backing.Unit {
+		result = " " + g.goType(scanner.Position{}, f.ResultType)
+	}
+	return fmt.Sprintf("%s(%s)%s", g.funcNames[f.Name], strings.Join(params, ", "), result)
+}
+
+// function returns the body of the Go function being generated, variables first.
+// The init function calls entry once it's done
+func (g *generator) function(entry string, indent int) string {
+	f := g.fn.f
+	g.fn.entry, g.fn.indent = entry, indent
+	g.fn.live, g.fn.labeled = make(map[*ir.Value]bool), make(map[*ir.Block]bool)
+	defer func() {
+		g.fn = nil
+	}()
+	read := g.liveness()
+
+	var out strings.Builder
+	tabs := strings.Repeat("\t", indent)
+	if entry == "" {
+		fmt.Fprintf(&out, "%srt.Enter(msLine, msCol)\n%sdefer rt.Leave()\n", tabs, tabs)
+	}
+	var decls []string
+	for _, b := range f.Blocks {
+		for _, v := range b.Instrs {
+			if read[v] && v.Op != ir.OpConst {
+				g.fn.names[v] = unique(g.fn.taken, "v"+strconv.Itoa(v.ID))
+				decls = append(decls, g.fn.names[v]+" "+g.goType(v.Pos, v.Type))
+			}
+		}
+	}
+	switch len(decls) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&out, "%svar %s\n", tabs, decls[0])
+	default:
+		fmt.Fprintf(&out, "%svar (\n", tabs)
+		for _, decl := range decls {
+			fmt.Fprintf(&out, "%s\t%s\n", tabs, decl)
+		}
+		fmt.Fprintf(&out, "%s)\n", tabs)
+	}
+
+	// labels are known once every block is generated
+	blocks := make([]string, len(f.Blocks))
+	for idx, b := range f.Blocks {
+		var next *ir.Block
+		if idx+1 < len(f.Blocks) {
+			next = f.Blocks[idx+1]
+		}
+		g.fn.body.Reset()
+		g.block(b, next)
+		blocks[idx] = g.fn.body.String()
+	}
+	for idx, b := range f.Blocks {
+		if g.fn.labeled[b] {
+			fmt.Fprintf(&out, "%s:\n", blockName(b))
+		}
+		out.WriteString(blocks[idx])
+	}
+	return out.String()
+}
+
+// liveness finds instructions to generate, the ones with effects or which may throw and
+// the ones they read, and returns values read, which Go requires of declared variables
+func (g *generator) liveness() map[*ir.Value]bool {
+	live, read := g.fn.live, make(map[*ir.Value]bool)
+	var work []*ir.Value
+	use := func(v *ir.Value) {
+		read[v] = true
+		if !live[v] {
+			live[v] = true
+			work = append(work, v)
+		}
+	}
+	for _, b := range g.fn.f.Blocks {
+		for _, v := range b.Instrs {
+			if v.Op != ir.OpPhi && v.Op != ir.OpCatch && (!v.HasResult() || v.MayThrow()) && !live[v] {
+				live[v] = true
+				work = append(work, v)
+			}
+		}
+		if b.Control != nil {
+			use(b.Control)
+		}
+	}
+	for len(work) > 0 {
+		v := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, arg := range v.Args {
+			if arg != v {
+				use(arg)
+			}
+		}
+	}
+	return read
+}
+
+func (g *generator) block(b *ir.Block, next *ir.Block) {
+	for _, v := range b.Instrs {
+		switch v.Op {
+		case ir.OpPhi, ir.OpConst, ir.OpCatch:
+			// phis are assigned by edges leading to the block and the caught exception
+			// on the way to the handler, constants are written out where they're used
+			continue
+		}
+		if !g.fn.live[v] {
+			continue
+		}
+		stmt := g.expr(v)
+		switch {
+		case g.fn.names[v] != "":
+			stmt = g.fn.names[v] + " = " + stmt
+		case v.HasResult() && (v.Op != ir.OpCall || backing.IsRuntimeCall(v.Callee())):
+			// some instructions are operators or conversions in Go, which can't stand alone
+			stmt = "_ = " + stmt
+		}
+		if b.Catch != nil && v.MayThrow() {
+			g.guard(b, stmt)
+		} else {
+			g.line("%s", stmt)
+		}
+	}
+
+	switch b.Kind {
+	case ir.BlockPlain:
+		g.jump(b, b.Succs[0], next)
+	case ir.BlockIf:
+		then, els := b.Succs[0], b.Succs[1]
+		cond := g.operand(b.Control)
+		if then == next && !g.hasCopies(b, then) {
+			cond = "!" + cond
+			then, els = els, then
+		}
+		g.line("if %s {", cond)
+		g.fn.indent++
+		g.jump(b, then, nil)
+		g.fn.indent--
+		g.line("}")
+		g.jump(b, els, next)
+	case ir.BlockReturn:
+		if g.fn.entry != "" {
+			g.line("%s(0, 0)", g.funcNames[g.fn.entry])
+			g.line("return")
+			break
+		}
+		if b.Control == nil {
+			g.line("return")
+		} else {
+			g.line("return %s", g.convert(b.Control, g.fn.f.ResultType))
+		}
+	case ir.BlockThrow:
+		raise := fmt.Sprintf("rt.Raise(%s, %d, %d)", g.operand(b.Control), b.Pos.Line, b.Pos.Column)
+		if b.Catch == nil {
+			g.line("panic(%s)", raise)
+			break
+		}
+		// the exception goes straight to the handler
+		if caught := g.caught(b.Catch); caught != "" {
+			raise = caught + " = " + raise
+		}
+		g.line("%s", raise)
+		g.jump(b, b.Catch, nil)
+	}
+}
+
+// guard runs stmt in a closure rt.Try recovers the exception it raises from,
+// the exception goes to the block handling exceptions raised by b
+func (g *generator) guard(b *ir.Block, stmt string) {
+	if g.fn.exc == "" {
+		g.fn.exc = unique(g.fn.taken, "exc")
+	}
+	caught := g.caught(b.Catch)
+	if caught == "" {
+		g.line("if rt.Try(func() {")
+	} else {
+		g.line("if %s := rt.Try(func() {", g.fn.exc)
+	}
+	g.line("\t%s", stmt)
+	if caught == "" {
+		g.line("}) != nil {")
+	} else {
+		g.line("}); %s != nil {", g.fn.exc)
+	}
+	g.fn.indent++
+	if caught != "" {
+		g.line("%s = %s", caught, g.fn.exc)
+	}
+	g.jump(b, b.Catch, nil)
+	g.fn.indent--
+	g.line("}")
+}
+
+// caught returns the variable the handler reads the exception it's entered with from,
+// "" if it doesn't read it
+func (g *generator) caught(handler *ir.Block) string {
+	for _, v := range handler.Instrs {
+		if v.Op == ir.OpCatch {
+			return g.fn.names[v]
+		}
+	}
+	return ""
+}
+
+// jump passes control from a block to its successor, which follows it unless it's next
+func (g *generator) jump(from, to *ir.Block, next *ir.Block) {
+	g.edge(from, to)
+	if to != next {
+		g.fn.labeled[to] = true
+		g.line("goto %s", blockName(to))
+	}
+}
+
+// phis returns phis of the block
+func phis(b *ir.Block) []*ir.Value {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == ir.OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// hasCopies reports whether the edge assigns phis
+func (g *generator) hasCopies(from, to *ir.Block) bool {
+	idx := to.PredIndex(from)
+	for _, phi := range phis(to) {
+		if g.fn.live[phi] && phi.Args[idx] != phi {
+			return true
+		}
+	}
+	return false
+}
+
+// edge assigns phis of the block control is passed to their arguments coming from
+// the block it's passed from, at once, so that every phi gets the value its argument
+// had before the edge
+func (g *generator) edge(from, to *ir.Block) {
+	idx := to.PredIndex(from)
+	var lhs, rhs []string
+	for _, phi := range phis(to) {
+		if g.fn.live[phi] && phi.Args[idx] != phi {
+			lhs = append(lhs, g.fn.names[phi])
+			rhs = append(rhs, g.convert(phi.Args[idx], phi.Type))
+		}
+	}
+	if len(lhs) > 0 {
+		g.line("%s = %s", strings.Join(lhs, ", "), strings.Join(rhs, ", "))
+	}
+}
+
+func blockName(b *ir.Block) string {
+	return "b" + strconv.Itoa(b.ID)
+}
+
+// goType returns the Go type values of the given type are represented with
+func (g *generator) goType(pos scanner.Position, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int:
+		return "int64"
+	case backing.Float:
+		return "float64"
+	case backing.Bool:
+		return "bool"
+	case backing.String:
+		return "string"
+	case backing.Array:
+		return "*rt.Array"
+	case backing.Exception:
+		return "*rt.Exception"
+	case backing.Any:
+		return "rt.Value"
+	}
+	g.errorf(pos, "values of type %s aren't supported by the Go backend", backing.ValueTypeToStr(valueType))
+	return "struct{}"
+}
+
+// typeConst returns the constant of package rt for the type
+func typeConst(valueType backing.ValueType) string {
+	return "rt.Type" + backing.ValueTypeToStr(valueType)
+}
+
+// operand returns a Go expression evaluating to the value, constants are written out
+func (g *generator) operand(v *ir.Value) string {
+	if v.Op != ir.OpConst {
+		return g.fn.names[v]
+	}
+	value := v.Aux.(backing.Value)
+	switch value.ValueType {
+	case backing.String:
+		return strconv.Quote(value.Value.(string))
+	case backing.Int:
+		return strconv.FormatInt(value.Value.(int64), 10)
+	case backing.Float:
+		return g.floatLit(value.Value.(float64))
+	case backing.Bool:
+		return strconv.FormatBool(value.Value.(bool))
+	}
+	g.errorf(v.Pos, "constants of type %s aren't supported by the Go backend", backing.ValueTypeToStr(value.ValueType))
+	return "nil"
+}
+
+// convert returns a Go expression evaluating to the value converted to the target type,
+// a value is boxed if it's passed where a value of type Any is expected
+func (g *generator) convert(v *ir.Value, target backing.ValueType) string {
+	if target == backing.Any && v.Type != backing.Any {
+		return g.box(v.Pos, g.operand(v), v.Type)
+	}
+	return g.operand(v)
+}
+
+func (g *generator) box(pos scanner.Position, value string, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int, backing.Float, backing.Bool, backing.String, backing.Array, backing.Exception:
+		return "rt." + backing.ValueTypeToStr(valueType) + "Value(" + value + ")"
+	}
+	g.errorf(pos, "values of type %s aren't supported by the Go backend", backing.ValueTypeToStr(valueType))
+	return "rt.Null()"
+}
+
+// unbox returns the value held by a value of type Any
+func unbox(value string, valueType backing.ValueType) string {
+	if valueType == backing.Any {
+		return value
+	}
+	return value + ".As" + backing.ValueTypeToStr(valueType) + "()"
+}
+
+// floatLit returns a Go expression holding exactly the same float64 as x
+func (g *generator) floatLit(x float64) string {
+	switch {
+	case math.IsNaN(x):
+		g.imports["math"] = true
+		return "math.NaN()"
+	case math.IsInf(x, 0):
+		g.imports["math"] = true
+		if x > 0 {
+			return "math.Inf(1)"
+		}
+		return "math.Inf(-1)"
+	case x == 0 && math.Signbit(x):
+		// the constant -0.0 is zero
+		g.imports["math"] = true
+		return "math.Copysign(0, -1)"
+	}
+	lit := strconv.FormatFloat(x, 'g', -1, 64)
+	if !strings.ContainsAny(lit, ".e") {
+		lit += ".0"
+	}
+	return lit
+}
+
+// constant returns the result of arithmetic on constants, which is an Int or a Float.
+// Go evaluates constant expressions exactly, rather than in int64 or float64 arithmetic,
+// so they're evaluated here instead, the way the program does
+func constant(v *ir.Value) (interface{}, bool) {
+	switch v.Op {
+	case ir.OpNeg, ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpDiv, ir.OpToFloat:
+	default:
+		return nil, false
+	}
+	var args []interface{}
+	for _, arg := range v.Args {
+		if arg.Op != ir.OpConst {
+			return nil, false
+		}
+		args = append(args, arg.Aux.(backing.Value).Value)
+	}
+	switch v.Type {
+	case backing.Int:
+		x, _ := args[0].(int64)
+		switch v.Op {
+		case ir.OpNeg:
+			return -x, true
+		case ir.OpAdd:
+			return x + args[1].(int64), true
+		case ir.OpSub:
+			return x - args[1].(int64), true
+		case ir.OpMul:
+			return x * args[1].(int64), true
+		}
+	case backing.Float:
+		if v.Op == ir.OpToFloat {
+			return float64(args[0].(int64)), true
+		}
+		x, _ := args[0].(float64)
+		switch v.Op {
+		case ir.OpNeg:
+			return -x, true
+		case ir.OpAdd:
+			return x + args[1].(float64), true
+		case ir.OpSub:
+			return x - args[1].(float64), true
+		case ir.OpMul:
+			return x * args[1].(float64), true
+		case ir.OpDiv:
+			return x / args[1].(float64), true
+		}
+	}
+	return nil, false
+}
+
+var operators = map[ir.Op]string{
+	ir.OpAdd: "+",
+	ir.OpSub: "-",
+	ir.OpMul: "*",
+	ir.OpDiv: "/",
+	ir.OpEq:  "==",
+	ir.OpNe:  "!=",
+	ir.OpLt:  "<",
+	ir.OpLe:  "<=",
+	ir.OpGt:  ">",
+	ir.OpGe:  ">=",
+	ir.OpAnd: "&&",
+	ir.OpOr:  "||",
+}
+
+// expr returns a Go expression carrying out the instruction, positions of instructions
+// which may throw are passed on to the runtime, so that the exception is located
+// the way the vm does
+func (g *generator) expr(v *ir.Value) string {
+	if value, ok := constant(v); ok {
+		if x, ok := value.(int64); ok {
+			return strconv.FormatInt(x, 10)
+		}
+		return g.floatLit(value.(float64))
+	}
+	args := make([]string, len(v.Args))
+	for idx, arg := range v.Args {
+		args[idx] = g.operand(arg)
+	}
+	pos := fmt.Sprintf("%d, %d", v.Pos.Line, v.Pos.Column)
+	switch v.Op {
+	case ir.OpLoadGlobal:
+		return g.globalNames[v.Aux.(string)]
+	case ir.OpStoreGlobal:
+		name := v.Aux.(string)
+		return g.globalNames[name] + " = " + g.convert(v.Args[0], g.globals[name])
+	case ir.OpDiv, ir.OpMod:
+		switch {
+		case v.Type == backing.Int && v.Op == ir.OpDiv:
+			return fmt.Sprintf("rt.Div(%s, %s, %s)", args[0], args[1], pos)
+		case v.Type == backing.Int:
+			return fmt.Sprintf("rt.Mod(%s, %s, %s)", args[0], args[1], pos)
+		case v.Op == ir.OpMod:
+			g.imports["math"] = true
+			return "math.Mod(" + args[0] + ", " + args[1] + ")"
+		}
+		// Go rejects division by a constant zero, x/0 is x*Inf for any x, NaN and Inf included
+		if divisor := v.Args[1]; divisor.Op == ir.OpConst && divisor.Aux.(backing.Value).Value.(float64) == 0 {
+			g.imports["math"] = true
+			sign := "1"
+			if math.Signbit(divisor.Aux.(backing.Value).Value.(float64)) {
+				sign = "-1"
+			}
+			return args[0] + " * math.Inf(" + sign + ")"
+		}
+		return args[0] + " / " + args[1]
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpEq, ir.OpNe, ir.OpLt, ir.OpLe, ir.OpGt, ir.OpGe, ir.OpAnd, ir.OpOr:
+		return args[0] + " " + operators[v.Op] + " " + args[1]
+	case ir.OpNeg:
+		return "-" + args[0]
+	case ir.OpNot:
+		return "!" + args[0]
+	case ir.OpToFloat:
+		return "float64(" + args[0] + ")"
+	case ir.OpCast:
+		castType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		switch {
+		case castType == operandType:
+			return args[0]
+		case castType == backing.Any:
+			return g.box(v.Pos, args[0], operandType)
+		}
+		return unbox(fmt.Sprintf("rt.Cast(%s, %s, %s)", g.convert(v.Args[0], backing.Any), typeConst(castType), pos), castType)
+	case ir.OpInstanceOf:
+		testType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		if operandType != backing.Any {
+			return strconv.FormatBool(backing.IsAssignable(testType, operandType))
+		}
+		return fmt.Sprintf("%s.Is(%s)", args[0], typeConst(testType))
+	case ir.OpCall:
+		return g.call(v, pos)
+	}
+	g.errorf(v.Pos, "instruction %s isn't supported by the Go backend", v.Op)
+	return "nil"
+}
+
+// call returns the Go expression calling the function, arguments are converted to types of its parameters
+func (g *generator) call(v *ir.Value, pos string) string {
+	name := v.Callee()
+	var paramTypes []backing.ValueType
+	runtimeCall := backing.IsRuntimeCall(name)
+	if runtimeCall {
+		paramTypes = backing.RuntimeFuncEntry(name).ParamTypes
+	} else {
+		f, ok := g.funcs[name]
+		if !ok {
+			g.errorf(v.Pos, "no function with name %s was found", name)
+			return "nil"
+		}
+		for _, param := range f.Params {
+			paramTypes = append(paramTypes, param.Type)
+		}
+	}
+	args := make([]string, len(v.Args))
+	for idx, arg := range v.Args {
+		args[idx] = g.convert(arg, paramTypes[idx])
+	}
+	if !runtimeCall {
+		return g.funcNames[name] + "(" + strings.Join(append([]string{pos}, args...), ", ") + ")"
+	}
+
+	switch name {
+	case "print":
+		return "rt.Print(" + args[0] + ")"
+	case "to_string":
+		return g.toString(v.Args[0])
+	case "toInt":
+		return fmt.Sprintf("rt.ToInt(%s, %s)", args[0], pos)
+	case "toFloat":
+		return "float64(" + args[0] + ")"
+	case "array_new":
+		return fmt.Sprintf("rt.NewArray(%s, %s, %s)", args[0], args[1], pos)
+	case "array_set":
+		return fmt.Sprintf("%s.Set(%s, %s, %s)", args[0], args[1], args[2], pos)
+	case "array_get":
+		return fmt.Sprintf("%s.Get(%s, %s)", args[0], args[1], pos)
+	case "array_size":
+		return args[0] + ".Len()"
+	case "exception_new":
+		return "rt.NewException(" + args[0] + ", " + args[1] + ")"
+	case "exception_kind":
+		return args[0] + ".Kind"
+	case "exception_message":
+		return args[0] + ".Message"
+	case "assert":
+		return fmt.Sprintf("rt.Assert(%s, %s, %s)", args[0], args[1], pos)
+	case "assertEquals":
+		return fmt.Sprintf("rt.AssertEquals(%s, %s, %s)", args[0], args[1], pos)
+	}
+	g.errorf(v.Pos, "runtime function %s isn't supported by the Go backend", name)
+	return "nil"
+}
+
+// toString renders the value the way to_string does, values other than arrays
+// and exceptions are rendered by the standard library
+func (g *generator) toString(arg *ir.Value) string {
+	value := g.operand(arg)
+	switch arg.Type {
+	case backing.String:
+		return value
+	case backing.Int:
+		g.imports["strconv"] = true
+		return "strconv.FormatInt(" + value + ", 10)"
+	case backing.Bool:
+		g.imports["strconv"] = true
+		return "strconv.FormatBool(" + value + ")"
+	case backing.Float:
+		g.imports["fmt"] = true
+		return "fmt.Sprint(" + value + ")"
+	case backing.Any:
+		return "rt.ToString(" + value + ")"
+	case backing.Exception:
+		return value + ".Error()"
+	}
+	return "rt.ToString(" + g.box(arg.Pos, value, arg.Type) + ")"
+}
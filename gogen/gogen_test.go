@@ -0,0 +1,84 @@
+package gogen
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backendtest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestDifferential checks that executables built from generated programs translated
+// to Go behave like the interpreter running the same programs
+func TestDifferential(t *testing.T) {
+	backendtest.Differential(t, backend(t), 40)
+}
+
+// TestScopes checks that variables declared in blocks, sharing names with others, are kept apart
+func TestScopes(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.Scopes)
+}
+
+// TestTailCalls checks that functions calling themselves in tail position run as deep as loops
+func TestTailCalls(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.TailCalls)
+}
+
+// TestFloatFormat checks that the runtime renders floats the way Go's %v does
+func TestFloatFormat(t *testing.T) {
+	backendtest.FloatFormat(t, backend(t))
+}
+
+// backend translates programs to main packages of a module and builds them with the go
+// command, skipping the test if there's none. The packages are built at once, which spares
+// linking the runtime over and over
+func backend(t *testing.T) backendtest.Backend {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("no go command: %v", err)
+	}
+	return backendtest.Backend{
+		Name: "go",
+		Run: func(t *testing.T, dir string, programs []backendtest.Program) []backendtest.Output {
+			t.Helper()
+			module(t, dir)
+			for idx, program := range programs {
+				generated, err := Generate(program.IR, "main")
+				if err != nil {
+					t.Fatalf("program %d: %v\n%s", idx, err, program.Src)
+				}
+				pkgDir := filepath.Join(dir, fmt.Sprintf("prog%d", idx))
+				if err := os.Mkdir(pkgDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(pkgDir, "main.go"), generated, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			build := exec.Command(goTool, "build", "-o", filepath.Join(dir, "bin")+string(filepath.Separator), "./...")
+			build.Dir = dir
+			if out, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("go build failed: %v\n%s", err, out)
+			}
+			outputs := make([]backendtest.Output, len(programs))
+			for idx := range programs {
+				outputs[idx] = backendtest.Exec(t, exec.Command(filepath.Join(dir, "bin", fmt.Sprintf("prog%d", idx))))
+			}
+			return outputs
+		},
+	}
+}
+
+// module makes dir the root of a module which gets the runtime from this repository
+func module(t *testing.T, dir string) {
+	t.Helper()
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goMod := fmt.Sprintf("module generated\n\ngo 1.17\n\nrequire github.com/ThreadedStream/miniscala v0.0.0\n\nreplace github.com/ThreadedStream/miniscala => %s\n", root)
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+// Package rt is the runtime of Go code generated by 'miniscala gen-go': the builtins of
+// miniscala, values of type Any (Value), arrays and exceptions. It doesn't depend on the
+// compiler, so that generated packages can be built into programs of their own.
+//
+// An exception is raised by panicking with an *Exception, Try recovers it. Runtime
+// functions which may throw take the position of the statement calling them, which
+// the exception is reported at, the way the vm reports it
+package rt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Stdout is where print writes to. Output is buffered while Run runs the program
+var Stdout io.Writer = os.Stdout
+
+var out *bufio.Writer
+
+// Exception is an exception raised by a program or by the runtime
+type Exception struct {
+	Kind    string
+	Message string
+	// Line and Col locate the statement the exception was first raised by, they're zero until then
+	Line, Col int
+}
+
+func (e *Exception) Error() string {
+	return e.Kind + ": " + e.Message
+}
+
+// NewException returns an exception which hasn't been raised yet, as exception_new does
+func NewException(kind, message string) *Exception {
+	return &Exception{Kind: kind, Message: message}
+}
+
+// Raise returns the exception located at the given position, unless it's been raised before.
+// It's meant to be panicked with, e.g panic(rt.Raise(e, line, col))
+func Raise(e *Exception, line, col int) *Exception {
+	if e.Line == 0 {
+		e.Line, e.Col = line, col
+	}
+	return e
+}
+
+func throw(line, col int, kind string, format string, args ...interface{}) {
+	panic(Raise(NewException(kind, fmt.Sprintf(format, args...)), line, col))
+}
+
+// Try runs body, returning the exception it raises, if any.
+// Panics other than exceptions are passed through
+func Try(body func()) (e *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if e, ok = r.(*Exception); !ok {
+				panic(r)
+			}
+		}
+	}()
+	body()
+	return nil
+}
+
+// MaxCallDepth is how deep calls of functions of a program may nest, as on the other backends
+const MaxCallDepth = 256
+
+// depth of calls of functions of the program being run
+var depth int
+
+// Enter counts a call of a function of the program, which the statement at the given position
+// makes, throwing StackOverflowError if calls nest deeper than MaxCallDepth. The function
+// defers Leave, which counts the call as done
+func Enter(line, col int) {
+	if depth > MaxCallDepth {
+		throw(line, col, "StackOverflowError", "calls nested deeper than %d", MaxCallDepth)
+	}
+	depth++
+}
+
+func Leave() {
+	depth--
+}
+
+// Run runs a program, returning the exception escaping it, if any. Programs must not
+// be run concurrently, as they share the output buffer
+func Run(program func()) error {
+	out = bufio.NewWriter(Stdout)
+	defer func() {
+		out.Flush()
+		out = nil
+	}()
+	if e := Try(program); e != nil {
+		return e
+	}
+	return nil
+}
+
+// Exit exits the process the way the compiler's runtime does if an exception escapes
+// the program: it's reported to stderr and the exit status is 1
+func Exit(err error) {
+	if err == nil {
+		return
+	}
+	if e, ok := err.(*Exception); ok {
+		fmt.Fprintf(os.Stderr, "[%d:%d] exception in main: %s\n", e.Line, e.Col, e)
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
+
+func Print(s string) {
+	if out == nil {
+		io.WriteString(Stdout, s)
+		return
+	}
+	out.WriteString(s)
+}
+
+// Div divides Ints, throwing ArithmeticException on division by zero.
+// The quotient of the smallest Int and -1 wraps around
+func Div(x, y int64, line, col int) int64 {
+	if y == 0 {
+		throw(line, col, "ArithmeticException", "/ by zero")
+	}
+	return x / y
+}
+
+func Mod(x, y int64, line, col int) int64 {
+	if y == 0 {
+		throw(line, col, "ArithmeticException", "%% by zero")
+	}
+	return x % y
+}
+
+// ToInt truncates x, throwing ArithmeticException if it's out of Int range, as toInt does
+func ToInt(x float64, line, col int) int64 {
+	if math.IsNaN(x) || x >= math.MaxInt64 || x < math.MinInt64 {
+		throw(line, col, "ArithmeticException", "%v is out of Int range", x)
+	}
+	return int64(x)
+}
+
+// And and Or evaluate both operands, like && and || of miniscala do
+
+func And(x, y bool) bool {
+	return x && y
+}
+
+func Or(x, y bool) bool {
+	return x || y
+}
+
+func Assert(cond bool, message string, line, col int) {
+	if !cond {
+		throw(line, col, "AssertionError", "%s", message)
+	}
+}
+
+func AssertEquals(expected, actual Value, line, col int) {
+	if !Equals(expected, actual) {
+		throw(line, col, "AssertionError", "expected %s, but got %s", describe(expected), describe(actual))
+	}
+}
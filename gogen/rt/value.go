@@ -0,0 +1,285 @@
+package rt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of a value held by a Value, numbered the way the compiler numbers them
+type Type int
+
+const (
+	TypeFloat Type = iota
+	TypeInt
+	TypeString
+	TypeUnit
+	TypeBool
+	TypeArray
+	TypeFunction
+	TypeRef
+	TypeAny
+	TypeNull
+	TypeUndefined
+	TypeException
+)
+
+var typeNames = [...]string{
+	TypeFloat:     "Float",
+	TypeInt:       "Int",
+	TypeString:    "String",
+	TypeUnit:      "Unit",
+	TypeBool:      "Bool",
+	TypeArray:     "Array",
+	TypeFunction:  "Function",
+	TypeRef:       "Ref",
+	TypeAny:       "Any",
+	TypeNull:      "Null",
+	TypeUndefined: "Undefined",
+	TypeException: "Exception",
+}
+
+// String returns the name programs refer to the type by
+func (t Type) String() string {
+	if t < 0 || int(t) >= len(typeNames) {
+		return "Unknown"
+	}
+	return typeNames[t]
+}
+
+// typeOfName returns the type named by a program, e.g by the argument of array_new
+func typeOfName(name string) Type {
+	for t, typeName := range typeNames {
+		switch Type(t) {
+		case TypeFunction, TypeRef, TypeNull, TypeUndefined:
+			continue
+		}
+		if typeName == name {
+			return Type(t)
+		}
+	}
+	return TypeUndefined
+}
+
+// Value is a value of type Any. The zero Value isn't valid, Null returns the null one
+type Value struct {
+	Type Type
+	data interface{}
+}
+
+func IntValue(x int64) Value {
+	return Value{Type: TypeInt, data: x}
+}
+
+func FloatValue(x float64) Value {
+	return Value{Type: TypeFloat, data: x}
+}
+
+func StringValue(s string) Value {
+	return Value{Type: TypeString, data: s}
+}
+
+func BoolValue(b bool) Value {
+	return Value{Type: TypeBool, data: b}
+}
+
+func ArrayValue(a *Array) Value {
+	return Value{Type: TypeArray, data: a}
+}
+
+func ExceptionValue(e *Exception) Value {
+	return Value{Type: TypeException, data: e}
+}
+
+// Null returns the value elements of arrays of types without a zero value start with
+func Null() Value {
+	return Value{Type: TypeNull}
+}
+
+// zeroValue returns the value elements of an array of type t start with
+func zeroValue(t Type) Value {
+	switch t {
+	case TypeFloat:
+		return FloatValue(0)
+	case TypeInt:
+		return IntValue(0)
+	case TypeString:
+		return StringValue("")
+	case TypeBool:
+		return BoolValue(false)
+	}
+	return Null()
+}
+
+// The As methods return what the value holds, they panic if it holds a value of another type
+
+func (v Value) AsInt() int64 {
+	return v.data.(int64)
+}
+
+func (v Value) AsFloat() float64 {
+	return v.data.(float64)
+}
+
+func (v Value) AsString() string {
+	return v.data.(string)
+}
+
+func (v Value) AsBool() bool {
+	return v.data.(bool)
+}
+
+func (v Value) AsArray() *Array {
+	return v.data.(*Array)
+}
+
+func (v Value) AsException() *Exception {
+	return v.data.(*Exception)
+}
+
+// Is reports whether the value is of type t, as the type test of a program does
+func (v Value) Is(t Type) bool {
+	return t == TypeAny || v.Type == t
+}
+
+// Cast checks that the value is of type t, throwing ClassCastException if it isn't
+func Cast(v Value, t Type, line, col int) Value {
+	if !v.Is(t) {
+		throw(line, col, "ClassCastException", "%s cannot be cast to %s", v.Type, t)
+	}
+	return v
+}
+
+// Array is an array of a program. Its elements are of type ElemType, unless it's TypeAny
+type Array struct {
+	ElemType Type
+	Elems    []Value
+}
+
+// NewArray returns an array of n elements of the named type, as array_new does
+func NewArray(n int64, elemType string, line, col int) *Array {
+	if n < 0 {
+		throw(line, col, "NegativeArraySizeException", "%d", n)
+	}
+	a := &Array{ElemType: typeOfName(elemType), Elems: make([]Value, n)}
+	for idx := range a.Elems {
+		a.Elems[idx] = zeroValue(a.ElemType)
+	}
+	return a
+}
+
+func (a *Array) Len() int64 {
+	return int64(len(a.Elems))
+}
+
+func (a *Array) Get(idx int64, line, col int) Value {
+	a.checkIndex(idx, line, col)
+	return a.Elems[idx]
+}
+
+// Set stores the value at idx, throwing ArrayStoreException if it's of a type the array doesn't hold
+func (a *Array) Set(idx int64, v Value, line, col int) {
+	a.checkIndex(idx, line, col)
+	if !v.Is(a.ElemType) {
+		throw(line, col, "ArrayStoreException", "array expected type %s, but got %s", a.ElemType, v.Type)
+	}
+	a.Elems[idx] = v
+}
+
+func (a *Array) checkIndex(idx int64, line, col int) {
+	if idx < 0 || idx >= a.Len() {
+		throw(line, col, "IndexOutOfBoundsException", "index %d out of bounds for length %d", idx, a.Len())
+	}
+}
+
+// ToString renders the value the way to_string does
+func ToString(v Value) string {
+	var b strings.Builder
+	format(&b, v)
+	return b.String()
+}
+
+// format renders v the way the compiler's runtime does, which is how Go's %v renders it
+func format(b *strings.Builder, v Value) {
+	switch v.Type {
+	case TypeInt:
+		b.WriteString(strconv.FormatInt(v.AsInt(), 10))
+	case TypeFloat:
+		fmt.Fprint(b, v.AsFloat())
+	case TypeString:
+		b.WriteString(v.AsString())
+	case TypeBool:
+		b.WriteString(strconv.FormatBool(v.AsBool()))
+	case TypeException:
+		b.WriteString(v.AsException().Error())
+	case TypeArray:
+		a := v.AsArray()
+		b.WriteString("{[")
+		for idx, elem := range a.Elems {
+			if idx > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteByte('{')
+			format(b, elem)
+			fmt.Fprintf(b, " %d false}", elem.Type)
+		}
+		fmt.Fprintf(b, "] %d}", a.ElemType)
+	default:
+		b.WriteString("<nil>")
+	}
+}
+
+// Equals reports whether a pair of values is equal the way assertEquals sees it. Numbers
+// are compared as Floats unless both are Ints, arrays are equal if their elements are,
+// exceptions if they're of the same kind and carry the same message
+func Equals(x, y Value) bool {
+	numeric := func(v Value) bool {
+		return v.Type == TypeInt || v.Type == TypeFloat
+	}
+	asFloat := func(v Value) float64 {
+		if v.Type == TypeInt {
+			return float64(v.AsInt())
+		}
+		return v.AsFloat()
+	}
+	switch {
+	case x.Type == TypeNull || y.Type == TypeNull:
+		return x.Type == y.Type
+	case x.Type == TypeInt && y.Type == TypeInt:
+		return x.AsInt() == y.AsInt()
+	case numeric(x) && numeric(y):
+		return asFloat(x) == asFloat(y)
+	case x.Type != y.Type:
+		return false
+	}
+	switch x.Type {
+	case TypeString:
+		return x.AsString() == y.AsString()
+	case TypeBool:
+		return x.AsBool() == y.AsBool()
+	case TypeArray:
+		xs, ys := x.AsArray().Elems, y.AsArray().Elems
+		if len(xs) != len(ys) {
+			return false
+		}
+		for idx := range xs {
+			if !Equals(xs[idx], ys[idx]) {
+				return false
+			}
+		}
+		return true
+	case TypeException:
+		ex, ey := x.AsException(), y.AsException()
+		return ex.Kind == ey.Kind && ex.Message == ey.Message
+	}
+	return false
+}
+
+// describe renders the value for a failure message, quoting strings so that
+// differences in whitespace stand out
+func describe(v Value) string {
+	if v.Type == TypeString {
+		return strconv.Quote(v.AsString())
+	}
+	return ToString(v) + " (" + v.Type.String() + ")"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/diff"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the actual output")
+
+// TestGolden runs every sample program the way 'miniscala run' does, on the vm, optimized
+// or not, on the tree-walking interpreter and on the vm running bytecode generated from
+// the IR, and, if there's a C compiler around, as executables built by 'miniscala build'
+// with the C and the assembly backends, the latter on linux/amd64 only, as well as a module
+// built with the WebAssembly backend, if Node.js is there to run it, and translated to Go
+// by 'miniscala gen-go', if there's a go command. It compares what it writes with golden
+// files kept next to it: name.out holds stdout, while name.err holds stderr, followed by
+// the exit status if it's nonzero. A missing file stands for no output.
+// Run 'go test -run TestGolden -update' to rewrite them after a deliberate change
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("sources", "*"+sourceExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range files {
+		if strings.HasSuffix(path, testFileSuffix) {
+			continue
+		}
+		backendNames := []string{"vm", "vm-O", "tree", "ir", "ir-O"}
+		if _, err := exec.LookPath(defaultCC()); err == nil {
+			backendNames = append(backendNames, "c")
+			if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+				backendNames = append(backendNames, "asm")
+			}
+		}
+		if _, err := exec.LookPath("node"); err == nil {
+			backendNames = append(backendNames, "wasm")
+		}
+		if _, err := exec.LookPath("go"); err == nil {
+			backendNames = append(backendNames, "go")
+		}
+		for _, backendName := range backendNames {
+			path, backendName := path, backendName
+			t.Run(filepath.Base(path)+"/"+backendName, func(t *testing.T) {
+				src, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var stdout, stderr bytes.Buffer
+				run := func(path string, src io.Reader, backendName string, stdout, stderr io.Writer) int {
+					// vm-O and ir-O stand for the vm running the optimized program
+					optimized := strings.HasSuffix(backendName, "-O")
+					return runSource(path, src, strings.TrimSuffix(backendName, "-O"), optimized, stdout, stderr)
+				}
+				if backendName == "c" || backendName == "asm" || backendName == "wasm" {
+					run = runNative(t.TempDir())
+				} else if backendName == "go" {
+					run = runGo(t.TempDir())
+				}
+				if exitCode := run(path, bytes.NewReader(src), backendName, &stdout, &stderr); exitCode != 0 {
+					fmt.Fprintf(&stderr, "exit status %d\n", exitCode)
+				}
+				base := strings.TrimSuffix(path, sourceExt)
+				checkGolden(t, base+".out", stdout.String())
+				checkGolden(t, base+".err", stderr.String())
+			})
+		}
+	}
+}
+
+// runNative returns a function which runs the program like runSource does, but builds
+// it in dir and runs the executable, or the module, instead
+func runNative(dir string) func(path string, src io.Reader, backendName string, stdout, stderr io.Writer) int {
+	return func(path string, src io.Reader, backendName string, stdout, stderr io.Writer) int {
+		output := filepath.Join(dir, "prog")
+		if exitCode := buildSource(path, src, output, defaultCC(), backendName, false, stderr); exitCode != 0 {
+			return exitCode
+		}
+		cmd := exec.Command(output)
+		if backendName == "wasm" {
+			cmd = exec.Command("node", filepath.Join("wasmgen", "host.js"), output)
+		}
+		return runCommand(cmd, stdout, stderr)
+	}
+}
+
+// runGo returns a function which runs the program like runSource does, but translates
+// it to Go in a module in dir, which gets the runtime from this repository, and runs that
+func runGo(dir string) func(path string, src io.Reader, backendName string, stdout, stderr io.Writer) int {
+	return func(path string, src io.Reader, backendName string, stdout, stderr io.Writer) int {
+		root, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		goMod := "module prog\n\ngo 1.17\n\nrequire github.com/ThreadedStream/miniscala v0.0.0\n\n" +
+			"replace github.com/ThreadedStream/miniscala => " + root + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0644); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if exitCode := genGoSource(path, src, filepath.Join(dir, "main.go"), "main", stderr); exitCode != 0 {
+			return exitCode
+		}
+		output := filepath.Join(dir, "prog")
+		build := exec.Command("go", "build", "-o", output)
+		build.Dir = dir
+		if out, err := build.CombinedOutput(); err != nil {
+			fmt.Fprintf(stderr, "go build failed: %v\n%s", err, out)
+			return 1
+		}
+		return runCommand(exec.Command(output), stdout, stderr)
+	}
+}
+
+// runCommand runs the built program, returns its exit code
+func runCommand(cmd *exec.Cmd, stdout, stderr io.Writer) int {
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// TestSampleTests runs tests of the sample test files, all of them are expected to pass
+func TestSampleTests(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("sources", "*"+testFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range files {
+		result := testFile(path, regexp.MustCompile(""), false, time.Minute)
+		for _, err := range result.buildErrors {
+			t.Error(err)
+		}
+		for _, test := range result.tests {
+			if test.outcome != testPassed {
+				t.Errorf("%s failed: %s", test.name, test.describe(path))
+			}
+		}
+	}
+}
+
+func checkGolden(t *testing.T, path string, actual string) {
+	t.Helper()
+	if *update {
+		if actual == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			return
+		}
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if d := diff.Unified(path, "actual", string(expected), actual); d != "" {
+		t.Errorf("output differs from %s:\n%s", path, d)
+	}
+}
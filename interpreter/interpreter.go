@@ -1,401 +1,404 @@
+// Package interpreter executes programs by walking their syntax trees. It's slower than
+// the vm, but simple enough to serve as the reference the vm is checked against
 package interpreter
 
 import (
-	"errors"
 	"fmt"
-	"github.com/ThreadedStream/miniscala/assert"
 	"github.com/ThreadedStream/miniscala/backing"
 	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"io"
+	"os"
 	"strconv"
+	"text/scanner"
 )
 
-func checkOpValues(op syntax.Operator, v1, v2 backing.Value, localEnv backing.ValueEnvironment) {
+type Interpreter struct {
+	program *syntax.Program
+	// types resolved by the typechecker
+	info *typecheck.Result
+	// function execution starts at
+	entry string
+	// functions defined by the program, keyed by name
+	funcs map[string]*syntax.DefDeclStmt
+	// values and variables declared at the top level, bound to *backing.Value
+	globals backing.SymbolTable
+	// locals of the function being executed, each call gets a table of its own
+	frame backing.SymbolTable
+	// number of calls in progress, main included
+	depth int
+	// position of the statement being executed, it's where exceptions are raised
+	pos scanner.Position
+	// where the program prints to
+	out io.Writer
+}
 
-	if v1.ValueType == backing.Ref {
-		v1, _ = backing.Lookup(v1.AsString(), localEnv, true)
-	}
+// New prepares the program, checked by the typechecker beforehand, for execution
+func New(program *syntax.Program, info *typecheck.Result) *Interpreter {
+	return NewWithEntry(program, info, "main")
+}
 
-	if v2.ValueType == backing.Ref {
-		v2, _ = backing.Lookup(v2.AsString(), localEnv, true)
-	}
+// NewWithEntry is like New, but execution starts at the function with the given
+// name rather than at main. The function must take no arguments
+func NewWithEntry(program *syntax.Program, info *typecheck.Result, entry string) *Interpreter {
+	in := new(Interpreter)
+	in.program = program
+	in.info = info
+	in.entry = entry
+	in.funcs = make(map[string]*syntax.DefDeclStmt)
+	in.globals = backing.SEmpty()
+	in.out = os.Stdout
+	return in
+}
 
-	switch op {
-	default:
-		panic("unknown operation")
-	case syntax.Plus:
-		if (v1.IsString() && v2.IsString()) || (v1.IsFloat() && v2.IsFloat()) {
-			return
-		}
-		panic("v1 and v2 must both be of type string or float")
-	case syntax.Minus:
-		if v1.IsFloat() && v2.IsFloat() {
-			return
+// SetOutput redirects whatever the program prints to out, which is stdout by default
+func (in *Interpreter) SetOutput(out io.Writer) {
+	in.out = out
+}
+
+// Run executes top-level statements of the program, then calls the entry function.
+// An exception raised and not handled by the program is returned as *backing.ExceptionValue,
+// with its Pos set to the statement which raised it
+func (in *Interpreter) Run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			exception, ok := r.(*backing.ExceptionValue)
+			if !ok {
+				panic(r)
+			}
+			in.locate(exception)
+			err = exception
 		}
-		panic("v1 and v2 must both be of type float")
-	case syntax.Mul:
-		if v1.IsFloat() && v2.IsFloat() {
-			return
+	}()
+	for _, stmt := range in.program.StmtList {
+		if defDeclStmt, ok := stmt.(*syntax.DefDeclStmt); ok {
+			in.funcs[defDeclStmt.Name.Value] = defDeclStmt
 		}
-		panic("v1 and v2 must both be of type float")
-	case syntax.Div:
-		if v1.IsFloat() && v2.IsFloat() {
-			if !v2.IsZero() {
-				return
-			} else {
-				panic("division by zero")
-			}
+	}
+	in.frame = in.globals
+	for _, stmt := range in.program.StmtList {
+		if _, ok := stmt.(*syntax.DefDeclStmt); !ok {
+			in.execStmt(stmt)
 		}
 	}
+	in.callFunc(in.entry, nil)
+	return nil
 }
 
-func checkDefReturnType(v backing.Value, defReturnType, funcName string) {
-	if v.ValueType == backing.MiniscalaTypeToValueType(defReturnType) {
-		return
-	}
-
-	panic(fmt.Errorf("(in %s()) expected to return a backing of type %s, but it returned %s", funcName, defReturnType, v.ValueTypeToStr()))
+func (in *Interpreter) abort(format string, args ...interface{}) {
+	panic(fmt.Errorf(format, args...))
 }
 
-func isReservedFuncCall(funcName string) bool {
-	switch funcName {
-	default:
-		return false
-	case "print":
-		return true
+// locate records where the exception was raised, unless it's been raised before
+func (in *Interpreter) locate(exception *backing.ExceptionValue) {
+	if exception.Pos.Line == 0 {
+		exception.Pos = in.pos
 	}
 }
 
-func unwrapValue(value backing.Value) interface{} {
-	switch {
-	default:
-		return nil
-	case value.IsString():
-		return value.AsString()
-	case value.IsFloat():
-		return value.AsFloat()
-	}
+// flow tells whether a statement completed normally or returned from the function
+type flow struct {
+	returned bool
+	value    backing.Value
+	// tailCall is the call in tail position whose result is returned, if any.
+	// It's made by callFunc, in place of the function returning
+	tailCall *tailCall
 }
 
-func callPrintFunc(call *syntax.Call, localEnv backing.ValueEnvironment) {
-	// TODO(threadedstream): allow more arguments to print
-	assert.Assert(len(call.ArgList) == 1, "expected a single argument for print got %d", len(call.ArgList))
-	value := unwrapValue(visitExpr(call.ArgList[0], localEnv))
-	fmt.Printf("%v", value)
+// tailCall is a call in tail position, its arguments evaluated
+type tailCall struct {
+	name string
+	args []backing.Value
 }
 
-func dispatchReservedCall(call *syntax.Call, localEnv backing.ValueEnvironment) {
-	switch call.CalleeName.Value {
-	case "print":
-		callPrintFunc(call, localEnv)
+func (in *Interpreter) execStmt(stmt syntax.Stmt) flow {
+	if _, ok := stmt.(*syntax.BlockStmt); !ok {
+		in.pos = stmt.Pos()
+	}
+	switch stmt.(type) {
+	default:
+		in.abort("unknown statement %T", stmt)
+	case *syntax.BlockStmt:
+		return in.execBlockStmt(stmt.(*syntax.BlockStmt))
+	case *syntax.IfStmt:
+		return in.execIfStmt(stmt.(*syntax.IfStmt))
+	case *syntax.WhileStmt:
+		return in.execWhileStmt(stmt.(*syntax.WhileStmt))
+	case *syntax.ReturnStmt:
+		returnStmt := stmt.(*syntax.ReturnStmt)
+		if call, ok := returnStmt.Value.(*syntax.Call); ok && in.info.TailCalls[call] {
+			return flow{returned: true, tailCall: in.evalTailCall(call)}
+		}
+		return flow{returned: true, value: in.evalExpr(returnStmt.Value)}
+	case *syntax.ThrowStmt:
+		operand := in.evalExpr(stmt.(*syntax.ThrowStmt).Value)
+		backing.Raise(operand.AsException())
+	case *syntax.TryStmt:
+		return in.execTryStmt(stmt.(*syntax.TryStmt))
+	case *syntax.DefDeclStmt:
+		defDeclStmt := stmt.(*syntax.DefDeclStmt)
+		// like the vm, nested functions share a single namespace with the others
+		in.funcs[defDeclStmt.Name.Value] = defDeclStmt
+	case *syntax.Call:
+		call := stmt.(*syntax.Call)
+		if in.info.TailCalls[call] {
+			return flow{returned: true, tailCall: in.evalTailCall(call)}
+		}
+		in.evalCall(call)
+	case *syntax.Assignment:
+		assignment := stmt.(*syntax.Assignment)
+		value := in.evalExpr(assignment.Rhs)
+		*in.lookup(assignment.Lhs.(*syntax.Name).Value) = value
+	case *syntax.VarDeclStmt:
+		varDeclStmt := stmt.(*syntax.VarDeclStmt)
+		in.declare(varDeclStmt.Name.Value, in.evalExpr(varDeclStmt.Rhs))
+	case *syntax.ValDeclStmt:
+		valDeclStmt := stmt.(*syntax.ValDeclStmt)
+		in.declare(valDeclStmt.Name.Value, in.evalExpr(valDeclStmt.Rhs))
 	}
+	return flow{}
 }
 
-func checkAssignmentValidity(name string, localEnv backing.ValueEnvironment) error {
-	// first, check against the presence of backing associated with name
-	value, _ := backing.Lookup(name, localEnv, true)
-
-	// second, check against the possibility to change this backing
-	if value.Immutable {
-		return errors.New("attempt to override val backing")
+func (in *Interpreter) execBlockStmt(block *syntax.BlockStmt) flow {
+	backing.SBeginScope(in.frame)
+	defer backing.SEndScope(in.frame)
+	for _, stmt := range block.Stmts {
+		if res := in.execStmt(stmt); res.returned {
+			return res
+		}
 	}
-
-	return nil
+	return flow{}
 }
 
-func resolveRef(v1 backing.Value, localEnv backing.ValueEnvironment) backing.Value {
-	switch {
-	default:
-		return v1
-	case v1.ValueType == backing.Ref:
-		v, _ := backing.Lookup(v1.AsString(), localEnv, true)
-		return v
+func (in *Interpreter) execIfStmt(ifStmt *syntax.IfStmt) flow {
+	if in.evalExpr(ifStmt.Cond).AsBool() {
+		return in.execBlockStmt(ifStmt.Body)
+	}
+	if ifStmt.ElseBody != nil {
+		return in.execStmt(ifStmt.ElseBody)
 	}
+	return flow{}
 }
 
-func isCondTrue(cond syntax.Operation, localEnv backing.ValueEnvironment) bool {
-	syntax.IsComparisonOp(cond.Op)
-	var (
-		lhs = visitExpr(cond.Lhs, localEnv)
-		rhs = visitExpr(cond.Rhs, localEnv)
-	)
-
-	lhs = resolveRef(lhs, localEnv)
-	rhs = resolveRef(rhs, localEnv)
-
-	switch cond.Op {
-	default:
-		return false
-	case syntax.GreaterThan:
-		if lhs.IsString() && rhs.IsString() {
-			return lhs.AsString() > rhs.AsString()
-		} else if lhs.IsFloat() && rhs.IsFloat() {
-			return lhs.AsFloat() > rhs.AsFloat()
-		} else {
-			panic("cast to string and float was unsuccessful")
+func (in *Interpreter) execWhileStmt(whileStmt *syntax.WhileStmt) flow {
+	for {
+		// the condition is evaluated on behalf of the loop, not of the last statement of its body
+		in.pos = whileStmt.Pos()
+		if !in.evalExpr(whileStmt.Cond).AsBool() {
+			return flow{}
 		}
-	case syntax.GreaterThanOrEqual:
-		if lhs.IsString() && rhs.IsString() {
-			return lhs.AsString() >= rhs.AsString()
-		} else if lhs.IsFloat() && rhs.IsFloat() {
-			return lhs.AsFloat() >= rhs.AsFloat()
-		} else {
-			panic("cast to string and float was unsuccessful")
+		if res := in.execBlockStmt(whileStmt.Body); res.returned {
+			return res
 		}
-	case syntax.LessThan:
-		if lhs.IsString() && rhs.IsString() {
-			return lhs.AsString() < rhs.AsString()
-		} else if lhs.IsFloat() && rhs.IsFloat() {
-			return lhs.AsFloat() < rhs.AsFloat()
-		} else {
-			panic("cast to string and float was unsuccessful")
+	}
+}
+
+// execTryStmt runs the body, handing an exception it raises over to the first matching
+// catch case. The finally block runs however the body and the case are left, and whatever
+// it raises or returns supersedes the outcome of them
+func (in *Interpreter) execTryStmt(tryStmt *syntax.TryStmt) flow {
+	res, exception := in.tryBlock(tryStmt.Body)
+	if exception != nil {
+		for _, catchClause := range tryStmt.Cases {
+			if catchClause.Type != nil && catchClause.Type.Value != exception.Kind {
+				continue
+			}
+			res, exception = in.tryCatchClause(catchClause, exception)
+			break
 		}
-	case syntax.LessThanOrEqual:
-		if lhs.IsString() && rhs.IsString() {
-			return lhs.AsString() <= rhs.AsString()
-		} else if lhs.IsFloat() && rhs.IsFloat() {
-			return lhs.AsFloat() <= rhs.AsFloat()
-		} else {
-			panic("cast to string and float was unsuccessful")
+	}
+	if tryStmt.Finally != nil {
+		if finallyRes := in.execBlockStmt(tryStmt.Finally); finallyRes.returned {
+			return finallyRes
 		}
-	case syntax.Equal:
-		return lhs.Value == rhs.Value
-	case syntax.NotEqual:
-		return lhs.Value != rhs.Value
 	}
+	if exception != nil {
+		backing.Raise(exception)
+	}
+	return res
 }
 
-func Execute(program *syntax.Program) {
-	for _, stmt := range program.StmtList {
-		visitStmt(stmt, nil)
-	}
+// tryBlock executes the block, returning the exception it raises, if any
+func (in *Interpreter) tryBlock(block *syntax.BlockStmt) (res flow, exception *backing.ExceptionValue) {
+	frame, depth := in.frame, in.depth
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			exception, ok = r.(*backing.ExceptionValue)
+			if !ok {
+				panic(r)
+			}
+			in.locate(exception)
+			// the exception may have been raised by a callee
+			in.frame, in.depth = frame, depth
+		}
+	}()
+	return in.execBlockStmt(block), nil
 }
 
-func DumpEnvState() {
-	//environment.state()
+func (in *Interpreter) tryCatchClause(catchClause *syntax.CatchClause, caught *backing.ExceptionValue) (flow, *backing.ExceptionValue) {
+	backing.SBeginScope(in.frame)
+	defer backing.SEndScope(in.frame)
+	in.declare(catchClause.Name.Value, backing.Value{
+		Value:     caught,
+		ValueType: backing.Exception,
+	})
+	return in.tryBlock(catchClause.Body)
 }
 
-func visitStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	switch stmt.(type) {
-	default:
-		// we don't allow it in perspective. Right now, we're totally good with that
-		return visitExpr(stmt, localEnv)
-		//panic(fmt.Errorf("unknown node type %v", reflect.TypeOf(stmt)))
-	case *syntax.VarDeclStmt:
-		return visitVarDeclStmt(stmt, localEnv)
-	case *syntax.ValDeclStmt:
-		return visitValDeclStmt(stmt, localEnv)
-	case *syntax.BlockStmt:
-		return visitBlockStmt(stmt, localEnv)
-	case *syntax.IfStmt:
-		return visitIfStmt(stmt, localEnv)
-	case *syntax.WhileStmt:
-		return visitWhileStmt(stmt, localEnv)
-	case *syntax.Assignment:
-		return visitAssignment(stmt, localEnv)
-	case *syntax.DefDeclStmt:
-		return visitDefDeclStmt(stmt, localEnv)
-	case *syntax.ReturnStmt:
-		return visitReturnStmt(stmt, localEnv)
-	case *syntax.Call:
-		return visitCall(stmt, localEnv)
+func (in *Interpreter) declare(name string, value backing.Value) {
+	backing.SEnter(in.frame, backing.SSymbol(name), &value)
+}
+
+// lookup returns the cell holding the value of a local, an argument or a global
+func (in *Interpreter) lookup(name string) *backing.Value {
+	sym := backing.SSymbol(name)
+	if value := backing.SLook(in.frame, sym); value != nil {
+		return value.(*backing.Value)
 	}
+	if value := backing.SLook(in.globals, sym); value != nil {
+		return value.(*backing.Value)
+	}
+	in.abort("undefined reference to name %s", name)
+	return nil
 }
 
-func visitExpr(expr syntax.Expr, localEnv backing.ValueEnvironment) backing.Value {
+func (in *Interpreter) evalExpr(expr syntax.Expr) backing.Value {
 	switch expr.(type) {
 	default:
-		return backing.Value{Value: nil}
-	case *syntax.Name:
-		return visitName(expr)
+		in.abort("unknown expression %T", expr)
 	case *syntax.BasicLit:
-		return visitBasicLit(expr)
+		return evalBasicLit(expr.(*syntax.BasicLit))
+	case *syntax.Name:
+		return *in.lookup(expr.(*syntax.Name).Value)
 	case *syntax.Operation:
-		return visitOperation(expr, localEnv)
-	}
-}
-
-// expressions
-func visitName(expr syntax.Expr) backing.Value {
-	name := expr.(*syntax.Name)
-	v := backing.Value{
-		Value:     name.Value,
-		ValueType: backing.Ref,
+		return in.evalOperation(expr.(*syntax.Operation))
+	case *syntax.Call:
+		return in.evalCall(expr.(*syntax.Call))
+	case *syntax.Cast:
+		cast := expr.(*syntax.Cast)
+		operand := in.evalExpr(cast.X)
+		castType := in.info.TypeOf(cast.Type)
+		if !backing.IsAssignable(castType, operand.ValueType) {
+			backing.Throw(backing.ClassCastException, "%s cannot be cast to %s",
+				backing.ValueTypeToStr(operand.ValueType),
+				backing.ValueTypeToStr(castType))
+		}
+		return operand
+	case *syntax.TypeTest:
+		typeTest := expr.(*syntax.TypeTest)
+		operand := in.evalExpr(typeTest.X)
+		return backing.Value{
+			Value:     backing.IsAssignable(in.info.TypeOf(typeTest.Type), operand.ValueType),
+			ValueType: backing.Bool,
+		}
 	}
-	return v
+	return backing.Value{}
 }
 
-func visitBasicLit(expr syntax.Expr) backing.Value {
-	basicLit := expr.(*syntax.BasicLit)
-	v := backing.Value{}
+func evalBasicLit(basicLit *syntax.BasicLit) backing.Value {
+	var value backing.Value
 	switch basicLit.Kind {
-	case syntax.FloatLit:
-		v.Value, _ = strconv.ParseFloat(basicLit.Value, 64)
-		v.ValueType = backing.Float
 	case syntax.StringLit:
-		v.Value = basicLit.Value
-		v.ValueType = backing.String
+		value.Value = basicLit.Value
+		value.ValueType = backing.String
+	case syntax.FloatLit:
+		value.Value, _ = strconv.ParseFloat(basicLit.Value, 64)
+		value.ValueType = backing.Float
 	case syntax.IntLit:
-		v.Value, _ = strconv.ParseInt(basicLit.Value, 10, 64)
-		v.ValueType = backing.Int
+		value.Value, _ = strconv.ParseInt(basicLit.Value, 10, 64)
+		value.ValueType = backing.Int
 	case syntax.BoolLit:
-		v.Value, _ = strconv.ParseBool(basicLit.Value)
-		v.ValueType = backing.Bool
+		value.Value, _ = strconv.ParseBool(basicLit.Value)
+		value.ValueType = backing.Bool
 	}
-	return v
+	return value
 }
 
-func visitOperation(expr syntax.Expr, localEnv backing.ValueEnv) backing.Value {
-	operation := expr.(*syntax.Operation)
-	lhsValue := visitExpr(operation.Lhs, localEnv)
-	rhsValue := visitExpr(operation.Rhs, localEnv)
+func (in *Interpreter) evalOperation(operation *syntax.Operation) backing.Value {
+	lhs := in.evalExpr(operation.Lhs)
+	if operation.Rhs == nil {
+		switch operation.Op {
+		case syntax.Minus:
+			return backing.Mul(lhs, backing.Value{Value: int64(-1), ValueType: backing.Int}, nil, backing.TreeWalkInterpreter)
+		case syntax.LogicalNot:
+			return backing.Value{Value: !lhs.AsBool(), ValueType: backing.Bool}
+		}
+		in.abort("unknown unary operator %s", syntax.OperatorToString(operation.Op))
+	}
+	// like in the vm, both operands of && and || are always evaluated
+	rhs := in.evalExpr(operation.Rhs)
 	switch operation.Op {
-	default:
-		panic("unknown operation")
 	case syntax.Plus:
-		checkOpValues(syntax.Plus, lhsValue, rhsValue, localEnv)
-		value := backing.Add(lhsValue, rhsValue, localEnv, backing.TreeWalkInterpreter)
-		return value
+		return backing.Add(lhs, rhs, nil, backing.TreeWalkInterpreter)
 	case syntax.Minus:
-		checkOpValues(syntax.Minus, lhsValue, rhsValue, localEnv)
-		value := backing.Sub(lhsValue, rhsValue, localEnv, backing.TreeWalkInterpreter)
-		return value
+		return backing.Sub(lhs, rhs, nil, backing.TreeWalkInterpreter)
 	case syntax.Mul:
-		checkOpValues(syntax.Mul, lhsValue, rhsValue, localEnv)
-		value := backing.Mul(lhsValue, rhsValue, localEnv, backing.TreeWalkInterpreter)
-		return value
+		return backing.Mul(lhs, rhs, nil, backing.TreeWalkInterpreter)
 	case syntax.Div:
-		checkOpValues(syntax.Div, lhsValue, rhsValue, localEnv)
-		value := backing.Div(lhsValue, rhsValue, localEnv, backing.TreeWalkInterpreter)
-		return value
-	}
-}
-
-func visitCall(expr syntax.Expr, localEnv backing.ValueEnv) backing.Value {
-	call := expr.(*syntax.Call)
-
-	if isReservedFuncCall(call.CalleeName.Value) {
-		// dispatch in case if call to a reserved function has been made
-		dispatchReservedCall(call, localEnv)
-		return backing.Value{}
-	}
-
-	value, _ := backing.LookupValue(call.CalleeName.Value, nil, true)
-	defValue := value.AsFunction()
-
-	var funcFrame = make(backing.ValueEnv)
-	// TODO(threadedstream): do some checks regarding the number of passed arguments
-	for idx, arg := range call.ArgList {
-		argValue := visitExpr(arg, localEnv)
-		paramName := defValue.DefDeclStmt.ParamList[idx].Name.Value
-		backing.StoreValue(paramName, argValue, funcFrame, backing.Assign)
+		return backing.Div(lhs, rhs, nil, backing.TreeWalkInterpreter)
+	case syntax.Mod:
+		return backing.Mod(lhs, rhs, nil, backing.TreeWalkInterpreter)
+	case syntax.GreaterThan, syntax.GreaterThanOrEqual, syntax.LessThan, syntax.LessThanOrEqual,
+		syntax.Equal, syntax.NotEqual:
+		return backing.Compare(operation.Op, lhs, rhs)
+	case syntax.LogicalAnd:
+		return backing.LogicalAnd(lhs, rhs)
+	case syntax.LogicalOr:
+		return backing.LogicalOr(lhs, rhs)
 	}
-
-	returnValue := visitBlockStmt(defValue.DefDeclStmt.Body, funcFrame)
-
-	checkDefReturnType(returnValue, defValue.DefDeclStmt.ReturnType.(*syntax.Name).Value, defValue.DefDeclStmt.Name.Value)
-
-	// destroy local environment
-	funcFrame = nil
-
-	return returnValue
-}
-
-func visitReturnStmt(stmt syntax.Stmt, localEnv backing.ValueEnv) backing.Value {
-	returnStmt := stmt.(*syntax.ReturnStmt)
-	returnValue := visitExpr(returnStmt.Value, localEnv)
-	returnValue.Returned = true
-	return returnValue
-}
-
-// statements
-func visitVarDeclStmt(stmt syntax.Stmt, localEnv backing.ValueEnv) backing.Value {
-	varDecl := stmt.(*syntax.VarDeclStmt)
-	value := visitExpr(varDecl.Rhs, localEnv)
-	value.Immutable = false
-	backing.Store(varDecl.Name.Value, value, localEnv, backing.Declare)
-	return backing.Value{}
-}
-
-func visitValDeclStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	valDecl := stmt.(*syntax.ValDeclStmt)
-	value := visitExpr(valDecl.Rhs, localEnv)
-	value.Immutable = true
-	backing.Store(valDecl.Name.Value, value, localEnv, backing.Declare)
+	in.abort("unknown operator %s", syntax.OperatorToString(operation.Op))
 	return backing.Value{}
 }
 
-func visitBlockStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	var (
-		block = stmt.(*syntax.BlockStmt)
-		value backing.Value
-	)
-
-	for _, currStmt := range block.Stmts {
-		value = visitStmt(currStmt, localEnv)
-		if value.Returned {
-			break
-		}
+func (in *Interpreter) evalCall(call *syntax.Call) backing.Value {
+	args := make([]backing.Value, len(call.ArgList))
+	for idx, arg := range call.ArgList {
+		args[idx] = in.evalExpr(arg)
 	}
-
-	return value
-}
-
-func visitIfStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	var (
-		value  = backing.Value{ValueType: backing.Null}
-		ifStmt = stmt.(*syntax.IfStmt)
-	)
-
-	if isCondTrue(ifStmt.Cond, localEnv) {
-		value = visitStmt(ifStmt.Body, localEnv)
-	} else {
-		if ifStmt.ElseBody != nil {
-			value = visitStmt(ifStmt.ElseBody, localEnv)
-		}
+	if backing.IsRuntimeCall(call.CalleeName.Value) {
+		return backing.DispatchRuntimeFuncCall(in.out, call.CalleeName.Value, args...)
 	}
-
-	return value
+	pos := in.pos
+	res := in.callFunc(call.CalleeName.Value, args)
+	// back to the statement the call is made by
+	in.pos = pos
+	return res
 }
 
-func visitWhileStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	var whileStmt = stmt.(*syntax.WhileStmt)
-	for isCondTrue(whileStmt.Cond, localEnv) {
-		visitStmt(whileStmt.Body, localEnv)
+// evalTailCall evaluates arguments of the call in tail position, which is left to callFunc
+func (in *Interpreter) evalTailCall(call *syntax.Call) *tailCall {
+	args := make([]backing.Value, len(call.ArgList))
+	for idx, arg := range call.ArgList {
+		args[idx] = in.evalExpr(arg)
 	}
-	return backing.Value{}
+	return &tailCall{name: call.CalleeName.Value, args: args}
 }
 
-func visitAssignment(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	assignment := stmt.(*syntax.Assignment)
-	lhsValue := visitExpr(assignment.Lhs, localEnv)
-	if lhsValue.ValueType != backing.Ref {
-		panic("lhs backing in assignment should have a backing type Ref")
+// callFunc calls the function defined by the program in a frame of its own. Calls
+// in tail position the function returns the result of take over the frame in turn
+func (in *Interpreter) callFunc(name string, args []backing.Value) backing.Value {
+	if in.depth > backing.MaxCallDepth {
+		backing.Throw(backing.StackOverflowError, "calls nested deeper than %d", backing.MaxCallDepth)
 	}
-	rhsValue := visitExpr(assignment.Rhs, localEnv)
-	if err := checkAssignmentValidity(lhsValue.AsString(), localEnv); err != nil {
-		panic(err)
-	}
-	backing.Store(lhsValue.AsString(), rhsValue, localEnv, backing.Assign)
-	return backing.Value{}
-}
-
-func visitDefDeclStmt(stmt syntax.Stmt, localEnv backing.ValueEnvironment) backing.Value {
-	var (
-		defDeclStmt = stmt.(*syntax.DefDeclStmt)
-		returnType  = visitExpr(defDeclStmt.ReturnType, localEnv)
-		defValue    = &backing.DefValue{
-			DefDeclStmt: defDeclStmt,
-			ReturnType:  backing.MiniscalaTypeToValueType(returnType.AsString()),
+	in.depth++
+	callerFrame := in.frame
+	res := flow{tailCall: &tailCall{name: name, args: args}}
+	for res.tailCall != nil {
+		defDeclStmt, ok := in.funcs[res.tailCall.name]
+		if !ok {
+			in.abort("no function named %s", res.tailCall.name)
 		}
-		value = backing.Value{
-			ValueType: backing.Function,
+		in.frame = backing.SEmpty()
+		for idx, param := range defDeclStmt.ParamList {
+			in.declare(param.Name.Value, res.tailCall.args[idx])
 		}
-	)
-
-	value.Value = defValue
-
-	// functions reside in global environment exclusively
-	backing.Store(defDeclStmt.Name.Value, value, nil, backing.Declare)
-
-	return backing.Value{}
+		res = in.execBlockStmt(defDeclStmt.Body)
+	}
+	in.frame = callerFrame
+	in.depth--
+	if !res.returned {
+		return backing.Value{ValueType: backing.Unit}
+	}
+	return res.value
 }
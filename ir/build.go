@@ -0,0 +1,806 @@
+package ir
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"strconv"
+	"text/scanner"
+)
+
+// InitName is the name of the function running top-level statements
+const InitName = "<init>"
+
+type (
+	builder struct {
+		info *typecheck.Result
+		// declarations of global variables
+		isGlobal map[syntax.Node]bool
+		prog     *Program
+		err      error
+	}
+
+	// funcBuilder builds a function, putting variables in SSA form the way Braun et al.
+	// describe in "Simple and Efficient Construction of Static Single Assignment Form":
+	// the value a variable holds is looked up backwards from the block reading it,
+	// placing phis where paths meet. A block is sealed once all its predecessors are
+	// known, phis of a block which isn't sealed yet get their arguments upon sealing
+	funcBuilder struct {
+		*builder
+		f    *Func
+		decl *syntax.DefDeclStmt // nil for the init function
+		// block instructions are appended to, nil if the statement being built is unreachable
+		cur *Block
+		// position of the statement being built
+		pos scanner.Position
+		// variables declared by the function, parameters included
+		locals map[syntax.Node]bool
+		// values of variables at the end of blocks, keyed by the variable's declaration
+		defs       map[syntax.Node]map[*Block]*Value
+		sealed     map[*Block]bool
+		incomplete map[*Block][]incompletePhi
+		// instructions using a value, and values trivial phis were replaced with
+		users   map[*Value][]*Value
+		forward map[*Value]*Value
+		// handler of exceptions raised by the statement being built, nil outside of try statements
+		catch *Block
+		// try statements with a finally block enclosing the statement being built, innermost last
+		finallies []finallyScope
+	}
+
+	incompletePhi struct {
+		variable syntax.Node
+		phi      *Value
+	}
+
+	// finallyScope is a try statement a return has to run the finally block of on its way out
+	finallyScope struct {
+		finally *syntax.BlockStmt
+		// handler in effect around the try statement
+		catch *Block
+	}
+)
+
+// Build translates the program checked by the typechecker to the IR. It fails on programs
+// the checker rejects, e.g the ones using values of type Unit or functions referring
+// to variables of enclosing ones, which the IR doesn't represent
+func Build(program *syntax.Program, info *typecheck.Result) (*Program, error) {
+	b := &builder{
+		info:     info,
+		isGlobal: make(map[syntax.Node]bool),
+		prog:     new(Program),
+	}
+	var topLevel []syntax.Stmt
+	for _, stmt := range program.StmtList {
+		switch stmt := stmt.(type) {
+		case *syntax.DefDeclStmt:
+		case *syntax.VarDeclStmt:
+			b.isGlobal[stmt] = true
+			b.prog.Globals = append(b.prog.Globals, Global{Name: stmt.Name.Value, Type: info.VarType(stmt)})
+		case *syntax.ValDeclStmt:
+			b.isGlobal[stmt] = true
+			b.prog.Globals = append(b.prog.Globals, Global{Name: stmt.Name.Value, Type: info.VarType(stmt)})
+		}
+		if _, ok := stmt.(*syntax.DefDeclStmt); !ok {
+			topLevel = append(topLevel, stmt)
+		}
+	}
+	defs := syntax.Defs(program.StmtList)
+
+	if len(topLevel) > 0 {
+		b.prog.Init = b.buildFunc(nil, topLevel)
+	}
+	for _, defDeclStmt := range defs {
+		b.prog.Funcs = append(b.prog.Funcs, b.buildFunc(defDeclStmt, defDeclStmt.Body.Stmts))
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.prog, nil
+}
+
+func (b *builder) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if b.err == nil {
+		b.err = fmt.Errorf("[%d:%d] %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))
+	}
+}
+
+func (b *builder) buildFunc(decl *syntax.DefDeclStmt, stmts []syntax.Stmt) *Func {
+	fb := &funcBuilder{
+		builder:    b,
+		f:          &Func{Name: InitName, ResultType: backing.Unit},
+		decl:       decl,
+		locals:     make(map[syntax.Node]bool),
+		defs:       make(map[syntax.Node]map[*Block]*Value),
+		sealed:     make(map[*Block]bool),
+		incomplete: make(map[*Block][]incompletePhi),
+		users:      make(map[*Value][]*Value),
+		forward:    make(map[*Value]*Value),
+	}
+	fb.cur = fb.newBlock()
+	if decl != nil {
+		fb.f.Name = decl.Name.Value
+		fb.f.ResultType = b.info.TypeOf(decl.ReturnType)
+		fb.pos = decl.Pos()
+		for idx, field := range decl.ParamList {
+			param := fb.f.newValue(field.Pos(), OpParam, b.info.TypeOf(field))
+			param.Aux = field.Name.Value
+			param.AuxInt = int64(idx)
+			fb.f.Params = append(fb.f.Params, param)
+			fb.locals[field] = true
+			fb.write(field, fb.cur, param)
+		}
+	}
+	fb.stmts(stmts)
+	if fb.cur != nil {
+		// falling off the end of a function returns, of a function returning something
+		// it may only happen on a path which is never taken, e.g after while (true)
+		fb.end(BlockReturn, nil)
+	}
+	fb.finish()
+	return fb.f
+}
+
+// newBlock appends a block to the function, blocks are sealed unless told otherwise
+func (fb *funcBuilder) newBlock() *Block {
+	b := fb.f.NewBlock()
+	fb.sealed[b] = true
+	return b
+}
+
+// newOpenBlock appends a block which isn't sealed, as some of its predecessors are yet to come
+func (fb *funcBuilder) newOpenBlock() *Block {
+	b := fb.f.NewBlock()
+	return b
+}
+
+// end makes the current block pass control on the given way and leaves
+// the code which follows unreachable until a block is started
+func (fb *funcBuilder) end(kind BlockKind, control *Value, succs ...*Block) {
+	b := fb.cur
+	b.Kind = kind
+	b.Pos = fb.pos
+	b.SetControl(control)
+	for _, succ := range succs {
+		b.AddEdge(succ)
+	}
+	if kind == BlockThrow && fb.catch != nil {
+		b.SetCatch(fb.catch)
+	}
+	fb.cur = nil
+}
+
+// jump ends the current block, if it's reachable, with a jump to succ
+func (fb *funcBuilder) jump(succ *Block) {
+	if fb.cur != nil {
+		fb.end(BlockPlain, nil, succ)
+	}
+}
+
+// start makes b the current block, unless it's unreachable
+func (fb *funcBuilder) start(b *Block) {
+	fb.cur = nil
+	if len(b.Preds) > 0 {
+		fb.cur = b
+	}
+}
+
+// value appends an instruction to the current block. An instruction which may
+// raise an exception within a try statement ends the block
+func (fb *funcBuilder) value(op Op, valueType backing.ValueType, aux interface{}, args ...*Value) *Value {
+	v := fb.cur.NewValue(fb.pos, op, valueType, args...)
+	v.Aux = aux
+	for _, arg := range args {
+		fb.users[arg] = append(fb.users[arg], v)
+	}
+	if fb.catch != nil && v.MayThrow() {
+		next := fb.newBlock()
+		fb.end(BlockPlain, nil, next)
+		v.Block.SetCatch(fb.catch)
+		fb.cur = next
+	}
+	return v
+}
+
+func (fb *funcBuilder) constant(valueType backing.ValueType, value interface{}) *Value {
+	return fb.value(OpConst, valueType, backing.Value{Value: value, ValueType: valueType})
+}
+
+func (fb *funcBuilder) stmts(stmts []syntax.Stmt) {
+	for _, stmt := range stmts {
+		if fb.cur == nil {
+			// the typechecker warns about unreachable code, there's nothing to build for it
+			return
+		}
+		fb.stmt(stmt)
+	}
+}
+
+func (fb *funcBuilder) stmt(stmt syntax.Stmt) {
+	if _, ok := stmt.(*syntax.BlockStmt); !ok {
+		fb.pos = stmt.Pos()
+	}
+	switch stmt := stmt.(type) {
+	default:
+		fb.expr(stmt)
+	case *syntax.BlockStmt:
+		fb.stmts(stmt.Stmts)
+	case *syntax.DefDeclStmt:
+		// functions are built on their own
+	case *syntax.VarDeclStmt:
+		fb.declare(stmt, fb.expr(stmt.Rhs))
+	case *syntax.ValDeclStmt:
+		fb.declare(stmt, fb.expr(stmt.Rhs))
+	case *syntax.Assignment:
+		value := fb.expr(stmt.Rhs)
+		name := stmt.Lhs.(*syntax.Name)
+		if decl := fb.variable(name); decl != nil {
+			fb.assign(decl, value)
+		}
+	case *syntax.Call:
+		fb.call(stmt)
+	case *syntax.IfStmt:
+		fb.ifStmt(stmt)
+	case *syntax.WhileStmt:
+		fb.whileStmt(stmt)
+	case *syntax.ReturnStmt:
+		fb.returnStmt(stmt)
+	case *syntax.ThrowStmt:
+		fb.end(BlockThrow, fb.expr(stmt.Value))
+	case *syntax.TryStmt:
+		fb.tryStmt(stmt)
+	}
+}
+
+func (fb *funcBuilder) declare(decl syntax.Node, value *Value) {
+	if fb.cur == nil {
+		return
+	}
+	if fb.isGlobal[decl] {
+		fb.assign(decl, value)
+		return
+	}
+	fb.locals[decl] = true
+	fb.write(decl, fb.cur, value)
+}
+
+// assign stores the value in the variable declared by decl
+func (fb *funcBuilder) assign(decl syntax.Node, value *Value) {
+	if fb.cur == nil {
+		return
+	}
+	if fb.isGlobal[decl] {
+		fb.value(OpStoreGlobal, backing.Unit, varName(decl), value)
+		return
+	}
+	fb.write(decl, fb.cur, value)
+}
+
+func (fb *funcBuilder) ifStmt(ifStmt *syntax.IfStmt) {
+	cond := fb.expr(ifStmt.Cond)
+	if fb.cur == nil {
+		return
+	}
+	then, join := fb.newBlock(), fb.newOpenBlock()
+	els := join
+	if ifStmt.ElseBody != nil {
+		els = fb.newBlock()
+	}
+	fb.end(BlockIf, cond, then, els)
+	fb.start(then)
+	fb.stmt(ifStmt.Body)
+	fb.jump(join)
+	if ifStmt.ElseBody != nil {
+		fb.start(els)
+		fb.stmt(ifStmt.ElseBody)
+		fb.jump(join)
+	}
+	fb.seal(join)
+	fb.start(join)
+}
+
+func (fb *funcBuilder) whileStmt(whileStmt *syntax.WhileStmt) {
+	header := fb.newOpenBlock()
+	fb.jump(header)
+	fb.cur = header
+	fb.pos = whileStmt.Pos()
+	cond := fb.expr(whileStmt.Cond)
+	if fb.cur == nil {
+		fb.seal(header)
+		return
+	}
+	body, exit := fb.newBlock(), fb.newBlock()
+	fb.end(BlockIf, cond, body, exit)
+	fb.start(body)
+	fb.stmt(whileStmt.Body)
+	fb.jump(header)
+	fb.seal(header)
+	fb.start(exit)
+}
+
+// returnStmt runs finally blocks of try statements being left on the way out,
+// innermost first, every one of them outside of its own try statement
+func (fb *funcBuilder) returnStmt(returnStmt *syntax.ReturnStmt) {
+	var value *Value
+	if call, ok := returnStmt.Value.(*syntax.Call); ok && fb.info.TypeOf(call) == backing.Unit {
+		// returning the result of a function returning nothing
+		fb.call(call)
+	} else if returnStmt.Value != nil {
+		value = fb.expr(returnStmt.Value)
+	}
+	catch, finallies := fb.catch, fb.finallies
+	for idx := len(finallies) - 1; idx >= 0 && fb.cur != nil; idx-- {
+		// try statements within the finally block mustn't append over the scopes left
+		fb.catch, fb.finallies = finallies[idx].catch, finallies[:idx:idx]
+		fb.stmt(finallies[idx].finally)
+	}
+	if fb.cur != nil {
+		fb.pos = returnStmt.Pos()
+		fb.end(BlockReturn, value)
+	}
+	fb.catch, fb.finallies = catch, finallies
+}
+
+// tryStmt lays out a try statement the way the vm does: the body and each catch case
+// are followed by a copy of the finally block, and yet another copy of it handles
+// exceptions raised by the body or by catch cases, raising them once again when done.
+// Catch cases test the kind of the exception in turn, an exception matched by none
+// of them is raised once again
+func (fb *funcBuilder) tryStmt(tryStmt *syntax.TryStmt) {
+	catch, finallies := fb.catch, fb.finallies
+	join := fb.newOpenBlock()
+	var casesHandler, finallyHandler *Block
+	if tryStmt.Finally != nil {
+		finallyHandler = fb.newOpenBlock()
+		fb.catch = finallyHandler
+		fb.finallies = append(fb.finallies, finallyScope{finally: tryStmt.Finally, catch: catch})
+	}
+	if len(tryStmt.Cases) > 0 {
+		casesHandler = fb.newOpenBlock()
+		fb.catch = casesHandler
+	}
+	// leaving the body or a catch case normally runs the finally block outside of the try
+	leave := func() {
+		if fb.cur == nil {
+			return
+		}
+		if tryStmt.Finally != nil {
+			fb.catch, fb.finallies = catch, finallies
+			fb.stmt(tryStmt.Finally)
+		}
+		fb.jump(join)
+	}
+
+	// the body starts a block of its own, instructions preceding the try statement
+	// aren't covered by its handlers
+	if fb.cur != nil && len(fb.cur.Instrs) > 0 {
+		body := fb.newBlock()
+		fb.jump(body)
+		fb.start(body)
+	}
+	fb.stmt(tryStmt.Body)
+	leave()
+	if casesHandler != nil {
+		fb.seal(casesHandler)
+		fb.start(casesHandler)
+		fb.catch, fb.finallies = catch, finallies
+		if finallyHandler != nil {
+			fb.catch = finallyHandler
+			fb.finallies = append(fb.finallies, finallyScope{finally: tryStmt.Finally, catch: catch})
+		}
+		handlerCatch, handlerFinallies := fb.catch, fb.finallies
+		if fb.cur != nil {
+			fb.pos = tryStmt.Pos()
+			exception := fb.value(OpCatch, backing.Exception, nil)
+			for _, catchClause := range tryStmt.Cases {
+				if fb.cur == nil {
+					break
+				}
+				fb.catch, fb.finallies = handlerCatch, handlerFinallies
+				fb.pos = catchClause.Pos()
+				caseBlock := fb.newBlock()
+				var next *Block
+				if catchClause.Type != nil {
+					kind := fb.value(OpCall, backing.String, "exception_kind", exception)
+					expected := fb.constant(backing.String, catchClause.Type.Value)
+					next = fb.newBlock()
+					fb.end(BlockIf, fb.value(OpEq, backing.Bool, nil, kind, expected), caseBlock, next)
+				} else {
+					fb.end(BlockPlain, nil, caseBlock)
+				}
+				fb.start(caseBlock)
+				fb.locals[catchClause] = true
+				fb.write(catchClause, fb.cur, exception)
+				fb.stmt(catchClause.Body)
+				leave()
+				if next != nil {
+					fb.start(next)
+				}
+			}
+			if fb.cur != nil {
+				// none of the cases matched
+				fb.catch, fb.finallies = handlerCatch, handlerFinallies
+				fb.pos = tryStmt.Pos()
+				fb.end(BlockThrow, exception)
+			}
+		}
+	}
+	if finallyHandler != nil {
+		fb.seal(finallyHandler)
+		fb.start(finallyHandler)
+		fb.catch, fb.finallies = catch, finallies
+		if fb.cur != nil {
+			fb.pos = tryStmt.Finally.Pos()
+			exception := fb.value(OpCatch, backing.Exception, nil)
+			fb.stmt(tryStmt.Finally)
+			if fb.cur != nil {
+				fb.end(BlockThrow, exception)
+			}
+		}
+	}
+	fb.catch, fb.finallies = catch, finallies
+	fb.seal(join)
+	fb.start(join)
+}
+
+// expr appends instructions evaluating the expression, returns the value it evaluates to,
+// nil if the value is of type Unit
+func (fb *funcBuilder) expr(e syntax.Expr) *Value {
+	if fb.cur == nil {
+		return nil
+	}
+	switch e := e.(type) {
+	case *syntax.BasicLit:
+		return fb.basicLit(e)
+	case *syntax.Name:
+		decl := fb.variable(e)
+		if decl == nil {
+			return fb.constant(backing.Null, nil)
+		}
+		if fb.isGlobal[decl] {
+			return fb.value(OpLoadGlobal, fb.info.TypeOf(e), e.Value)
+		}
+		return fb.read(decl, fb.cur)
+	case *syntax.Operation:
+		return fb.operation(e)
+	case *syntax.Call:
+		v := fb.call(e)
+		if v == nil {
+			fb.errorf(e.Pos(), "values of type Unit aren't supported by the IR")
+			return fb.constant(backing.Null, nil)
+		}
+		return v
+	case *syntax.Cast:
+		x := fb.expr(e.X)
+		return fb.value(OpCast, fb.info.TypeOf(e), fb.info.TypeOf(e.Type), x)
+	case *syntax.TypeTest:
+		x := fb.expr(e.X)
+		return fb.value(OpInstanceOf, backing.Bool, fb.info.TypeOf(e.Type), x)
+	}
+	fb.errorf(e.Pos(), "unexpected expression")
+	return fb.constant(backing.Null, nil)
+}
+
+// variable returns the declaration of the variable the name refers to
+func (fb *funcBuilder) variable(name *syntax.Name) syntax.Node {
+	decl, ok := fb.info.Decls[name]
+	switch decl.(type) {
+	case *syntax.VarDeclStmt, *syntax.ValDeclStmt, *syntax.Field, *syntax.CatchClause:
+	default:
+		ok = false
+	}
+	if !ok {
+		fb.errorf(name.Pos(), "%s isn't a variable", name.Value)
+		return nil
+	}
+	if !fb.isGlobal[decl] && !fb.locals[decl] {
+		fb.errorf(name.Pos(), "%s belongs to an enclosing function, which the IR doesn't support", name.Value)
+		return nil
+	}
+	return decl
+}
+
+// varName returns the name of the variable declared by decl
+func varName(decl syntax.Node) string {
+	switch decl := decl.(type) {
+	case *syntax.VarDeclStmt:
+		return decl.Name.Value
+	case *syntax.ValDeclStmt:
+		return decl.Name.Value
+	case *syntax.Field:
+		return decl.Name.Value
+	case *syntax.CatchClause:
+		return decl.Name.Value
+	}
+	return ""
+}
+
+func (fb *funcBuilder) basicLit(basicLit *syntax.BasicLit) *Value {
+	switch basicLit.Kind {
+	case syntax.StringLit:
+		return fb.constant(backing.String, basicLit.Value)
+	case syntax.FloatLit:
+		x, _ := strconv.ParseFloat(basicLit.Value, 64)
+		return fb.constant(backing.Float, x)
+	case syntax.IntLit:
+		x, _ := strconv.ParseInt(basicLit.Value, 10, 64)
+		return fb.constant(backing.Int, x)
+	case syntax.BoolLit:
+		x, _ := strconv.ParseBool(basicLit.Value)
+		return fb.constant(backing.Bool, x)
+	}
+	fb.errorf(basicLit.Pos(), "unexpected literal %s", basicLit.Value)
+	return fb.constant(backing.Null, nil)
+}
+
+var operationOps = map[syntax.Operator]Op{
+	syntax.Plus:               OpAdd,
+	syntax.Minus:              OpSub,
+	syntax.Mul:                OpMul,
+	syntax.Div:                OpDiv,
+	syntax.Mod:                OpMod,
+	syntax.Equal:              OpEq,
+	syntax.NotEqual:           OpNe,
+	syntax.LessThan:           OpLt,
+	syntax.LessThanOrEqual:    OpLe,
+	syntax.GreaterThan:        OpGt,
+	syntax.GreaterThanOrEqual: OpGe,
+	syntax.LogicalAnd:         OpAnd,
+	syntax.LogicalOr:          OpOr,
+}
+
+// operation appends the operation, an Int operand meeting a Float one is promoted first
+func (fb *funcBuilder) operation(operation *syntax.Operation) *Value {
+	resultType := fb.info.TypeOf(operation)
+	x := fb.expr(operation.Lhs)
+	if operation.Rhs == nil {
+		switch operation.Op {
+		case syntax.Minus:
+			return fb.value(OpNeg, resultType, nil, x)
+		case syntax.LogicalNot:
+			return fb.value(OpNot, resultType, nil, x)
+		}
+		fb.errorf(operation.Pos(), "unexpected operator %s", syntax.OperatorToString(operation.Op))
+		return x
+	}
+	y := fb.expr(operation.Rhs)
+	op, ok := operationOps[operation.Op]
+	if !ok {
+		fb.errorf(operation.Pos(), "unexpected operator %s", syntax.OperatorToString(operation.Op))
+		return x
+	}
+	if promoted, ok := backing.PromoteNumeric(x.Type, y.Type); ok && promoted == backing.Float {
+		if x.Type == backing.Int {
+			x = fb.value(OpToFloat, backing.Float, nil, x)
+		}
+		if y.Type == backing.Int {
+			y = fb.value(OpToFloat, backing.Float, nil, y)
+		}
+	}
+	return fb.value(op, resultType, nil, x, y)
+}
+
+// call appends the call, returns its result, which is nil if it's of type Unit
+func (fb *funcBuilder) call(call *syntax.Call) *Value {
+	args := make([]*Value, len(call.ArgList))
+	for idx, arg := range call.ArgList {
+		args[idx] = fb.expr(arg)
+	}
+	if fb.cur == nil {
+		return nil
+	}
+	resultType := fb.info.TypeOf(call)
+	v := fb.value(OpCall, resultType, call.CalleeName.Value, args...)
+	if fb.info.TailCalls[call] {
+		v.AuxInt = 1
+	}
+	if !v.HasResult() {
+		return nil
+	}
+	return v
+}
+
+func (fb *funcBuilder) write(variable syntax.Node, b *Block, v *Value) {
+	defs, ok := fb.defs[variable]
+	if !ok {
+		defs = make(map[*Block]*Value)
+		fb.defs[variable] = defs
+	}
+	defs[b] = v
+}
+
+// read returns the value the variable holds at the end of the block
+func (fb *funcBuilder) read(variable syntax.Node, b *Block) *Value {
+	if v, ok := fb.defs[variable][b]; ok {
+		return fb.resolve(v)
+	}
+	var v *Value
+	switch {
+	case !fb.sealed[b]:
+		v = fb.newPhi(variable, b)
+		fb.incomplete[b] = append(fb.incomplete[b], incompletePhi{variable: variable, phi: v})
+	case len(b.Preds) == 1:
+		v = fb.read(variable, b.Preds[0])
+	default:
+		// the phi breaks cycles of blocks which have no value for the variable
+		v = fb.newPhi(variable, b)
+		fb.write(variable, b, v)
+		v = fb.addPhiArgs(variable, v)
+	}
+	fb.write(variable, b, v)
+	return v
+}
+
+// resolve follows replacements of trivial phis
+func (fb *funcBuilder) resolve(v *Value) *Value {
+	for {
+		replacement, ok := fb.forward[v]
+		if !ok {
+			return v
+		}
+		v = replacement
+	}
+}
+
+func (fb *funcBuilder) newPhi(variable syntax.Node, b *Block) *Value {
+	phi := fb.f.newValue(fb.pos, OpPhi, fb.info.VarType(variable))
+	phi.Block = b
+	phis := 0
+	for phis < len(b.Instrs) && b.Instrs[phis].Op == OpPhi {
+		phis++
+	}
+	b.Instrs = append(b.Instrs, nil)
+	copy(b.Instrs[phis+1:], b.Instrs[phis:])
+	b.Instrs[phis] = phi
+	return phi
+}
+
+func (fb *funcBuilder) addPhiArgs(variable syntax.Node, phi *Value) *Value {
+	for _, pred := range phi.Block.Preds {
+		arg := fb.read(variable, pred)
+		phi.AddArg(arg)
+		fb.users[arg] = append(fb.users[arg], phi)
+	}
+	return fb.removeTrivialPhi(phi)
+}
+
+// removeTrivialPhi replaces the phi with its only argument other than the phi itself,
+// if it has got one, which may make phis using it trivial in turn
+func (fb *funcBuilder) removeTrivialPhi(phi *Value) *Value {
+	var same *Value
+	for _, arg := range phi.Args {
+		if arg == same || arg == phi {
+			continue
+		}
+		if same != nil {
+			return phi
+		}
+		same = arg
+	}
+	if same == nil {
+		// the variable is read where it was never assigned, which the typechecker rules out
+		fb.errorf(phi.Pos, "variable read before it's assigned")
+		return phi
+	}
+	fb.forward[phi] = same
+	var phiUsers []*Value
+	for _, user := range fb.users[phi] {
+		if user == phi {
+			continue
+		}
+		for idx, arg := range user.Args {
+			if arg == phi {
+				user.SetArg(idx, same)
+			}
+		}
+		fb.users[same] = append(fb.users[same], user)
+		if user.Op == OpPhi {
+			phiUsers = append(phiUsers, user)
+		}
+	}
+	delete(fb.users, phi)
+	for _, user := range phiUsers {
+		if _, removed := fb.forward[user]; !removed {
+			fb.removeTrivialPhi(user)
+		}
+	}
+	return same
+}
+
+// seal tells that all predecessors of the block are known,
+// so that phis placed in it so far get their arguments
+func (fb *funcBuilder) seal(b *Block) {
+	for _, incomplete := range fb.incomplete[b] {
+		fb.addPhiArgs(incomplete.variable, incomplete.phi)
+	}
+	delete(fb.incomplete, b)
+	fb.sealed[b] = true
+}
+
+// finish drops trivial phis replaced with other values, resolving references to them,
+// and phis of no use, then orders blocks, leaving out the ones which turned out to be unreachable
+func (fb *funcBuilder) finish() {
+	for _, b := range fb.f.Blocks {
+		if b.Control != nil {
+			b.SetControl(fb.resolve(b.Control))
+		}
+		instrs := b.Instrs[:0]
+		for _, v := range b.Instrs {
+			if _, removed := fb.forward[v]; removed {
+				for idx := range v.Args {
+					v.Args[idx].Uses--
+				}
+				v.Args = nil
+				continue
+			}
+			for idx, arg := range v.Args {
+				if resolved := fb.resolve(arg); resolved != arg {
+					v.SetArg(idx, resolved)
+				}
+			}
+			instrs = append(instrs, v)
+		}
+		b.Instrs = instrs
+	}
+	// phis of variables which are never read once they're assigned are of no use,
+	// neither are the ones only such phis use
+	for dropped := true; dropped; {
+		dropped = false
+		for _, b := range fb.f.Blocks {
+			instrs := b.Instrs[:0]
+			for _, v := range b.Instrs {
+				if v.Op == OpPhi && v.Uses == countArg(v, v) {
+					for idx := range v.Args {
+						v.Args[idx].Uses--
+					}
+					v.Args = nil
+					dropped = true
+					continue
+				}
+				instrs = append(instrs, v)
+			}
+			b.Instrs = instrs
+		}
+	}
+	fb.f.Blocks = reversePostorder(fb.f.Blocks[0])
+	for idx, b := range fb.f.Blocks {
+		b.ID = idx
+	}
+}
+
+// reversePostorder returns blocks reachable from entry, every one of them preceding its
+// successors, back edges of loops aside. Successors come in order, handlers last
+func reversePostorder(entry *Block) []*Block {
+	var postorder []*Block
+	visited := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		visited[b] = true
+		if b.Catch != nil && !visited[b.Catch] {
+			visit(b.Catch)
+		}
+		for idx := len(b.Succs) - 1; idx >= 0; idx-- {
+			if !visited[b.Succs[idx]] {
+				visit(b.Succs[idx])
+			}
+		}
+		postorder = append(postorder, b)
+	}
+	visit(entry)
+	for i, j := 0, len(postorder)-1; i < j; i, j = i+1, j-1 {
+		postorder[i], postorder[j] = postorder[j], postorder[i]
+	}
+	return postorder
+}
+
+// countArg returns how many times arg is an argument of v
+func countArg(v *Value, arg *Value) int {
+	n := 0
+	for _, a := range v.Args {
+		if a == arg {
+			n++
+		}
+	}
+	return n
+}
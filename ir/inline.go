@@ -0,0 +1,205 @@
+package ir
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+)
+
+// inlineBudget is the number of instructions, passing control on included,
+// up to which a function is small enough to be inlined
+const inlineBudget = 24
+
+// Inline substitutes bodies of small functions for calls to them, saving the cost of
+// the calls. Functions calling themselves, directly or through other functions, are
+// left alone, as are calls within try statements, and calls made by inlined bodies
+// aren't inlined in turn. Exceptions keep the positions of the statements raising them
+func (p *Program) Inline() {
+	funcs := make(map[string]*Func)
+	for _, f := range p.Funcs {
+		if _, ok := funcs[f.Name]; ok {
+			// a function of the same name is defined elsewhere, calls may refer to any of them
+			funcs[f.Name] = nil
+			continue
+		}
+		funcs[f.Name] = f
+	}
+	inlinable := make(map[string]bool)
+	for name, f := range funcs {
+		inlinable[name] = f != nil && f.size() <= inlineBudget && len(f.Blocks[0].Preds) == 0 &&
+			f.returns() && !reaches(funcs, f, name, make(map[string]bool))
+	}
+	for _, f := range append([]*Func{p.Init}, p.Funcs...) {
+		if f == nil {
+			continue
+		}
+		// blocks made by inlining are appended, so only the ones there were to begin with are visited,
+		// along with blocks holding instructions which follow calls inlined
+		for _, b := range f.Blocks {
+			for idx := 0; idx < len(b.Instrs); idx++ {
+				v := b.Instrs[idx]
+				if v.Op == OpCall && b.Catch == nil && inlinable[v.Callee()] {
+					// instructions following the call move to a block of their own
+					b = f.inline(b, idx, funcs[v.Callee()])
+					idx = -1
+				}
+			}
+		}
+	}
+}
+
+// size returns the number of instructions of the function, passing control on included
+func (f *Func) size() int {
+	n := 0
+	for _, b := range f.Blocks {
+		n += len(b.Instrs) + 1
+	}
+	return n
+}
+
+// returns reports whether the function returns at all and, if it returns something,
+// whether every return has a value, which paths falling off the end of it lack
+func (f *Func) returns() bool {
+	returns := false
+	for _, b := range f.Blocks {
+		if b.Kind != BlockReturn {
+			continue
+		}
+		if b.Control == nil && f.ResultType != backing.Unit {
+			return false
+		}
+		returns = true
+	}
+	return returns
+}
+
+// reaches reports whether the function calls the one named target, directly or through
+// functions of the program. Functions in visited have been looked into already
+func reaches(funcs map[string]*Func, f *Func, target string, visited map[string]bool) bool {
+	for _, b := range f.Blocks {
+		for _, v := range b.Instrs {
+			if v.Op != OpCall {
+				continue
+			}
+			callee := v.Callee()
+			if callee == target {
+				return true
+			}
+			if g := funcs[callee]; g != nil && !visited[callee] {
+				visited[callee] = true
+				if reaches(funcs, g, target, visited) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// inline substitutes a copy of callee for the call at idx in the block. The block is split
+// after the call, returned blocks of the copy pass control to the block holding instructions
+// which follow the call, which is returned. The value returned replaces the call
+func (f *Func) inline(b *Block, idx int, callee *Func) *Block {
+	call := b.Instrs[idx]
+	rest := f.NewBlock()
+	rest.Kind, rest.Pos = b.Kind, b.Pos
+	rest.SetControl(b.Control)
+	for _, v := range b.Instrs[idx+1:] {
+		v.Block = rest
+	}
+	rest.Instrs = append(rest.Instrs, b.Instrs[idx+1:]...)
+	rest.Succs = b.Succs
+	for _, succ := range rest.Succs {
+		succ.Preds[succ.PredIndex(b)] = rest
+	}
+	b.Instrs = b.Instrs[:idx]
+	b.Kind, b.Pos, b.Succs = BlockPlain, call.Pos, nil
+	b.SetControl(nil)
+
+	values := make(map[*Value]*Value)
+	for idx, param := range callee.Params {
+		values[param] = call.Args[idx]
+	}
+	blocks := make(map[*Block]*Block)
+	for _, cb := range callee.Blocks {
+		nb := f.NewBlock()
+		nb.Kind, nb.Pos = cb.Kind, cb.Pos
+		blocks[cb] = nb
+		for _, cv := range cb.Instrs {
+			nv := f.newValue(cv.Pos, cv.Op, cv.Type)
+			nv.Aux, nv.AuxInt, nv.Block = cv.Aux, cv.AuxInt, nb
+			if cv.TailCall() && !call.TailCall() {
+				// the caller goes on once the copy returns
+				nv.AuxInt = 0
+			}
+			nb.Instrs = append(nb.Instrs, nv)
+			values[cv] = nv
+		}
+	}
+	// arguments are set once every value is copied, as phis refer to values coming later
+	var returns []*Block
+	for _, cb := range callee.Blocks {
+		nb := blocks[cb]
+		for idx, cv := range cb.Instrs {
+			for _, arg := range cv.Args {
+				nb.Instrs[idx].AddArg(values[arg])
+			}
+		}
+		for _, pred := range cb.Preds {
+			nb.Preds = append(nb.Preds, blocks[pred])
+		}
+		for _, succ := range cb.Succs {
+			nb.Succs = append(nb.Succs, blocks[succ])
+		}
+		if cb.Catch != nil {
+			nb.Catch = blocks[cb.Catch]
+		}
+		if cb.Kind == BlockReturn {
+			returns = append(returns, cb)
+			continue
+		}
+		if cb.Control != nil {
+			nb.SetControl(values[cb.Control])
+		}
+	}
+	b.AddEdge(blocks[callee.Blocks[0]])
+	for _, arg := range call.Args {
+		arg.Uses--
+	}
+
+	var results []*Value
+	for _, cb := range returns {
+		nb := blocks[cb]
+		nb.Kind = BlockPlain
+		nb.AddEdge(rest)
+		if cb.Control != nil {
+			results = append(results, values[cb.Control])
+		}
+	}
+	if call.Uses > 0 {
+		result := results[0]
+		if len(results) > 1 {
+			// returned values meet at the block following the call
+			phi := f.newValue(call.Pos, OpPhi, call.Type, results...)
+			phi.Block = rest
+			rest.Instrs = append([]*Value{phi}, rest.Instrs...)
+			result = phi
+		}
+		f.replaceUses(call, result)
+	}
+	return rest
+}
+
+// replaceUses makes arguments and controls referring to old refer to v instead
+func (f *Func) replaceUses(old, v *Value) {
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			for idx, arg := range instr.Args {
+				if arg == old {
+					instr.SetArg(idx, v)
+				}
+			}
+		}
+		if b.Control == old {
+			b.SetControl(v)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ir
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"testing"
+)
+
+// TestInline checks that a function returning from two places is inlined, unlike
+// a recursive one and a call within a try statement
+func TestInline(t *testing.T) {
+	src := `def abs(x: Int): Int {
+    if (x < 0) {
+        return -x
+    }
+    return x
+}
+
+def fac(n: Int): Int {
+    if (n < 2) {
+        return 1
+    }
+    return n * fac(n - 1)
+}
+
+def main(): Unit {
+    val y = abs(-3) + fac(3)
+    try {
+        print(to_string(abs(y)))
+    } catch {
+        case e: ArithmeticException =>
+            print("never")
+    }
+}
+`
+	expected := `def main(): Unit
+b0:
+    v0 = Const <Int> 3
+    v1 = Neg <Int> v0
+    Plain -> b8
+b1: <- b7
+    v6 = Call <Int> abs v5
+    Plain -> b2 catch b3
+b2: <- b1
+    v7 = Call <String> to_string v6
+    Call <Unit> print v7
+    Plain -> b5
+b3: <- b1
+    v9 = Catch <Exception>
+    v10 = Call <String> exception_kind v9
+    v11 = Const <String> "ArithmeticException"
+    v12 = Eq <Bool> v10 v11
+    If v12 -> b4 b6
+b4: <- b3
+    v13 = Const <String> "never"
+    Call <Unit> print v13
+    Plain -> b5
+b5: <- b2 b4
+    Return
+b6: <- b3
+    Throw v9
+b7: <- b9 b10
+    v18 = Phi <Int> v17 v1
+    v3 = Const <Int> 3
+    v4 = Call <Int> fac v3
+    v5 = Add <Int> v18 v4
+    Plain -> b1
+b8: <- b0
+    v15 = Const <Int> 0
+    v16 = Lt <Bool> v1 v15
+    If v16 -> b9 b10
+b9: <- b8
+    v17 = Neg <Int> v1
+    Plain -> b7
+b10: <- b8
+    Plain -> b7
+`
+	program, err := Build(check(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.Inline()
+	var main *Func
+	for _, f := range program.Funcs {
+		if f.Name == "main" {
+			main = f
+		}
+	}
+	if d := diff.Unified("expected", "actual", expected, main.String()); d != "" {
+		t.Error(d)
+	}
+}
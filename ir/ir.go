@@ -0,0 +1,301 @@
+// Package ir is an intermediate representation of programs lying between syntax trees
+// and code of the backends: functions made up of basic blocks of typed three-address
+// instructions in static single assignment form. Build constructs it from a program
+// checked by the typechecker, String dumps it as text.
+//
+// Variables of a function don't exist as such in the IR, every instruction producing
+// a value is a Value of its own, and blocks where values flowing along different
+// paths meet start with phis. Variables declared at the top level of a program, which
+// functions share, are globals accessed by LoadGlobal and StoreGlobal instead.
+//
+// An instruction which may raise an exception within a try statement ends its block,
+// whose Catch is then the block handling the exception. That way, values reaching
+// the handler are the ones variables hold at the time the exception is raised
+package ir
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"text/scanner"
+)
+
+// Op is the operation carried out by an instruction
+type Op uint8
+
+const (
+	OpInvalid Op = iota
+	// Const is the constant Aux, a backing.Value
+	OpConst
+	// Param is the parameter of the function named Aux, numbered AuxInt
+	OpParam
+	// Phi picks the argument matching the predecessor control came from
+	OpPhi
+	// Catch is the exception a handler block is entered with, it starts the block
+	OpCatch
+	// LoadGlobal and StoreGlobal read and write the global variable named Aux
+	OpLoadGlobal
+	OpStoreGlobal
+
+	// arithmetic on operands of the type of the result, Add concatenates Strings as well.
+	// Div and Mod of Ints raise ArithmeticException on division by zero
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpNeg
+
+	// comparisons of operands of the same type
+	OpEq
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+
+	// logical operators evaluate both operands, as the ones of miniscala do
+	OpAnd
+	OpOr
+	OpNot
+
+	// ToFloat promotes an Int operand to Float
+	OpToFloat
+	// Cast raises ClassCastException unless the operand is of type Aux, a backing.ValueType
+	OpCast
+	// InstanceOf tells whether the operand is of type Aux, a backing.ValueType
+	OpInstanceOf
+	// Call calls the function named Aux, a runtime function or one of the program.
+	// AuxInt is 1 if the call is in tail position, see TailCall
+	OpCall
+)
+
+var opNames = [...]string{
+	OpInvalid:     "Invalid",
+	OpConst:       "Const",
+	OpParam:       "Param",
+	OpPhi:         "Phi",
+	OpCatch:       "Catch",
+	OpLoadGlobal:  "LoadGlobal",
+	OpStoreGlobal: "StoreGlobal",
+	OpAdd:         "Add",
+	OpSub:         "Sub",
+	OpMul:         "Mul",
+	OpDiv:         "Div",
+	OpMod:         "Mod",
+	OpNeg:         "Neg",
+	OpEq:          "Eq",
+	OpNe:          "Ne",
+	OpLt:          "Lt",
+	OpLe:          "Le",
+	OpGt:          "Gt",
+	OpGe:          "Ge",
+	OpAnd:         "And",
+	OpOr:          "Or",
+	OpNot:         "Not",
+	OpToFloat:     "ToFloat",
+	OpCast:        "Cast",
+	OpInstanceOf:  "InstanceOf",
+	OpCall:        "Call",
+}
+
+func (op Op) String() string {
+	if int(op) >= len(opNames) {
+		return "Unknown"
+	}
+	return opNames[op]
+}
+
+// BlockKind tells how a block passes control on once its instructions are done
+type BlockKind uint8
+
+const (
+	// BlockPlain goes on to its only successor
+	BlockPlain BlockKind = iota
+	// BlockIf goes on to Succs[0] if Control is true and to Succs[1] otherwise
+	BlockIf
+	// BlockReturn returns Control from the function, or nothing if it's nil
+	BlockReturn
+	// BlockThrow raises Control, an exception
+	BlockThrow
+)
+
+type (
+	// Program is a whole program in the IR
+	Program struct {
+		// Funcs are the functions of the program, nested ones included, in order of definition
+		Funcs []*Func
+		// Init runs top-level statements other than definitions of functions,
+		// it's nil if there are none
+		Init *Func
+		// Globals are the global variables, in order of declaration
+		Globals []Global
+	}
+
+	// Global is a variable declared at the top level of a program
+	Global struct {
+		Name string
+		Type backing.ValueType
+	}
+
+	Func struct {
+		Name       string
+		Params     []*Value
+		ResultType backing.ValueType
+		// Blocks holds blocks in the order they were made, the first one is the entry
+		Blocks []*Block
+		// counters numbering values and blocks
+		values, blocks int
+	}
+
+	Block struct {
+		ID   int
+		Kind BlockKind
+		// Instrs are the instructions of the block in order of execution, phis come first
+		Instrs  []*Value
+		Control *Value
+		Preds   []*Block
+		Succs   []*Block
+		// Catch is where an exception raised by the block is handled within the function,
+		// nil if it propagates to the caller. Only the last instruction, or a throw, may raise it
+		Catch *Block
+		// Pos is the position of the statement passing control on
+		Pos  scanner.Position
+		Func *Func
+	}
+
+	// Value is an instruction, along with the value it produces, if any
+	Value struct {
+		ID   int
+		Op   Op
+		Type backing.ValueType
+		Args []*Value
+		// Aux and AuxInt are operands which aren't values, their meaning depends on Op
+		Aux    interface{}
+		AuxInt int64
+		Block  *Block
+		// Pos is the position of the statement the instruction comes from
+		Pos scanner.Position
+		// Uses counts arguments and controls referring to the value
+		Uses int
+	}
+)
+
+// HasResult reports whether the instruction produces a value
+func (v *Value) HasResult() bool {
+	return v.Type != backing.Unit
+}
+
+// MayThrow reports whether the instruction may raise an exception
+func (v *Value) MayThrow() bool {
+	switch v.Op {
+	case OpDiv, OpMod:
+		return v.Type == backing.Int
+	case OpEq, OpNe, OpLt, OpLe, OpGt, OpGe:
+		switch operandType := v.Args[0].Type; operandType {
+		case backing.Int, backing.Float, backing.String:
+			return false
+		case backing.Bool:
+			return v.Op != OpEq && v.Op != OpNe
+		}
+		return true
+	case OpCast:
+		castType := v.Aux.(backing.ValueType)
+		return castType != backing.Any && castType != v.Args[0].Type
+	case OpCall:
+		// runtime functions which never throw, the rest of them check their arguments
+		switch v.Callee() {
+		case "print", "to_string", "toFloat", "array_size", "exception_new", "exception_kind", "exception_message":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// TailCall reports whether the instruction is a call in tail position,
+// see typecheck.Result.TailCalls. Nothing but returning the value of such
+// a call, if any, follows it, so that the callee may return in place of the caller
+func (v *Value) TailCall() bool {
+	return v.Op == OpCall && v.AuxInt == 1
+}
+
+// Callee returns the name of the function an OpCall calls
+func (v *Value) Callee() string {
+	return v.Aux.(string)
+}
+
+// NewValue appends an instruction to the block and returns it
+func (b *Block) NewValue(pos scanner.Position, op Op, valueType backing.ValueType, args ...*Value) *Value {
+	v := b.Func.newValue(pos, op, valueType, args...)
+	v.Block = b
+	b.Instrs = append(b.Instrs, v)
+	return v
+}
+
+// SetControl makes v the control value of the block, see BlockKind
+func (b *Block) SetControl(v *Value) {
+	if b.Control != nil {
+		b.Control.Uses--
+	}
+	b.Control = v
+	if v != nil {
+		v.Uses++
+	}
+}
+
+// AddEdge makes succ a successor of the block
+func (b *Block) AddEdge(succ *Block) {
+	b.Succs = append(b.Succs, succ)
+	succ.Preds = append(succ.Preds, b)
+}
+
+// SetCatch makes handler the block handling exceptions raised by the block
+func (b *Block) SetCatch(handler *Block) {
+	b.Catch = handler
+	handler.Preds = append(handler.Preds, b)
+}
+
+// PredIndex returns the index of the predecessor among Preds of the block,
+// which is the index of the argument phis of the block take from it
+func (b *Block) PredIndex(pred *Block) int {
+	for idx, p := range b.Preds {
+		if p == pred {
+			return idx
+		}
+	}
+	return -1
+}
+
+// NewBlock appends an empty block to the function
+func (f *Func) NewBlock() *Block {
+	b := &Block{ID: f.blocks, Func: f}
+	f.blocks++
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// NumValues returns a number greater than IDs of all the values of the function
+func (f *Func) NumValues() int {
+	return f.values
+}
+
+func (f *Func) newValue(pos scanner.Position, op Op, valueType backing.ValueType, args ...*Value) *Value {
+	v := &Value{ID: f.values, Op: op, Type: valueType, Pos: pos}
+	f.values++
+	for _, arg := range args {
+		v.AddArg(arg)
+	}
+	return v
+}
+
+// AddArg appends an argument to the instruction
+func (v *Value) AddArg(arg *Value) {
+	v.Args = append(v.Args, arg)
+	arg.Uses++
+}
+
+// SetArg replaces the argument at idx
+func (v *Value) SetArg(idx int, arg *Value) {
+	v.Args[idx].Uses--
+	v.Args[idx] = arg
+	arg.Uses++
+}
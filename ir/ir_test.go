@@ -0,0 +1,131 @@
+package ir
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"strings"
+	"testing"
+)
+
+// TestBuild checks the dump of a program with a loop, a try statement and a global
+func TestBuild(t *testing.T) {
+	src := `var calls = 0
+
+def count(n: Int): Int {
+    var sum = 0
+    var i = 0
+    while (i < n) {
+        try {
+            sum = sum + 10 / i
+        } catch {
+            case e: ArithmeticException =>
+                sum = -1
+        }
+        i = i + 1
+    }
+    calls = calls + 1
+    return sum
+}
+`
+	expected := `global calls: Int
+
+def <init>(): Unit
+b0:
+    v0 = Const <Int> 0
+    StoreGlobal <Unit> calls v0
+    Return
+
+def count(v0 n: Int): Int
+b0:
+    v1 = Const <Int> 0
+    v2 = Const <Int> 0
+    Plain -> b1
+b1: <- b0 b6
+    v3 = Phi <Int> v2 v18
+    v6 = Phi <Int> v1 v20
+    v5 = Lt <Bool> v3 v0
+    If v5 -> b2 b8
+b2: <- b1
+    v7 = Const <Int> 10
+    v8 = Div <Int> v7 v3
+    Plain -> b3 catch b4
+b3: <- b2
+    v9 = Add <Int> v6 v8
+    Plain -> b6
+b4: <- b2
+    v10 = Catch <Exception>
+    v11 = Call <String> exception_kind v10
+    v12 = Const <String> "ArithmeticException"
+    v13 = Eq <Bool> v11 v12
+    If v13 -> b5 b7
+b5: <- b4
+    v14 = Const <Int> 1
+    v15 = Neg <Int> v14
+    Plain -> b6
+b6: <- b3 b5
+    v20 = Phi <Int> v9 v15
+    v17 = Const <Int> 1
+    v18 = Add <Int> v3 v17
+    Plain -> b1
+b7: <- b4
+    Throw v10
+b8: <- b1
+    v21 = LoadGlobal <Int> calls
+    v22 = Const <Int> 1
+    v23 = Add <Int> v21 v22
+    StoreGlobal <Unit> calls v23
+    Return v6
+`
+	program, err := Build(check(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Unified("expected", "actual", expected, program.String()); d != "" {
+		t.Error(d)
+	}
+}
+
+// TestBuildChecked checks that programs coming close to what the checker rejects, calls of
+// functions returning Unit and functions referring to variables declared outside of them,
+// are translated to the IR
+func TestBuildChecked(t *testing.T) {
+	src := `val limit = 3
+
+def log(s: String): Unit {
+    return print(s)
+}
+
+def f(x: Int): Int {
+    def g(y: Int): Int {
+        val z = y * 2
+        return z + limit
+    }
+    log(to_string(x))
+    return g(x)
+}
+
+if (limit > 0) {
+    val local = limit
+    def h(): Int {
+        return limit + 1
+    }
+    log(to_string(local + h()))
+}
+`
+	if _, err := Build(check(t, src)); err != nil {
+		t.Error(err)
+	}
+}
+
+func check(t *testing.T, src string) (*syntax.Program, *typecheck.Result) {
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(src))
+	if len(syntaxErrors) > 0 {
+		t.Fatalf("syntax errors: %v", syntaxErrors)
+	}
+	info := typecheck.NewChecker().Check(program)
+	if info.HadErrors() {
+		t.Fatalf("type errors: %v", info.Errors)
+	}
+	return program, info
+}
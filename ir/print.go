@@ -0,0 +1,135 @@
+package ir
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"io"
+	"strings"
+)
+
+// String dumps the program: globals, the function running top-level statements
+// under the name <init>, then the rest of functions
+func (p *Program) String() string {
+	var b strings.Builder
+	p.Fprint(&b)
+	return b.String()
+}
+
+// Fprint writes the dump of the program to w
+func (p *Program) Fprint(w io.Writer) {
+	for _, global := range p.Globals {
+		fmt.Fprintf(w, "global %s: %s\n", global.Name, backing.ValueTypeToStr(global.Type))
+	}
+	first := len(p.Globals) == 0
+	for _, f := range append([]*Func{p.Init}, p.Funcs...) {
+		if f == nil {
+			continue
+		}
+		if !first {
+			fmt.Fprintln(w)
+		}
+		first = false
+		f.Fprint(w)
+	}
+}
+
+func (f *Func) String() string {
+	var b strings.Builder
+	f.Fprint(&b)
+	return b.String()
+}
+
+// Fprint writes the dump of the function to w. It starts with the signature, followed by
+// blocks, every one of them listing its predecessors, its instructions and where it
+// passes control to, e.g
+//
+//	def fac(v0 x: Int): Int
+//	b0:
+//	    v1 = Const <Int> 1
+//	    v2 = Eq <Bool> v0 v1
+//	    If v2 -> b1 b2
+func (f *Func) Fprint(w io.Writer) {
+	params := make([]string, len(f.Params))
+	for idx, param := range f.Params {
+		params[idx] = fmt.Sprintf("%s %s: %s", param, param.Aux, backing.ValueTypeToStr(param.Type))
+	}
+	fmt.Fprintf(w, "def %s(%s): %s\n", f.Name, strings.Join(params, ", "), backing.ValueTypeToStr(f.ResultType))
+	for _, b := range f.Blocks {
+		fmt.Fprintf(w, "%s:", b)
+		if len(b.Preds) > 0 {
+			fmt.Fprint(w, " <-")
+			for _, pred := range b.Preds {
+				fmt.Fprintf(w, " %s", pred)
+			}
+		}
+		fmt.Fprintln(w)
+		for _, v := range b.Instrs {
+			fmt.Fprintf(w, "    %s\n", v.LongString())
+		}
+		fmt.Fprintf(w, "    %s\n", b.LongString())
+	}
+}
+
+func (b *Block) String() string {
+	return fmt.Sprintf("b%d", b.ID)
+}
+
+// LongString renders the way the block passes control on
+func (b *Block) LongString() string {
+	var s string
+	switch b.Kind {
+	case BlockPlain:
+		s = "Plain"
+	case BlockIf:
+		s = "If " + b.Control.String()
+	case BlockReturn:
+		s = "Return"
+		if b.Control != nil {
+			s += " " + b.Control.String()
+		}
+	case BlockThrow:
+		s = "Throw " + b.Control.String()
+	}
+	if len(b.Succs) > 0 {
+		s += " ->"
+		for _, succ := range b.Succs {
+			s += " " + succ.String()
+		}
+	}
+	if b.Catch != nil {
+		s += " catch " + b.Catch.String()
+	}
+	return s
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+// LongString renders the instruction, e.g 'v3 = Add <Int> v1 v2'
+func (v *Value) LongString() string {
+	var b strings.Builder
+	if v.HasResult() {
+		fmt.Fprintf(&b, "%s = ", v)
+	}
+	fmt.Fprintf(&b, "%s <%s>", v.Op, backing.ValueTypeToStr(v.Type))
+	switch aux := v.Aux.(type) {
+	case backing.Value:
+		if aux.ValueType == backing.String {
+			fmt.Fprintf(&b, " %q", aux.AsString())
+		} else {
+			fmt.Fprintf(&b, " %v", aux.Value)
+		}
+	case backing.ValueType:
+		fmt.Fprintf(&b, " %s", backing.ValueTypeToStr(aux))
+	case string:
+		fmt.Fprintf(&b, " %s", aux)
+	}
+	for _, arg := range v.Args {
+		fmt.Fprintf(&b, " %s", arg)
+	}
+	if v.TailCall() {
+		b.WriteString(" (tail)")
+	}
+	return b.String()
+}
@@ -0,0 +1,123 @@
+package ir
+
+// LoopTailCalls turns calls functions make to themselves in tail position into jumps
+// back to their start, which leaves recursion of the kind free of the limit on nesting
+// of calls, as the vm and the interpreter have it. Parameters give way to phis picking
+// either the arguments of the function or the ones of the call jumping back. Functions
+// sharing a name with another one are left alone, as calls may refer to any of them
+func (p *Program) LoopTailCalls() {
+	names := make(map[string]int)
+	for _, f := range p.Funcs {
+		names[f.Name]++
+	}
+	for _, f := range p.Funcs {
+		if names[f.Name] == 1 {
+			f.loopTailCalls()
+		}
+	}
+}
+
+// selfTailCall returns the call to the function the block returns the result of, nil
+// if there's none. A call whose result is left unused ends a function returning nothing,
+// which may go on through empty blocks to the one returning
+func (b *Block) selfTailCall() *Value {
+	if b.Catch != nil || len(b.Instrs) == 0 {
+		return nil
+	}
+	call := b.Instrs[len(b.Instrs)-1]
+	if call.Op != OpCall || !call.TailCall() || call.Callee() != b.Func.Name {
+		return nil
+	}
+	switch {
+	case b.Kind == BlockReturn && b.Control == call:
+		return call
+	case b.Kind == BlockReturn && b.Control == nil && call.Uses == 0:
+		return call
+	case b.Kind == BlockPlain && call.Uses == 0 && returnsNothing(b.Succs[0]):
+		return call
+	}
+	return nil
+}
+
+// returnsNothing reports whether the block returns without a value,
+// or passes control on to such a block, doing nothing on the way
+func returnsNothing(b *Block) bool {
+	for steps := 0; steps < len(b.Func.Blocks); steps++ {
+		if len(b.Instrs) > 0 {
+			return false
+		}
+		switch b.Kind {
+		case BlockReturn:
+			return b.Control == nil
+		case BlockPlain:
+			b = b.Succs[0]
+		default:
+			return false
+		}
+	}
+	// empty blocks going round in circles
+	return false
+}
+
+// unlink removes the edge from pred to succ. A block left without predecessors is removed
+// in turn, which only happens to empty blocks, the ones returnsNothing goes through
+func (f *Func) unlink(pred, succ *Block) {
+	succ.Preds = append(succ.Preds[:succ.PredIndex(pred)], succ.Preds[succ.PredIndex(pred)+1:]...)
+	if len(succ.Preds) > 0 {
+		return
+	}
+	for _, next := range succ.Succs {
+		f.unlink(succ, next)
+	}
+	for idx, b := range f.Blocks {
+		if b == succ {
+			f.Blocks = append(f.Blocks[:idx], f.Blocks[idx+1:]...)
+			break
+		}
+	}
+}
+
+func (f *Func) loopTailCalls() {
+	var tails []*Block
+	for _, b := range f.Blocks {
+		if b.selfTailCall() != nil {
+			tails = append(tails, b)
+		}
+	}
+	if len(tails) == 0 {
+		return
+	}
+
+	// the function starts with a block of its own, jumping to the former entry,
+	// so that the entry has a predecessor to take the parameters from
+	entry := f.Blocks[0]
+	start := f.NewBlock()
+	start.Kind, start.Pos = BlockPlain, entry.Pos
+	f.Blocks = append([]*Block{start}, f.Blocks[:len(f.Blocks)-1]...)
+	start.AddEdge(entry)
+	phis := make([]*Value, len(f.Params))
+	for idx, param := range f.Params {
+		phi := f.newValue(param.Pos, OpPhi, param.Type)
+		phi.Block = entry
+		f.replaceUses(param, phi)
+		phi.AddArg(param)
+		phis[idx] = phi
+	}
+	entry.Instrs = append(phis, entry.Instrs...)
+
+	for _, b := range tails {
+		call := b.Instrs[len(b.Instrs)-1]
+		b.Instrs = b.Instrs[:len(b.Instrs)-1]
+		for idx, arg := range call.Args {
+			phis[idx].AddArg(arg)
+			arg.Uses--
+		}
+		if b.Kind == BlockPlain {
+			f.unlink(b, b.Succs[0])
+			b.Succs = nil
+		}
+		b.Kind = BlockPlain
+		b.SetControl(nil)
+		b.AddEdge(entry)
+	}
+}
@@ -0,0 +1,92 @@
+package ir
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"testing"
+)
+
+// TestLoopTailCalls checks that functions calling themselves in tail position jump back
+// to their start instead, whether they return the result of the call or nothing, and that
+// calls to other functions in tail position stay
+func TestLoopTailCalls(t *testing.T) {
+	src := `def sum(n: Int, acc: Int): Int {
+    if (n == 0) {
+        return acc
+    }
+    return sum(n - 1, acc + n)
+}
+
+def countdown(n: Int): Unit {
+    if (n > 0) {
+        print(to_string(n))
+        countdown(n - 1)
+    } else {
+        print("liftoff")
+    }
+}
+
+def main(): Unit {
+    print(to_string(sum(10, 0)))
+    countdown(10)
+}
+`
+	expected := `def sum(v0 n: Int, v1 acc: Int): Int
+b3:
+    Plain -> b0
+b0: <- b3 b2
+    v8 = Phi <Int> v0 v5
+    v9 = Phi <Int> v1 v6
+    v2 = Const <Int> 0
+    v3 = Eq <Bool> v8 v2
+    If v3 -> b1 b2
+b1: <- b0
+    Return v9
+b2: <- b0
+    v4 = Const <Int> 1
+    v5 = Sub <Int> v8 v4
+    v6 = Add <Int> v9 v8
+    Plain -> b0
+def countdown(v0 n: Int): Unit
+b4:
+    Plain -> b0
+b0: <- b4 b1
+    v10 = Phi <Int> v0 v6
+    v1 = Const <Int> 0
+    v2 = Gt <Bool> v10 v1
+    If v2 -> b1 b2
+b1: <- b0
+    v3 = Call <String> to_string v10
+    Call <Unit> print v3
+    v5 = Const <Int> 1
+    v6 = Sub <Int> v10 v5
+    Plain -> b0
+b2: <- b0
+    v8 = Const <String> "liftoff"
+    Call <Unit> print v8
+    Plain -> b3
+b3: <- b2
+    Return
+def main(): Unit
+b0:
+    v0 = Const <Int> 10
+    v1 = Const <Int> 0
+    v2 = Call <Int> sum v0 v1
+    v3 = Call <String> to_string v2
+    Call <Unit> print v3
+    v5 = Const <Int> 10
+    Call <Unit> countdown v5 (tail)
+    Return
+`
+	program, err := Build(check(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.LoopTailCalls()
+	var actual string
+	for _, f := range program.Funcs {
+		actual += f.String()
+	}
+	if d := diff.Unified("expected", "actual", expected, actual); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,409 @@
+package lsp
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"sort"
+	"strings"
+	"text/scanner"
+	"unicode/utf16"
+)
+
+// document is the latest text of a file opened by the client
+type document struct {
+	uri   string
+	lines []string
+	// diagnostics found in the latest text
+	diagnostics []Diagnostic
+	// program, result and visible come from the latest text free of syntax errors,
+	// so that navigation keeps working while the user is in the middle of typing
+	program *syntax.Program
+	result  *typecheck.Result
+	// names visible at the top level, runtime functions included
+	visible map[string]*backing.EnvEntry
+	// lines of the text program was parsed from
+	programLines []string
+}
+
+// update parses and typechecks the text, collecting diagnostics
+func (d *document) update(text string) {
+	d.lines = strings.Split(text, "\n")
+	d.diagnostics = []Diagnostic{}
+
+	program, syntaxErrors, crash := parse(text)
+	if crash != "" {
+		d.diagnostics = append(d.diagnostics, Diagnostic{
+			Range:    Range{},
+			Severity: severityError,
+			Source:   "miniscala",
+			Message:  crash,
+		})
+		return
+	}
+	for _, err := range syntaxErrors {
+		d.diagnostics = append(d.diagnostics, d.diagnostic(err.Pos, err.Msg, severityError))
+	}
+	if len(syntaxErrors) > 0 {
+		return
+	}
+
+	checker := typecheck.NewChecker()
+	result, crash := check(checker, program)
+	if crash != "" {
+		d.diagnostics = append(d.diagnostics, Diagnostic{
+			Range:    Range{},
+			Severity: severityError,
+			Source:   "miniscala",
+			Message:  crash,
+		})
+		return
+	}
+	for _, err := range result.Errors {
+		d.diagnostics = append(d.diagnostics, d.diagnostic(err.Pos, err.Msg, severityError))
+	}
+	for _, warning := range result.Warnings {
+		d.diagnostics = append(d.diagnostics, d.diagnostic(warning.Pos, warning.Msg, severityWarning))
+	}
+	d.program = program
+	d.result = result
+	d.visible = checker.Visible()
+	d.programLines = d.lines
+}
+
+// parse parses text, turning a panic of the parser into a message
+func parse(text string) (program *syntax.Program, errors []syntax.Error, crash string) {
+	defer func() {
+		if r := recover(); r != nil {
+			crash = fmt.Sprintf("parser crashed: %v", r)
+		}
+	}()
+	program, errors = syntax.ParseErrors(strings.NewReader(text))
+	return program, errors, ""
+}
+
+// check typechecks program, turning a panic of the checker into a message
+func check(checker *typecheck.Checker, program *syntax.Program) (result *typecheck.Result, crash string) {
+	defer func() {
+		if r := recover(); r != nil {
+			crash = fmt.Sprintf("typechecker crashed: %v", r)
+		}
+	}()
+	return checker.Check(program), ""
+}
+
+// diagnostic spans the word starting at pos, or a single character if there's no word
+func (d *document) diagnostic(pos scanner.Position, msg string, severity int) Diagnostic {
+	start := toPosition(d.lines, pos)
+	end := start
+	if start.Line < len(d.lines) {
+		line := []rune(d.lines[start.Line])
+		col := pos.Column - 1
+		for col < len(line) && isWordChar(line[col]) {
+			col++
+		}
+		if col == pos.Column-1 && col < len(line) {
+			// not a word, e.g a brace, which is worth highlighting anyway
+			col++
+		}
+		end.Character = utf16Len(line[:min(col, len(line))])
+	}
+	return Diagnostic{
+		Range:    Range{Start: start, End: end},
+		Severity: severity,
+		Source:   "miniscala",
+		Message:  msg,
+	}
+}
+
+func (d *document) hover(pos Position) *hover {
+	name := d.nameAt(pos)
+	if name == nil {
+		return nil
+	}
+	var text string
+	if decl, ok := d.result.Decls[name]; ok {
+		text = d.describe(decl)
+	} else if entry := backing.RuntimeFuncEntry(name.Value); entry != nil {
+		text = funcSignature(name.Value, entry)
+	} else if valueType := d.result.TypeOf(name); valueType != backing.Undefined {
+		text = "type " + backing.ValueTypeToStr(valueType)
+	}
+	if text == "" {
+		return nil
+	}
+	return &hover{
+		Contents: markupContent{Kind: "plaintext", Value: text},
+		Range:    d.nameRange(name),
+	}
+}
+
+func (d *document) definition(pos Position) *Location {
+	name := d.nameAt(pos)
+	if name == nil {
+		return nil
+	}
+	decl, ok := d.result.Decls[name]
+	if !ok {
+		return nil
+	}
+	return &Location{
+		URI:   d.uri,
+		Range: d.nameRange(declName(decl)),
+	}
+}
+
+// completion returns names visible at pos: runtime functions, names declared at the
+// top level and those declared by enclosing functions and blocks before pos
+func (d *document) completion(pos Position) []completionItem {
+	items := make(map[string]completionItem)
+	for name, entry := range d.visible {
+		if entry.Decl != nil {
+			items[name] = d.completionItem(name, entry.Decl)
+			continue
+		}
+		items[name] = completionItem{
+			Label:  name,
+			Kind:   completionKindFunction,
+			Detail: funcSignature(name, entry),
+		}
+	}
+	if d.program != nil {
+		at := fromPosition(d.programLines, pos)
+		for _, decl := range localsAt(d.program.StmtList, at) {
+			name := declName(decl)
+			items[name.Value] = d.completionItem(name.Value, decl)
+		}
+	}
+
+	var res []completionItem
+	for _, item := range items {
+		res = append(res, item)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Label < res[j].Label
+	})
+	return res
+}
+
+func (d *document) completionItem(name string, decl syntax.Node) completionItem {
+	kind := completionKindVariable
+	if _, ok := decl.(*syntax.DefDeclStmt); ok {
+		kind = completionKindFunction
+	}
+	return completionItem{
+		Label:  name,
+		Kind:   kind,
+		Detail: d.describe(decl),
+	}
+}
+
+// nameAt returns the name found at pos in the last analyzed program
+func (d *document) nameAt(pos Position) *syntax.Name {
+	if d.program == nil {
+		return nil
+	}
+	at := fromPosition(d.programLines, pos)
+	var res *syntax.Name
+	syntax.Inspect(d.program, func(node syntax.Node) bool {
+		if res != nil {
+			return false
+		}
+		name, ok := node.(*syntax.Name)
+		if !ok {
+			return true
+		}
+		start := name.Pos()
+		if start.Line == at.Line && start.Column <= at.Column && at.Column <= start.Column+len([]rune(name.Value)) {
+			res = name
+		}
+		return true
+	})
+	return res
+}
+
+func (d *document) nameRange(name *syntax.Name) Range {
+	start := toPosition(d.programLines, name.Pos())
+	end := start
+	end.Character += utf16Len([]rune(name.Value))
+	return Range{Start: start, End: end}
+}
+
+// describe renders the declaration as it would be written, e.g "val x: Int"
+func (d *document) describe(decl syntax.Node) string {
+	switch decl.(type) {
+	case *syntax.DefDeclStmt:
+		defDeclStmt := decl.(*syntax.DefDeclStmt)
+		var params []string
+		for _, param := range defDeclStmt.ParamList {
+			params = append(params, d.describe(param))
+		}
+		return fmt.Sprintf("def %s(%s): %s",
+			defDeclStmt.Name.Value,
+			strings.Join(params, ", "),
+			d.typeName(defDeclStmt.ReturnType))
+	case *syntax.ValDeclStmt:
+		valDeclStmt := decl.(*syntax.ValDeclStmt)
+		return "val " + valDeclStmt.Name.Value + ": " + d.declaredType(valDeclStmt.Type, valDeclStmt.Rhs)
+	case *syntax.VarDeclStmt:
+		varDeclStmt := decl.(*syntax.VarDeclStmt)
+		return "var " + varDeclStmt.Name.Value + ": " + d.declaredType(varDeclStmt.Type, varDeclStmt.Rhs)
+	case *syntax.Field:
+		field := decl.(*syntax.Field)
+		return field.Name.Value + ": " + d.typeName(field)
+	case *syntax.CatchClause:
+		return decl.(*syntax.CatchClause).Name.Value + ": " + backing.ValueTypeToStr(backing.Exception)
+	}
+	return ""
+}
+
+// declaredType is the type stated by typeExpr, or else the one inferred from rhs
+func (d *document) declaredType(typeExpr syntax.Expr, rhs syntax.Expr) string {
+	if typeExpr != nil {
+		return d.typeName(typeExpr)
+	}
+	return d.typeName(rhs)
+}
+
+func (d *document) typeName(expr syntax.Expr) string {
+	return backing.ValueTypeToStr(d.result.TypeOf(expr))
+}
+
+func funcSignature(name string, entry *backing.EnvEntry) string {
+	var params []string
+	for _, paramType := range entry.ParamTypes {
+		params = append(params, backing.ValueTypeToStr(paramType))
+	}
+	return fmt.Sprintf("def %s(%s): %s", name, strings.Join(params, ", "), backing.ValueTypeToStr(entry.ResultType))
+}
+
+// declName returns the name introduced by decl
+func declName(decl syntax.Node) *syntax.Name {
+	switch decl.(type) {
+	case *syntax.DefDeclStmt:
+		return decl.(*syntax.DefDeclStmt).Name
+	case *syntax.ValDeclStmt:
+		return &decl.(*syntax.ValDeclStmt).Name
+	case *syntax.VarDeclStmt:
+		return &decl.(*syntax.VarDeclStmt).Name
+	case *syntax.Field:
+		return decl.(*syntax.Field).Name
+	case *syntax.CatchClause:
+		return decl.(*syntax.CatchClause).Name
+	}
+	return nil
+}
+
+// localsAt returns declarations among stmts, or nested into them, which are in scope at pos,
+// outer ones first, so that inner ones shadow them
+func localsAt(stmts []syntax.Stmt, pos scanner.Position) []syntax.Node {
+	var res []syntax.Node
+	for _, stmt := range stmts {
+		if before(pos, stmt.Pos()) {
+			break
+		}
+		switch stmt.(type) {
+		case *syntax.ValDeclStmt, *syntax.VarDeclStmt:
+			res = append(res, stmt)
+		case *syntax.DefDeclStmt:
+			defDeclStmt := stmt.(*syntax.DefDeclStmt)
+			if defDeclStmt.Body == nil || before(defDeclStmt.Body.End, pos) {
+				continue
+			}
+			for _, param := range defDeclStmt.ParamList {
+				res = append(res, param)
+			}
+			res = append(res, localsAt(defDeclStmt.Body.Stmts, pos)...)
+		case *syntax.BlockStmt:
+			res = append(res, blockLocalsAt(stmt.(*syntax.BlockStmt), pos)...)
+		case *syntax.WhileStmt:
+			res = append(res, blockLocalsAt(stmt.(*syntax.WhileStmt).Body, pos)...)
+		case *syntax.IfStmt:
+			ifStmt := stmt.(*syntax.IfStmt)
+			res = append(res, blockLocalsAt(ifStmt.Body, pos)...)
+			if ifStmt.ElseBody != nil {
+				res = append(res, localsAt([]syntax.Stmt{ifStmt.ElseBody}, pos)...)
+			}
+		case *syntax.TryStmt:
+			tryStmt := stmt.(*syntax.TryStmt)
+			res = append(res, blockLocalsAt(tryStmt.Body, pos)...)
+			for _, catchClause := range tryStmt.Cases {
+				if catchClause.Name == nil || catchClause.Body == nil ||
+					before(pos, catchClause.Pos()) || before(catchClause.Body.End, pos) {
+					continue
+				}
+				res = append(res, catchClause)
+				res = append(res, localsAt(catchClause.Body.Stmts, pos)...)
+			}
+			res = append(res, blockLocalsAt(tryStmt.Finally, pos)...)
+		}
+	}
+	return res
+}
+
+// blockLocalsAt returns declarations of the block in scope at pos, none if pos is outside of it
+func blockLocalsAt(block *syntax.BlockStmt, pos scanner.Position) []syntax.Node {
+	if block == nil || before(pos, block.Pos()) || before(block.End, pos) {
+		return nil
+	}
+	return localsAt(block.Stmts, pos)
+}
+
+// before reports whether a precedes b
+func before(a, b scanner.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// toPosition converts pos, whose line and column are 1-based and the latter counts
+// characters, into the zero-based position counting UTF-16 code units
+func toPosition(lines []string, pos scanner.Position) Position {
+	res := Position{Line: max(pos.Line-1, 0), Character: max(pos.Column-1, 0)}
+	if res.Line < len(lines) {
+		line := []rune(lines[res.Line])
+		res.Character = utf16Len(line[:min(res.Character, len(line))])
+	}
+	return res
+}
+
+// fromPosition is the inverse of toPosition
+func fromPosition(lines []string, pos Position) scanner.Position {
+	res := scanner.Position{Line: pos.Line + 1, Column: pos.Character + 1}
+	if pos.Line < len(lines) {
+		line := []rune(lines[pos.Line])
+		units := 0
+		for idx, r := range line {
+			if units >= pos.Character {
+				res.Column = idx + 1
+				return res
+			}
+			units += len(utf16.Encode([]rune{r}))
+		}
+		res.Column = len(line) + 1
+	}
+	return res
+}
+
+func utf16Len(runes []rune) int {
+	return len(utf16.Encode(runes))
+}
+
+// isWordChar reports whether r can be part of an identifier or a literal
+func isWordChar(r rune) bool {
+	return r == '_' || r == '$' || r == '-' ||
+		'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r > 0x7f
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
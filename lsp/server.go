@@ -0,0 +1,249 @@
+// Package lsp implements a Language Server Protocol server for miniscala, talking
+// JSON-RPC over a pair of streams, usually stdin and stdout of the server process
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Server keeps documents opened by the client, along with results of their analysis
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+	// keyed by document URI
+	docs map[string]*document
+	// whether the client asked to shut down, which makes exiting a success
+	shutdown bool
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	s := new(Server)
+	s.in = bufio.NewReader(in)
+	s.out = out
+	s.docs = make(map[string]*document)
+	return s
+}
+
+// Serve handles messages until the client sends exit or closes the connection.
+// It returns nil only if the client asked the server to shut down beforehand
+func (s *Server) Serve() error {
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return errors.New("connection closed without shutdown")
+		}
+		var rpcErr *responseError
+		if errors.As(err, &rpcErr) {
+			// the id of a message which can't be parsed is unknown, so the response has a null one
+			s.write(errorResponse{JSONRPC: "2.0", Error: *rpcErr})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		if msg.ID == nil {
+			// past shutdown, only exit matters
+			if !s.shutdown {
+				s.handleNotification(msg)
+			}
+			continue
+		}
+		if s.shutdown {
+			s.write(errorResponse{JSONRPC: "2.0", ID: msg.ID, Error: responseError{
+				Code:    codeInvalidRequest,
+				Message: fmt.Sprintf("%s after shutdown", msg.Method),
+			}})
+			continue
+		}
+		result, err := s.handleRequest(msg)
+		if err != nil {
+			code := codeInternalError
+			var rpcErr *responseError
+			if errors.As(err, &rpcErr) {
+				code = rpcErr.Code
+			}
+			s.write(errorResponse{JSONRPC: "2.0", ID: msg.ID, Error: responseError{Code: code, Message: err.Error()}})
+			continue
+		}
+		s.write(response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+	}
+}
+
+func (e *responseError) Error() string {
+	return e.Message
+}
+
+func (s *Server) handleRequest(msg *message) (interface{}, error) {
+	switch msg.Method {
+	case "initialize":
+		return initializeResult{
+			Capabilities: serverCapabilities{
+				TextDocumentSync:   textDocumentSyncFull,
+				HoverProvider:      true,
+				DefinitionProvider: true,
+				CompletionProvider: completionOptions{TriggerCharacters: []string{}},
+			},
+			ServerInfo: serverInfo{Name: "miniscala"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			if h := doc.hover(params.Position); h != nil {
+				return h, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			if location := doc.definition(params.Position); location != nil {
+				return location, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		items := []completionItem{}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			items = doc.completion(params.Position)
+		}
+		return items, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %s is not supported", msg.Method)}
+}
+
+// handleNotification handles a message which expects no response, unknown ones are ignored
+func (s *Server) handleNotification(msg *message) {
+	switch msg.Method {
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if unmarshalParams(msg, &params) != nil {
+			return
+		}
+		s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if unmarshalParams(msg, &params) != nil || len(params.ContentChanges) == 0 {
+			return
+		}
+		// with full sync, the last change holds the whole text
+		s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if unmarshalParams(msg, &params) != nil {
+			return
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.publishDiagnostics(params.TextDocument.URI, []Diagnostic{})
+	}
+}
+
+// update analyzes the new text of the document and publishes diagnostics found
+func (s *Server) update(uri, text string) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		doc = &document{uri: uri}
+		s.docs[uri] = doc
+	}
+	doc.update(text)
+	s.publishDiagnostics(uri, doc.diagnostics)
+}
+
+func (s *Server) publishDiagnostics(uri string, diagnostics []Diagnostic) {
+	s.write(notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params: publishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: diagnostics,
+		},
+	})
+}
+
+func unmarshalParams(msg *message, params interface{}) error {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// read reads a single message, which is preceded by headers, one of them
+// being Content-Length, followed by an empty line. A message which isn't JSON, or
+// whose headers are malformed, is reported as *responseError with codeParseError.
+// In the latter case, where the message ends is unknown, so the input is skipped
+// up to the headers of the next one
+func (s *Server) read() (*message, error) {
+	headers, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, s.skipMessage(fmt.Sprintf("bad headers: %v", err))
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(headers.Get("Content-Length")))
+	if err != nil || length < 0 {
+		return nil, s.skipMessage(fmt.Sprintf("bad Content-Length header %q", headers.Get("Content-Length")))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	msg := new(message)
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, &responseError{Code: codeParseError, Message: err.Error()}
+	}
+	return msg, nil
+}
+
+// skipMessage discards the input up to the next Content-Length header
+// and returns a parse error with the given message
+func (s *Server) skipMessage(msg string) error {
+	header := []byte("Content-Length:")
+	for {
+		next, err := s.in.Peek(len(header))
+		if err != nil {
+			// there's no next message, the connection is going to be found closed
+			s.in.Discard(len(next))
+			break
+		}
+		if bytes.Equal(next, header) {
+			break
+		}
+		s.in.Discard(1)
+	}
+	return &responseError{Code: codeParseError, Message: msg}
+}
+
+func (s *Server) write(msg interface{}) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
@@ -0,0 +1,345 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const uri = "file:///test.miniscala"
+
+const src = `val limit = 10
+
+def clamp(n: Int): Int {
+    val bound = limit
+    if (n > bound) {
+        return bound
+    }
+    return n
+}
+
+def main(): Unit {
+    print(to_string(clamp(42)))
+}
+`
+
+// reply is a message the server sends, either a response or a notification
+type reply struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func request(id int, method string, params interface{}) interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notify(method string, params interface{}) interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func didOpen(text string) interface{} {
+	return notify("textDocument/didOpen", didOpenParams{
+		TextDocument: textDocumentItem{URI: uri, Version: 1, Text: text},
+	})
+}
+
+func at(line, character int) textDocumentPositionParams {
+	return textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: uri},
+		Position:     Position{Line: line, Character: character},
+	}
+}
+
+// frame writes messages to in, each preceded by its headers
+func frame(t *testing.T, in *bytes.Buffer, msgs ...interface{}) {
+	t.Helper()
+	for _, msg := range msgs {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+}
+
+// serve has the server handle messages, followed by shutdown and exit, and returns what
+// it replies, leaving out the response to shutdown
+func serve(t *testing.T, msgs ...interface{}) []reply {
+	t.Helper()
+	var in bytes.Buffer
+	frame(t, &in, msgs...)
+	return serveInput(t, &in)
+}
+
+// serveInput is serve taking messages already framed in in
+func serveInput(t *testing.T, in *bytes.Buffer) []reply {
+	t.Helper()
+	var out bytes.Buffer
+	frame(t, in, request(-1, "shutdown", nil), notify("exit", nil))
+	if err := NewServer(in, &out).Serve(); err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	var replies []reply
+	r := bufio.NewReader(&out)
+	for {
+		headers, err := textproto.NewReader(r).ReadMIMEHeader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := strconv.Atoi(headers.Get("Content-Length"))
+		if err != nil {
+			t.Fatalf("bad Content-Length header: %v", err)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		var msg reply
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		if msg.ID == nil || *msg.ID != -1 {
+			replies = append(replies, msg)
+		}
+	}
+	return replies
+}
+
+// result decodes the result of the response to the request with the given id
+func result(t *testing.T, replies []reply, id int, v interface{}) {
+	t.Helper()
+	for _, msg := range replies {
+		if msg.ID == nil || *msg.ID != id {
+			continue
+		}
+		if msg.Error != nil {
+			t.Fatalf("request %d failed: %s", id, msg.Error.Message)
+		}
+		if err := json.Unmarshal(msg.Result, v); err != nil {
+			t.Fatalf("%v: %s", err, msg.Result)
+		}
+		return
+	}
+	t.Fatalf("no response to request %d", id)
+}
+
+// diagnostics returns the diagnostics published last
+func diagnostics(t *testing.T, replies []reply) []Diagnostic {
+	t.Helper()
+	var params *publishDiagnosticsParams
+	for _, msg := range replies {
+		if msg.Method == "textDocument/publishDiagnostics" {
+			params = new(publishDiagnosticsParams)
+			if err := json.Unmarshal(msg.Params, params); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if params == nil {
+		t.Fatal("no diagnostics published")
+	}
+	if params.URI != uri {
+		t.Errorf("diagnostics published for %s, expected %s", params.URI, uri)
+	}
+	return params.Diagnostics
+}
+
+// TestInitialize checks that the server announces what it provides
+func TestInitialize(t *testing.T) {
+	replies := serve(t, request(1, "initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}))
+	var res initializeResult
+	result(t, replies, 1, &res)
+	expected := serverCapabilities{
+		TextDocumentSync:   textDocumentSyncFull,
+		HoverProvider:      true,
+		DefinitionProvider: true,
+		CompletionProvider: completionOptions{TriggerCharacters: []string{}},
+	}
+	if !reflect.DeepEqual(res.Capabilities, expected) {
+		t.Errorf("capabilities %+v, expected %+v", res.Capabilities, expected)
+	}
+	if res.ServerInfo.Name != "miniscala" {
+		t.Errorf("server name %q, expected miniscala", res.ServerInfo.Name)
+	}
+}
+
+// TestDiagnostics checks what is published on opening a valid document, one with a syntax
+// error and one with a type error
+func TestDiagnostics(t *testing.T) {
+	if d := diagnostics(t, serve(t, didOpen(src))); len(d) != 0 {
+		t.Errorf("unexpected diagnostics for a valid document: %+v", d)
+	}
+
+	broken := "def main(): Unit {\n    val x = (1 + \n}\n"
+	d := diagnostics(t, serve(t, didOpen(broken)))
+	if len(d) == 0 {
+		t.Fatal("no diagnostics for a document with a syntax error")
+	}
+	if d[0].Severity != severityError || d[0].Source != "miniscala" || d[0].Message == "" {
+		t.Errorf("unexpected diagnostic %+v", d[0])
+	}
+	if d[0].Range.Start.Line != 2 {
+		t.Errorf("diagnostic on line %d, expected the closing brace on line 2: %+v", d[0].Range.Start.Line, d[0])
+	}
+
+	illTyped := "def main(): Unit {\n    val x: Int = \"one\"\n    print(to_string(x))\n}\n"
+	expected := []Diagnostic{{
+		Range:    Range{Start: Position{Line: 1, Character: 11}, End: Position{Line: 1, Character: 14}},
+		Severity: severityError,
+		Source:   "miniscala",
+		Message:  "x is declared as Int, but initialized with String",
+	}}
+	if d := diagnostics(t, serve(t, didOpen(illTyped))); !reflect.DeepEqual(d, expected) {
+		t.Errorf("diagnostics %+v, expected %+v", d, expected)
+	}
+}
+
+// TestHover checks hovering over a variable, a function, a runtime function and a keyword
+func TestHover(t *testing.T) {
+	replies := serve(t,
+		didOpen(src),
+		request(1, "textDocument/hover", at(5, 16)),  // bound in return bound
+		request(2, "textDocument/hover", at(11, 20)), // clamp in the call
+		request(3, "textDocument/hover", at(11, 6)),  // print
+		request(4, "textDocument/hover", at(0, 0)),   // val
+	)
+	for id, expected := range map[int]hover{
+		1: {Contents: markupContent{Kind: "plaintext", Value: "val bound: Int"}, Range: Range{Start: Position{5, 15}, End: Position{5, 20}}},
+		2: {Contents: markupContent{Kind: "plaintext", Value: "def clamp(n: Int): Int"}, Range: Range{Start: Position{11, 20}, End: Position{11, 25}}},
+		3: {Contents: markupContent{Kind: "plaintext", Value: "def print(String): Unit"}, Range: Range{Start: Position{11, 4}, End: Position{11, 9}}},
+	} {
+		var h hover
+		result(t, replies, id, &h)
+		if h != expected {
+			t.Errorf("hover %d: %+v, expected %+v", id, h, expected)
+		}
+	}
+	var h *hover
+	result(t, replies, 4, &h)
+	if h != nil {
+		t.Errorf("hover over a keyword: %+v, expected none", h)
+	}
+}
+
+// TestDefinition checks going to declarations of a function, a global, a parameter and
+// a runtime function, which has none
+func TestDefinition(t *testing.T) {
+	replies := serve(t,
+		didOpen(src),
+		request(1, "textDocument/definition", at(11, 22)), // clamp in the call
+		request(2, "textDocument/definition", at(3, 18)),  // limit in clamp
+		request(3, "textDocument/definition", at(4, 8)),   // n in the condition
+		request(4, "textDocument/definition", at(11, 6)),  // print, which has no declaration
+	)
+	for id, expected := range map[int]Range{
+		1: {Start: Position{2, 4}, End: Position{2, 9}},
+		2: {Start: Position{0, 4}, End: Position{0, 9}},
+		3: {Start: Position{2, 10}, End: Position{2, 11}},
+	} {
+		var location Location
+		result(t, replies, id, &location)
+		if location.URI != uri || location.Range != expected {
+			t.Errorf("definition %d: %+v, expected %v in %s", id, location, expected, uri)
+		}
+	}
+	var location *Location
+	result(t, replies, 4, &location)
+	if location != nil {
+		t.Errorf("definition of a runtime function: %+v, expected none", location)
+	}
+}
+
+// TestCompletion checks that names in scope are offered, locals of other functions aside
+func TestCompletion(t *testing.T) {
+	replies := serve(t,
+		didOpen(src),
+		request(1, "textDocument/completion", at(5, 8)),  // within the if of clamp
+		request(2, "textDocument/completion", at(11, 4)), // within main
+	)
+	var inClamp, inMain []completionItem
+	result(t, replies, 1, &inClamp)
+	result(t, replies, 2, &inMain)
+	labels := func(items []completionItem) map[string]completionItem {
+		res := make(map[string]completionItem)
+		for _, item := range items {
+			res[item.Label] = item
+		}
+		return res
+	}
+	expected := []completionItem{
+		{Label: "bound", Kind: completionKindVariable, Detail: "val bound: Int"},
+		{Label: "n", Kind: completionKindVariable, Detail: "n: Int"},
+		{Label: "limit", Kind: completionKindVariable, Detail: "val limit: Int"},
+		{Label: "clamp", Kind: completionKindFunction, Detail: "def clamp(n: Int): Int"},
+		{Label: "print", Kind: completionKindFunction, Detail: "def print(String): Unit"},
+	}
+	items := labels(inClamp)
+	for _, item := range expected {
+		if items[item.Label] != item {
+			t.Errorf("completion within clamp: %+v, expected %+v", items[item.Label], item)
+		}
+	}
+	items = labels(inMain)
+	for _, label := range []string{"bound", "n"} {
+		if _, ok := items[label]; ok {
+			t.Errorf("completion within main offers %s, a local of clamp", label)
+		}
+	}
+	if _, ok := items["main"]; !ok {
+		t.Error("completion within main doesn't offer main")
+	}
+}
+
+// TestMalformedMessages checks that the server responds to a message which isn't JSON, or
+// whose Content-Length is wrong, with a parse error and goes on serving the messages following
+func TestMalformedMessages(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("Content-Length: 6\r\n\r\n{oops}")
+	// the body of a message without a length can't be told from whatever follows
+	in.WriteString("Content-Length: many\r\n\r\n" + `{"jsonrpc":"2.0","id":2,"method":"shutdown"}`)
+	in.WriteString("Content-Length: -2\r\n\r\n{}")
+	frame(t, &in, request(1, "initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}))
+	replies := serveInput(t, &in)
+
+	if len(replies) != 4 {
+		t.Fatalf("%d replies, expected 3 parse errors and a response: %+v", len(replies), replies)
+	}
+	for _, msg := range replies[:3] {
+		if msg.ID != nil || msg.Error == nil || msg.Error.Code != codeParseError {
+			t.Errorf("reply %+v, expected a parse error without id", msg)
+		}
+	}
+	var res initializeResult
+	result(t, replies, 1, &res)
+}
+
+// TestAfterShutdown checks that requests following shutdown are invalid
+// and notifications are ignored
+func TestAfterShutdown(t *testing.T) {
+	var in bytes.Buffer
+	frame(t, &in, request(1, "shutdown", nil), request(2, "textDocument/hover", at(0, 0)), didOpen(src))
+	replies := serveInput(t, &in)
+
+	if len(replies) != 2 {
+		t.Fatalf("%d replies, expected responses to shutdown and hover: %+v", len(replies), replies)
+	}
+	if msg := replies[0]; msg.ID == nil || *msg.ID != 1 || msg.Error != nil || string(msg.Result) != "null" {
+		t.Errorf("reply %+v, expected a null result of shutdown", msg)
+	}
+	if msg := replies[1]; msg.ID == nil || *msg.ID != 2 || msg.Error == nil || msg.Error.Code != codeInvalidRequest {
+		t.Errorf("reply %+v, expected hover to be an invalid request", msg)
+	}
+}
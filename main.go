@@ -2,22 +2,239 @@ package main
 
 import "C"
 import (
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/interpreter"
+	"github.com/ThreadedStream/miniscala/ir"
+	"github.com/ThreadedStream/miniscala/lsp"
+	"github.com/ThreadedStream/miniscala/optimize"
+	"github.com/ThreadedStream/miniscala/repl"
 	"github.com/ThreadedStream/miniscala/syntax"
 	"github.com/ThreadedStream/miniscala/typecheck"
 	"github.com/ThreadedStream/miniscala/vm"
+	"io"
+	"os"
 )
 
+const usage = `usage: miniscala <command> [arguments]
+
+commands:
+  run [--backend=vm|tree|ir] [-O] <file>
+                typecheck the program and run its main function, either
+                on the bytecode vm, on the tree-walking interpreter or
+                on the vm running bytecode generated from the SSA IR,
+                optimizing it first with -O, which has the vm run
+                bytecode generated from the IR too, with small
+                functions inlined
+  ir [-O] <file>
+                show the SSA intermediate representation of the program,
+                optimized with small functions inlined with -O
+  disasm [-O] [-d] <file>
+                show the bytecode of the program, optimized with -O,
+                or the diff of the bytecode before and after with -d
+  build [-o file] [-cc compiler] [-backend c|asm|wasm] [-S] <file>
+                compile the program to C, or to x86-64 assembly, and
+                that to an executable with the system C compiler, or
+                to a WebAssembly module
+  gen-go [-o file] [-package name] <file>
+                translate the program to a Go package, which depends
+                on github.com/ThreadedStream/miniscala/gogen/rt only
+  repl          start an interactive session
+  fmt [-w] [-d] [path ...]
+                format source files
+  test [-v] [-run regexp] [-junit file] [path ...]
+                run test functions of *_test.miniscala files
+  lsp           serve the Language Server Protocol over stdin and stdout
+`
+
 func main() {
-	path := "sources/sort.miniscala"
-	program, hadErrors := syntax.Parse(path)
-	if hadErrors {
-		return
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	case "run":
+		os.Exit(runCmd(os.Args[2:]))
+	case "build":
+		os.Exit(buildCmd(os.Args[2:]))
+	case "gen-go":
+		os.Exit(genGoCmd(os.Args[2:]))
+	case "ir":
+		os.Exit(irCmd(os.Args[2:]))
+	case "disasm":
+		os.Exit(disasmCmd(os.Args[2:]))
+	case "repl":
+		repl.Run(os.Stdin, os.Stdout)
+	case "fmt":
+		os.Exit(formatCmd(os.Args[2:]))
+	case "test":
+		os.Exit(testCmd(os.Args[2:]))
+	case "lsp":
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runCmd implements 'miniscala run', returns the exit code
+func runCmd(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	backendName := flags.String("backend", "vm", "backend executing the program, vm, tree or ir")
+	optimized := flags.Bool("O", false, "fold constants and drop unreachable code before running the program, on the vm inline small functions as well")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala run [--backend=vm|tree|ir] [-O] <file>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*backendName != "vm" && *backendName != "tree" && *backendName != "ir") {
+		flags.Usage()
+		return 2
+	}
+	return runFile(flags.Arg(0), *backendName, *optimized)
+}
+
+// runFile runs the program stored at path, returns the exit code
+func runFile(path string, backendName string, optimized bool) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	hadErrors = typecheck.Typecheck(program)
+	defer file.Close()
+	return runSource(path, file, backendName, optimized, os.Stdout, os.Stderr)
+}
+
+// backend executes a program checked by the typechecker
+type backend interface {
+	SetOutput(out io.Writer)
+	Run() error
+}
+
+// newBackend returns the backend with the given name, ir stands for the vm running
+// bytecode generated from the IR
+func newBackend(name string, program *syntax.Program, info *typecheck.Result, optimized bool) (backend, error) {
+	switch name {
+	case "tree":
+		return interpreter.New(program, info), nil
+	case "ir":
+		return newVM(program, info, true, optimized)
+	}
+	return newVM(program, info, optimized, optimized)
+}
+
+// newVM compiles the program to bytecode for the vm, either straight from the syntax tree
+// or through the IR, with small functions inlined into it if asked to
+func newVM(program *syntax.Program, info *typecheck.Result, viaIR, inline bool) (*vm.VM, error) {
+	if !viaIR {
+		return vm.NewVM(program, info), nil
+	}
+	irProgram, err := ir.Build(program, info)
+	if err != nil {
+		return nil, err
+	}
+	if inline {
+		irProgram.Inline()
+	}
+	return vm.NewVMFromIR(irProgram, "main"), nil
+}
+
+// runSource runs the program read from src, which is named path in messages, on the backend
+// with the given name, having it optimized first if asked to. The program prints to stdout,
+// while diagnostics go to stderr. It returns the exit code
+func runSource(path string, src io.Reader, backendName string, optimized bool, stdout, stderr io.Writer) int {
+	program, result, ok := loadProgram(path, src, stderr)
+	if !ok {
+		return 1
+	}
+	if optimized {
+		optimize.Program(program, result)
+	}
+	executor, err := newBackend(backendName, program, result, optimized)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	executor.SetOutput(stdout)
+	if err := executor.Run(); err != nil {
+		exception := err.(*backing.ExceptionValue)
+		fmt.Fprintf(stderr, "[%d:%d] exception in main: %v\n", exception.Pos.Line, exception.Pos.Column, exception)
+		return 1
+	}
+	return 0
+}
+
+// irCmd implements 'miniscala ir', returns the exit code
+func irCmd(args []string) int {
+	flags := flag.NewFlagSet("ir", flag.ContinueOnError)
+	optimized := flags.Bool("O", false, "optimize the program and inline small functions")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala ir [-O] <file>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	program, result, ok := loadProgram(flags.Arg(0), file, os.Stderr)
+	if !ok {
+		return 1
+	}
+	if *optimized {
+		optimize.Program(program, result)
+	}
+	irProgram, err := ir.Build(program, result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *optimized {
+		irProgram.Inline()
+	}
+	irProgram.Fprint(os.Stdout)
+	return 0
+}
+
+// loadProgram parses and typechecks the program read from src, which is named path in messages,
+// and makes sure it has a main function. Diagnostics go to stderr, ok is false if there were errors
+func loadProgram(path string, src io.Reader, stderr io.Writer) (program *syntax.Program, result *typecheck.Result, ok bool) {
+	program, hadErrors := syntax.ParseSource(src, stderr)
 	if hadErrors {
-		return
+		return nil, nil, false
+	}
+	result = typecheck.NewChecker().Check(program)
+	result.Report(stderr)
+	if result.HadErrors() {
+		return nil, nil, false
 	}
 
-	vmHandle := vm.NewVM(program)
-	vmHandle.Run()
+	if !hasMain(program) {
+		fmt.Fprintf(stderr, "%s: no main function, test files are run with 'miniscala test'\n", path)
+		return nil, nil, false
+	}
+	return program, result, true
+}
+
+func hasMain(program *syntax.Program) bool {
+	for _, stmt := range program.StmtList {
+		if defDeclStmt, ok := stmt.(*syntax.DefDeclStmt); ok && defDeclStmt.Name.Value == "main" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,254 @@
+// Package optimize simplifies syntax trees checked by the typechecker before they're
+// compiled: operations on literals are folded into literals, if and while statements
+// with a constant condition give way to the branch taken, and statements control never
+// reaches are dropped. The program behaves the same, exceptions and their positions included
+package optimize
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+type optimizer struct {
+	info *typecheck.Result
+}
+
+// Program optimizes the program in place. Types of literals it makes up are recorded
+// in info, so that the program is compiled with info as if it had been checked as is
+func Program(program *syntax.Program, info *typecheck.Result) {
+	o := &optimizer{info: info}
+	// top-level statements declare globals functions refer to, so the ones following
+	// a throw are kept
+	var stmts []syntax.Stmt
+	for _, stmt := range program.StmtList {
+		if stmt = o.stmt(stmt); stmt != nil {
+			stmts = append(stmts, stmt)
+		}
+	}
+	program.StmtList = stmts
+}
+
+// stmts optimizes statements of a block, dropping the ones following a statement
+// which never lets control through. Functions are kept, as calls may precede them
+func (o *optimizer) stmts(stmts []syntax.Stmt) []syntax.Stmt {
+	var res []syntax.Stmt
+	terminated := false
+	for _, stmt := range stmts {
+		if terminated {
+			if _, ok := stmt.(*syntax.DefDeclStmt); ok {
+				res = append(res, o.stmt(stmt))
+			}
+			continue
+		}
+		stmt = o.stmt(stmt)
+		if stmt == nil {
+			continue
+		}
+		res = append(res, stmt)
+		terminated = typecheck.Terminates(stmt)
+	}
+	return res
+}
+
+// stmt returns the optimized statement, nil if there's nothing left of it
+func (o *optimizer) stmt(stmt syntax.Stmt) syntax.Stmt {
+	switch stmt := stmt.(type) {
+	default:
+		return o.expr(stmt)
+	case *syntax.BlockStmt:
+		o.block(stmt)
+	case *syntax.DefDeclStmt:
+		o.block(stmt.Body)
+	case *syntax.VarDeclStmt:
+		stmt.Rhs = o.expr(stmt.Rhs)
+	case *syntax.ValDeclStmt:
+		stmt.Rhs = o.expr(stmt.Rhs)
+	case *syntax.Assignment:
+		stmt.Rhs = o.expr(stmt.Rhs)
+	case *syntax.ReturnStmt:
+		if stmt.Value != nil {
+			stmt.Value = o.expr(stmt.Value)
+		}
+	case *syntax.ThrowStmt:
+		stmt.Value = o.expr(stmt.Value)
+	case *syntax.IfStmt:
+		return o.ifStmt(stmt)
+	case *syntax.WhileStmt:
+		stmt.Cond = o.expr(stmt.Cond)
+		if cond, ok := boolLit(stmt.Cond); ok && !cond {
+			return nil
+		}
+		o.block(stmt.Body)
+	case *syntax.TryStmt:
+		o.block(stmt.Body)
+		for _, catchClause := range stmt.Cases {
+			o.block(catchClause.Body)
+		}
+		if stmt.Finally != nil {
+			o.block(stmt.Finally)
+		}
+	}
+	return stmt
+}
+
+func (o *optimizer) block(blockStmt *syntax.BlockStmt) {
+	blockStmt.Stmts = o.stmts(blockStmt.Stmts)
+}
+
+// ifStmt replaces an if statement with a constant condition with the branch taken,
+// which is a block of its own, so that its declarations stay local to it
+func (o *optimizer) ifStmt(ifStmt *syntax.IfStmt) syntax.Stmt {
+	ifStmt.Cond = o.expr(ifStmt.Cond)
+	cond, ok := boolLit(ifStmt.Cond)
+	switch {
+	case ok && cond:
+		return o.stmt(ifStmt.Body)
+	case ok && ifStmt.ElseBody == nil:
+		return nil
+	case ok:
+		return o.stmt(ifStmt.ElseBody)
+	}
+	o.block(ifStmt.Body)
+	if ifStmt.ElseBody != nil {
+		// nil if it's an if statement with a false condition and no else branch
+		ifStmt.ElseBody = o.stmt(ifStmt.ElseBody)
+	}
+	return ifStmt
+}
+
+// expr returns the optimized expression
+func (o *optimizer) expr(e syntax.Expr) syntax.Expr {
+	switch e := e.(type) {
+	case *syntax.Operation:
+		e.Lhs = o.expr(e.Lhs)
+		if e.Rhs != nil {
+			e.Rhs = o.expr(e.Rhs)
+		}
+		if lit := o.fold(e); lit != nil {
+			return lit
+		}
+	case *syntax.Call:
+		for idx, arg := range e.ArgList {
+			e.ArgList[idx] = o.expr(arg)
+		}
+	case *syntax.Cast:
+		e.X = o.expr(e.X)
+	case *syntax.TypeTest:
+		e.X = o.expr(e.X)
+	}
+	return e
+}
+
+// fold returns the literal the operation evaluates to, nil unless its operands
+// are literals or if evaluating it raises an exception, e.g on division by zero
+func (o *optimizer) fold(operation *syntax.Operation) (lit *syntax.BasicLit) {
+	lhs, ok := operation.Lhs.(*syntax.BasicLit)
+	if !ok {
+		return nil
+	}
+	var rhs *syntax.BasicLit
+	if operation.Rhs != nil {
+		if rhs, ok = operation.Rhs.(*syntax.BasicLit); !ok {
+			return nil
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*backing.ExceptionValue); !ok {
+				panic(r)
+			}
+			// the exception is left to be raised at run time
+			lit = nil
+		}
+	}()
+	value := evalOperation(operation.Op, litValue(lhs), rhs)
+	valueType := o.info.TypeOf(operation)
+	if value.ValueType != valueType {
+		return nil
+	}
+	lit = newLit(value, operation.Pos())
+	o.info.Types[lit] = valueType
+	return lit
+}
+
+// evalOperation evaluates the operation the way the interpreter does, rhs is nil for unary ones
+func evalOperation(op syntax.Operator, x backing.Value, rhs *syntax.BasicLit) backing.Value {
+	if rhs == nil {
+		switch op {
+		case syntax.Minus:
+			return backing.Mul(x, backing.Value{Value: int64(-1), ValueType: backing.Int}, nil, backing.Vm)
+		case syntax.LogicalNot:
+			return backing.Value{Value: !x.AsBool(), ValueType: backing.Bool}
+		}
+		return backing.Value{ValueType: backing.Undefined}
+	}
+	y := litValue(rhs)
+	switch op {
+	case syntax.Plus:
+		return backing.Add(x, y, nil, backing.Vm)
+	case syntax.Minus:
+		return backing.Sub(x, y, nil, backing.Vm)
+	case syntax.Mul:
+		return backing.Mul(x, y, nil, backing.Vm)
+	case syntax.Div:
+		return backing.Div(x, y, nil, backing.Vm)
+	case syntax.Mod:
+		return backing.Mod(x, y, nil, backing.Vm)
+	case syntax.GreaterThan, syntax.GreaterThanOrEqual, syntax.LessThan, syntax.LessThanOrEqual,
+		syntax.Equal, syntax.NotEqual:
+		return backing.Compare(op, x, y)
+	case syntax.LogicalAnd:
+		return backing.LogicalAnd(x, y)
+	case syntax.LogicalOr:
+		return backing.LogicalOr(x, y)
+	}
+	return backing.Value{ValueType: backing.Undefined}
+}
+
+// litValue returns the value of the literal
+func litValue(lit *syntax.BasicLit) backing.Value {
+	value := backing.Value{ValueType: backing.LitKindToValueType(lit.Kind)}
+	switch lit.Kind {
+	case syntax.StringLit:
+		value.Value = lit.Value
+	case syntax.FloatLit:
+		value.Value, _ = strconv.ParseFloat(lit.Value, 64)
+	case syntax.IntLit:
+		value.Value, _ = strconv.ParseInt(lit.Value, 10, 64)
+	case syntax.BoolLit:
+		value.Value, _ = strconv.ParseBool(lit.Value)
+	}
+	return value
+}
+
+// newLit returns a literal holding the value, which is parsed back exactly by the backends
+func newLit(value backing.Value, pos scanner.Position) *syntax.BasicLit {
+	switch value.ValueType {
+	case backing.Int:
+		return syntax.NewBasicLit(syntax.IntLit, strconv.FormatInt(value.AsInt(), 10), pos)
+	case backing.Float:
+		s := strconv.FormatFloat(value.AsFloat(), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			// keeps it apart from an Int in listings
+			s += ".0"
+		}
+		return syntax.NewBasicLit(syntax.FloatLit, s, pos)
+	case backing.Bool:
+		return syntax.NewBasicLit(syntax.BoolLit, strconv.FormatBool(value.AsBool()), pos)
+	}
+	return syntax.NewBasicLit(syntax.StringLit, value.AsString(), pos)
+}
+
+// boolLit returns the value of a Bool literal, ok is false if e isn't one
+func boolLit(e syntax.Expr) (value bool, ok bool) {
+	lit, ok := e.(*syntax.BasicLit)
+	if !ok || lit.Kind != syntax.BoolLit {
+		return false, false
+	}
+	value, _ = strconv.ParseBool(lit.Value)
+	return value, true
+}
@@ -0,0 +1,65 @@
+package optimize
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/format"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"strings"
+	"testing"
+)
+
+// TestProgram checks the optimized program, formatted. The formatter keeps
+// a blank line in place of dropped statements spanning several lines
+func TestProgram(t *testing.T) {
+	src := `def f(x: Int): Float {
+    val n = -(2 * 3) + 1
+    val s = "a" + "b"
+    var y = x * (4 - 1)
+    if (3 > 1 && !(1 > 2)) {
+        y = 1 / 0
+    } else {
+        print("never")
+    }
+    if (1 == 2) {
+        print("never")
+    } else if (x > 0) {
+        print("maybe")
+    } else if (2 < 1) {
+        print("never")
+    }
+    while (1 > 2) {
+        print("never")
+    }
+    return y + 0.5 * 3
+    print("dead")
+}
+`
+	expected := `def f(x: Int): Float {
+    val n = -5
+    val s = "ab"
+    var y = x * 3
+    {
+        y = 1 / 0
+    }
+
+    if (x > 0) {
+        print("maybe")
+    }
+
+    return y + 1.5
+}
+`
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(src))
+	if len(syntaxErrors) > 0 {
+		t.Fatalf("syntax errors: %v", syntaxErrors)
+	}
+	info := typecheck.NewChecker().Check(program)
+	if info.HadErrors() {
+		t.Fatalf("type errors: %v", info.Errors)
+	}
+	Program(program, info)
+	if d := diff.Unified("expected", "actual", expected, string(format.Program(program))); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,484 @@
+// Package progen generates random well-typed programs. Every program it generates
+// terminates: loops are bounded by counters and functions only call functions defined
+// before them, so there's no recursion. Functions share values and variables declared
+// at the top level, which statements between the functions and main make use of too. A program may still end with an exception, e.g.
+// on division by zero. The programs are meant to be run by several backends, whose
+// outputs are then compared
+package progen
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+)
+
+// types a generated program deals with
+const (
+	tInt    = "Int"
+	tFloat  = "Float"
+	tBool   = "Bool"
+	tString = "String"
+	tUnit   = "Unit"
+)
+
+var valueTypes = []string{tInt, tFloat, tBool, tString}
+
+// limits keeping programs small and quick to run
+const (
+	maxFuncs     = 5
+	maxGlobals   = 3
+	maxParams    = 3
+	maxStmts     = 5
+	maxExprDepth = 3
+	maxStmtDepth = 3
+	maxLoopCount = 4
+)
+
+type (
+	variable struct {
+		name    string
+		typ     string
+		mutable bool
+		// nesting depth of the block declaring it, parameters belong to the function's body,
+		// globals are at depth -1
+		depth int
+	}
+
+	function struct {
+		name       string
+		params     []variable
+		returnType string
+	}
+
+	generator struct {
+		rnd *rand.Rand
+		out strings.Builder
+		// functions defined so far, the one being generated may call any of them
+		funcs []function
+		// values and variables declared at the top level
+		globals []variable
+		// variables declared so far and still in scope at the current point of the
+		// function being generated. A variable may be shadowed by a later one
+		vars []variable
+		// names of variables declared so far, in scope or not, which declarations may reuse
+		names []string
+		// return type of the function being generated
+		returnType string
+		// counter used to make up fresh names
+		fresh  int
+		indent int
+	}
+)
+
+// Generate returns source text of a program made up from the seed,
+// the same seed always gives the same program
+func Generate(seed int64) string {
+	g := &generator{rnd: rand.New(rand.NewSource(seed))}
+	g.globalDecls()
+	numFuncs := 1 + g.rnd.Intn(maxFuncs)
+	for i := 0; i < numFuncs; i++ {
+		g.function()
+	}
+	g.topLevelStmts()
+	g.main()
+	return g.out.String()
+}
+
+// globalDecls declares values and variables at the top level. They're initialized before
+// any function is called, thus initializers refer to nothing but the globals before them
+func (g *generator) globalDecls() {
+	for i := g.rnd.Intn(maxGlobals + 1); i > 0; i-- {
+		typ := g.pick(valueTypes)
+		v := variable{name: g.newName("g"), typ: typ, mutable: g.rnd.Intn(3) != 0, depth: -1}
+		keyword := "var"
+		if !v.mutable {
+			keyword = "val"
+		}
+		g.vars = g.globals
+		g.line("%s %s = %s", keyword, v.name, g.expr(typ, 0))
+		g.globals = append(g.globals, v)
+	}
+	if len(g.globals) > 0 {
+		g.line("")
+	}
+}
+
+// topLevelStmts generates statements running between the initialization of globals and main
+func (g *generator) topLevelStmts() {
+	g.vars = g.globals
+	n := g.rnd.Intn(3)
+	for i := n; i > 0; i-- {
+		switch g.rnd.Intn(3) {
+		case 0:
+			if v, ok := g.mutableVar(); ok {
+				g.line("%s = %s", v.name, g.expr(v.typ, 0))
+				continue
+			}
+		case 1:
+			if fn, ok := g.funcReturning(tUnit); ok {
+				g.line("%s", g.call(fn, 0))
+				continue
+			}
+		}
+		g.printStmt()
+	}
+	if n > 0 {
+		g.line("")
+	}
+}
+
+func (g *generator) function() {
+	fn := function{
+		name:       fmt.Sprintf("f%d", len(g.funcs)),
+		returnType: g.pick(append([]string{tUnit}, valueTypes...)),
+	}
+	for i := g.rnd.Intn(maxParams + 1); i > 0; i-- {
+		fn.params = append(fn.params, variable{name: g.newName("p"), typ: g.pick(valueTypes)})
+	}
+	params := make([]string, len(fn.params))
+	for idx, param := range fn.params {
+		params[idx] = param.name + ": " + param.typ
+	}
+	g.line("def %s(%s): %s {", fn.name, strings.Join(params, ", "), fn.returnType)
+	g.body(fn.params, fn.returnType)
+	g.line("}")
+	g.line("")
+	g.funcs = append(g.funcs, fn)
+}
+
+func (g *generator) main() {
+	g.line("def main(): Unit {")
+	g.body(nil, tUnit)
+	g.line("}")
+}
+
+func (g *generator) body(params []variable, returnType string) {
+	g.vars = append(append([]variable(nil), g.globals...), params...)
+	g.returnType = returnType
+	g.indent++
+	g.stmts(0)
+	// whatever is computed along the way is printed, so that backends
+	// disagreeing on a value show up in the output
+	for _, v := range g.visible() {
+		g.line("print(%s)", g.show(v.name, v.typ))
+	}
+	if returnType != tUnit {
+		g.line("return %s", g.expr(returnType, 0))
+	}
+	g.indent--
+}
+
+func (g *generator) stmts(depth int) {
+	for i := 1 + g.rnd.Intn(maxStmts); i > 0; i-- {
+		g.stmt(depth, i == 1)
+	}
+}
+
+// stmt generates a statement, last tells whether it ends the block, which is
+// the only place where leaving the block by return or throw is allowed
+func (g *generator) stmt(depth int, last bool) {
+	choice := g.rnd.Intn(10)
+	if depth >= maxStmtDepth && choice >= 6 {
+		// no more nesting
+		choice = g.rnd.Intn(6)
+	}
+	switch choice {
+	case 0, 1:
+		typ := g.pick(valueTypes)
+		v := variable{name: g.declName(depth), typ: typ, mutable: true, depth: depth}
+		keyword := "var"
+		if g.rnd.Intn(3) == 0 {
+			v.mutable = false
+			keyword = "val"
+		}
+		g.line("%s %s = %s", keyword, v.name, g.expr(typ, 0))
+		g.vars = append(g.vars, v)
+	case 2:
+		if v, ok := g.mutableVar(); ok {
+			g.line("%s = %s", v.name, g.expr(v.typ, 0))
+			return
+		}
+		g.printStmt()
+	case 3, 4:
+		g.printStmt()
+	case 5:
+		if fn, ok := g.funcReturning(tUnit); ok {
+			g.line("%s", g.call(fn, 0))
+			return
+		}
+		g.printStmt()
+	case 6:
+		g.line("if (%s) {", g.expr(tBool, 0))
+		g.block(depth)
+		if g.rnd.Intn(2) == 0 {
+			g.line("} else {")
+			g.block(depth)
+		}
+		g.line("}")
+	case 7:
+		// the counter is never shadowed, so that the loop ends
+		counter := g.newName("i")
+		g.line("var %s = 0", counter)
+		g.line("while (%s < %d) {", counter, g.rnd.Intn(maxLoopCount+1))
+		g.block(depth)
+		g.indent++
+		g.line("%s = %s + 1", counter, counter)
+		g.indent--
+		g.line("}")
+	case 8:
+		g.tryStmt(depth)
+	case 9:
+		switch {
+		case !last || depth == 0:
+			g.printStmt()
+		case g.returnType == tUnit || g.rnd.Intn(3) == 0:
+			// there's no return without a value
+			g.line("throw exception_new(%q, %s)", g.pick([]string{"IllegalArgumentException", "Custom"}), g.expr(tString, 0))
+		default:
+			g.line("return %s", g.expr(g.returnType, 0))
+		}
+	}
+}
+
+// block generates nested statements, variables declared by them aren't visible after it
+func (g *generator) block(depth int) {
+	vars := g.vars
+	g.indent++
+	g.stmts(depth + 1)
+	g.indent--
+	g.vars = vars
+}
+
+func (g *generator) tryStmt(depth int) {
+	g.line("try {")
+	g.block(depth)
+	hasCatch := g.rnd.Intn(4) != 0
+	if hasCatch {
+		g.line("} catch {")
+		g.indent++
+		for _, kind := range g.rnd.Perm(3)[:1+g.rnd.Intn(3)] {
+			e := g.declName(depth + 1)
+			switch kind {
+			case 0:
+				g.line("case %s: ArithmeticException =>", e)
+			case 1:
+				g.line("case %s: IllegalArgumentException =>", e)
+			case 2:
+				g.line("case %s =>", e)
+			}
+			g.indent++
+			g.line("print(exception_kind(%s) + \": \" + exception_message(%s) + \"\\n\")", e, e)
+			g.indent--
+		}
+		g.indent--
+	}
+	if !hasCatch || g.rnd.Intn(2) == 0 {
+		g.line("} finally {")
+		g.block(depth)
+	}
+	g.line("}")
+}
+
+func (g *generator) printStmt() {
+	typ := g.pick(valueTypes)
+	g.line("print(%s)", g.show(g.expr(typ, 0), typ))
+}
+
+// show returns an expression turning the expression of the given type into a line of output
+func (g *generator) show(expr string, typ string) string {
+	if typ == tString {
+		return expr + ` + "\n"`
+	}
+	return "to_string(" + expr + `) + "\n"`
+}
+
+// expr returns an expression of the given type
+func (g *generator) expr(typ string, depth int) string {
+	choice := g.rnd.Intn(10)
+	if depth >= maxExprDepth {
+		// leaves only
+		choice = g.rnd.Intn(3)
+	}
+	switch {
+	case choice < 2:
+		return g.literal(typ)
+	case choice < 4:
+		if v, ok := g.varOfType(typ); ok {
+			return v.name
+		}
+		return g.literal(typ)
+	case choice < 5:
+		if fn, ok := g.funcReturning(typ); ok {
+			return g.call(fn, depth)
+		}
+	}
+	switch typ {
+	case tInt:
+		switch g.rnd.Intn(4) {
+		case 0:
+			return "toInt(" + g.expr(tFloat, depth+1) + ")"
+		case 1:
+			return "-" + g.operand(tInt, depth)
+		}
+		return g.operand(tInt, depth) + " " + g.pick([]string{"+", "-", "*", "/", "%"}) + " " + g.operand(tInt, depth)
+	case tFloat:
+		switch g.rnd.Intn(4) {
+		case 0:
+			return "toFloat(" + g.expr(tInt, depth+1) + ")"
+		case 1:
+			return "-" + g.operand(tFloat, depth)
+		}
+		// one of the operands may be an Int, it's promoted then
+		lhsType, rhsType := tFloat, g.pick([]string{tInt, tFloat})
+		if g.rnd.Intn(2) == 0 {
+			lhsType, rhsType = rhsType, lhsType
+		}
+		return g.operand(lhsType, depth) + " " + g.pick([]string{"+", "-", "*", "/"}) + " " + g.operand(rhsType, depth)
+	case tBool:
+		switch g.rnd.Intn(5) {
+		case 0:
+			return "!" + g.operand(tBool, depth)
+		case 1:
+			return g.operand(tBool, depth) + " " + g.pick([]string{"&&", "||", "==", "!="}) + " " + g.operand(tBool, depth)
+		case 2:
+			return g.operand(tString, depth) + " " + g.pick([]string{"==", "!="}) + " " + g.operand(tString, depth)
+		}
+		operandType := g.pick([]string{tInt, tFloat})
+		return g.operand(operandType, depth) + " " + g.pick([]string{"<", "<=", ">", ">=", "==", "!="}) + " " + g.operand(operandType, depth)
+	case tString:
+		if g.rnd.Intn(2) == 0 {
+			return "to_string(" + g.expr(g.pick([]string{tInt, tFloat, tBool}), depth+1) + ")"
+		}
+		return g.operand(tString, depth) + " + " + g.operand(tString, depth)
+	}
+	panic("unknown type " + typ)
+}
+
+// leaf matches literals and names
+var leaf = regexp.MustCompile(`^[\w."]*$`)
+
+// operand returns an expression which is safe to use as an operand, i.e it's parenthesized
+// unless it's a leaf
+func (g *generator) operand(typ string, depth int) string {
+	expr := g.expr(typ, depth+1)
+	if leaf.MatchString(expr) {
+		return expr
+	}
+	return "(" + expr + ")"
+}
+
+func (g *generator) literal(typ string) string {
+	switch typ {
+	case tInt:
+		return fmt.Sprint(g.rnd.Intn(20))
+	case tFloat:
+		return fmt.Sprintf("%d.%d", g.rnd.Intn(10), g.rnd.Intn(100))
+	case tBool:
+		// there are no boolean literals
+		return fmt.Sprintf("(%d %s %d)", g.rnd.Intn(5), g.pick([]string{"<", "=="}), g.rnd.Intn(5))
+	case tString:
+		return fmt.Sprintf("%q", g.pick([]string{"", "a", "b", "ab", "miniscala"}))
+	}
+	panic("unknown type " + typ)
+}
+
+func (g *generator) call(fn function, depth int) string {
+	args := make([]string, len(fn.params))
+	for idx, param := range fn.params {
+		args[idx] = g.expr(param.typ, depth+1)
+	}
+	return fn.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (g *generator) varOfType(typ string) (variable, bool) {
+	var candidates []variable
+	for _, v := range g.visible() {
+		if v.typ == typ {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return variable{}, false
+	}
+	return candidates[g.rnd.Intn(len(candidates))], true
+}
+
+func (g *generator) mutableVar() (variable, bool) {
+	var candidates []variable
+	for _, v := range g.visible() {
+		if v.mutable {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return variable{}, false
+	}
+	return candidates[g.rnd.Intn(len(candidates))], true
+}
+
+func (g *generator) funcReturning(typ string) (function, bool) {
+	var candidates []function
+	for _, fn := range g.funcs {
+		if fn.returnType == typ {
+			candidates = append(candidates, fn)
+		}
+	}
+	if len(candidates) == 0 {
+		return function{}, false
+	}
+	return candidates[g.rnd.Intn(len(candidates))], true
+}
+
+func (g *generator) pick(choices []string) string {
+	return choices[g.rnd.Intn(len(choices))]
+}
+
+// visible returns variables which aren't shadowed by others
+func (g *generator) visible() []variable {
+	var visible []variable
+	for idx, v := range g.vars {
+		shadowed := false
+		for _, other := range g.vars[idx+1:] {
+			shadowed = shadowed || other.name == v.name
+		}
+		if !shadowed {
+			visible = append(visible, v)
+		}
+	}
+	return visible
+}
+
+// declName returns a name for a variable declared in a block at the given depth. It's
+// often the name of a variable declared earlier, either out of scope by now or visible
+// and then shadowed, unless the variable belongs to the same block
+func (g *generator) declName(depth int) string {
+	if len(g.names) > 0 && g.rnd.Intn(2) == 0 {
+		name := g.names[g.rnd.Intn(len(g.names))]
+		for _, v := range g.vars {
+			if v.name == name && v.depth >= depth {
+				return g.newName("v")
+			}
+		}
+		return name
+	}
+	return g.newName("v")
+}
+
+// newName makes up a name no variable has had so far
+func (g *generator) newName(prefix string) string {
+	g.fresh++
+	name := fmt.Sprintf("%s%d", prefix, g.fresh)
+	if prefix != "i" {
+		g.names = append(g.names, name)
+	}
+	return name
+}
+
+func (g *generator) line(format string, args ...interface{}) {
+	if format != "" {
+		g.out.WriteString(strings.Repeat("    ", g.indent))
+		fmt.Fprintf(&g.out, format, args...)
+	}
+	g.out.WriteString("\n")
+}
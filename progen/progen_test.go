@@ -0,0 +1,119 @@
+package progen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/format"
+	"github.com/ThreadedStream/miniscala/interpreter"
+	"github.com/ThreadedStream/miniscala/ir"
+	"github.com/ThreadedStream/miniscala/optimize"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"github.com/ThreadedStream/miniscala/vm"
+	"strings"
+	"testing"
+)
+
+// outcome is what running a program amounts to: its output and the exception
+// which stopped it, if any
+type outcome struct {
+	output    string
+	exception string
+}
+
+func (o outcome) String() string {
+	return fmt.Sprintf("exception: %s\noutput:\n%s", o.exception, o.output)
+}
+
+// TestDifferential runs generated programs on the vm, on the vm running bytecode generated
+// from the IR, on the interpreter and on the vm once again after optimizing them,
+// the backends must agree on every one of them
+func TestDifferential(t *testing.T) {
+	for seed := int64(0); seed < 300; seed++ {
+		checkSeed(t, seed)
+	}
+}
+
+// FuzzDifferential is TestDifferential going through seeds picked by the fuzzer
+func FuzzDifferential(f *testing.F) {
+	f.Add(int64(0))
+	f.Fuzz(checkSeed)
+}
+
+func checkSeed(t *testing.T, seed int64) {
+	src := Generate(seed)
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(src))
+	if len(syntaxErrors) > 0 {
+		t.Fatalf("seed %d: generated program has syntax errors: %v\n%s", seed, syntaxErrors, src)
+	}
+	info := typecheck.NewChecker().Check(program)
+	if info.HadErrors() {
+		t.Fatalf("seed %d: generated program is ill-typed: %v\n%s", seed, info.Errors, src)
+	}
+
+	vmOutcome := run(t, func(out *bytes.Buffer) error {
+		machine := vm.NewVM(program, info)
+		machine.SetOutput(out)
+		return machine.Run()
+	})
+	treeOutcome := run(t, func(out *bytes.Buffer) error {
+		in := interpreter.New(program, info)
+		in.SetOutput(out)
+		return in.Run()
+	})
+	if vmOutcome != treeOutcome {
+		t.Fatalf("seed %d: backends disagree\n%s\nprogram:\n%s", seed, diff.Unified("vm", "tree", vmOutcome.String(), treeOutcome.String()), src)
+	}
+	irProgram, err := ir.Build(program, info)
+	if err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, src)
+	}
+	irOutcome := run(t, func(out *bytes.Buffer) error {
+		machine := vm.NewVMFromIR(irProgram, "main")
+		machine.SetOutput(out)
+		return machine.Run()
+	})
+	if irOutcome != treeOutcome {
+		t.Fatalf("seed %d: backends disagree\n%s\nprogram:\n%s\nIR:\n%s", seed, diff.Unified("ir", "tree", irOutcome.String(), treeOutcome.String()), src, irProgram)
+	}
+	inlinedProgram, err := ir.Build(program, info)
+	if err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, src)
+	}
+	inlinedProgram.Inline()
+	inlinedOutcome := run(t, func(out *bytes.Buffer) error {
+		machine := vm.NewVMFromIR(inlinedProgram, "main")
+		machine.SetOutput(out)
+		return machine.Run()
+	})
+	if inlinedOutcome != treeOutcome {
+		t.Fatalf("seed %d: backends disagree\n%s\nprogram:\n%s\nIR:\n%s", seed, diff.Unified("inlined", "tree", inlinedOutcome.String(), treeOutcome.String()), src, inlinedProgram)
+	}
+	// the optimizer rewrites the tree in place, so it goes last
+	optimize.Program(program, info)
+	optimizedOutcome := run(t, func(out *bytes.Buffer) error {
+		machine := vm.NewVM(program, info)
+		machine.SetOutput(out)
+		return machine.Run()
+	})
+	if optimizedOutcome != treeOutcome {
+		t.Fatalf("seed %d: backends disagree\n%s\nprogram:\n%s\noptimized:\n%s", seed, diff.Unified("optimized", "tree", optimizedOutcome.String(), treeOutcome.String()), src, format.Program(program))
+	}
+}
+
+func run(t *testing.T, backend func(out *bytes.Buffer) error) (res outcome) {
+	var out bytes.Buffer
+	defer func() {
+		res.output = out.String()
+		if r := recover(); r != nil {
+			res.exception = fmt.Sprintf("internal error: %v", r)
+		}
+	}()
+	if err := backend(&out); err != nil {
+		exception := err.(*backing.ExceptionValue)
+		res.exception = fmt.Sprintf("[%d:%d] %s", exception.Pos.Line, exception.Pos.Column, exception)
+	}
+	return res
+}
@@ -0,0 +1,238 @@
+// Package repl implements the interactive read-eval-print loop of miniscala
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"github.com/ThreadedStream/miniscala/vm"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	prompt             = "miniscala> "
+	continuationPrompt = "         | "
+)
+
+const help = `Enter definitions, statements or expressions to have them evaluated.
+Results of expressions are bound to res0, res1 and so on.
+
+Commands:
+  :type <expr>   show the type of the expression without evaluating it
+  :disasm [fn]   show the bytecode of the function, or list compiled functions
+  :load <file>   evaluate the contents of the file
+  :help          show this message
+  :quit          leave the REPL
+`
+
+// Session holds definitions and values entered so far. The checker and the vm
+// both keep their state between inputs, so every input is checked and compiled
+// against whatever was entered before
+type Session struct {
+	checker *typecheck.Checker
+	vm      *vm.VM
+	out     io.Writer
+	// number of results bound so far
+	results int
+}
+
+func NewSession(out io.Writer) *Session {
+	s := new(Session)
+	s.checker = typecheck.NewChecker()
+	s.vm = vm.NewInteractiveVM()
+	s.vm.SetOutput(out)
+	s.out = out
+	return s
+}
+
+// Run reads inputs from in until it's exhausted or :quit is entered. An input spans
+// several lines as long as it has unclosed braces or parentheses
+func Run(in io.Reader, out io.Writer) {
+	s := NewSession(out)
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(out, prompt)
+	var input strings.Builder
+	for scanner.Scan() {
+		input.WriteString(scanner.Text())
+		input.WriteString("\n")
+		if unclosed(input.String()) > 0 {
+			fmt.Fprint(out, continuationPrompt)
+			continue
+		}
+		if !s.Eval(input.String()) {
+			return
+		}
+		input.Reset()
+		fmt.Fprint(out, prompt)
+	}
+	fmt.Fprintln(out)
+}
+
+// unclosed counts braces and parentheses in src which are yet to be closed
+func unclosed(src string) int {
+	depth := 0
+	inString := false
+	for idx := 0; idx < len(src); idx++ {
+		switch {
+		case inString:
+			if src[idx] == '\\' {
+				idx++
+			} else if src[idx] == '"' {
+				inString = false
+			}
+		case src[idx] == '"':
+			inString = true
+		case strings.HasPrefix(src[idx:], "//"):
+			for idx < len(src) && src[idx] != '\n' {
+				idx++
+			}
+		case src[idx] == '{' || src[idx] == '(':
+			depth++
+		case src[idx] == '}' || src[idx] == ')':
+			depth--
+		}
+	}
+	return depth
+}
+
+// Eval handles a single input, which is either a command, an expression or a sequence
+// of statements. It returns false once the session is over
+func (s *Session) Eval(input string) (goOn bool) {
+	defer func() {
+		// the vm aborts on conditions the checker is supposed to rule out,
+		// which is no reason to throw away the whole session
+		if r := recover(); r != nil {
+			fmt.Fprintf(s.out, "internal error: %v\n", r)
+			s.checker.DiscardInput()
+			goOn = true
+		}
+	}()
+
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return true
+	}
+	if strings.HasPrefix(input, ":") {
+		return s.command(input)
+	}
+	// an input parsing as an expression is evaluated for its result,
+	// otherwise it has to be a sequence of statements
+	if expr, hadErrors := syntax.ParseExpr(strings.NewReader(input), io.Discard); !hadErrors {
+		s.evalExpr(expr)
+		return true
+	}
+	program, hadErrors := syntax.ParseSource(strings.NewReader(input), s.out)
+	if hadErrors {
+		return true
+	}
+	s.evalProgram(program)
+	return true
+}
+
+func (s *Session) command(input string) bool {
+	command, arg := input, ""
+	if idx := strings.IndexAny(input, " \t"); idx >= 0 {
+		command, arg = input[:idx], strings.TrimSpace(input[idx:])
+	}
+	switch command {
+	default:
+		fmt.Fprintf(s.out, "unknown command %s, try :help\n", command)
+	case ":help":
+		fmt.Fprint(s.out, help)
+	case ":quit":
+		return false
+	case ":type":
+		s.showType(arg)
+	case ":disasm":
+		s.disassemble(arg)
+	case ":load":
+		s.load(arg)
+	}
+	return true
+}
+
+func (s *Session) showType(src string) {
+	expr, hadErrors := syntax.ParseExpr(strings.NewReader(src), s.out)
+	if hadErrors {
+		return
+	}
+	result := s.checker.CheckExpr(expr)
+	if s.report(result) {
+		return
+	}
+	fmt.Fprintln(s.out, backing.ValueTypeToStr(result.TypeOf(expr)))
+}
+
+func (s *Session) disassemble(funcName string) {
+	if funcName == "" {
+		for _, name := range s.vm.FuncNames() {
+			fmt.Fprintln(s.out, name)
+		}
+		return
+	}
+	if !s.vm.Disassemble(funcName, s.out) {
+		fmt.Fprintf(s.out, "no function named %s\n", funcName)
+	}
+}
+
+func (s *Session) load(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+	defer file.Close()
+	program, hadErrors := syntax.ParseSource(file, s.out)
+	if hadErrors {
+		return
+	}
+	if s.evalProgram(program) {
+		fmt.Fprintf(s.out, "loaded %s\n", path)
+	}
+}
+
+// evalExpr evaluates the expression, binding its result to the next resN,
+// unless it's a Unit, which is not worth showing
+func (s *Session) evalExpr(expr syntax.Expr) {
+	result := s.checker.CheckExpr(expr)
+	if s.report(result) {
+		return
+	}
+	valueType := result.TypeOf(expr)
+	if valueType == backing.Unit {
+		s.evalProgram(&syntax.Program{StmtList: []syntax.Stmt{expr}})
+		return
+	}
+	name := fmt.Sprintf("res%d", s.results)
+	program := &syntax.Program{StmtList: []syntax.Stmt{syntax.NewValDeclStmt(name, expr)}}
+	if !s.evalProgram(program) {
+		return
+	}
+	s.results++
+	value, _ := s.vm.Global(name)
+	fmt.Fprintf(s.out, "%s: %s = %s\n", name, backing.ValueTypeToStr(valueType), backing.ToString(value))
+}
+
+// evalProgram checks and runs the program, returns false if either of these failed
+func (s *Session) evalProgram(program *syntax.Program) bool {
+	result := s.checker.CheckInput(program)
+	if s.report(result) {
+		return false
+	}
+	if err := s.vm.Eval(program, result); err != nil {
+		fmt.Fprintf(s.out, "exception: %v\n", err)
+		s.checker.DiscardInput()
+		return false
+	}
+	return true
+}
+
+// report shows errors and warnings of the result, returns true if there were errors
+func (s *Session) report(result *typecheck.Result) bool {
+	result.Report(s.out)
+	return result.HadErrors()
+}
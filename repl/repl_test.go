@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"strings"
+	"testing"
+)
+
+// TestSession runs a scripted session: a definition spanning several lines, expressions
+// bound to results, a type error and an exception, neither of which ends the session
+// or leaves anything declared behind, and commands
+func TestSession(t *testing.T) {
+	script := `def square(n: Int): Int {
+    return n * n
+}
+square(7)
+val s: String = square(2)
+s
+res0 + 1
+var count = 0
+count = count + res0
+print(to_string(count) + "\n")
+val broken = 1 / 0
+broken
+count
+:type square(1) > 2
+:quit
+square(3)
+`
+	expected := "miniscala>          |          | miniscala> res0: Int = 49\n" +
+		"miniscala> [1:8] s is declared as String, but initialized with Int\n" +
+		"miniscala> [1:1] name s is neither a type name nor var, nor val\n" +
+		"miniscala> res1: Int = 50\n" +
+		"miniscala> miniscala> miniscala> 49\n" +
+		"miniscala> exception: ArithmeticException: / by zero\n" +
+		"miniscala> [1:1] name broken is neither a type name nor var, nor val\n" +
+		"miniscala> res2: Int = 49\n" +
+		"miniscala> Bool\n" +
+		"miniscala> "
+	var out strings.Builder
+	Run(strings.NewReader(script), &out)
+	if d := diff.Unified("expected", "actual", expected, out.String()); d != "" {
+		t.Error(d)
+	}
+}
+
+// TestUnclosed checks that an input goes on as long as braces or parentheses are left open,
+// ignoring those within strings and comments
+func TestUnclosed(t *testing.T) {
+	for src, expected := range map[string]int{
+		"def f(): Unit {":           1,
+		"print(to_string((1 + 2)":   2,
+		"print(\"{(\")":             0,
+		"val x = 1 // {":            0,
+		"if (x > 0) {\n}":           0,
+		"print(\"\\\"{\")":          0,
+		"while (f(g(1)) {\n    {\n": 3,
+	} {
+		if depth := unclosed(src); depth != expected {
+			t.Errorf("unclosed(%q) = %d, expected %d", src, depth, expected)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package syntax
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addSeeds adds sample programs to the seed corpus of f
+func addSeeds(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("..", "sources", "*.miniscala"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+	f.Add("def main(): Unit {\n    while (x) {\n    }\n}\n")
+}
+
+// FuzzParse checks that the parser neither panics nor hangs, whatever the input is
+func FuzzParse(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, src string) {
+		program, _ := ParseErrors(strings.NewReader(src))
+		if program == nil {
+			t.Fatal("no program")
+		}
+	})
+}
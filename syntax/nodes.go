@@ -74,10 +74,18 @@ func (n *node) Pos() scanner.Position {
 
 type Program struct {
 	StmtList []Stmt
+	// Comments are kept aside from statements, sorted by position
+	Comments []*Comment
 	EOF      scanner.Position
 	node
 }
 
+// Comment is a line comment, Text includes the leading //
+type Comment struct {
+	Text string
+	node
+}
+
 type (
 	Expr interface {
 		Node
@@ -100,10 +108,11 @@ type (
 		expr
 	}
 
-	// Name: Type
+	// Annotations Name: Type
 	Field struct {
-		Name *Name
-		Type Expr
+		Name        *Name
+		Type        Expr
+		Annotations []*Annotation
 		expr
 	}
 
@@ -111,8 +120,47 @@ type (
 		Value string
 		expr
 	}
+
+	// X.asInstanceOf[Type]
+	Cast struct {
+		X    Expr
+		Type Expr
+		expr
+	}
+
+	// X.isInstanceOf[Type]
+	TypeTest struct {
+		X    Expr
+		Type Expr
+		expr
+	}
+
+	// @Name
+	Annotation struct {
+		Name *Name
+		node
+	}
+
+	// case Name [: Type] => Body, where Body has no braces of its own,
+	// so that its End is the position of whatever follows the last statement
+	CatchClause struct {
+		Name *Name
+		Type *Name // nil catches exceptions of any kind
+		Body *BlockStmt
+		node
+	}
 )
 
+// HasAnnotation reports whether an annotation with the given name is among annotations
+func HasAnnotation(annotations []*Annotation, name string) bool {
+	for _, annotation := range annotations {
+		if annotation.Name.Value == name {
+			return true
+		}
+	}
+	return false
+}
+
 type expr struct {
 	node
 }
@@ -129,12 +177,13 @@ type (
 	// { Stmts }
 	BlockStmt struct {
 		Stmts []Stmt
+		End   scanner.Position // position of the closing brace
 		stmt
 	}
 
 	// while (Cond) { Body }
 	WhileStmt struct {
-		Cond *Operation
+		Cond Expr
 		Body *BlockStmt
 		stmt
 	}
@@ -147,7 +196,7 @@ type (
 
 	// if (Cond) { Body } else ElseBody
 	IfStmt struct {
-		Cond     *Operation
+		Cond     Expr
 		Body     *BlockStmt
 		ElseBody Stmt
 		stmt
@@ -157,6 +206,21 @@ type (
 		Value Expr
 		stmt
 	}
+
+	// throw Value
+	ThrowStmt struct {
+		Value Expr
+		stmt
+	}
+
+	// try Body catch { Cases } finally Finally
+	TryStmt struct {
+		Body    *BlockStmt
+		Cases   []*CatchClause
+		Finally *BlockStmt       // nil, unless there's a finally clause
+		End     scanner.Position // position of the closing brace of the last clause
+		stmt
+	}
 	// Lhs = Rhs
 	Assignment struct {
 		Lhs Expr
@@ -164,26 +228,31 @@ type (
 		stmt
 	}
 
-	// var Name = Rhs
+	// Annotations var Name [: Type] = Rhs
 	VarDeclStmt struct {
-		Name Name
-		Rhs  Expr
+		Name        Name
+		Type        Expr // nil, unless the type is given explicitly
+		Rhs         Expr
+		Annotations []*Annotation
 		stmt
 	}
 
-	// val Name = Rhs
+	// Annotations val Name [: Type] = Rhs
 	ValDeclStmt struct {
-		Name Name
-		Rhs  Expr
+		Name        Name
+		Type        Expr // nil, unless the type is given explicitly
+		Rhs         Expr
+		Annotations []*Annotation
 		stmt
 	}
 
-	// def Name ( ParamList ) :Type { Body }
+	// Annotations def Name ( ParamList ) :Type { Body }
 	DefDeclStmt struct {
-		Name       *Name
-		ParamList  []*Field
-		ReturnType Expr
-		Body       *BlockStmt
+		Name        *Name
+		ParamList   []*Field
+		ReturnType  Expr
+		Body        *BlockStmt
+		Annotations []*Annotation
 		stmt
 	}
 )
@@ -192,6 +261,25 @@ type stmt struct {
 	node
 }
 
+// NewValDeclStmt makes 'val name = rhs', positioned at rhs. It's meant for statements
+// which have no source text of their own, e.g. the binding of a result in the REPL
+func NewValDeclStmt(name string, rhs Expr) *ValDeclStmt {
+	valDeclStmt := new(ValDeclStmt)
+	valDeclStmt.pos = rhs.Pos()
+	valDeclStmt.Name.Value = name
+	valDeclStmt.Name.pos = rhs.Pos()
+	valDeclStmt.Rhs = rhs
+	return valDeclStmt
+}
+
+// NewBasicLit makes a literal of the given kind, positioned at pos. It's meant for literals
+// which have no source text of their own, e.g. the ones operations on literals are folded into
+func NewBasicLit(kind LitKind, value string, pos scanner.Position) *BasicLit {
+	basicLit := &BasicLit{Value: value, Kind: kind}
+	basicLit.pos = pos
+	return basicLit
+}
+
 type LitKind uint8
 
 const (
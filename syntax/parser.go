@@ -3,8 +3,11 @@ package syntax
 import (
 	"fmt"
 	"github.com/ThreadedStream/miniscala/assert"
+	"io"
 	"os"
 	"reflect"
+	"strconv"
+	"text/scanner"
 )
 
 type AssociativityType int
@@ -15,19 +18,33 @@ const (
 )
 
 type (
-	syntaxerror struct {
-		fmt  string
-		args []interface{}
+	// Error is a syntax error found by the parser
+	Error struct {
+		Pos scanner.Position
+		Msg string
 	}
 
 	Parser struct {
 		tokenStream []Token
+		comments    []*Comment
 		currIdx     int
 		hadErrors   bool
-		errors      []syntaxerror
+		errors      []Error
 	}
 )
 
+func (e Error) Error() string {
+	return fmt.Sprintf("[%d:%d] %s", e.Pos.Line, e.Pos.Column, e.Msg)
+}
+
+func (p *Parser) errorf(pos scanner.Position, format string, args ...interface{}) {
+	p.hadErrors = true
+	p.errors = append(p.errors, Error{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
 func (p *Parser) isOfType(lhs Token, rhs Token) bool {
 	return reflect.TypeOf(lhs) == reflect.TypeOf(rhs)
 }
@@ -57,11 +74,7 @@ func (p *Parser) consume(token Token) {
 		p.next()
 	} else {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected %s but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr()), tokToString(token)},
-		})
+		p.errorf(errPos, "expected %s but got %s", tokToString(token), tokToString(p.curr()))
 	}
 }
 
@@ -75,15 +88,18 @@ func (p *Parser) match(token Token) bool {
 
 func (p *Parser) binOp(min int) Node {
 	res := p.atom()
-	for IsOperator(p.curr()) && prec(p.curr()) >= min {
+	// ! is unary only, a ! b is a syntax error rather than an operation
+	for IsOperator(p.curr()) && !p.isOfType(p.curr(), &TokenLogicalNot{}) && prec(p.curr()) >= min {
 		op := tokenToOperator(p.curr())
 		nextMin := prec(p.curr()) + int(assoc(p.curr()))
 		p.next()
-		res = &Operation{
+		operation := &Operation{
 			Op:  op,
 			Lhs: res,
 			Rhs: p.binOp(nextMin),
 		}
+		operation.pos = res.Pos()
+		res = operation
 	}
 
 	return res
@@ -105,6 +121,12 @@ func (p *Parser) stmt() Stmt {
 		return p.defDeclStmt()
 	case *TokenReturn:
 		return p.returnStmt()
+	case *TokenThrow:
+		return p.throwStmt()
+	case *TokenTry:
+		return p.tryStmt()
+	case *TokenAt:
+		return p.annotatedDeclStmt()
 	case *TokenIdent:
 		// handling simple statements
 		switch p.peek().(type) {
@@ -116,28 +138,33 @@ func (p *Parser) stmt() Stmt {
 			return p.assignment()
 		default:
 			errPos := p.curr().Pos()
-			p.hadErrors = true
-			p.errors = append(p.errors, syntaxerror{
-				fmt:  "[%d:%d] expected a '(' or '=' but got %s\n",
-				args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-			})
+			p.errorf(errPos, "expected a '(' or '=' but got %s", tokToString(p.curr()))
 			p.next()
-			return &ErrStmt{}
+			return p.errStmt(errPos)
 		}
 	default:
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected a statement but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected a statement but got %s", tokToString(p.curr()))
 		p.next()
-		return &ErrStmt{}
+		return p.errStmt(errPos)
 	}
 }
 
+func (p *Parser) errStmt(pos scanner.Position) *ErrStmt {
+	errStmt := new(ErrStmt)
+	errStmt.pos = pos
+	return errStmt
+}
+
+func (p *Parser) errExpr(pos scanner.Position) *ErrExpr {
+	errExpr := new(ErrExpr)
+	errExpr.pos = pos
+	return errExpr
+}
+
 func (p *Parser) unary() Node {
 	operation := new(Operation)
+	operation.pos = p.curr().Pos()
 	switch p.curr().(type) {
 	default:
 		return operation
@@ -154,7 +181,46 @@ func (p *Parser) unary() Node {
 	}
 }
 
+// atom parses a primary expression, followed by any number of type casts
+// and type tests, i.e primary.asInstanceOf[Type] or primary.isInstanceOf[Type]
 func (p *Parser) atom() Node {
+	res := p.primary()
+	for p.match(&TokenDot{}) {
+		dotPos := p.curr().Pos()
+		p.consume(&TokenDot{})
+		if !p.match(&TokenIdent{}) {
+			errPos := p.curr().Pos()
+			p.errorf(errPos, "expected asInstanceOf or isInstanceOf, but got %s", tokToString(p.curr()))
+			return p.errExpr(errPos)
+		}
+		method := p.name()
+		p.consume(&TokenOpenBracket{})
+		typ := p.typeName()
+		p.consume(&TokenCloseBracket{})
+		switch method.Value {
+		default:
+			p.errorf(method.Pos(), "expected asInstanceOf or isInstanceOf, but got %s", method.Value)
+			return p.errExpr(method.Pos())
+		case "asInstanceOf":
+			cast := &Cast{
+				X:    res,
+				Type: typ,
+			}
+			cast.pos = dotPos
+			res = cast
+		case "isInstanceOf":
+			typeTest := &TypeTest{
+				X:    res,
+				Type: typ,
+			}
+			typeTest.pos = dotPos
+			res = typeTest
+		}
+	}
+	return res
+}
+
+func (p *Parser) primary() Node {
 	switch p.curr().(type) {
 	case *TokenMinus, *TokenLogicalNot:
 		return p.unary()
@@ -164,20 +230,30 @@ func (p *Parser) atom() Node {
 		var kind LitKind
 		if tokenNum.kind == integer {
 			kind = IntLit
+			if _, err := strconv.ParseInt(tokenNum.value, 10, 64); err != nil {
+				p.errorf(tokenNum.Pos(), "integer literal %s is out of range", tokenNum.value)
+			}
 		} else {
 			kind = FloatLit
 		}
-		return &BasicLit{
+		basicLit := &BasicLit{
 			Value: tokenNum.value,
 			Kind:  kind,
 		}
+		basicLit.pos = tokenNum.Pos()
+		return basicLit
 	case *TokenString:
 		tokenString := p.curr().(*TokenString)
 		p.consume(&TokenString{})
-		return &BasicLit{
+		if tokenString.unterminated {
+			p.errorf(tokenString.Pos(), "string literal not terminated")
+		}
+		basicLit := &BasicLit{
 			Value: tokenString.value,
 			Kind:  StringLit,
 		}
+		basicLit.pos = tokenString.Pos()
+		return basicLit
 	case *TokenOpenParen:
 		p.consume(&TokenOpenParen{})
 		simpNode := p.expr()
@@ -193,51 +269,52 @@ func (p *Parser) atom() Node {
 			// call to function
 			return p.call()
 		}
-		ident := p.curr().(*TokenIdent)
-		p.next()
-		return &Name{
-			Value: ident.value,
-		}
+		return p.name()
 	default:
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] unknown node in atom()\n",
-			args: []interface{}{errPos.Line, errPos.Column},
-		})
+		p.errorf(errPos, "unknown node in atom()")
 		p.next()
-		return &ErrExpr{}
+		return p.errExpr(errPos)
+	}
+}
+
+// name turns the current identifier token into a Name
+func (p *Parser) name() *Name {
+	ident := p.curr().(*TokenIdent)
+	p.next()
+	name := &Name{
+		Value: ident.value,
 	}
+	name.pos = ident.Pos()
+	return name
 }
 
 func (p *Parser) program() *Program {
 	program := new(Program)
+	program.pos = p.curr().Pos()
 
 	for reflect.TypeOf(p.curr()) != reflect.TypeOf(&TokenEOF{}) {
 		program.StmtList = append(program.StmtList, p.stmt())
 	}
 
 	program.EOF = p.curr().Pos()
+	program.Comments = p.comments
 
 	return program
 }
 
 func (p *Parser) valDeclStmt() *ValDeclStmt {
 	var valDeclStmt = &ValDeclStmt{}
+	valDeclStmt.pos = p.curr().Pos()
 	p.consume(&TokenVal{})
 	if !p.match(&TokenIdent{}) {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected TokenIdent, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected TokenIdent, but got %s", tokToString(p.curr()))
 		p.next()
 		return &ValDeclStmt{}
 	}
-	tokenIdent := p.curr().(*TokenIdent)
-	valDeclStmt.Name = Name{Value: tokenIdent.value}
-	p.next()
+	valDeclStmt.Name = *p.name()
+	valDeclStmt.Type = p.typeAnnotation()
 	p.consume(&TokenAssign{})
 	valDeclStmt.Rhs = p.expr()
 
@@ -246,81 +323,66 @@ func (p *Parser) valDeclStmt() *ValDeclStmt {
 
 func (p *Parser) varDeclStmt() *VarDeclStmt {
 	var varDeclStmt = &VarDeclStmt{}
+	varDeclStmt.pos = p.curr().Pos()
 	p.consume(&TokenVar{})
 	if !p.match(&TokenIdent{}) {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected TokenIdent, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected TokenIdent, but got %s", tokToString(p.curr()))
 		p.next()
 		return &VarDeclStmt{}
 	}
-	tokenIdent := p.curr().(*TokenIdent)
-	varDeclStmt.Name = Name{Value: tokenIdent.value}
-	p.next()
+	varDeclStmt.Name = *p.name()
+	varDeclStmt.Type = p.typeAnnotation()
 	p.consume(&TokenAssign{})
 	varDeclStmt.Rhs = p.expr()
 
 	return varDeclStmt
 }
 
+// typeAnnotation parses an optional ': Type' following the name of a declared variable,
+// returns nil if there's none
+func (p *Parser) typeAnnotation() Expr {
+	if !p.match(&TokenColon{}) {
+		return nil
+	}
+	p.consume(&TokenColon{})
+	return p.typeName()
+}
+
+func (p *Parser) typeName() Expr {
+	if !p.match(&TokenIdent{}) {
+		errPos := p.curr().Pos()
+		p.errorf(errPos, "expected a type name, but got %s", tokToString(p.curr()))
+		return p.errExpr(errPos)
+	}
+	return p.name()
+}
+
 func (p *Parser) defDeclStmt() *DefDeclStmt {
-	var (
-		defDeclStmt          = &DefDeclStmt{}
-		paramName, paramType Expr
-	)
+	var defDeclStmt = &DefDeclStmt{}
+	defDeclStmt.pos = p.curr().Pos()
 	p.consume(&TokenDef{})
 	if !p.match(&TokenIdent{}) {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected name of the function, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected name of the function, but got %s", tokToString(p.curr()))
 		p.next()
 		return &DefDeclStmt{}
 	}
-	tokenIdent := p.curr().(*TokenIdent)
-	defDeclStmt.Name = &Name{Value: tokenIdent.value}
-	p.next()
+	defDeclStmt.Name = p.name()
 	p.consume(&TokenOpenParen{})
 	if p.match(&TokenCloseParen{}) {
 		p.consume(&TokenCloseParen{})
 		goto parseReturnType
 	}
 
-	// TODO(threadedstream): should really be paramName = expr()
-	paramName = p.expr()
-	p.consume(&TokenColon{})
-	//if !p.match(&TokenIdent{}) {
-	//	panic(fmt.Errorf("expected a type, but got %s", p.curr()))
-	//}
-	// TODO(threadedstream): the same as with paramName
-	paramType = p.expr()
-
-	defDeclStmt.ParamList = append(defDeclStmt.ParamList, &Field{
-		Name: paramName.(*Name),
-		Type: paramType,
-	})
+	defDeclStmt.ParamList = append(defDeclStmt.ParamList, p.param())
 
 	for p.isOfType(p.curr(), &TokenComma{}) &&
 		!p.isOfType(p.peek(), &TokenCloseParen{}) &&
 		!p.isOfType(p.peek(), &TokenEOF{}) {
 
 		p.consume(&TokenComma{})
-		paramName := p.expr()
-		p.consume(&TokenColon{})
-		//if !p.match(&TokenIdent{}) {
-		//	panic(fmt.Errorf("expected a type, but got %s", p.curr()))
-		//}
-		paramType := p.expr()
-
-		defDeclStmt.ParamList = append(defDeclStmt.ParamList, &Field{
-			Name: paramName.(*Name),
-			Type: paramType,
-		})
+		defDeclStmt.ParamList = append(defDeclStmt.ParamList, p.param())
 	}
 
 	p.consume(&TokenCloseParen{})
@@ -328,39 +390,91 @@ func (p *Parser) defDeclStmt() *DefDeclStmt {
 parseReturnType:
 	if !p.match(&TokenColon{}) {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected a specification of return type, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected a specification of return type, but got %s", tokToString(p.curr()))
 		p.next()
 		return &DefDeclStmt{}
 	}
 	p.next()
 	if !p.match(&TokenIdent{}) {
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected a type name, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected a type name, but got %s", tokToString(p.curr()))
 		p.next()
 		return &DefDeclStmt{}
 	}
-	defDeclStmt.ReturnType = p.expr()
+	defDeclStmt.ReturnType = p.typeName()
 	defDeclStmt.Body = p.blockStmt()
 
 	return defDeclStmt
 }
 
+// param parses a parameter of the function, i.e Annotations Name: Type
+func (p *Parser) param() *Field {
+	var field = &Field{}
+	field.Annotations = p.annotations()
+	field.pos = p.curr().Pos()
+	if !p.match(&TokenIdent{}) {
+		p.errorf(field.pos, "expected name of the parameter, but got %s", tokToString(p.curr()))
+		// the name is left empty, yet not nil, for the sake of whoever walks the erroneous tree
+		field.Name = new(Name)
+		field.Name.pos = field.pos
+	} else {
+		field.Name = p.name()
+	}
+	p.consume(&TokenColon{})
+	field.Type = p.typeName()
+	return field
+}
+
+// annotations parses a possibly empty sequence of @Name
+func (p *Parser) annotations() []*Annotation {
+	var annotations []*Annotation
+	for p.match(&TokenAt{}) {
+		annotation := new(Annotation)
+		annotation.pos = p.curr().Pos()
+		p.consume(&TokenAt{})
+		if !p.match(&TokenIdent{}) {
+			errPos := p.curr().Pos()
+			p.errorf(errPos, "expected name of the annotation, but got %s", tokToString(p.curr()))
+			return annotations
+		}
+		annotation.Name = p.name()
+		annotations = append(annotations, annotation)
+	}
+	return annotations
+}
+
+// annotatedDeclStmt parses a declaration preceded by annotations
+func (p *Parser) annotatedDeclStmt() Stmt {
+	annotations := p.annotations()
+	switch p.curr().(type) {
+	case *TokenVar:
+		varDeclStmt := p.varDeclStmt()
+		varDeclStmt.Annotations = annotations
+		return varDeclStmt
+	case *TokenVal:
+		valDeclStmt := p.valDeclStmt()
+		valDeclStmt.Annotations = annotations
+		return valDeclStmt
+	case *TokenDef:
+		defDeclStmt := p.defDeclStmt()
+		defDeclStmt.Annotations = annotations
+		return defDeclStmt
+	default:
+		errPos := p.curr().Pos()
+		p.errorf(errPos, "expected a declaration after annotations, but got %s", tokToString(p.curr()))
+		return p.errStmt(errPos)
+	}
+}
+
 func (p *Parser) call() *Call {
-	var (
-		call  = &Call{}
-		ident = p.curr().(*TokenIdent)
-	)
-	call.CalleeName = &Name{Value: ident.value}
-	p.next()
+	var call = &Call{}
+	call.pos = p.curr().Pos()
+	call.CalleeName = p.name()
 	p.consume(&TokenOpenParen{})
+	if p.match(&TokenCloseParen{}) {
+		p.consume(&TokenCloseParen{})
+		return call
+	}
 	// parsing arguments
 	arg := p.expr()
 	call.ArgList = append(call.ArgList, arg)
@@ -382,9 +496,10 @@ func (p *Parser) call() *Call {
 
 func (p *Parser) whileStmt() *WhileStmt {
 	var whileStmt = &WhileStmt{}
+	whileStmt.pos = p.curr().Pos()
 	p.consume(&TokenWhile{})
 	p.consume(&TokenOpenParen{})
-	whileStmt.Cond = p.expr().(*Operation)
+	whileStmt.Cond = p.expr()
 	p.consume(&TokenCloseParen{})
 	whileStmt.Body = p.blockStmt()
 	return whileStmt
@@ -392,9 +507,10 @@ func (p *Parser) whileStmt() *WhileStmt {
 
 func (p *Parser) ifStmt() *IfStmt {
 	var ifStmt = &IfStmt{}
+	ifStmt.pos = p.curr().Pos()
 	p.consume(&TokenIf{})
 	p.consume(&TokenOpenParen{})
-	ifStmt.Cond = p.expr().(*Operation)
+	ifStmt.Cond = p.expr()
 	p.consume(&TokenCloseParen{})
 	ifStmt.Body = p.blockStmt()
 	if p.match(&TokenElse{}) {
@@ -411,11 +527,7 @@ func (p *Parser) cond() Operation {
 	operator := tokenToOperator(p.curr())
 	if !IsComparisonOp(operator) {
 		errorPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected operator, got %s\n",
-			args: []interface{}{errorPos.Line, errorPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errorPos, "expected operator, got %s", tokToString(p.curr()))
 		return Operation{}
 	}
 	condition.Op = operator
@@ -430,16 +542,10 @@ func (p *Parser) assignment() *Assignment {
 	assignment.node = node{pos: p.curr().Pos()}
 	if !p.match(&TokenIdent{}) {
 		errorPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected TokenIdent, but got %s\n",
-			args: []interface{}{errorPos.Line, errorPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errorPos, "expected TokenIdent, but got %s", tokToString(p.curr()))
 		return nil
 	}
-	ident := p.curr().(*TokenIdent)
-	p.next()
-	assignment.Lhs = &Name{Value: ident.value}
+	assignment.Lhs = p.name()
 	p.consume(&TokenAssign{})
 	assignment.Rhs = p.expr()
 
@@ -454,6 +560,69 @@ func (p *Parser) returnStmt() *ReturnStmt {
 	return returnStmt
 }
 
+func (p *Parser) throwStmt() *ThrowStmt {
+	throwStmt := new(ThrowStmt)
+	throwStmt.pos = p.curr().Pos()
+	p.consume(&TokenThrow{})
+	throwStmt.Value = p.expr()
+	return throwStmt
+}
+
+func (p *Parser) tryStmt() *TryStmt {
+	tryStmt := new(TryStmt)
+	tryStmt.pos = p.curr().Pos()
+	p.consume(&TokenTry{})
+	tryStmt.Body = p.blockStmt()
+	if p.match(&TokenCatch{}) {
+		p.consume(&TokenCatch{})
+		p.consume(&TokenOpenBrace{})
+		for p.match(&TokenCase{}) {
+			tryStmt.Cases = append(tryStmt.Cases, p.catchClause())
+		}
+		tryStmt.End = p.curr().Pos()
+		p.consume(&TokenCloseBrace{})
+	}
+	if p.match(&TokenFinally{}) {
+		p.consume(&TokenFinally{})
+		tryStmt.Finally = p.blockStmt()
+		tryStmt.End = tryStmt.Finally.End
+	}
+	if tryStmt.Cases == nil && tryStmt.Finally == nil {
+		errPos := tryStmt.Pos()
+		p.errorf(errPos, "expected try to be followed by catch cases or finally")
+	}
+	return tryStmt
+}
+
+// catchClause parses 'case Name [: Type] => Stmts', where statements
+// extend up to the next case or the end of the catch block
+func (p *Parser) catchClause() *CatchClause {
+	catchClause := new(CatchClause)
+	catchClause.pos = p.curr().Pos()
+	p.consume(&TokenCase{})
+	if !p.match(&TokenIdent{}) {
+		errPos := p.curr().Pos()
+		p.errorf(errPos, "expected name of the caught exception, but got %s", tokToString(p.curr()))
+		p.next()
+		return catchClause
+	}
+	catchClause.Name = p.name()
+	if p.match(&TokenColon{}) {
+		p.consume(&TokenColon{})
+		if typeName, ok := p.typeName().(*Name); ok {
+			catchClause.Type = typeName
+		}
+	}
+	catchClause.Body = new(BlockStmt)
+	catchClause.Body.pos = p.curr().Pos()
+	p.consume(&TokenArrow{})
+	for !p.match(&TokenEOF{}) && !p.match(&TokenCloseBrace{}) && !p.match(&TokenCase{}) {
+		catchClause.Body.Stmts = append(catchClause.Body.Stmts, p.stmt())
+	}
+	catchClause.Body.End = p.curr().Pos()
+	return catchClause
+}
+
 func (p *Parser) blockStmt() *BlockStmt {
 	block := new(BlockStmt)
 	block.pos = p.curr().Pos()
@@ -462,6 +631,7 @@ func (p *Parser) blockStmt() *BlockStmt {
 	// do not allow empty blocks
 	p.consume(&TokenOpenBrace{})
 	block.Stmts = p.stmts()
+	block.End = p.curr().Pos()
 	p.consume(&TokenCloseBrace{})
 
 	return block
@@ -484,13 +654,9 @@ func (p *Parser) expr() Node {
 		return p.binOp(0)
 	default:
 		errPos := p.curr().Pos()
-		p.hadErrors = true
-		p.errors = append(p.errors, syntaxerror{
-			fmt:  "[%d:%d] expected number, '(' , '{' , identifier, val, or var, but got %s\n",
-			args: []interface{}{errPos.Line, errPos.Column, tokToString(p.curr())},
-		})
+		p.errorf(errPos, "expected number, '(' , '{' , identifier, val, or var, but got %s", tokToString(p.curr()))
 		p.next()
-		return &ErrExpr{}
+		return p.errExpr(errPos)
 	}
 }
 
@@ -499,26 +665,56 @@ func Parse(path string) (*Program, bool) {
 	if err != nil {
 		panic("no file with such path was found")
 	}
+	defer stream.Close()
+
+	return ParseSource(stream, os.Stderr)
+}
 
-	scanner := newCharScanner(stream)
+func newParser(src io.Reader) *Parser {
+	scanner := newCharScanner(src)
 	tokens := scanner.Tokenize()
 
-	var parser = &Parser{
+	return &Parser{
 		tokenStream: tokens,
+		comments:    scanner.comments,
 		currIdx:     0,
 	}
+}
 
-	program := parser.program()
-
-	if parser.hadErrors {
-		for _, err := range parser.errors {
-			fmt.Fprintf(os.Stderr, err.fmt, err.args...)
-		}
+func (p *Parser) reportErrors(errOut io.Writer) {
+	for _, err := range p.errors {
+		fmt.Fprintln(errOut, err.Error())
 	}
+}
 
+// ParseSource parses the program read from src, reporting syntax errors to errOut
+func ParseSource(src io.Reader, errOut io.Writer) (*Program, bool) {
+	parser := newParser(src)
+	program := parser.program()
+	parser.reportErrors(errOut)
 	return program, parser.hadErrors
 }
 
+// ParseErrors parses the program read from src, returning syntax errors instead of reporting them
+func ParseErrors(src io.Reader) (*Program, []Error) {
+	parser := newParser(src)
+	program := parser.program()
+	return program, parser.errors
+}
+
+// ParseExpr parses src as a single expression, reporting syntax errors to errOut.
+// Anything following the expression is an error
+func ParseExpr(src io.Reader, errOut io.Writer) (Expr, bool) {
+	parser := newParser(src)
+	expr := parser.expr()
+	if !parser.match(&TokenEOF{}) {
+		errPos := parser.curr().Pos()
+		parser.errorf(errPos, "expected end of expression, but got %s", tokToString(parser.curr()))
+	}
+	parser.reportErrors(errOut)
+	return expr, parser.hadErrors
+}
+
 // precedence of operators, the higher precedence the tighter binding
 // stolen from C
 func prec(token Token) int {
@@ -601,6 +797,51 @@ func tokenToOperator(token Token) Operator {
 	}
 }
 
+func operatorToToken(op Operator) Token {
+	switch op {
+	case Plus:
+		return &TokenPlus{}
+	case Minus:
+		return &TokenMinus{}
+	case Mul:
+		return &TokenMul{}
+	case Div:
+		return &TokenDiv{}
+	case Mod:
+		return &TokenMod{}
+	case GreaterThan:
+		return &TokenGreaterThan{}
+	case GreaterThanOrEqual:
+		return &TokenGreaterThanOrEqual{}
+	case LessThan:
+		return &TokenLessThan{}
+	case LessThanOrEqual:
+		return &TokenLessThanOrEqual{}
+	case Equal:
+		return &TokenEqual{}
+	case NotEqual:
+		return &TokenNotEqual{}
+	case LogicalAnd:
+		return &TokenLogicalAnd{}
+	case LogicalOr:
+		return &TokenLogicalOr{}
+	default:
+		return &TokenLogicalNot{}
+	}
+}
+
+// Precedence returns how tightly the binary operator binds its operands,
+// higher values bind tighter
+func Precedence(op Operator) int {
+	return prec(operatorToToken(op))
+}
+
+// IsLeftAssociative reports whether a chain of operators of the same precedence,
+// starting with op, is grouped from the left
+func IsLeftAssociative(op Operator) bool {
+	return assoc(operatorToToken(op)) == LeftAssociative
+}
+
 func IsComparisonOp(op Operator) bool {
 	switch op {
 	default:
@@ -28,6 +28,8 @@ type (
 	CharScanner struct {
 		CharReader
 		s *scanner.Scanner
+		// comments met by Tokenize, in the order of appearance
+		comments []*Comment
 	}
 )
 
@@ -36,6 +38,8 @@ func newCharScanner(reader io.Reader) *CharScanner {
 		s: new(scanner.Scanner),
 	}
 	charScanner.s = charScanner.s.Init(reader)
+	// malformed input turns into unknown tokens reported by the parser, rather than printed here
+	charScanner.s.Error = func(*scanner.Scanner, string) {}
 	return charScanner
 }
 
@@ -47,9 +51,21 @@ func (cs *CharScanner) Tokenize() []Token {
 		default:
 			tokens = append(tokens, token)
 		case *TokenComment:
-			break
+			// comments don't take part in parsing, yet the formatter needs them
+			tokenComment := token.(*TokenComment)
+			comment := &Comment{Text: tokenComment.value}
+			comment.pos = tokenComment.Pos()
+			cs.comments = append(cs.comments, comment)
 		}
 	}
+	// the stream always ends with EOF, so that errors at the end of input have a position
+	if len(tokens) == 0 || !isEOF(tokens[len(tokens)-1]) {
+		tokens = append(tokens, &TokenEOF{
+			tok: tok{
+				pos: cs.s.Pos(),
+			},
+		})
+	}
 
 	return tokens
 }
@@ -69,7 +85,7 @@ func (cs *CharScanner) tokenize() Token {
 				cs.s.Next()
 			}
 			if isKeyword(string(tokenValue)) {
-				return cs.tokenizeKeyword(string(tokenValue))
+				return cs.tokenizeKeyword(string(tokenValue), pos)
 			} else {
 				return &TokenIdent{
 					value: string(tokenValue),
@@ -79,7 +95,13 @@ func (cs *CharScanner) tokenize() Token {
 				}
 			}
 		}
-		return &TokenUnknown{}
+		pos := cs.s.Pos()
+		cs.s.Next()
+		return &TokenUnknown{
+			tok: tok{
+				pos: pos,
+			},
+		}
 	case '=':
 		pos := cs.s.Pos()
 		cs.s.Next()
@@ -90,6 +112,13 @@ func (cs *CharScanner) tokenize() Token {
 					pos: pos,
 				},
 			}
+		} else if cs.s.Peek() == '>' {
+			cs.s.Next()
+			return &TokenArrow{
+				tok: tok{
+					pos: pos,
+				},
+			}
 		} else {
 			return &TokenAssign{
 				tok: tok{
@@ -157,8 +186,12 @@ func (cs *CharScanner) tokenize() Token {
 		pos := cs.s.Pos()
 		cs.s.Next()
 		if cs.s.Peek() == '/' {
-			cs.handleComment()
-			return &TokenComment{}
+			return &TokenComment{
+				value: "/" + cs.handleComment(),
+				tok: tok{
+					pos: pos,
+				},
+			}
 		}
 		return &TokenDiv{
 			tok: tok{
@@ -211,6 +244,7 @@ func (cs *CharScanner) tokenize() Token {
 		pos := cs.s.Pos()
 		cs.s.Next()
 		if cs.s.Peek() == '=' {
+			cs.s.Next()
 			return &TokenNotEqual{
 				tok: tok{
 					pos: pos,
@@ -233,16 +267,27 @@ func (cs *CharScanner) tokenize() Token {
 				},
 			}
 		}
+		return &TokenUnknown{
+			tok: tok{
+				pos: pos,
+			},
+		}
 	case '|':
 		pos := cs.s.Pos()
 		cs.s.Next()
 		if cs.s.Peek() == '|' {
+			cs.s.Next()
 			return &TokenLogicalOr{
 				tok: tok{
 					pos: pos,
 				},
 			}
 		}
+		return &TokenUnknown{
+			tok: tok{
+				pos: pos,
+			},
+		}
 	case ':':
 		pos := cs.s.Pos()
 		cs.s.Next()
@@ -251,6 +296,38 @@ func (cs *CharScanner) tokenize() Token {
 				pos: pos,
 			},
 		}
+	case '.':
+		pos := cs.s.Pos()
+		cs.s.Next()
+		return &TokenDot{
+			tok: tok{
+				pos: pos,
+			},
+		}
+	case '[':
+		pos := cs.s.Pos()
+		cs.s.Next()
+		return &TokenOpenBracket{
+			tok: tok{
+				pos: pos,
+			},
+		}
+	case ']':
+		pos := cs.s.Pos()
+		cs.s.Next()
+		return &TokenCloseBracket{
+			tok: tok{
+				pos: pos,
+			},
+		}
+	case '@':
+		pos := cs.s.Pos()
+		cs.s.Next()
+		return &TokenAt{
+			tok: tok{
+				pos: pos,
+			},
+		}
 	case ',':
 		pos := cs.s.Pos()
 		cs.s.Next()
@@ -278,8 +355,11 @@ func (cs *CharScanner) tokenize() Token {
 			},
 		}
 	}
+}
 
-	return &TokenUnknown{}
+func isEOF(token Token) bool {
+	_, ok := token.(*TokenEOF)
+	return ok
 }
 
 func (cs *CharScanner) peek() rune {
@@ -324,6 +404,12 @@ func (cs *CharScanner) tokenizeNumber() *TokenNumber {
 func (cs *CharScanner) tokenizeString() *TokenString {
 	var tokenValue []rune
 	for cs.s.Peek() != '"' {
+		if cs.s.Peek() == scanner.EOF {
+			return &TokenString{
+				value:        string(tokenValue),
+				unterminated: true,
+			}
+		}
 		// handling escape sequences
 		if cs.s.Peek() == '\\' {
 			cs.s.Next()
@@ -332,6 +418,12 @@ func (cs *CharScanner) tokenizeString() *TokenString {
 				tokenValue = append(tokenValue, '\n')
 			case 'r':
 				tokenValue = append(tokenValue, '\r')
+			case 't':
+				tokenValue = append(tokenValue, '\t')
+			case '\\', '"':
+				tokenValue = append(tokenValue, cs.s.Peek())
+			case scanner.EOF:
+				continue
 			}
 			cs.s.Next()
 			continue
@@ -348,30 +440,46 @@ func (cs *CharScanner) tokenizeString() *TokenString {
 	}
 }
 
-func (cs *CharScanner) handleComment() {
-	for cs.s.Peek() != '\n' && cs.s.Peek() != '\r' {
-		cs.s.Next()
+// handleComment consumes the rest of the line, returns the consumed text
+func (cs *CharScanner) handleComment() string {
+	var text []rune
+	for cs.s.Peek() != '\n' && cs.s.Peek() != '\r' && cs.s.Peek() != scanner.EOF {
+		text = append(text, cs.s.Next())
 	}
+	return string(text)
 }
 
-func (cs *CharScanner) tokenizeKeyword(kwd string) Token {
+func (cs *CharScanner) tokenizeKeyword(kwd string, pos scanner.Position) Token {
+	var t = tok{
+		pos: pos,
+	}
 	switch kwd {
 	case "val":
-		return &TokenVal{}
+		return &TokenVal{t}
 	case "var":
-		return &TokenVar{}
+		return &TokenVar{t}
 	case "if":
-		return &TokenIf{}
+		return &TokenIf{t}
 	case "else":
-		return &TokenElse{}
+		return &TokenElse{t}
 	case "while":
-		return &TokenWhile{}
+		return &TokenWhile{t}
 	case "def":
-		return &TokenDef{}
+		return &TokenDef{t}
 	case "return":
-		return &TokenReturn{}
+		return &TokenReturn{t}
+	case "throw":
+		return &TokenThrow{t}
+	case "try":
+		return &TokenTry{t}
+	case "catch":
+		return &TokenCatch{t}
+	case "finally":
+		return &TokenFinally{t}
+	case "case":
+		return &TokenCase{t}
 	default:
-		return &TokenUnknown{}
+		return &TokenUnknown{t}
 	}
 }
 
@@ -384,7 +492,7 @@ func isKeyword(kwd string) bool {
 	switch kwd {
 	default:
 		return false
-	case "val", "var", "if", "else", "while", "def", "return":
+	case "val", "var", "if", "else", "while", "def", "return", "throw", "try", "catch", "finally", "case":
 		return true
 	}
 }
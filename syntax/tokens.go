@@ -122,12 +122,30 @@ type (
 		tok
 	}
 
+	TokenAt struct {
+		tok
+	}
+
+	TokenDot struct {
+		tok
+	}
+
+	TokenOpenBracket struct {
+		tok
+	}
+
+	TokenCloseBracket struct {
+		tok
+	}
+
 	TokenIdent struct {
 		value string
 		tok
 	}
 
+	// the text of a line comment, including the leading //
 	TokenComment struct {
+		value string
 		tok
 	}
 
@@ -139,6 +157,8 @@ type (
 
 	TokenString struct {
 		value string
+		// the closing quote is missing
+		unterminated bool
 		tok
 	}
 
@@ -154,6 +174,31 @@ type (
 		tok
 	}
 
+	TokenThrow struct {
+		tok
+	}
+
+	TokenTry struct {
+		tok
+	}
+
+	TokenCatch struct {
+		tok
+	}
+
+	TokenFinally struct {
+		tok
+	}
+
+	TokenCase struct {
+		tok
+	}
+
+	// =>
+	TokenArrow struct {
+		tok
+	}
+
 	TokenEOF struct {
 		tok
 	}
@@ -221,6 +266,28 @@ func tokToString(token Token) string {
 		return "TokenCloseParen"
 	case *TokenReturn:
 		return "TokenReturn"
+	case *TokenAt:
+		return "TokenAt"
+	case *TokenDot:
+		return "TokenDot"
+	case *TokenOpenBracket:
+		return "TokenOpenBracket"
+	case *TokenCloseBracket:
+		return "TokenCloseBracket"
+	case *TokenElse:
+		return "TokenElse"
+	case *TokenThrow:
+		return "TokenThrow"
+	case *TokenTry:
+		return "TokenTry"
+	case *TokenCatch:
+		return "TokenCatch"
+	case *TokenFinally:
+		return "TokenFinally"
+	case *TokenCase:
+		return "TokenCase"
+	case *TokenArrow:
+		return "TokenArrow"
 	case *TokenEOF:
 		return "TokenEOF"
 	default:
@@ -0,0 +1,127 @@
+package syntax
+
+// Inspect traverses the tree rooted at node in depth-first order, calling f for every
+// node met, nil children excluded. Children of a node are visited only if f returns true
+// for it. Names held by value, like the one of ValDeclStmt, are passed by pointer
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	inspect := func(nodes ...Node) {
+		for _, child := range nodes {
+			if child != nil && !isNilNode(child) {
+				Inspect(child, f)
+			}
+		}
+	}
+
+	switch node.(type) {
+	case *Program:
+		for _, stmt := range node.(*Program).StmtList {
+			inspect(stmt)
+		}
+	case *BlockStmt:
+		for _, stmt := range node.(*BlockStmt).Stmts {
+			inspect(stmt)
+		}
+	case *Operation:
+		operation := node.(*Operation)
+		inspect(operation.Lhs, operation.Rhs)
+	case *Field:
+		field := node.(*Field)
+		for _, annotation := range field.Annotations {
+			inspect(annotation)
+		}
+		inspect(field.Name, field.Type)
+	case *Cast:
+		cast := node.(*Cast)
+		inspect(cast.X, cast.Type)
+	case *TypeTest:
+		typeTest := node.(*TypeTest)
+		inspect(typeTest.X, typeTest.Type)
+	case *Annotation:
+		inspect(node.(*Annotation).Name)
+	case *Call:
+		call := node.(*Call)
+		inspect(call.CalleeName)
+		for _, arg := range call.ArgList {
+			inspect(arg)
+		}
+	case *WhileStmt:
+		whileStmt := node.(*WhileStmt)
+		inspect(whileStmt.Cond, whileStmt.Body)
+	case *IfStmt:
+		ifStmt := node.(*IfStmt)
+		inspect(ifStmt.Cond, ifStmt.Body, ifStmt.ElseBody)
+	case *ReturnStmt:
+		inspect(node.(*ReturnStmt).Value)
+	case *ThrowStmt:
+		inspect(node.(*ThrowStmt).Value)
+	case *TryStmt:
+		tryStmt := node.(*TryStmt)
+		inspect(tryStmt.Body)
+		for _, catchClause := range tryStmt.Cases {
+			inspect(catchClause)
+		}
+		inspect(tryStmt.Finally)
+	case *CatchClause:
+		catchClause := node.(*CatchClause)
+		inspect(catchClause.Name, catchClause.Type, catchClause.Body)
+	case *Assignment:
+		assignment := node.(*Assignment)
+		inspect(assignment.Lhs, assignment.Rhs)
+	case *VarDeclStmt:
+		varDeclStmt := node.(*VarDeclStmt)
+		for _, annotation := range varDeclStmt.Annotations {
+			inspect(annotation)
+		}
+		inspect(&varDeclStmt.Name, varDeclStmt.Type, varDeclStmt.Rhs)
+	case *ValDeclStmt:
+		valDeclStmt := node.(*ValDeclStmt)
+		for _, annotation := range valDeclStmt.Annotations {
+			inspect(annotation)
+		}
+		inspect(&valDeclStmt.Name, valDeclStmt.Type, valDeclStmt.Rhs)
+	case *DefDeclStmt:
+		defDeclStmt := node.(*DefDeclStmt)
+		for _, annotation := range defDeclStmt.Annotations {
+			inspect(annotation)
+		}
+		inspect(defDeclStmt.Name)
+		for _, param := range defDeclStmt.ParamList {
+			inspect(param)
+		}
+		inspect(defDeclStmt.ReturnType, defDeclStmt.Body)
+	}
+}
+
+// Defs returns functions defined among stmts, functions nested in them included,
+// in the order they're defined in
+func Defs(stmts []Stmt) []*DefDeclStmt {
+	var defs []*DefDeclStmt
+	for _, stmt := range stmts {
+		Inspect(stmt, func(node Node) bool {
+			if defDeclStmt, ok := node.(*DefDeclStmt); ok {
+				defs = append(defs, defDeclStmt)
+			}
+			return true
+		})
+	}
+	return defs
+}
+
+// isNilNode reports whether the node is a typed nil, e.g. a missing *BlockStmt
+// stored in an interface
+func isNilNode(node Node) bool {
+	switch node.(type) {
+	case *BlockStmt:
+		return node.(*BlockStmt) == nil
+	case *Name:
+		return node.(*Name) == nil
+	case *Operation:
+		return node.(*Operation) == nil
+	case *CatchClause:
+		return node.(*CatchClause) == nil
+	}
+	return false
+}
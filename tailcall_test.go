@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestTailCalls checks that calls in tail position nest as deep as they like on backends
+// which make them take over the caller's frame. Code made by build and gen-go only loops
+// calls functions make to themselves, see backendtest.TailCalls
+func TestTailCalls(t *testing.T) {
+	src := `def count(n: Int, acc: Int): Int {
+    if (n == 0) {
+        return acc
+    }
+    if (n % 2 == 0) {
+        return count(n - 1, acc + 1)
+    }
+    return skip(n, acc)
+}
+
+def skip(n: Int, acc: Int): Int {
+    return count(n - 1, acc)
+}
+
+def loop(n: Int): Unit {
+    if (n > 0) {
+        loop(n - 1)
+    }
+}
+
+def main(): Unit {
+    loop(100000)
+    print(to_string(count(100000, 0)))
+}
+`
+	for _, backendName := range []string{"vm", "vm-O", "tree", "ir", "ir-O"} {
+		var stdout, stderr bytes.Buffer
+		optimized := strings.HasSuffix(backendName, "-O")
+		exitCode := runSource("tailcall.miniscala", strings.NewReader(src), strings.TrimSuffix(backendName, "-O"), optimized, &stdout, &stderr)
+		if exitCode != 0 || stdout.String() != "50000" {
+			t.Errorf("%s: exit status %d, output %q, expected 50000\n%s", backendName, exitCode, stdout.String(), stderr.String())
+		}
+	}
+}
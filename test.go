@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"github.com/ThreadedStream/miniscala/vm"
+	"os"
+	"regexp"
+	"strings"
+	"text/scanner"
+	"time"
+)
+
+const (
+	testFileSuffix = "_test" + sourceExt
+	testFuncPrefix = "test_"
+)
+
+// testOutcome tells how a single test ended
+type testOutcome int
+
+const (
+	testPassed testOutcome = iota
+	// an assertion didn't hold
+	testFailed
+	// the test raised an exception other than AssertionError, or couldn't be run at all
+	testErrored
+)
+
+type testResult struct {
+	name    string
+	outcome testOutcome
+	// kind and message of the exception which stopped the test
+	kind    string
+	message string
+	pos     scanner.Position
+	elapsed time.Duration
+}
+
+// fileResult holds results of tests found in a single file
+type fileResult struct {
+	path string
+	// buildErrors are syntax and type errors which prevented running the tests
+	buildErrors []string
+	tests       []testResult
+	// internalErrors are tests the runner broke down on, which tell nothing about the tests
+	internalErrors []internalError
+	elapsed        time.Duration
+}
+
+// internalError is a test which couldn't be run, as the vm panicked on it
+type internalError struct {
+	test string
+	err  string
+}
+
+func (r *fileResult) failed() bool {
+	if len(r.buildErrors) > 0 || len(r.internalErrors) > 0 {
+		return true
+	}
+	for _, test := range r.tests {
+		if test.outcome != testPassed {
+			return true
+		}
+	}
+	return false
+}
+
+// testCmd implements 'miniscala test', returns the exit code
+func testCmd(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "report every test, not only failing ones")
+	run := flags.String("run", "", "run only tests whose names match the regular expression")
+	junit := flags.String("junit", "", "write a JUnit XML report to the file")
+	timeout := flags.Duration("timeout", 10*time.Second, "fail a test running longer than the duration, 0 for no limit")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: miniscala test [-v] [-run regexp] [-timeout d] [-junit file] [path ...]\n\n")
+		fmt.Fprintf(os.Stderr, "Runs %s functions found in *%s files under paths, the current directory by default.\n",
+			testFuncPrefix+"*(): Unit", testFileSuffix)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad -run pattern: %v\n", err)
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var files []string
+	for _, path := range paths {
+		found, err := sourceFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, file := range found {
+			// files given explicitly are taken as they are
+			if file == path || strings.HasSuffix(file, testFileSuffix) {
+				files = append(files, file)
+			}
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "no test files")
+		return 1
+	}
+
+	exitCode := 0
+	var results []*fileResult
+	for _, file := range files {
+		result := testFile(file, filter, *verbose, *timeout)
+		results = append(results, result)
+		if result.failed() {
+			exitCode = 1
+		}
+	}
+	if *junit != "" {
+		if err := writeJUnitReport(*junit, results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return exitCode
+}
+
+// testFile runs tests of a single file matching filter, reporting them to stdout as they finish
+func testFile(path string, filter *regexp.Regexp, verbose bool, timeout time.Duration) *fileResult {
+	result := &fileResult{path: path}
+	start := time.Now()
+	defer func() {
+		result.elapsed = time.Since(start)
+		switch {
+		case len(result.buildErrors) > 0:
+			fmt.Printf("FAIL\t%s [build failed]\n", path)
+		case len(result.internalErrors) > 0:
+			fmt.Printf("FAIL\t%s [internal error]\n", path)
+		case result.failed():
+			fmt.Printf("FAIL\t%s\t%.3fs\n", path, result.elapsed.Seconds())
+		case len(result.tests) == 0:
+			fmt.Printf("ok  \t%s\t%.3fs [no tests to run]\n", path, result.elapsed.Seconds())
+		default:
+			fmt.Printf("ok  \t%s\t%.3fs\n", path, result.elapsed.Seconds())
+		}
+	}()
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		result.buildErrors = append(result.buildErrors, err.Error())
+		fmt.Println(err)
+		return result
+	}
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(string(src)))
+	for _, err := range syntaxErrors {
+		result.buildErrors = append(result.buildErrors, fmt.Sprintf("%s:%d:%d: %s", path, err.Pos.Line, err.Pos.Column, err.Msg))
+	}
+	if len(syntaxErrors) == 0 {
+		info := typecheck.NewChecker().Check(program)
+		for _, err := range info.Errors {
+			result.buildErrors = append(result.buildErrors, fmt.Sprintf("%s:%d:%d: %s", path, err.Pos.Line, err.Pos.Column, err.Msg))
+		}
+		if !info.HadErrors() {
+			for _, stmt := range program.StmtList {
+				defDeclStmt, ok := stmt.(*syntax.DefDeclStmt)
+				if !ok || !strings.HasPrefix(defDeclStmt.Name.Value, testFuncPrefix) || !filter.MatchString(defDeclStmt.Name.Value) {
+					continue
+				}
+				if verbose {
+					fmt.Printf("=== RUN   %s\n", defDeclStmt.Name.Value)
+				}
+				test, err := runTest(program, info, defDeclStmt, timeout)
+				if err != nil {
+					result.internalErrors = append(result.internalErrors, internalError{test: test.name, err: err.Error()})
+					fmt.Printf("--- FAIL: %s\n    %s: %v\n", test.name, path, err)
+					continue
+				}
+				result.tests = append(result.tests, test)
+				reportTest(path, test, verbose)
+			}
+		}
+	}
+	for _, err := range result.buildErrors {
+		fmt.Println(err)
+	}
+	return result
+}
+
+// runTest runs top-level statements of the program, followed by the test function, in a VM
+// of their own, giving up on the test once it runs longer than timeout, unless that's zero.
+// An error is returned if the vm panics, rather than the program raises an exception
+func runTest(program *syntax.Program, info *typecheck.Result, defDeclStmt *syntax.DefDeclStmt, timeout time.Duration) (result testResult, err error) {
+	result.name = defDeclStmt.Name.Value
+	if len(defDeclStmt.ParamList) > 0 || info.TypeOf(defDeclStmt.ReturnType) != backing.Unit {
+		result.outcome = testErrored
+		result.message = fmt.Sprintf("test function %s must take no arguments and return Unit", result.name)
+		result.pos = defDeclStmt.Pos()
+		return result, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		result.elapsed = time.Since(start)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	machine := vm.NewVMWithEntry(program, info, result.name)
+	if timeout > 0 {
+		machine.SetDeadline(start.Add(timeout))
+	}
+	runErr := machine.Run()
+	if runErr == nil {
+		return result, nil
+	}
+	if runErr == vm.ErrDeadline {
+		result.outcome = testErrored
+		result.message = fmt.Sprintf("test timed out after %v", timeout)
+		result.pos = defDeclStmt.Pos()
+		return result, nil
+	}
+	exception := runErr.(*backing.ExceptionValue)
+	result.outcome = testErrored
+	if exception.Kind == backing.AssertionError {
+		result.outcome = testFailed
+	}
+	result.kind = exception.Kind
+	result.message = exception.Message
+	result.pos = exception.Pos
+	return result, nil
+}
+
+func reportTest(path string, test testResult, verbose bool) {
+	if test.outcome == testPassed {
+		if verbose {
+			fmt.Printf("--- PASS: %s (%.3fs)\n", test.name, test.elapsed.Seconds())
+		}
+		return
+	}
+	fmt.Printf("--- FAIL: %s (%.3fs)\n", test.name, test.elapsed.Seconds())
+	fmt.Printf("    %s\n", test.describe(path))
+}
+
+// describe tells where and why the test didn't pass
+func (r testResult) describe(path string) string {
+	var res strings.Builder
+	res.WriteString(path)
+	if r.pos.Line > 0 {
+		fmt.Fprintf(&res, ":%d:%d", r.pos.Line, r.pos.Column)
+	}
+	res.WriteString(": ")
+	if r.kind != "" {
+		res.WriteString(r.kind + ": ")
+	}
+	res.WriteString(r.message)
+	return res.String()
+}
+
+// JUnit XML report, in the shape understood by most CI servers
+type (
+	junitTestSuites struct {
+		XMLName  xml.Name         `xml:"testsuites"`
+		Tests    int              `xml:"tests,attr"`
+		Failures int              `xml:"failures,attr"`
+		Errors   int              `xml:"errors,attr"`
+		Time     string           `xml:"time,attr"`
+		Suites   []junitTestSuite `xml:"testsuite"`
+	}
+
+	junitTestSuite struct {
+		Name     string          `xml:"name,attr"`
+		Tests    int             `xml:"tests,attr"`
+		Failures int             `xml:"failures,attr"`
+		Errors   int             `xml:"errors,attr"`
+		Time     string          `xml:"time,attr"`
+		Cases    []junitTestCase `xml:"testcase"`
+	}
+
+	junitTestCase struct {
+		Name      string        `xml:"name,attr"`
+		ClassName string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitProblem `xml:"failure,omitempty"`
+		Error     *junitProblem `xml:"error,omitempty"`
+	}
+
+	junitProblem struct {
+		Message string `xml:"message,attr"`
+		Type    string `xml:"type,attr,omitempty"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+func writeJUnitReport(path string, results []*fileResult) error {
+	var report junitTestSuites
+	var elapsed time.Duration
+	for _, result := range results {
+		suite := junitTestSuite{
+			Name: result.path,
+			Time: seconds(result.elapsed),
+		}
+		if len(result.buildErrors) > 0 {
+			// a suite which failed to build holds a single errored case
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      "build",
+				ClassName: result.path,
+				Time:      seconds(0),
+				Error: &junitProblem{
+					Message: "build failed",
+					Text:    strings.Join(result.buildErrors, "\n"),
+				},
+			})
+			suite.Errors++
+		}
+		for _, internal := range result.internalErrors {
+			suite.Cases = append(suite.Cases, junitTestCase{
+				Name:      internal.test,
+				ClassName: result.path,
+				Time:      seconds(0),
+				Error: &junitProblem{
+					Message: "internal error",
+					Text:    internal.err,
+				},
+			})
+			suite.Errors++
+		}
+		for _, test := range result.tests {
+			testCase := junitTestCase{
+				Name:      test.name,
+				ClassName: result.path,
+				Time:      seconds(test.elapsed),
+			}
+			problem := &junitProblem{
+				Message: test.message,
+				Type:    test.kind,
+				Text:    test.describe(result.path),
+			}
+			switch test.outcome {
+			case testFailed:
+				testCase.Failure = problem
+				suite.Failures++
+			case testErrored:
+				testCase.Error = problem
+				suite.Errors++
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Tests = len(suite.Cases)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		elapsed += result.elapsed
+		report.Suites = append(report.Suites, suite)
+	}
+	report.Time = seconds(elapsed)
+
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const failingTests = `def test_passes(): Unit {
+    assertEquals(4, 2 + 2)
+}
+
+def test_fails(): Unit {
+    assertEquals(5, 2 + 2)
+}
+
+def test_asserts(): Unit {
+    assert(1 > 2, "one isn't greater than two")
+}
+
+def test_divides(): Unit {
+    print(to_string(1 / 0))
+}
+
+def test_loops(): Unit {
+    var i = 0
+    while (i >= 0) {
+        i = (i + 1) % 10
+    }
+}
+`
+
+// writeTests writes src to a test file in a temporary directory and returns its path
+func writeTests(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "failing"+testFileSuffix)
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestOutcomes checks that a failing assertion fails a test, any other exception
+// and running out of time make it errored
+func TestOutcomes(t *testing.T) {
+	path := writeTests(t, failingTests)
+	result := testFile(path, regexp.MustCompile(""), false, 100*time.Millisecond)
+	if len(result.buildErrors) > 0 {
+		t.Fatal(result.buildErrors)
+	}
+	expected := []struct {
+		name    string
+		outcome testOutcome
+		desc    string
+	}{
+		{"test_passes", testPassed, ""},
+		{"test_fails", testFailed, path + ":6:5: AssertionError: expected 5 (Int), but got 4 (Int)"},
+		{"test_asserts", testFailed, path + ":10:5: AssertionError: one isn't greater than two"},
+		{"test_divides", testErrored, path + ":14:5: ArithmeticException: / by zero"},
+		{"test_loops", testErrored, path + ":17:1: test timed out after 100ms"},
+	}
+	if len(result.tests) != len(expected) {
+		t.Fatalf("%d tests run, expected %d", len(result.tests), len(expected))
+	}
+	for idx, test := range result.tests {
+		desc := ""
+		if test.outcome != testPassed {
+			desc = test.describe(path)
+		}
+		if test.name != expected[idx].name || test.outcome != expected[idx].outcome || desc != expected[idx].desc {
+			t.Errorf("%s: outcome %d, %q, expected %s: outcome %d, %q", test.name, test.outcome, desc,
+				expected[idx].name, expected[idx].outcome, expected[idx].desc)
+		}
+	}
+	if !result.failed() {
+		t.Error("file with failing tests didn't fail")
+	}
+}
+
+// TestJUnitReport checks the report written by 'miniscala test -junit' on tests which
+// pass, fail and error out, and on a file which doesn't build
+func TestJUnitReport(t *testing.T) {
+	path := writeTests(t, failingTests)
+	broken := filepath.Join(filepath.Dir(path), "broken"+testFileSuffix)
+	if err := os.WriteFile(broken, []byte("def test_broken(): Unit {\n    val x: Int = \"x\"\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(t.TempDir(), "report.xml")
+	if code := testCmd([]string{"-timeout", "100ms", "-junit", report, broken, path}); code != 1 {
+		t.Errorf("exit code %d, expected 1", code)
+	}
+	out, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(out, &suites); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	// times vary from run to run
+	suites.Time = ""
+	for idx := range suites.Suites {
+		suites.Suites[idx].Time = ""
+		for jdx := range suites.Suites[idx].Cases {
+			suites.Suites[idx].Cases[jdx].Time = ""
+		}
+	}
+
+	expected := junitTestSuites{
+		XMLName:  xml.Name{Local: "testsuites"},
+		Tests:    6,
+		Failures: 2,
+		Errors:   3,
+		Suites: []junitTestSuite{
+			{
+				Name:   broken,
+				Tests:  1,
+				Errors: 1,
+				Cases: []junitTestCase{{
+					Name:      "build",
+					ClassName: broken,
+					Error: &junitProblem{
+						Message: "build failed",
+						Text:    broken + ":2:12: x is declared as Int, but initialized with String",
+					},
+				}},
+			},
+			{
+				Name:     path,
+				Tests:    5,
+				Failures: 2,
+				Errors:   2,
+				Cases: []junitTestCase{
+					{Name: "test_passes", ClassName: path},
+					{Name: "test_fails", ClassName: path, Failure: &junitProblem{
+						Message: "expected 5 (Int), but got 4 (Int)",
+						Type:    "AssertionError",
+						Text:    path + ":6:5: AssertionError: expected 5 (Int), but got 4 (Int)",
+					}},
+					{Name: "test_asserts", ClassName: path, Failure: &junitProblem{
+						Message: "one isn't greater than two",
+						Type:    "AssertionError",
+						Text:    path + ":10:5: AssertionError: one isn't greater than two",
+					}},
+					{Name: "test_divides", ClassName: path, Error: &junitProblem{
+						Message: "/ by zero",
+						Type:    "ArithmeticException",
+						Text:    path + ":14:5: ArithmeticException: / by zero",
+					}},
+					{Name: "test_loops", ClassName: path, Error: &junitProblem{
+						Message: "test timed out after 100ms",
+						Text:    path + ":17:1: test timed out after 100ms",
+					}},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(suites, expected) {
+		t.Errorf("report\n%s\nexpected %+v", out, expected)
+	}
+}
@@ -0,0 +1,45 @@
+package typecheck
+
+import "github.com/ThreadedStream/miniscala/syntax"
+
+// Terminates reports whether control never flows past stmt, i.e every
+// path through it ends up in a return or a throw statement
+func Terminates(stmt syntax.Stmt) bool {
+	switch stmt.(type) {
+	default:
+		return false
+	case *syntax.ReturnStmt, *syntax.ThrowStmt:
+		return true
+	case *syntax.BlockStmt:
+		blockStmt := stmt.(*syntax.BlockStmt)
+		for _, blockMember := range blockStmt.Stmts {
+			if Terminates(blockMember) {
+				return true
+			}
+		}
+		return false
+	case *syntax.IfStmt:
+		// without else branch, the condition being false lets control through
+		ifStmt := stmt.(*syntax.IfStmt)
+		return ifStmt.ElseBody != nil && Terminates(ifStmt.Body) && Terminates(ifStmt.ElseBody)
+	case *syntax.TryStmt:
+		// a terminating finally block overrides whatever happened before,
+		// otherwise both the body and every catch case have to terminate
+		tryStmt := stmt.(*syntax.TryStmt)
+		if tryStmt.Finally != nil && Terminates(tryStmt.Finally) {
+			return true
+		}
+		if !Terminates(tryStmt.Body) {
+			return false
+		}
+		for _, catchClause := range tryStmt.Cases {
+			if !Terminates(catchClause.Body) {
+				return false
+			}
+		}
+		return true
+	case *syntax.WhileStmt:
+		// the loop's body may be never entered
+		return false
+	}
+}
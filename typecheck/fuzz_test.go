@@ -0,0 +1,31 @@
+package typecheck
+
+import (
+	"github.com/ThreadedStream/miniscala/syntax"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzTypecheck checks that the checker doesn't panic on any program free of syntax errors
+func FuzzTypecheck(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("..", "sources", "*.miniscala"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		program, errors := syntax.ParseErrors(strings.NewReader(src))
+		if len(errors) > 0 {
+			t.Skip()
+		}
+		NewChecker().Check(program)
+	})
+}
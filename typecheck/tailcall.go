@@ -0,0 +1,125 @@
+package typecheck
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+)
+
+// markTailCalls records calls the function makes in tail position, that is calls of
+// functions of the program returning the same type as the function does, which are
+// either returned or, in a function returning Unit, made by the statement it ends with.
+// Nothing is left for the function to do once such a call returns, so backends may have
+// the callee take over the frame of the function. Calls within try statements aren't
+// in tail position, as handlers and finally blocks of the function may still run
+func (c *Checker) markTailCalls(defDeclStmt *syntax.DefDeclStmt, resultType backing.ValueType) {
+	var mark func(stmt syntax.Stmt, last bool)
+	mark = func(stmt syntax.Stmt, last bool) {
+		switch stmt := stmt.(type) {
+		case *syntax.ReturnStmt:
+			if call, ok := stmt.Value.(*syntax.Call); ok {
+				c.markTailCall(call, resultType)
+			}
+		case *syntax.Call:
+			if last && resultType == backing.Unit {
+				c.markTailCall(stmt, resultType)
+			}
+		case *syntax.BlockStmt:
+			for idx, blockMember := range stmt.Stmts {
+				mark(blockMember, last && idx == len(stmt.Stmts)-1)
+			}
+		case *syntax.IfStmt:
+			mark(stmt.Body, last)
+			if stmt.ElseBody != nil {
+				mark(stmt.ElseBody, last)
+			}
+		case *syntax.WhileStmt:
+			// the loop goes on once its body is done
+			mark(stmt.Body, false)
+		}
+	}
+	mark(defDeclStmt.Body, true)
+}
+
+func (c *Checker) markTailCall(call *syntax.Call, resultType backing.ValueType) {
+	if _, ok := c.decls[call.CalleeName].(*syntax.DefDeclStmt); ok && c.types[call] == resultType {
+		c.tailCalls[call] = true
+	}
+}
+
+// checkTailrec makes sure that a function annotated @tailrec calls itself,
+// and only in tail position
+func (c *Checker) checkTailrec(defDeclStmt *syntax.DefDeclStmt) {
+	recursive := false
+	var check func(node syntax.Node)
+	check = func(node syntax.Node) {
+		switch node := node.(type) {
+		case *syntax.DefDeclStmt:
+			// calls made by nested functions are theirs
+			if node != defDeclStmt {
+				return
+			}
+			check(node.Body)
+		case *syntax.Call:
+			if c.decls[node.CalleeName] == defDeclStmt {
+				recursive = true
+				if !c.tailCalls[node] {
+					c.errorf(node.Pos(), "recursive call of %s, which is annotated @tailrec, isn't in tail position",
+						defDeclStmt.Name.Value)
+				}
+			}
+			for _, arg := range node.ArgList {
+				check(arg)
+			}
+		case *syntax.Operation:
+			check(node.Lhs)
+			if node.Rhs != nil {
+				check(node.Rhs)
+			}
+		case *syntax.Cast:
+			check(node.X)
+		case *syntax.TypeTest:
+			check(node.X)
+		case *syntax.BlockStmt:
+			for _, stmt := range node.Stmts {
+				check(stmt)
+			}
+		case *syntax.VarDeclStmt:
+			check(node.Rhs)
+		case *syntax.ValDeclStmt:
+			check(node.Rhs)
+		case *syntax.Assignment:
+			check(node.Rhs)
+		case *syntax.ReturnStmt:
+			if node.Value != nil {
+				check(node.Value)
+			}
+		case *syntax.ThrowStmt:
+			check(node.Value)
+		case *syntax.IfStmt:
+			check(node.Cond)
+			check(node.Body)
+			if node.ElseBody != nil {
+				check(node.ElseBody)
+			}
+		case *syntax.WhileStmt:
+			check(node.Cond)
+			check(node.Body)
+		case *syntax.TryStmt:
+			check(node.Body)
+			for _, catchClause := range node.Cases {
+				check(catchClause.Body)
+			}
+			if node.Finally != nil {
+				check(node.Finally)
+			}
+		}
+	}
+	check(defDeclStmt)
+	if !recursive {
+		for _, annotation := range defDeclStmt.Annotations {
+			if annotation.Name.Value == "tailrec" {
+				c.errorf(annotation.Pos(), "%s is annotated @tailrec, but it doesn't call itself", defDeclStmt.Name.Value)
+			}
+		}
+	}
+}
@@ -5,55 +5,211 @@ import (
 	"github.com/ThreadedStream/miniscala/assert"
 	"github.com/ThreadedStream/miniscala/backing"
 	"github.com/ThreadedStream/miniscala/syntax"
+	"io"
 	"os"
 	"text/scanner"
 )
 
-type typecheckerror struct {
-	fmt  string
-	args []interface{}
+// Error describes a single typecheck failure, or a warning
+type Error struct {
+	Pos scanner.Position
+	Msg string
 }
 
-var (
-	errors    []typecheckerror
-	hadErrors = false
-	// map from reserved functions' names to the type of their parameters
-	//reservedFunctions = map[string][]backing.ValueType{
-	//	"print": {backing.Any},
-	//}
+func (e Error) Error() string {
+	return fmt.Sprintf("[%d:%d] %s", e.Pos.Line, e.Pos.Column, e.Msg)
+}
 
-	venv = &backing.Venv
-	tenv = &backing.Tenv
-)
+// Result is what a Checker produces for a single program
+type Result struct {
+	Errors []Error
+	// Warnings point at suspicious code which doesn't prevent the program from running
+	Warnings []Error
+	// Types maps every checked expression (including calls made as statements
+	// and type names) to its resolved type
+	Types map[syntax.Expr]backing.ValueType
+	// Decls maps names, both declaring and referring ones, to the node declaring them,
+	// i.e *syntax.VarDeclStmt, *syntax.ValDeclStmt, *syntax.DefDeclStmt or *syntax.Field.
+	// Names of runtime functions and types have no declaring node, thus no entry
+	Decls map[*syntax.Name]syntax.Node
+	// TailCalls holds calls made in tail position, see Checker.markTailCalls
+	TailCalls map[*syntax.Call]bool
+}
+
+// TypeOf returns the resolved type of expr, or backing.Undefined if expr
+// was never seen by the checker
+func (r *Result) TypeOf(expr syntax.Expr) backing.ValueType {
+	valueType, ok := r.Types[expr]
+	if !ok {
+		return backing.Undefined
+	}
+	return valueType
+}
+
+// VarType returns the type of the variable declared by decl, i.e the type stated by
+// the declaration, if any, or else the type of the value the variable is initialized with
+func (r *Result) VarType(decl syntax.Node) backing.ValueType {
+	switch decl := decl.(type) {
+	case *syntax.VarDeclStmt:
+		if decl.Type != nil {
+			return r.TypeOf(decl.Type)
+		}
+		return r.TypeOf(decl.Rhs)
+	case *syntax.ValDeclStmt:
+		if decl.Type != nil {
+			return r.TypeOf(decl.Type)
+		}
+		return r.TypeOf(decl.Rhs)
+	case *syntax.Field:
+		return r.TypeOf(decl)
+	case *syntax.CatchClause:
+		return backing.Exception
+	}
+	return backing.Undefined
+}
+
+func (r *Result) HadErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// Report writes errors and warnings to w, one per line
+func (r *Result) Report(w io.Writer) {
+	for _, err := range r.Errors {
+		fmt.Fprintln(w, err.Error())
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "[%d:%d] warning: %s\n", warning.Pos.Line, warning.Pos.Column, warning.Msg)
+	}
+}
 
-func typecheckError(format string, args ...interface{}) {
-	errors = append(errors, typecheckerror{
-		fmt:  format,
-		args: args,
+// Checker owns the value and type environments used during typechecking.
+// Since no state is shared between checkers, distinct programs can be
+// checked in parallel, each one by its own Checker
+type Checker struct {
+	venv     backing.SymbolTable
+	tenv     backing.SymbolTable
+	errors   []Error
+	warnings []Error
+	types    map[syntax.Expr]backing.ValueType
+	decls    map[*syntax.Name]syntax.Node
+	// calls made in tail position
+	tailCalls map[*syntax.Call]bool
+	// references to declarations, in the order declarations were made
+	usages  map[syntax.Node]*usage
+	tracked []syntax.Node
+	// entry of the function whose body is being checked, nil at the top level
+	fun *backing.EnvEntry
+	// whether names declared by the last input given to CheckInput are still in scope
+	inputInScope bool
+}
+
+func NewChecker() *Checker {
+	c := new(Checker)
+	c.venv = backing.BaseValueEnv()
+	c.tenv = backing.BaseTypeEnv()
+	return c
+}
+
+func (c *Checker) errorf(pos scanner.Position, format string, args ...interface{}) {
+	c.errors = append(c.errors, Error{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
 	})
-	hadErrors = true
 }
 
-func Typecheck(program *syntax.Program) bool {
+func (c *Checker) warnf(pos scanner.Position, format string, args ...interface{}) {
+	c.warnings = append(c.warnings, Error{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check typechecks the program against environments of c. The environments outlive
+// the call, so that names declared by one program remain visible to the next one
+func (c *Checker) Check(program *syntax.Program) *Result {
+	assert.Assert(program != nil, "program is nil!!!")
+	c.reset()
+	c.typecheckProgram(program, backing.OutermostLevel())
+	c.reportUnused()
+	return c.result()
+}
+
+// CheckInput typechecks a single input of an interactive session. Unlike Check, it leaves
+// the value env as it was if the input turns out to be ill-typed, so that a mistake
+// doesn't leave half-declared names behind. Declarations aren't reported as unused,
+// since inputs to come may still refer to them
+func (c *Checker) CheckInput(program *syntax.Program) *Result {
 	assert.Assert(program != nil, "program is nil!!!")
-	*venv = backing.BaseValueEnv()
-	*tenv = backing.BaseTypeEnv()
-	level := backing.OutermostLevel()
-	//typifyReservedFunctions()
-	typecheckProgram(program, level)
-	if hadErrors {
-		for _, err := range errors {
-			fmt.Fprintf(os.Stderr, err.fmt, err.args...)
+	c.reset()
+	backing.SBeginScope(c.venv)
+	c.typecheckProgram(program, backing.OutermostLevel())
+	c.inputInScope = len(c.errors) == 0
+	if !c.inputInScope {
+		backing.SEndScope(c.venv)
+	}
+	return c.result()
+}
+
+// DiscardInput forgets names declared by the input which was last given to CheckInput,
+// e.g. because running it failed, so they never got their values
+func (c *Checker) DiscardInput() {
+	if !c.inputInScope {
+		return
+	}
+	backing.SEndScope(c.venv)
+	c.inputInScope = false
+}
+
+// CheckExpr typechecks a standalone expression against environments of c
+func (c *Checker) CheckExpr(expr syntax.Expr) *Result {
+	assert.Assert(expr != nil, "expr is nil!!!")
+	c.reset()
+	c.typecheckExpr(expr, backing.OutermostLevel())
+	return c.result()
+}
+
+// Visible returns entries of names visible at the top level of programs checked by c,
+// runtime functions included. A name declared more than once maps to its latest entry
+func (c *Checker) Visible() map[string]*backing.EnvEntry {
+	visible := make(map[string]*backing.EnvEntry)
+	backing.SDump(c.venv, func(sym *backing.Symbol, value interface{}) {
+		if _, ok := visible[sym.Name]; ok {
+			return
+		}
+		if entry, ok := value.(*backing.EnvEntry); ok {
+			visible[sym.Name] = entry
 		}
+	})
+	return visible
+}
+
+func (c *Checker) reset() {
+	c.errors = nil
+	c.warnings = nil
+	c.types = make(map[syntax.Expr]backing.ValueType)
+	c.decls = make(map[*syntax.Name]syntax.Node)
+	c.tailCalls = make(map[*syntax.Call]bool)
+	c.usages = make(map[syntax.Node]*usage)
+	c.tracked = nil
+}
+
+func (c *Checker) result() *Result {
+	return &Result{
+		Errors:    c.errors,
+		Warnings:  c.warnings,
+		Types:     c.types,
+		Decls:     c.decls,
+		TailCalls: c.tailCalls,
 	}
-	return hadErrors
 }
 
-//func typifyReservedFunctions() {
-//	for name, paramTypes := range reservedFunctions {
-//		backing.StoreType(name, backing.Unit, true, paramTypes, nil)
-//	}
-//}
+// Typecheck checks the program with a fresh Checker, reports errors to stderr
+// and returns true if there were any
+func Typecheck(program *syntax.Program) bool {
+	result := NewChecker().Check(program)
+	result.Report(os.Stderr)
+	return result.HadErrors()
+}
 
 func typecheckUnary(targetType backing.ValueType, op syntax.Operator) (backing.ValueType, bool) {
 	switch op {
@@ -78,11 +234,77 @@ func typecheckUnary(targetType backing.ValueType, op syntax.Operator) (backing.V
 	}
 }
 
-func typecheckExpr(expr syntax.Expr, level *backing.Level) backing.ValueType {
+// typecheckExpr infers the type of expr and records it in the side table
+func (c *Checker) typecheckExpr(expr syntax.Expr, level *backing.Level) backing.ValueType {
+	valueType := c.inferExpr(expr, level)
+	c.types[expr] = valueType
+	return valueType
+}
+
+// typecheckValue is typecheckExpr for an expression whose value is used, which rules out
+// calls of functions returning Unit: none of the backends but the tree-walking interpreter
+// represent a value of type Unit
+func (c *Checker) typecheckValue(expr syntax.Expr, level *backing.Level) backing.ValueType {
+	valueType := c.typecheckExpr(expr, level)
+	if valueType == backing.Unit {
+		errorPos := expr.Pos()
+		c.errorf(errorPos, "expression of type Unit has no value to use")
+		return backing.Undefined
+	}
+	return valueType
+}
+
+// checkCapture complains if the variable entry belongs to code enclosing the function at
+// level, be it another function or a top-level block. Functions may only refer to their
+// own variables and global ones
+func (c *Checker) checkCapture(name *syntax.Name, entry *backing.EnvEntry, level *backing.Level) {
+	if entry.Kind != backing.EntryVar || entry.Level == blockLevel(level) || entry.Level == backing.OutermostLevel() {
+		return
+	}
+	errorPos := name.Pos()
+	c.errorf(errorPos, "function %s can't refer to %s, which is neither its own variable nor a global one",
+		level.Label, name.Value)
+}
+
+// topLevelBlock is the level of variables declared by blocks nested in top-level code,
+// which aren't global
+var topLevelBlock = backing.NewLevel("", backing.OutermostLevel())
+
+// blockLevel returns the level of variables declared by a block nested in code at level
+func blockLevel(level *backing.Level) *backing.Level {
+	if level == backing.OutermostLevel() {
+		return topLevelBlock
+	}
+	return level
+}
+
+// declare enters an entry for name declared by decl into the value env
+func (c *Checker) declare(name *syntax.Name, entry *backing.EnvEntry, decl syntax.Node) {
+	entry.Decl = decl
+	c.decls[name] = decl
+	c.track(decl)
+	backing.SEnter(c.venv, backing.SSymbol(name.Value), entry)
+}
+
+// lookup returns the value env entry associated with name, recording the declaration
+// it refers to, or nil if there's no such entry
+func (c *Checker) lookup(name *syntax.Name) *backing.EnvEntry {
+	entry := backing.SLook(c.venv, backing.SSymbol(name.Value))
+	if entry == nil {
+		return nil
+	}
+	envEntry := entry.(*backing.EnvEntry)
+	if envEntry.Decl != nil {
+		c.decls[name] = envEntry.Decl
+	}
+	return envEntry
+}
+
+func (c *Checker) inferExpr(expr syntax.Expr, level *backing.Level) backing.ValueType {
 	switch expr.(type) {
 	default:
 		errorPos := expr.Pos()
-		typecheckError("[%d:%d] undefined type\n", errorPos.Line, errorPos.Column)
+		c.errorf(errorPos, "undefined type")
 		return backing.Undefined
 	case *syntax.BasicLit:
 		basicLit := expr.(*syntax.BasicLit)
@@ -90,244 +312,271 @@ func typecheckExpr(expr syntax.Expr, level *backing.Level) backing.ValueType {
 	case *syntax.Name:
 		name := expr.(*syntax.Name)
 		// name can be a type, as well as a value
-		entry := backing.SLook(*venv, backing.SSymbol(name.Value))
+		entry := c.lookup(name)
 		if entry == nil {
 			// probably, this is just a type name
-			valueType := backing.SLook(*tenv, backing.SSymbol(name.Value))
+			valueType := backing.SLook(c.tenv, backing.SSymbol(name.Value))
 			if valueType == nil {
 				errorPos := name.Pos()
-				typecheckError("[%d:%d] name %s is neither a type name nor var, nor val\n", errorPos.Line, errorPos.Column, name.Value)
+				c.errorf(errorPos, "name %s is neither a type name nor var, nor val", name.Value)
 				return backing.Undefined
 			}
 			return valueType.(backing.ValueType)
 		}
-		return entry.(*backing.EnvEntry).ResultType
+		c.markRead(entry)
+		c.checkCapture(name, entry, level)
+		return entry.ResultType
 	case *syntax.Field:
 		field := expr.(*syntax.Field)
-		return typecheckExpr(field.Type, level)
+		return c.typecheckExpr(field.Type, level)
 	case *syntax.Operation:
 		var lhsType, rhsType backing.ValueType
 		operation := expr.(*syntax.Operation)
-		lhsType = typecheckExpr(operation.Lhs, level)
+		lhsType = c.typecheckExpr(operation.Lhs, level)
 		if operation.Rhs == nil {
 			// handling unary
 			resultingType, ok := typecheckUnary(lhsType, operation.Op)
 			if !ok {
 				errorPos := operation.Pos()
-				typecheckError("[%d:%d] unary %d didn't expect expression of type %s", errorPos.Line, errorPos.Column,
+				c.errorf(errorPos, "unary %d didn't expect expression of type %s",
 					operation.Op, backing.ValueTypeToStr(resultingType))
 				return backing.Undefined
 			}
 			return resultingType
 		}
-		rhsType = typecheckExpr(operation.Rhs, level)
+		rhsType = c.typecheckExpr(operation.Rhs, level)
+		if lhsType == backing.Undefined || rhsType == backing.Undefined {
+			// the error has been already reported
+			return backing.Undefined
+		}
 		resultingType, compatible := typesCompatible(lhsType, rhsType, operation.Op)
 		if !compatible {
 			errorPos := operation.Pos()
-			typecheckError("[%d:%d] types %s and %s are not compatible under %s operation\n",
-				errorPos.Line, errorPos.Column,
+			c.errorf(errorPos, "types %s and %s are not compatible under %s operation",
 				backing.ValueTypeToStr(lhsType),
 				backing.ValueTypeToStr(rhsType),
 				syntax.OperatorToString(operation.Op))
 		}
 		return resultingType
 
+	case *syntax.Cast:
+		cast := expr.(*syntax.Cast)
+		sourceType := c.typecheckValue(cast.X, level)
+		targetType := c.typecheckExpr(cast.Type, level)
+		if sourceType == backing.Undefined || targetType == backing.Undefined {
+			return backing.Undefined
+		}
+		// only values of type Any need to be checked during a runtime,
+		// casting anything else to a different type is doomed to fail
+		if sourceType != backing.Any && !backing.IsAssignable(targetType, sourceType) {
+			errorPos := cast.Pos()
+			c.errorf(errorPos, "%s cannot be cast to %s",
+				backing.ValueTypeToStr(sourceType),
+				backing.ValueTypeToStr(targetType))
+			return backing.Undefined
+		}
+		return targetType
+	case *syntax.TypeTest:
+		typeTest := expr.(*syntax.TypeTest)
+		c.typecheckValue(typeTest.X, level)
+		if c.typecheckExpr(typeTest.Type, level) == backing.Undefined {
+			return backing.Undefined
+		}
+		return backing.Bool
+
 	// although call is the statement, we may implicitly treat it
 	// as if it were an expression in that particular case
 	case *syntax.Call:
-		return typecheckCall(expr, level)
+		return c.typecheckCall(expr, level)
 	}
 }
 
 // typesCompatible checks against compatibility of passed types and returns
-// a resulting type upon success
+// a resulting type upon success. Operands of type Any are never compatible, they
+// have to be cast to a concrete type first. Numeric operands are subject to
+// promotion, as defined by backing.PromoteNumeric
 func typesCompatible(t1, t2 backing.ValueType, op syntax.Operator) (backing.ValueType, bool) {
 	switch op {
 	default:
 		return backing.Undefined, false
 	case syntax.Plus:
-		switch {
-		default:
-			if t1 != backing.Any && t2 != backing.Any {
-				return backing.Undefined, false
-			}
-			return backing.Any, true
-		case t1 == backing.Float && t2 == backing.Int:
-			return backing.Float, true
-		case t1 == backing.Int && t2 == backing.Float:
-			return backing.Float, true
-		case t1 == backing.Float && t2 == backing.Float:
-			return backing.Float, true
-		case t1 == backing.Int && t2 == backing.Int:
-			return backing.Int, true
-		case t1 == backing.String && t2 == backing.String:
+		if t1 == backing.String && t2 == backing.String {
 			return backing.String, true
 		}
-	case syntax.Minus, syntax.Mul, syntax.Div:
-		switch {
-		default:
-			if t1 != backing.Any && t2 != backing.Any {
-				return backing.Undefined, false
-			}
-			return backing.Any, true
-		case t1 == backing.Float && t2 == backing.Int:
-			return backing.Float, true
-		case t1 == backing.Int && t2 == backing.Float:
-			return backing.Float, true
-		case t1 == backing.Float && t2 == backing.Float:
-			return backing.Float, true
-		case t1 == backing.Int && t2 == backing.Int:
-			return backing.Int, true
-		}
+		return backing.PromoteNumeric(t1, t2)
+	case syntax.Minus, syntax.Mul, syntax.Div, syntax.Mod:
+		return backing.PromoteNumeric(t1, t2)
 	case syntax.GreaterThan, syntax.GreaterThanOrEqual,
 		syntax.LessThan, syntax.LessThanOrEqual,
 		syntax.Equal, syntax.NotEqual:
 
 		switch {
 		default:
-			if t1 != backing.Any && t2 != backing.Any {
+			if _, ok := backing.PromoteNumeric(t1, t2); !ok {
 				return backing.Undefined, false
 			}
-			return backing.Any, true
-		case t1 == backing.Float && t2 == backing.Float:
-			return backing.Bool, true
-		case t1 == backing.Float && t2 == backing.Int:
-			return backing.Bool, true
-		case t1 == backing.Int && t2 == backing.Float:
-			return backing.Bool, true
-		case t1 == backing.Int && t2 == backing.Int:
 			return backing.Bool, true
 		case t1 == backing.String && t2 == backing.String:
 			return backing.Bool, true
 		case t1 == backing.Bool && t2 == backing.Bool:
-			return backing.Bool, true
-		}
-	case syntax.Mod:
-		switch {
-		default:
-			if t1 != backing.Any && t2 != backing.Any {
+			// booleans aren't ordered
+			if op != syntax.Equal && op != syntax.NotEqual {
 				return backing.Undefined, false
 			}
-			return backing.Any, true
-		case t1 == backing.Int && t2 == backing.Int:
-			return backing.Int, true
-		}
-	case syntax.LogicalAnd:
-		switch {
-		default:
-			if t1 != backing.Any && t2 != backing.Any {
-				return backing.Undefined, false
-			}
-			return backing.Any, true
-		case t1 == backing.Bool && t2 == backing.Bool:
 			return backing.Bool, true
 		}
-	case syntax.LogicalOr:
-		switch {
-		default:
-			if t1 != backing.Any && t2 != backing.Any {
-				return backing.Undefined, false
-			}
-			return backing.Any, true
-		case t1 == backing.Bool && t2 == backing.Bool:
+	case syntax.LogicalAnd, syntax.LogicalOr:
+		if t1 == backing.Bool && t2 == backing.Bool {
 			return backing.Bool, true
 		}
+		return backing.Undefined, false
 	}
 }
 
-func typecheckProgram(program *syntax.Program, level *backing.Level) {
+func (c *Checker) typecheckProgram(program *syntax.Program, level *backing.Level) {
+	c.declareDefs(program.StmtList, level)
 	for _, stmt := range program.StmtList {
-		typecheckStmt(stmt, level)
+		c.typecheckStmt(stmt, level)
+	}
+}
+
+// declareDefs enters signatures of all functions defined among stmts, so that
+// a function may be referred to before its definition, e.g in mutual recursion
+func (c *Checker) declareDefs(stmts []syntax.Stmt, level *backing.Level) {
+	declared := make(map[string]bool)
+	for _, stmt := range stmts {
+		defDeclStmt, ok := stmt.(*syntax.DefDeclStmt)
+		if !ok {
+			continue
+		}
+		if declared[defDeclStmt.Name.Value] {
+			errorPos := defDeclStmt.Pos()
+			c.errorf(errorPos, "function %s is already defined", defDeclStmt.Name.Value)
+			continue
+		}
+		declared[defDeclStmt.Name.Value] = true
+		c.declareDef(defDeclStmt, level)
 	}
 }
 
-func typecheckStmt(stmt syntax.Stmt, level *backing.Level) {
+// declareDef resolves the signature of the function and enters it into the value env
+func (c *Checker) declareDef(defDeclStmt *syntax.DefDeclStmt, level *backing.Level) *backing.EnvEntry {
+	var paramTypes []backing.ValueType
+
+	c.checkAnnotations(defDeclStmt.Annotations, true)
+	expectedReturnType := c.typecheckExpr(defDeclStmt.ReturnType, level)
+	funLevel := backing.NewLevel(defDeclStmt.Name.Value, level)
+	for _, param := range defDeclStmt.ParamList {
+		c.checkAnnotations(param.Annotations, false)
+		paramTypes = append(paramTypes, c.typecheckField(param, funLevel))
+	}
+
+	entry := backing.MakeFunEntry(
+		defDeclStmt.Name.Value,
+		paramTypes,
+		funLevel,
+		expectedReturnType,
+	)
+	c.declare(defDeclStmt.Name, entry, defDeclStmt)
+	return entry
+}
+
+func (c *Checker) typecheckStmt(stmt syntax.Stmt, level *backing.Level) {
 	switch stmt.(type) {
 	// add a block statement
 	case *syntax.VarDeclStmt:
-		typecheckVarDeclStmt(stmt, level)
+		c.typecheckVarDeclStmt(stmt, level)
 	case *syntax.ValDeclStmt:
-		typecheckValDeclStmt(stmt, level)
+		c.typecheckValDeclStmt(stmt, level)
 	case *syntax.DefDeclStmt:
-		typecheckDefDeclStmt(stmt, level)
+		c.typecheckDefDeclStmt(stmt, level)
 	case *syntax.IfStmt:
-		typecheckIfStmt(stmt, level)
+		c.typecheckIfStmt(stmt, level)
 	case *syntax.WhileStmt:
-		typecheckWhileStmt(stmt, level)
+		c.typecheckWhileStmt(stmt, level)
 	case *syntax.Call:
-		typecheckCall(stmt, level)
+		c.typecheckExpr(stmt, level)
 	case *syntax.BlockStmt:
-		typecheckBlockStmt(stmt, level)
+		// names declared by a nested block go out of scope at its end
+		backing.SBeginScope(c.venv)
+		c.typecheckBlockStmt(stmt, level)
+		backing.SEndScope(c.venv)
 	case *syntax.Assignment:
-		typecheckAssignment(stmt, level)
+		c.typecheckAssignment(stmt, level)
+	case *syntax.ReturnStmt:
+		c.typecheckReturnStmt(stmt, level)
+	case *syntax.ThrowStmt:
+		c.typecheckThrowStmt(stmt, level)
+	case *syntax.TryStmt:
+		c.typecheckTryStmt(stmt, level)
 	}
 }
 
-func typecheckAssignment(stmt syntax.Stmt, level *backing.Level) {
+func (c *Checker) typecheckAssignment(stmt syntax.Stmt, level *backing.Level) {
 	assignment := stmt.(*syntax.Assignment)
-	assigneeName := assignment.Lhs.(*syntax.Name).Value
+	assignee := assignment.Lhs.(*syntax.Name)
+	assigneeName := assignee.Value
 	// should make assignment's Lhs of type *Name
-	lhs := backing.SLook(*venv, backing.SSymbol(assigneeName))
-	if lhs == nil {
+	lhsEntry := c.lookup(assignee)
+	if lhsEntry == nil {
 		errorPos := assignment.Pos()
-		typecheckError("[%d:%d] assigning to the undefined variable %s\n",
-			errorPos.Line, errorPos.Column,
+		c.errorf(errorPos, "assigning to the undefined variable %s",
 			assigneeName,
 		)
 		return
 	}
-	lhsEntry := lhs.(*backing.EnvEntry)
-	rhsType := typecheckExpr(assignment.Rhs, level)
+	c.markWrite(lhsEntry)
+	c.checkCapture(assignee, lhsEntry, level)
+	rhsType := c.typecheckValue(assignment.Rhs, level)
 	if lhsEntry.Immutable {
 		errorPos := assignment.Pos()
 		// reporting the type mismatch issue
-		typecheckError("[%d:%d] %v is immutable, thus non-assignable", errorPos.Line, errorPos.Column, assigneeName)
+		c.errorf(errorPos, "%v is immutable, thus non-assignable", assigneeName)
 		return
 	}
 	// TODO(threadedstream): rhsType should be resolved during a runtime
-	if !backing.TypesEqual(lhsEntry.ResultType, rhsType) {
+	if !backing.IsAssignable(lhsEntry.ResultType, rhsType) {
 		errorPos := assignment.Pos()
-		typecheckError("[%d:%d] expected to have rhs type %s, but got %s\n",
-			errorPos.Line, errorPos.Column,
+		c.errorf(errorPos, "expected to have rhs type %s, but got %s",
 			backing.ValueTypeToStr(lhsEntry.ResultType),
 			backing.ValueTypeToStr(rhsType))
 	}
 }
 
-func typecheckCall(stmt syntax.Stmt, level *backing.Level) backing.ValueType {
+func (c *Checker) typecheckCall(stmt syntax.Stmt, level *backing.Level) backing.ValueType {
 	callStmt := stmt.(*syntax.Call)
-	entry := backing.SLook(*venv, backing.SSymbol(callStmt.CalleeName.Value))
-	if entry == nil {
+	calleeEntry := c.lookup(callStmt.CalleeName)
+	if calleeEntry == nil {
 		errorPos := callStmt.Pos()
-		typecheckError("[%d:%d] no function with name %s was found\n", errorPos.Line, errorPos.Column, callStmt.CalleeName.Value)
+		c.errorf(errorPos, "no function with name %s was found", callStmt.CalleeName.Value)
 		// bravely return at that point, as it panics if entry is nil
 		return backing.Undefined
 	}
-	calleeEntry := entry.(*backing.EnvEntry)
 	if calleeEntry.Kind != backing.EntryFun {
 		errorPos := callStmt.Pos()
-		typecheckError("[%d:%d] %s is not a function\n", errorPos.Line, errorPos.Column, callStmt.CalleeName.Value)
+		c.errorf(errorPos, "%s is not a function", callStmt.CalleeName.Value)
 		return backing.Undefined
 	}
+	c.markRead(calleeEntry)
 	// first, check number of passed parameters
 	if len(calleeEntry.ParamTypes) != len(callStmt.ArgList) {
 		errorPos := callStmt.Pos()
-		typecheckError("[%d:%d] function %s expects %d parameters, but %d were provided\n", errorPos.Line, errorPos.Column,
+		c.errorf(errorPos, "function %s expects %d parameters, but %d were provided",
 			callStmt.CalleeName.Value, len(calleeEntry.ParamTypes), len(callStmt.ArgList))
 		return backing.Undefined
 	}
 	var valueTypes []backing.ValueType
 	for _, arg := range callStmt.ArgList {
-		argType := typecheckExpr(arg, level)
+		argType := c.typecheckValue(arg, level)
 		if argType == backing.Undefined {
 			return backing.Undefined
 		}
 		valueTypes = append(valueTypes, argType)
 	}
 	for idx, paramType := range calleeEntry.ParamTypes {
-		if !backing.TypesEqual(paramType, valueTypes[idx]) {
+		if !backing.IsAssignable(paramType, valueTypes[idx]) {
 			errorPos := callStmt.Pos()
-			typecheckError("[%d:%d] parameter %d expected type %s, but %s was provided\n", errorPos.Line, errorPos.Column,
+			c.errorf(errorPos, "parameter %d expected type %s, but %s was provided",
 				idx+1, backing.ValueTypeToStr(paramType), backing.ValueTypeToStr(valueTypes[idx]))
 			return backing.Undefined
 		}
@@ -335,136 +584,222 @@ func typecheckCall(stmt syntax.Stmt, level *backing.Level) backing.ValueType {
 	return calleeEntry.ResultType
 }
 
-func typecheckBlockStmt(stmt syntax.Stmt, level *backing.Level) (backing.ValueType, scanner.Position) {
+func (c *Checker) typecheckBlockStmt(stmt syntax.Stmt, level *backing.Level) {
 	blockStmt := stmt.(*syntax.BlockStmt)
+	level = blockLevel(level)
+	reachable := true
 	for _, decStmt := range blockStmt.Stmts {
-		switch decStmt.(type) {
-		default:
-			typecheckStmt(decStmt, level)
-		case *syntax.ReturnStmt:
-			// handling the special case
-			return typecheckReturnStmt(decStmt, level)
+		if !reachable {
+			// complain only once per block
+			errorPos := decStmt.Pos()
+			c.warnf(errorPos, "unreachable code")
+			reachable = true
+		}
+		c.typecheckStmt(decStmt, level)
+		if Terminates(decStmt) {
+			reachable = false
 		}
 	}
-	return backing.Unit, scanner.Position{}
 }
 
-func typecheckVarDeclStmt(stmt syntax.Stmt, level *backing.Level) {
+func (c *Checker) typecheckVarDeclStmt(stmt syntax.Stmt, level *backing.Level) {
 	varDeclStmt := stmt.(*syntax.VarDeclStmt)
 	if syntax.IsKeyword(varDeclStmt.Name.Value) {
 		errorPos := varDeclStmt.Pos()
-		typecheckError("[%d:%d] name %s is reserved\n", errorPos.Line, errorPos.Column, varDeclStmt.Name.Value)
+		c.errorf(errorPos, "name %s is reserved", varDeclStmt.Name.Value)
 		return
 	}
-	inferredType := typecheckExpr(varDeclStmt.Rhs, level)
-	backing.SEnter(
-		*venv, backing.SSymbol(varDeclStmt.Name.Value), backing.MakeVarEntry(
+	c.checkAnnotations(varDeclStmt.Annotations, false)
+	inferredType := c.typecheckValue(varDeclStmt.Rhs, level)
+	inferredType = c.checkDeclaredType(varDeclStmt.Name.Value, varDeclStmt.Type, inferredType, level)
+	c.declare(
+		&varDeclStmt.Name, backing.MakeVarEntry(
 			varDeclStmt.Name.Value,
 			level,
 			inferredType,
 			false,
 		),
+		varDeclStmt,
 	)
 }
 
-func typecheckValDeclStmt(stmt syntax.Stmt, level *backing.Level) {
+func (c *Checker) typecheckValDeclStmt(stmt syntax.Stmt, level *backing.Level) {
 	valDeclStmt := stmt.(*syntax.ValDeclStmt)
 	// first, check if declared name is a keyword or not
 	if syntax.IsKeyword(valDeclStmt.Name.Value) {
 		errorPos := valDeclStmt.Pos()
-		typecheckError("[%d:%d] name %s is reserved\n", errorPos.Line, errorPos.Column, valDeclStmt.Name.Value)
+		c.errorf(errorPos, "name %s is reserved", valDeclStmt.Name.Value)
 		return
 	}
-	valueType := typecheckExpr(valDeclStmt.Rhs, level)
-	backing.SEnter(
-		*venv, backing.SSymbol(valDeclStmt.Name.Value), backing.MakeVarEntry(
+	c.checkAnnotations(valDeclStmt.Annotations, false)
+	valueType := c.typecheckValue(valDeclStmt.Rhs, level)
+	valueType = c.checkDeclaredType(valDeclStmt.Name.Value, valDeclStmt.Type, valueType, level)
+	c.declare(
+		&valDeclStmt.Name, backing.MakeVarEntry(
 			valDeclStmt.Name.Value,
 			level,
 			valueType,
 			true,
 		),
+		valDeclStmt,
 	)
 }
 
-func typecheckIfStmt(stmt syntax.Stmt, level *backing.Level) {
+// checkDeclaredType verifies that the type inferred from the right hand side of a declaration
+// agrees with the type the declaration explicitly states, if any. It returns the type the
+// declared name should have
+func (c *Checker) checkDeclaredType(name string, typeExpr syntax.Expr, inferredType backing.ValueType, level *backing.Level) backing.ValueType {
+	if typeExpr == nil {
+		return inferredType
+	}
+	declaredType := c.typecheckExpr(typeExpr, level)
+	if declaredType == backing.Undefined {
+		return backing.Undefined
+	}
+	if !backing.IsAssignable(declaredType, inferredType) {
+		errorPos := typeExpr.Pos()
+		c.errorf(errorPos, "%s is declared as %s, but initialized with %s",
+			name,
+			backing.ValueTypeToStr(declaredType),
+			backing.ValueTypeToStr(inferredType))
+	}
+	return declaredType
+}
+
+func (c *Checker) typecheckIfStmt(stmt syntax.Stmt, level *backing.Level) {
 	ifStmt := stmt.(*syntax.IfStmt)
-	condValueType := typecheckExpr(ifStmt.Cond, level)
-	if condValueType != backing.Bool && condValueType != backing.Any {
+	condValueType := c.typecheckExpr(ifStmt.Cond, level)
+	if condValueType != backing.Bool && condValueType != backing.Undefined {
 		errorPos := ifStmt.Pos()
-		typecheckError("[%d:%d] condition is not of bool type\n", errorPos.Line, errorPos.Column)
+		c.errorf(errorPos, "condition is not of bool type")
 		return
 	}
-	typecheckBlockStmt(ifStmt.Body, level)
+	backing.SBeginScope(c.venv)
+	c.typecheckBlockStmt(ifStmt.Body, level)
+	backing.SEndScope(c.venv)
 	if ifStmt.ElseBody != nil {
-		typecheckStmt(ifStmt.ElseBody, level)
+		// an else block or else if opens a scope of its own
+		c.typecheckStmt(ifStmt.ElseBody, level)
 	}
 }
 
-func typecheckWhileStmt(stmt syntax.Stmt, level *backing.Level) {
+func (c *Checker) typecheckWhileStmt(stmt syntax.Stmt, level *backing.Level) {
 	whileStmt := stmt.(*syntax.WhileStmt)
-	condValueType := typecheckExpr(whileStmt.Cond, level)
-	if condValueType != backing.Bool && condValueType != backing.Any {
+	condValueType := c.typecheckExpr(whileStmt.Cond, level)
+	if condValueType != backing.Bool && condValueType != backing.Undefined {
 		errorPos := whileStmt.Pos()
-		typecheckError("[%d:%d] condition is not of bool type\n", errorPos.Line, errorPos.Column)
+		c.errorf(errorPos, "condition is not of bool type")
 		return
 	}
-	backing.SBeginScope(*venv)
-	typecheckBlockStmt(whileStmt.Body, level)
-	backing.SEndScope(*venv)
+	backing.SBeginScope(c.venv)
+	c.typecheckBlockStmt(whileStmt.Body, level)
+	backing.SEndScope(c.venv)
 }
 
-func typecheckDefDeclStmt(stmt syntax.Stmt, level *backing.Level) {
+func (c *Checker) typecheckDefDeclStmt(stmt syntax.Stmt, level *backing.Level) {
 	defDeclStmt := stmt.(*syntax.DefDeclStmt)
-	var paramTypes []backing.ValueType
-
-	expectedReturnType := typecheckExpr(defDeclStmt.ReturnType, level)
-	funLevel := backing.NewLevel(defDeclStmt.Name.Value, level)
-	for _, param := range defDeclStmt.ParamList {
-		paramTypes = append(paramTypes, typecheckField(param, funLevel))
+	entry := c.lookup(defDeclStmt.Name)
+	if entry == nil || entry.Decl != defDeclStmt {
+		// signature wasn't collected up front
+		entry = c.declareDef(defDeclStmt, level)
 	}
+	enclosingFun := c.fun
+	c.fun = entry
 
-	backing.SEnter(
-		*venv, backing.SSymbol(defDeclStmt.Name.Value), backing.MakeFunEntry(
-			defDeclStmt.Name.Value,
-			paramTypes,
-			funLevel,
-			expectedReturnType),
-	)
-
-	backing.SBeginScope(*venv)
+	backing.SBeginScope(c.venv)
 	for idx, param := range defDeclStmt.ParamList {
-		backing.SEnter(
-			*venv, backing.SSymbol(param.Name.Value), backing.MakeVarEntry(
+		c.declare(
+			param.Name, backing.MakeVarEntry(
 				param.Name.Value,
-				funLevel,
-				paramTypes[idx],
+				entry.Level,
+				entry.ParamTypes[idx],
 				false,
 			),
+			param,
 		)
 	}
 
-	returnType, pos := typecheckBlockStmt(defDeclStmt.Body, level)
-	if returnType != expectedReturnType {
-		errorPos := pos
-		typecheckError("[%d:%d] expected return type %s but got %s\n",
-			errorPos.Line,
-			errorPos.Column,
-			backing.ValueTypeToStr(expectedReturnType),
-			backing.ValueTypeToStr(returnType))
+	c.typecheckBlockStmt(defDeclStmt.Body, entry.Level)
+	if entry.ResultType != backing.Unit && !Terminates(defDeclStmt.Body) {
+		errorPos := defDeclStmt.Pos()
+		c.errorf(errorPos, "missing return in function %s, which is expected to return %s",
+			defDeclStmt.Name.Value,
+			backing.ValueTypeToStr(entry.ResultType))
+	}
+	c.markTailCalls(defDeclStmt, entry.ResultType)
+	if syntax.HasAnnotation(defDeclStmt.Annotations, "tailrec") {
+		c.checkTailrec(defDeclStmt)
 	}
 
-	backing.SEndScope(*venv)
+	backing.SEndScope(c.venv)
+	c.fun = enclosingFun
 }
 
-func typecheckReturnStmt(stmt syntax.Stmt, level *backing.Level) (backing.ValueType, scanner.Position) {
+func (c *Checker) typecheckReturnStmt(stmt syntax.Stmt, level *backing.Level) {
 	returnStmt := stmt.(*syntax.ReturnStmt)
-	returnType := typecheckExpr(returnStmt.Value, level)
-	pos := returnStmt.Pos()
-	return returnType, pos
+	returnType := c.typecheckExpr(returnStmt.Value, level)
+	if c.fun == nil {
+		errorPos := returnStmt.Pos()
+		c.errorf(errorPos, "return outside of function")
+		return
+	}
+	if returnType == backing.Unit && c.fun.ResultType != backing.Unit {
+		// a function returning Unit may end with a call of another one, but Any doesn't take Unit
+		errorPos := returnStmt.Value.Pos()
+		c.errorf(errorPos, "expression of type Unit has no value to use")
+		return
+	}
+	if !backing.IsAssignable(c.fun.ResultType, returnType) {
+		errorPos := returnStmt.Pos()
+		c.errorf(errorPos, "expected return type %s but got %s",
+			backing.ValueTypeToStr(c.fun.ResultType),
+			backing.ValueTypeToStr(returnType))
+	}
+}
+
+func (c *Checker) typecheckThrowStmt(stmt syntax.Stmt, level *backing.Level) {
+	throwStmt := stmt.(*syntax.ThrowStmt)
+	valueType := c.typecheckExpr(throwStmt.Value, level)
+	if valueType != backing.Exception && valueType != backing.Undefined {
+		errorPos := throwStmt.Pos()
+		c.errorf(errorPos, "expected to throw Exception, but got %s", backing.ValueTypeToStr(valueType))
+	}
+}
+
+func (c *Checker) typecheckTryStmt(stmt syntax.Stmt, level *backing.Level) {
+	tryStmt := stmt.(*syntax.TryStmt)
+	backing.SBeginScope(c.venv)
+	c.typecheckBlockStmt(tryStmt.Body, level)
+	backing.SEndScope(c.venv)
+	for _, catchClause := range tryStmt.Cases {
+		if catchClause.Name == nil {
+			// the parser has already complained
+			continue
+		}
+		// catch cases match on the kind of an exception, which isn't a type known
+		// to the checker, so any name goes. The caught value is always an Exception
+		backing.SBeginScope(c.venv)
+		c.declare(
+			catchClause.Name, backing.MakeVarEntry(
+				catchClause.Name.Value,
+				blockLevel(level),
+				backing.Exception,
+				true,
+			),
+			catchClause,
+		)
+		c.typecheckBlockStmt(catchClause.Body, level)
+		backing.SEndScope(c.venv)
+	}
+	if tryStmt.Finally != nil {
+		backing.SBeginScope(c.venv)
+		c.typecheckBlockStmt(tryStmt.Finally, level)
+		backing.SEndScope(c.venv)
+	}
 }
 
-func typecheckField(field *syntax.Field, level *backing.Level) backing.ValueType {
-	valueType := typecheckExpr(field, level)
-	//backing.StoreType(field.Name.Value, valueType, false, nil, )
+func (c *Checker) typecheckField(field *syntax.Field, level *backing.Level) backing.ValueType {
+	valueType := c.typecheckExpr(field, level)
+	//backing.StoreType(field.Name.Value, valueType, false, nil)
 	return valueType
 }
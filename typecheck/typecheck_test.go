@@ -0,0 +1,545 @@
+package typecheck
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// check parses src and typechecks it with a fresh Checker
+func check(t *testing.T, src string) *Result {
+	t.Helper()
+	program, errors := syntax.ParseErrors(strings.NewReader(src))
+	if len(errors) > 0 {
+		t.Fatalf("syntax errors: %v", errors)
+	}
+	return NewChecker().Check(program)
+}
+
+// TestBlockScopes checks that names declared in the bodies of if and else, and in
+// nested blocks, go out of scope at the end of the body
+func TestBlockScopes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{"if", `if (1 < 2) {
+        val y = 3
+    }`},
+		{"else", `if (1 > 2) {
+        print("")
+    } else {
+        val y = 3
+    }`},
+		{"else if", `if (1 > 2) {
+        print("")
+    } else if (1 < 2) {
+        val y = 3
+    }`},
+		{"block", `{
+        val y = 3
+    }`},
+	} {
+		src := "def main(): Unit {\n    " + tc.body + "\n    print(to_string(y))\n}\n"
+		result := check(t, src)
+		if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Msg, "name y is neither") {
+			t.Errorf("%s: expected y to be undefined after the body, got errors %v", tc.name, result.Errors)
+		}
+	}
+}
+
+// TestShadowingInBlock checks that a name declared in a block may shadow an outer one
+func TestShadowingInBlock(t *testing.T) {
+	src := `def main(): Unit {
+    val x = 1
+    if (1 < 2) {
+        val x = "two"
+        print(x)
+    }
+    print(to_string(x + 1))
+}
+`
+	result := check(t, src)
+	if result.HadErrors() {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+}
+
+// TestDeclsAfterBlock checks that references following a block which shadows a name
+// resolve to the declaration outside of the block
+func TestDeclsAfterBlock(t *testing.T) {
+	src := `def main(): Unit {
+    val x = 1
+    if (1 < 2) {
+        val x = 2
+        print(to_string(x))
+    }
+    print(to_string(x))
+}
+`
+	program, _ := syntax.ParseErrors(strings.NewReader(src))
+	result := NewChecker().Check(program)
+	if result.HadErrors() {
+		t.Fatalf("unexpected errors: %v", result.Errors)
+	}
+	body := program.StmtList[0].(*syntax.DefDeclStmt).Body.Stmts
+	outer := body[0].(*syntax.ValDeclStmt)
+	ifBody := body[1].(*syntax.IfStmt).Body.Stmts
+	inner := ifBody[0].(*syntax.ValDeclStmt)
+	refOf := func(stmt syntax.Stmt) *syntax.Name {
+		toString := stmt.(*syntax.Call).ArgList[0].(*syntax.Call)
+		return toString.ArgList[0].(*syntax.Name)
+	}
+	if decl := result.Decls[refOf(ifBody[1])]; decl != inner {
+		t.Errorf("x in the block refers to %v, expected the declaration in the block", decl)
+	}
+	if decl := result.Decls[refOf(body[2])]; decl != outer {
+		t.Errorf("x after the block refers to %v, expected the declaration before the block", decl)
+	}
+}
+
+// TestUnitValues checks that values of calls of functions returning Unit can't be used
+func TestUnitValues(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stmt string
+	}{
+		{"val", `val u = log()`},
+		{"var", `var u: Any = log()`},
+		{"argument", `print(to_string(log()))`},
+		{"cast", `val s = log().asInstanceOf[String]`},
+		{"type test", `val b = log().isInstanceOf[Int]`},
+		{"return", `return log()`},
+	} {
+		src := "def log(): Unit {\n    print(\"\")\n}\n\ndef f(): Any {\n    " + tc.stmt + "\n    return 0\n}\n"
+		result := check(t, src)
+		if len(result.Errors) != 1 || result.Errors[0].Msg != "expression of type Unit has no value to use" {
+			t.Errorf("%s: expected the value of type Unit to be rejected, got errors %v", tc.name, result.Errors)
+		}
+	}
+
+	// a function returning Unit may return what another one does
+	result := check(t, "def log(): Unit {\n    return print(\"\")\n}\n")
+	if result.HadErrors() {
+		t.Errorf("unexpected errors: %v", result.Errors)
+	}
+}
+
+// TestCaptures checks that functions may refer to their own variables and global ones only
+func TestCaptures(t *testing.T) {
+	for _, tc := range []struct {
+		name, src, err string
+	}{
+		{"parameter", `def f(x: Int): Int {
+    def g(): Int {
+        return x
+    }
+    return g()
+}
+`, "[3:16] function g can't refer to x, which is neither its own variable nor a global one"},
+		{"assignment", `def f(): Int {
+    var n = 0
+    def g(): Unit {
+        n = 1
+    }
+    g()
+    return n
+}
+`, "[4:9] function g can't refer to n, which is neither its own variable nor a global one"},
+		{"exception", `def f(): Unit {
+    try {
+        print("")
+    } catch {
+        case e: Oops =>
+            def g(): String {
+                return exception_message(e)
+            }
+            print(g())
+    }
+}
+`, "[7:42] function g can't refer to e, which is neither its own variable nor a global one"},
+		{"top-level block", `if (1 < 2) {
+    val x = 1
+    def g(): Int {
+        return x
+    }
+    print(to_string(g()))
+}
+`, "[4:16] function g can't refer to x, which is neither its own variable nor a global one"},
+	} {
+		result := check(t, tc.src)
+		if len(result.Errors) != 1 || result.Errors[0].Error() != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, result.Errors)
+		}
+	}
+
+	src := `val limit = 10
+
+def f(x: Int): Int {
+    def g(y: Int): Int {
+        val z = y + limit
+        return z
+    }
+    return g(x)
+}
+
+{
+    val x = 1
+    print(to_string(f(x) + limit))
+}
+`
+	if result := check(t, src); result.HadErrors() {
+		t.Errorf("unexpected errors: %v", result.Errors)
+	}
+}
+
+// messages renders errs as Error does, positions first
+func messages(errs []Error) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+// TestReturnsAndReachability checks that functions returning a value have to return it on
+// every path, and that code following a return or a throw is reported once per block.
+// Each source is followed by main, which calls f
+func TestReturnsAndReachability(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src      string
+		errors   []string
+		warnings []string
+	}{
+		{"if and else", `def f(x: Int): Int {
+    if (x > 0) {
+        return x
+    } else {
+        return 2
+    }
+}
+`, nil, nil},
+		{"if without else", `def f(x: Int): Int {
+    if (x > 0) {
+        return x
+    }
+}
+`, []string{"[1:1] missing return in function f, which is expected to return Int"}, nil},
+		{"else without return", `def f(x: Int): Int {
+    if (x > 0) {
+        return x
+    } else {
+        print("")
+    }
+}
+`, []string{"[1:1] missing return in function f, which is expected to return Int"}, nil},
+		{"while", `def f(x: Int): Int {
+    while (x > 0) {
+        return x
+    }
+}
+`, []string{"[1:1] missing return in function f, which is expected to return Int"}, nil},
+		{"throw", `def f(x: Int): Int {
+    throw exception_new("Oops", to_string(x))
+}
+`, nil, nil},
+		{"nested block", `def f(x: Int): Int {
+    {
+        return x
+    }
+}
+`, nil, nil},
+		{"unit", `def f(x: Int): Unit {
+    print(to_string(x))
+}
+`, nil, nil},
+		{"after return", `def f(x: Int): Int {
+    return x
+    print("")
+    print("")
+}
+`, nil, []string{"[3:5] unreachable code"}},
+		{"after throw", `def f(x: Int): Int {
+    throw exception_new("Oops", to_string(x))
+    return x
+}
+`, nil, []string{"[3:5] unreachable code"}},
+		{"after if and else", `def f(x: Int): Int {
+    if (x > 0) {
+        return x
+    } else {
+        throw exception_new("Oops", to_string(x))
+    }
+    return 2
+}
+`, nil, []string{"[7:5] unreachable code"}},
+		{"in while body", `def f(x: Int): Int {
+    while (x > 0) {
+        return x
+        print("")
+    }
+    return 2
+}
+`, nil, []string{"[4:9] unreachable code"}},
+		{"in nested block", `def f(x: Int): Int {
+    {
+        return x
+        print("")
+    }
+    print("")
+}
+`, nil, []string{"[4:9] unreachable code", "[6:5] unreachable code"}},
+	} {
+		result := check(t, tc.src+"\ndef main(): Unit {\n    f(1)\n}\n")
+		if errors := messages(result.Errors); !reflect.DeepEqual(errors, tc.errors) {
+			t.Errorf("%s: errors %q, expected %q", tc.name, errors, tc.errors)
+		}
+		if warnings := messages(result.Warnings); !reflect.DeepEqual(warnings, tc.warnings) {
+			t.Errorf("%s: warnings %q, expected %q", tc.name, warnings, tc.warnings)
+		}
+	}
+}
+
+// TestUnused checks warnings about declarations which are never used, or assigned but never
+// read, and that @unused and a leading underscore keep them quiet
+func TestUnused(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src      string
+		warnings []string
+	}{
+		{"val", `def main(): Unit {
+    val x = 1
+}
+`, []string{"[2:9] value x is declared but never used"}},
+		{"var", `def main(): Unit {
+    var x = 1
+}
+`, []string{"[2:9] variable x is declared but never used"}},
+		{"assigned var", `def main(): Unit {
+    var x = 1
+    x = 2
+}
+`, []string{"[2:9] variable x is assigned but never read"}},
+		{"parameter", `def f(x: Int): Int {
+    return 1
+}
+
+def main(): Unit {
+    print(to_string(f(2)))
+}
+`, []string{"[1:7] parameter x is never used"}},
+		{"exception", `def main(): Unit {
+    try {
+        print("")
+    } catch {
+        case e: Oops =>
+            print("oops")
+    }
+}
+`, []string{"[5:14] exception e is never used"}},
+		{"function", `def f(): Unit {
+    print("")
+}
+
+def main(): Unit {
+    print("")
+}
+`, []string{"[1:5] function f is never called"}},
+		{"recursive function", `def f(n: Int): Int {
+    if (n > 0) {
+        return f(n - 1)
+    }
+    return n
+}
+
+def main(): Unit {
+    print("")
+}
+`, []string{"[1:5] function f is never called"}},
+		{"annotated", `@unused
+def f(@unused x: Int): Unit {
+    @unused
+    val y = 1
+    @unused
+    var z = 1
+    z = 2
+}
+
+def main(): Unit {
+    print("")
+}
+`, nil},
+		{"underscore", `def _f(_x: Int): Unit {
+    val _y = 1
+    var _z = 1
+    try {
+        _z = 2
+    } catch {
+        case _e: Oops =>
+            print("oops")
+    }
+}
+
+def main(): Unit {
+    print("")
+}
+`, nil},
+		{"used", `def f(x: Int): Int {
+    val y = x + 1
+    var z = 0
+    z = y
+    try {
+        z = z + 1
+    } catch {
+        case e: Oops =>
+            print(exception_message(e))
+    }
+    return z
+}
+
+def test_f(): Unit {
+    print(to_string(f(1)))
+}
+
+def main(): Unit {
+    print(to_string(f(1)))
+}
+`, nil},
+	} {
+		result := check(t, tc.src)
+		if result.HadErrors() {
+			t.Errorf("%s: unexpected errors: %v", tc.name, result.Errors)
+			continue
+		}
+		if warnings := messages(result.Warnings); !reflect.DeepEqual(warnings, tc.warnings) {
+			t.Errorf("%s: warnings %q, expected %q", tc.name, warnings, tc.warnings)
+		}
+	}
+}
+
+// TestAnnotatedTypes checks that values, variables, arguments and results have to agree
+// with the types their declarations state
+func TestAnnotatedTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"val", `val x: Int = "one"`, "[6:12] x is declared as Int, but initialized with String"},
+		{"var", `var x: String = 1`, "[6:12] x is declared as String, but initialized with Int"},
+		{"assignment", `var x: Float = 1.0
+    x = "one"`, "[7:5] expected to have rhs type Float, but got String"},
+		{"argument", `val x = f("one")`, "[6:13] parameter 1 expected type Int, but String was provided"},
+		{"result", `val x: String = f(1)`, "[6:12] x is declared as String, but initialized with Int"},
+		{"return", `return "one"`, "[6:5] expected return type Int but got String"},
+		{"any", `val x: Any = f(1)`, ""},
+		{"float", `var x: Float = 1.0
+    x = 2.0`, ""},
+	} {
+		src := "def f(x: Int): Int {\n    return x\n}\n\ndef g(): Int {\n    " + tc.body + "\n    return 0\n}\n" +
+			"\ndef main(): Unit {\n    print(to_string(g()))\n}\n"
+		result := check(t, src)
+		var err string
+		if len(result.Errors) > 0 {
+			err = result.Errors[0].Error()
+		}
+		if len(result.Errors) > 1 || err != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, result.Errors)
+		}
+	}
+}
+
+// TestAnyValues checks that values of type Any have to be cast to a concrete type before
+// they're used as one, and which casts and type tests are accepted
+func TestAnyValues(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stmt string
+		err  string
+	}{
+		{"operand", `print(to_string(a + 1))`, "[5:21] types Any and Int are not compatible under + operation"},
+		{"argument", `print(a)`, "[5:5] parameter 1 expected type String, but Any was provided"},
+		{"val", `val s: String = a`, "[5:12] s is declared as String, but initialized with Any"},
+		{"condition", `if (a) {
+        print("")
+    }`, "[5:5] condition is not of bool type"},
+		{"return", `return a`, "[5:5] expected return type Int but got Any"},
+		{"cast", `print(to_string(a.asInstanceOf[Int] + 1))`, ""},
+		{"cast to the same type", `print(to_string(i.asInstanceOf[Int]))`, ""},
+		{"cast to Any", `val b: Any = i.asInstanceOf[Any]`, ""},
+		{"cast to another type", `print(i.asInstanceOf[String])`, "[5:12] Int cannot be cast to String"},
+		{"cast to an unknown type", `print(a.asInstanceOf[Text])`, "[5:26] name Text is neither a type name nor var, nor val"},
+		{"type test", `print(to_string(a.isInstanceOf[String]))`, ""},
+		{"type test of a concrete type", `print(to_string(i.isInstanceOf[String]))`, ""},
+		{"type test of an unknown type", `print(to_string(a.isInstanceOf[Text]))`, "[5:36] name Text is neither a type name nor var, nor val"},
+	} {
+		src := "val a: Any = 1\nval i = 1\n\ndef f(): Int {\n    " + tc.stmt + "\n    return 0\n}\n" +
+			"\ndef main(): Unit {\n    print(to_string(f()))\n}\n"
+		result := check(t, src)
+		var err string
+		if len(result.Errors) > 0 {
+			err = result.Errors[0].Error()
+		}
+		if len(result.Errors) > 1 || err != tc.err {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, result.Errors)
+		}
+	}
+}
+
+// TestConcurrentChecks checks programs in sources with checkers running in parallel, which
+// share the symbols interned by backing and the table of runtime functions, and expects
+// the same results as checking them one by one afterwards. Run with -race
+func TestConcurrentChecks(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "sources", "*.miniscala"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var programs []*syntax.Program
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		program, errors := syntax.ParseErrors(strings.NewReader(string(src)))
+		if len(errors) > 0 {
+			continue
+		}
+		names = append(names, path)
+		programs = append(programs, program)
+	}
+
+	const workers = 8
+	var wg sync.WaitGroup
+	results := make([][]*Result, workers)
+	for i := 0; i < workers; i++ {
+		results[i] = make([]*Result, len(programs))
+		wg.Add(1)
+		go func(results []*Result) {
+			defer wg.Done()
+			for idx, program := range programs {
+				backing.RuntimeFuncEntry("print")
+				results[idx] = NewChecker().Check(program)
+			}
+		}(results[i])
+	}
+	wg.Wait()
+
+	for idx, program := range programs {
+		result := NewChecker().Check(program)
+		expected := append(messages(result.Errors), messages(result.Warnings)...)
+		for i := 0; i < workers; i++ {
+			msgs := append(messages(results[i][idx].Errors), messages(results[i][idx].Warnings)...)
+			if !reflect.DeepEqual(msgs, expected) {
+				t.Errorf("%s: %q, expected %q", names[idx], msgs, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package typecheck
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"strings"
+)
+
+// usage counts references to a single declaration
+type usage struct {
+	reads  int
+	writes int
+}
+
+// annotations the checker knows about, mapped to whether they only apply to functions
+var knownAnnotations = map[string]bool{
+	// suppresses warnings about the declaration not being used
+	"unused": false,
+	// checks that the function only calls itself in tail position, see checkTailrec
+	"tailrec": true,
+}
+
+// checkAnnotations checks annotations of a declaration, fun tells whether it declares a function
+func (c *Checker) checkAnnotations(annotations []*syntax.Annotation, fun bool) {
+	for _, annotation := range annotations {
+		funcOnly, ok := knownAnnotations[annotation.Name.Value]
+		if !ok {
+			errorPos := annotation.Pos()
+			c.errorf(errorPos, "unknown annotation @%s", annotation.Name.Value)
+		} else if funcOnly && !fun {
+			errorPos := annotation.Pos()
+			c.errorf(errorPos, "annotation @%s only applies to functions", annotation.Name.Value)
+		}
+	}
+}
+
+// track starts counting references to decl
+func (c *Checker) track(decl syntax.Node) {
+	if _, ok := c.usages[decl]; ok {
+		return
+	}
+	c.usages[decl] = new(usage)
+	c.tracked = append(c.tracked, decl)
+}
+
+func (c *Checker) markRead(entry *backing.EnvEntry) {
+	// recursive calls don't make a function used
+	if entry.Kind == backing.EntryFun && entry == c.fun {
+		return
+	}
+	if u, ok := c.usages[entry.Decl]; ok {
+		u.reads++
+	}
+}
+
+func (c *Checker) markWrite(entry *backing.EnvEntry) {
+	if u, ok := c.usages[entry.Decl]; ok {
+		u.writes++
+	}
+}
+
+// suppressed reports whether warnings about an unused declaration should be kept quiet,
+// either by annotating it with @unused or by naming it with a leading underscore
+func suppressed(name string, annotations []*syntax.Annotation) bool {
+	return strings.HasPrefix(name, "_") || syntax.HasAnnotation(annotations, "unused")
+}
+
+// reportUnused warns about declarations which are never referred to,
+// as well as about variables which are assigned, but never read
+func (c *Checker) reportUnused() {
+	for _, decl := range c.tracked {
+		u := c.usages[decl]
+		if u.reads > 0 {
+			continue
+		}
+		switch decl.(type) {
+		case *syntax.VarDeclStmt:
+			varDeclStmt := decl.(*syntax.VarDeclStmt)
+			if suppressed(varDeclStmt.Name.Value, varDeclStmt.Annotations) {
+				continue
+			}
+			if u.writes > 0 {
+				c.warnf(varDeclStmt.Name.Pos(), "variable %s is assigned but never read", varDeclStmt.Name.Value)
+				continue
+			}
+			c.warnf(varDeclStmt.Name.Pos(), "variable %s is declared but never used", varDeclStmt.Name.Value)
+		case *syntax.ValDeclStmt:
+			valDeclStmt := decl.(*syntax.ValDeclStmt)
+			if suppressed(valDeclStmt.Name.Value, valDeclStmt.Annotations) {
+				continue
+			}
+			c.warnf(valDeclStmt.Name.Pos(), "value %s is declared but never used", valDeclStmt.Name.Value)
+		case *syntax.Field:
+			field := decl.(*syntax.Field)
+			if suppressed(field.Name.Value, field.Annotations) {
+				continue
+			}
+			c.warnf(field.Name.Pos(), "parameter %s is never used", field.Name.Value)
+		case *syntax.CatchClause:
+			catchClause := decl.(*syntax.CatchClause)
+			if suppressed(catchClause.Name.Value, nil) {
+				continue
+			}
+			c.warnf(catchClause.Name.Pos(), "exception %s is never used", catchClause.Name.Value)
+		case *syntax.DefDeclStmt:
+			defDeclStmt := decl.(*syntax.DefDeclStmt)
+			// main is called by the runtime, test functions by the test runner
+			if defDeclStmt.Name.Value == "main" || strings.HasPrefix(defDeclStmt.Name.Value, "test_") ||
+				suppressed(defDeclStmt.Name.Value, defDeclStmt.Annotations) {
+				continue
+			}
+			c.warnf(defDeclStmt.Name.Pos(), "function %s is never called", defDeclStmt.Name.Value)
+		}
+	}
+}
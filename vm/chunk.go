@@ -2,43 +2,98 @@ package vm
 
 import (
 	"github.com/ThreadedStream/miniscala/backing"
-	"runtime/debug"
+	"text/scanner"
 )
 
-var (
-	chunkStore = make(map[string]Chunk)
+const (
+	// name of the chunk holding top-level statements of a program given to VM.Eval
+	inputChunkName = "<input>"
+	// name of the chunk running top-level statements of a program before its entry function
+	initChunkName = "<init>"
 )
 
 type Chunk struct {
 	funcName    string
 	instrStream []Instruction
 	argNames    []string // temporary solution
-	localVars   map[string]backing.Value
-	argPool     map[string]backing.Value
-	doesReturn  bool
+	// locals of the call in progress, arguments first, see allocateLocals
+	locals []backing.Value
+	// number of locals, arguments included
+	localCount int
+	doesReturn bool
+	// unwind table, innermost handlers come first
+	handlers []handler
+	// source positions of statements, ordered by start
+	lines []lineEntry
+}
+
+// handler transfers control to target whenever an exception is raised by
+// an instruction in [start, end), the exception is then pushed onto the stack
+type handler struct {
+	start  int
+	end    int
+	target int
+}
+
+// lineEntry attributes instructions from start up to the start of the next entry
+// to the statement at pos
+type lineEntry struct {
+	start int
+	pos   scanner.Position
+}
+
+// positionAt returns the position of the statement the instruction at ip was compiled from
+func (chunk *Chunk) positionAt(ip int) scanner.Position {
+	var pos scanner.Position
+	for _, entry := range chunk.lines {
+		if entry.start > ip {
+			break
+		}
+		pos = entry.pos
+	}
+	return pos
+}
+
+// allocateLocals numbers locals of the chunk, which LoadRef and SetLocal refer to by name,
+// so that they're kept in slots of a slice rather than looked up by name as the code runs.
+// Arguments take the first slots, in order. Names of locals are unique within a chunk,
+// see compiler.slot, so each name gets a slot of its own
+func allocateLocals(chunk *Chunk) {
+	slots := make(map[string]int)
+	for idx, name := range chunk.argNames {
+		slots[name] = idx
+	}
+	slot := func(name string) int {
+		idx, ok := slots[name]
+		if !ok {
+			idx = len(slots)
+			slots[name] = idx
+		}
+		return idx
+	}
+	for _, instruction := range chunk.instrStream {
+		switch instruction := instruction.(type) {
+		case *InstrLoadRef:
+			instruction.Slot = slot(instruction.RefName)
+		case *InstrSetLocal:
+			instruction.Slot = slot(instruction.Name)
+		}
+	}
+	chunk.localCount = len(slots)
 }
 
 func newChunk(code []Instruction, name string) Chunk {
 	chunk := Chunk{}
 	chunk.instrStream = code
-	//chunk.argPool = make(map[string]backing.Value)
 	chunk.argNames = make([]string, 0)
 	chunk.funcName = name
 	return chunk
 }
 
-func lookupChunk(name string, shouldPanic bool, abort func(format string, args ...interface{})) Chunk {
-	chunk, ok := chunkStore[name]
+func (vm *VM) lookupChunk(name string) Chunk {
+	chunk, ok := vm.chunks[name]
 	if !ok {
-		if shouldPanic {
-			if abort != nil {
-				abort("no chunk associated with name %s", name)
-			} else {
-				debug.PrintStack()
-				panic("no abort function was passed, so i invoked myself")
-			}
-		}
-		return Chunk{}
+		vm.abort("no chunk associated with name %s", name)
 	}
 	return chunk
 }
@@ -3,6 +3,7 @@ package vm
 import (
 	"github.com/ThreadedStream/miniscala/backing"
 	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
 	"strconv"
 )
 
@@ -12,13 +13,67 @@ var (
 )
 
 type compiler struct {
+	// chunks compiled so far, keyed by function name
+	chunks            map[string]Chunk
 	code              []Instruction
 	hadCompilerErrors bool
 	errors            []string
+	// types resolved by the typechecker
+	info *typecheck.Result
+	// unwind table of the chunk being compiled
+	handlers []handler
+	// finally blocks enclosing the statement being compiled, innermost last
+	finallyBlocks []*syntax.BlockStmt
+	// try statements enclosing the statement being compiled, innermost last
+	tries []*tryScope
+	// line table of the chunk being compiled
+	lines []lineEntry
+	// names of the locals holding values declared in the chunk being compiled, see slot
+	slots map[syntax.Node]string
+	// names of locals, arguments and globals the chunk being compiled makes use of
+	taken map[string]bool
+	// declarations of values and variables at the top level, which are kept in globals
+	globals map[syntax.Node]bool
+	// whether compiled chunks go through the peephole pass
+	fuse bool
 }
 
-func newCompiler() *compiler {
-	return new(compiler)
+// tryScope is a try statement being compiled
+type tryScope struct {
+	finally *syntax.BlockStmt
+	// parts of the body and catch cases its handlers must not cover, i.e copies of finally
+	// blocks which a return runs on the way out of this try, see compileReturnStmt
+	holes []handler
+}
+
+// cover returns handlers covering the same code as the given ones, except for holes of the try
+func (scope *tryScope) cover(handlers []handler) []handler {
+	for _, hole := range scope.holes {
+		var res []handler
+		for _, h := range handlers {
+			if hole.end <= h.start || hole.start >= h.end {
+				res = append(res, h)
+				continue
+			}
+			if h.start < hole.start {
+				res = append(res, handler{start: h.start, end: hole.start, target: h.target})
+			}
+			if hole.end < h.end {
+				res = append(res, handler{start: hole.end, end: h.end, target: h.target})
+			}
+		}
+		handlers = res
+	}
+	return handlers
+}
+
+func newCompiler(info *typecheck.Result, chunks map[string]Chunk, fuse bool) *compiler {
+	comp := new(compiler)
+	comp.info = info
+	comp.chunks = chunks
+	comp.globals = make(map[syntax.Node]bool)
+	comp.fuse = fuse
+	return comp
 }
 
 func litKindToValueType(kind syntax.LitKind) backing.ValueType {
@@ -39,18 +94,159 @@ func litKindToValueType(kind syntax.LitKind) backing.ValueType {
 func (c *compiler) prepareReservedFunctions() {
 	for _, funcName := range reservedFuncNames {
 		chunk := newChunk(nil, funcName)
-		chunkStore[funcName] = chunk
+		c.chunks[funcName] = chunk
 	}
 }
 
-func (c *compiler) compile(program *syntax.Program) {
+// compile compiles functions defined by the program. The rest of its statements go into
+// the init chunk, which calls the function named entry once they're done, returns false
+// if there are no such statements
+func (c *compiler) compile(program *syntax.Program, entry string) bool {
 	c.prepareReservedFunctions()
+	c.declareGlobals(program, nil)
+	for _, stmt := range program.StmtList {
+		if defStmt, ok := stmt.(*syntax.DefDeclStmt); ok {
+			c.compileDefDeclStmt(defStmt)
+		}
+	}
+	chunk := c.compileTopLevel(program, initChunkName)
+	if len(chunk.instrStream) == 0 {
+		return false
+	}
+	entryChunk := c.chunks[entry]
+	chunk.instrStream = append(chunk.instrStream, &InstrCall{FuncName: entry})
+	if entryChunk.doesReturn {
+		chunk.instrStream = append(chunk.instrStream, &InstrPop{})
+	}
+	chunk.instrStream = append(chunk.instrStream, &InstrReturn{})
+	c.chunks[initChunkName] = chunk
+	return true
+}
+
+// compileInput compiles functions defined by the program, then puts
+// the rest of its statements into a chunk of their own
+func (c *compiler) compileInput(program *syntax.Program, globals map[string]backing.Value) Chunk {
+	c.declareGlobals(program, globals)
+	for _, stmt := range program.StmtList {
+		if defStmt, ok := stmt.(*syntax.DefDeclStmt); ok {
+			c.compileDefDeclStmt(defStmt)
+		}
+	}
+	return c.compileTopLevel(program, inputChunkName)
+}
+
+// declareGlobals records values and variables declared at the top level of the program,
+// as well as the ones it refers to which were declared by programs evaluated before,
+// whose names are in globals
+func (c *compiler) declareGlobals(program *syntax.Program, globals map[string]backing.Value) {
 	for _, stmt := range program.StmtList {
-		c.compileStmt(stmt)
+		switch stmt.(type) {
+		case *syntax.ValDeclStmt, *syntax.VarDeclStmt:
+			c.globals[stmt] = true
+		}
+	}
+	if len(globals) == 0 {
+		return
 	}
+	declared := make(map[syntax.Node]bool)
+	syntax.Inspect(program, func(n syntax.Node) bool {
+		declared[n] = true
+		return true
+	})
+	syntax.Inspect(program, func(n syntax.Node) bool {
+		name, ok := n.(*syntax.Name)
+		if !ok {
+			return true
+		}
+		switch decl := c.info.Decls[name]; decl.(type) {
+		case *syntax.ValDeclStmt, *syntax.VarDeclStmt:
+			if _, ok := globals[name.Value]; ok && !declared[decl] {
+				c.globals[decl] = true
+			}
+		}
+		return true
+	})
+}
+
+// compileTopLevel puts statements of the program other than function definitions into
+// a chunk of their own, which holds no code if there are none
+func (c *compiler) compileTopLevel(program *syntax.Program, name string) Chunk {
+	c.beginChunk(program)
+	for _, stmt := range program.StmtList {
+		if _, ok := stmt.(*syntax.DefDeclStmt); !ok {
+			c.compileStmt(stmt)
+		}
+	}
+	chunk := newChunk(c.code, name)
+	chunk.handlers = c.handlers
+	chunk.lines = c.lines
+	allocateLocals(&chunk)
+	if c.fuse {
+		peephole(&chunk)
+	}
+	c.code = nil
+	c.handlers = nil
+	c.lines = nil
+	c.slots = nil
+	c.taken = nil
+	return chunk
+}
+
+// beginChunk prepares for compiling the code of node, a function or an input, into a chunk
+// of its own. Names which the code refers to, but doesn't declare, are taken from the start
+func (c *compiler) beginChunk(node syntax.Node) {
+	c.slots = make(map[syntax.Node]string)
+	c.taken = make(map[string]bool)
+	declared := make(map[syntax.Node]bool)
+	var refs []*syntax.Name
+	syntax.Inspect(node, func(n syntax.Node) bool {
+		switch n.(type) {
+		case *syntax.ValDeclStmt, *syntax.VarDeclStmt, *syntax.CatchClause, *syntax.Field:
+			declared[n] = true
+		case *syntax.Name:
+			refs = append(refs, n.(*syntax.Name))
+		}
+		return true
+	})
+	for _, ref := range refs {
+		switch decl := c.info.Decls[ref]; decl.(type) {
+		case *syntax.ValDeclStmt, *syntax.VarDeclStmt, *syntax.CatchClause, *syntax.Field:
+			if !declared[decl] {
+				c.taken[ref.Value] = true
+			}
+		}
+	}
+}
+
+// slot returns the name of the local holding the value declared by decl under the given name.
+// Locals of a chunk are looked up by name, regardless of the block declaring them, so a
+// declaration of a name already in use by the chunk gets a local of its own. Its name can't
+// be written in the source, thus it doesn't clash with any other
+func (c *compiler) slot(decl syntax.Node, name string) string {
+	if slot, ok := c.slots[decl]; ok {
+		return slot
+	}
+	slot := name
+	for idx := 1; c.taken[slot]; idx++ {
+		slot = name + "$" + strconv.Itoa(idx)
+	}
+	c.slots[decl] = slot
+	c.taken[slot] = true
+	return slot
+}
+
+// ref returns the name of the local, argument or global name refers to
+func (c *compiler) ref(name *syntax.Name) string {
+	if slot, ok := c.slots[c.info.Decls[name]]; ok {
+		return slot
+	}
+	return name.Value
 }
 
 func (c *compiler) compileStmt(stmt syntax.Stmt) {
+	if _, ok := stmt.(*syntax.BlockStmt); !ok {
+		c.lines = append(c.lines, lineEntry{start: len(c.code), pos: stmt.Pos()})
+	}
 	switch stmt.(type) {
 	default:
 		c.compileExpr(stmt)
@@ -66,12 +262,20 @@ func (c *compiler) compileStmt(stmt syntax.Stmt) {
 		c.compileDefDeclStmt(stmt)
 	case *syntax.Call:
 		c.compileCall(stmt)
+		// the result of a call made for its side effects is of no use
+		if resultType := c.info.TypeOf(stmt.(*syntax.Call)); resultType != backing.Unit && resultType != backing.Undefined {
+			c.code = append(c.code, &InstrPop{})
+		}
 	case *syntax.Assignment:
 		c.compileAssignment(stmt)
 	case *syntax.VarDeclStmt:
 		c.compileVarDeclStmt(stmt)
 	case *syntax.ValDeclStmt:
 		c.compileValDeclStmt(stmt)
+	case *syntax.ThrowStmt:
+		c.compileThrowStmt(stmt)
+	case *syntax.TryStmt:
+		c.compileTryStmt(stmt)
 	}
 }
 
@@ -85,8 +289,12 @@ func (c *compiler) compileBlockStmt(stmt syntax.Stmt) {
 func (c *compiler) compileValDeclStmt(stmt syntax.Stmt) {
 	valDeclStmt := stmt.(*syntax.ValDeclStmt)
 	c.compileExpr(valDeclStmt.Rhs)
+	if c.globals[valDeclStmt] {
+		c.code = append(c.code, &InstrSetGlobal{Name: valDeclStmt.Name.Value})
+		return
+	}
 	c.code = append(c.code, &InstrSetLocal{
-		Name:       valDeclStmt.Name.Value,
+		Name:       c.slot(valDeclStmt, valDeclStmt.Name.Value),
 		StoringCtx: backing.Declare,
 		Immutable:  true,
 	})
@@ -95,8 +303,12 @@ func (c *compiler) compileValDeclStmt(stmt syntax.Stmt) {
 func (c *compiler) compileVarDeclStmt(stmt syntax.Stmt) {
 	varDeclStmt := stmt.(*syntax.VarDeclStmt)
 	c.compileExpr(varDeclStmt.Rhs)
+	if c.globals[varDeclStmt] {
+		c.code = append(c.code, &InstrSetGlobal{Name: varDeclStmt.Name.Value})
+		return
+	}
 	c.code = append(c.code, &InstrSetLocal{
-		Name:       varDeclStmt.Name.Value,
+		Name:       c.slot(varDeclStmt, varDeclStmt.Name.Value),
 		StoringCtx: backing.Declare,
 	})
 }
@@ -108,8 +320,18 @@ func (c *compiler) compileIfStmt(stmt syntax.Stmt) {
 	c.code = append(c.code, jmpIfFalseInstr)
 	priorCodeLen := len(c.code)
 	c.compileBlockStmt(ifStmt.Body)
-	posteriorCodeLen := len(c.code)
-	jmpIfFalseInstr.Offset = posteriorCodeLen - priorCodeLen
+	if ifStmt.ElseBody == nil {
+		posteriorCodeLen := len(c.code)
+		jmpIfFalseInstr.Offset = posteriorCodeLen - priorCodeLen
+		return
+	}
+	// jump over the else branch once the body is done
+	jmpInstr := &InstrJmp{}
+	c.code = append(c.code, jmpInstr)
+	elseCodeLen := len(c.code)
+	jmpIfFalseInstr.Offset = elseCodeLen - priorCodeLen
+	c.compileStmt(ifStmt.ElseBody)
+	jmpInstr.Offset = len(c.code) - elseCodeLen
 }
 
 func (c *compiler) compileAssignment(stmt syntax.Stmt) {
@@ -117,8 +339,12 @@ func (c *compiler) compileAssignment(stmt syntax.Stmt) {
 	c.compileExpr(assignment.Rhs)
 	// dirty little hack, not encouraged, by any means, in industry-strength compilers
 	lhs := assignment.Lhs.(*syntax.Name)
+	if c.globals[c.info.Decls[lhs]] {
+		c.code = append(c.code, &InstrSetGlobal{Name: lhs.Value})
+		return
+	}
 	setLocalInstr := &InstrSetLocal{
-		Name:       lhs.Value,
+		Name:       c.ref(lhs),
 		StoringCtx: backing.Assign,
 	}
 	c.code = append(c.code, setLocalInstr)
@@ -149,9 +375,18 @@ func (c *compiler) compileDefDeclStmt(stmt syntax.Stmt) {
 		chunk.argNames = append(chunk.argNames, param.Name.Value)
 	}
 
-	chunk.doesReturn = defStmt.ReturnType.(*syntax.Name).Value != "Unit"
-	chunkStore[defStmt.Name.Value] = chunk
+	chunk.doesReturn = c.info.TypeOf(defStmt.ReturnType) != backing.Unit
+	c.chunks[defStmt.Name.Value] = chunk
+	enclosingSlots, enclosingTaken := c.slots, c.taken
+	c.beginChunk(defStmt)
+	for _, param := range defStmt.ParamList {
+		c.slots[param] = param.Name.Value
+		c.taken[param.Name.Value] = true
+	}
 	c.compileBlockStmt(defStmt.Body)
+	if len(c.code) == 0 {
+		c.code = append(c.code, &InstrReturn{})
+	}
 	switch c.code[len(c.code)-1].(type) {
 	default:
 		c.code = append(c.code, &InstrReturn{})
@@ -160,14 +395,23 @@ func (c *compiler) compileDefDeclStmt(stmt syntax.Stmt) {
 	}
 
 	// dirty hack to mutate an element in a map (not a hack at all)
-	chunk = chunkStore[defStmt.Name.Value]
+	chunk = c.chunks[defStmt.Name.Value]
 
 	// allocate a space for an instruction buffer
 	chunk.instrStream = make([]Instruction, len(c.code))
 	copy(chunk.instrStream, c.code)
+	chunk.handlers = c.handlers
+	chunk.lines = c.lines
+	allocateLocals(&chunk)
+	if c.fuse {
+		peephole(&chunk)
+	}
 	c.code = nil
 	c.code = make([]Instruction, 0)
-	chunkStore[defStmt.Name.Value] = chunk
+	c.handlers = nil
+	c.lines = nil
+	c.slots, c.taken = enclosingSlots, enclosingTaken
+	c.chunks[defStmt.Name.Value] = chunk
 }
 
 func (c *compiler) compileExpr(expr syntax.Expr) {
@@ -183,6 +427,18 @@ func (c *compiler) compileExpr(expr syntax.Expr) {
 		c.compileOperation(expr)
 	case *syntax.Call:
 		c.compileCall(expr)
+	case *syntax.Cast:
+		cast := expr.(*syntax.Cast)
+		c.compileExpr(cast.X)
+		c.code = append(c.code, &InstrCast{
+			Type: c.info.TypeOf(cast.Type),
+		})
+	case *syntax.TypeTest:
+		typeTest := expr.(*syntax.TypeTest)
+		c.compileExpr(typeTest.X)
+		c.code = append(c.code, &InstrInstanceOf{
+			Type: c.info.TypeOf(typeTest.Type),
+		})
 	}
 }
 
@@ -211,8 +467,12 @@ func (c *compiler) compileBasicLit(expr syntax.Expr) {
 
 func (c *compiler) compileName(expr syntax.Expr) {
 	name := expr.(*syntax.Name)
+	if c.globals[c.info.Decls[name]] {
+		c.code = append(c.code, &InstrLoadGlobal{Name: name.Value})
+		return
+	}
 	loadRefInstr := &InstrLoadRef{
-		RefName: name.Value,
+		RefName: c.ref(name),
 	}
 	c.code = append(c.code, loadRefInstr)
 }
@@ -220,27 +480,85 @@ func (c *compiler) compileName(expr syntax.Expr) {
 func (c *compiler) compileCall(expr syntax.Expr) {
 	call := expr.(*syntax.Call)
 
-	chunk := lookupChunk(call.CalleeName.Value, false, nil)
-
+	// the callee might not have been compiled yet, thus arguments get bound
+	// to its parameters by the vm, at the time the call is made
 	callInstr := &InstrCall{
 		FuncName: call.CalleeName.Value,
+		ArgCount: len(call.ArgList),
 	}
 
 	for _, arg := range call.ArgList {
 		c.compileExpr(arg)
 	}
 
-	callInstr.ArgNames = chunk.argNames
-
+	if c.info.TailCalls[call] {
+		// whatever follows the call is never reached, the callee returns to the caller instead
+		c.code = append(c.code, &InstrTailCall{FuncName: callInstr.FuncName, ArgCount: callInstr.ArgCount})
+		return
+	}
 	c.code = append(c.code, callInstr)
 }
 
+// operandsOfType reports whether both operands of the binary operation
+// were resolved to valueType by the typechecker
+func (c *compiler) operandsOfType(operation *syntax.Operation, valueType backing.ValueType) bool {
+	return operation.Rhs != nil &&
+		c.info.TypeOf(operation.Lhs) == valueType &&
+		c.info.TypeOf(operation.Rhs) == valueType
+}
+
+// compileSpecializedOperation emits an instruction dedicated to operands of a known type,
+// returns false if there's no such instruction for the operation
+func (c *compiler) compileSpecializedOperation(operation *syntax.Operation) bool {
+	var instr Instruction
+	switch {
+	case c.operandsOfType(operation, backing.Int):
+		switch operation.Op {
+		case syntax.Plus:
+			instr = &InstrAddInt{}
+		case syntax.Minus:
+			instr = &InstrSubInt{}
+		case syntax.Mul:
+			instr = &InstrMulInt{}
+		case syntax.GreaterThan:
+			instr = &InstrGreaterThanInt{}
+		case syntax.GreaterThanOrEqual:
+			instr = &InstrGreaterThanOrEqualInt{}
+		case syntax.LessThan:
+			instr = &InstrLessThanInt{}
+		case syntax.LessThanOrEqual:
+			instr = &InstrLessThanOrEqualInt{}
+		case syntax.Equal:
+			instr = &InstrEqualInt{}
+		}
+	case c.operandsOfType(operation, backing.Float):
+		switch operation.Op {
+		case syntax.Plus:
+			instr = &InstrAddFloat{}
+		case syntax.Minus:
+			instr = &InstrSubFloat{}
+		case syntax.Mul:
+			instr = &InstrMulFloat{}
+		case syntax.Div:
+			instr = &InstrDivFloat{}
+		}
+	}
+	if instr == nil {
+		return false
+	}
+	c.code = append(c.code, instr)
+	return true
+}
+
 func (c *compiler) compileOperation(expr syntax.Expr) {
 	operation := expr.(*syntax.Operation)
 	c.compileExpr(operation.Lhs)
 	if operation.Rhs != nil {
 		c.compileExpr(operation.Rhs)
 	}
+	if c.compileSpecializedOperation(operation) {
+		return
+	}
 	switch operation.Op {
 	default:
 		// TODO(threadedstream): handle an error
@@ -273,6 +591,8 @@ func (c *compiler) compileOperation(expr syntax.Expr) {
 		c.code = append(c.code, &InstrLessThanOrEqual{})
 	case syntax.Equal:
 		c.code = append(c.code, &InstrEqual{})
+	case syntax.NotEqual:
+		c.code = append(c.code, &InstrNotEqual{})
 	case syntax.Mod:
 		c.code = append(c.code, &InstrMod{})
 	case syntax.LogicalAnd:
@@ -287,5 +607,170 @@ func (c *compiler) compileOperation(expr syntax.Expr) {
 func (c *compiler) compileReturnStmt(stmt syntax.Stmt) {
 	returnStmt := stmt.(*syntax.ReturnStmt)
 	c.compileExpr(returnStmt.Value)
+	// leaving try blocks runs their finally blocks on the way out, innermost first.
+	// A finally block is compiled outside of its own try, so that a return within it
+	// doesn't run it once again. The value is kept in a local meanwhile, as an exception
+	// handled within a finally block clears the stack
+	var valueName string
+	if len(c.finallyBlocks) > 0 {
+		valueName = "$return" + strconv.Itoa(len(c.code))
+		c.code = append(c.code, &InstrSetLocal{
+			Name:       valueName,
+			StoringCtx: backing.Declare,
+			Immutable:  true,
+		})
+	}
+	enclosingFinallyBlocks := c.finallyBlocks
+	for len(c.finallyBlocks) > 0 {
+		finallyBlock := c.finallyBlocks[len(c.finallyBlocks)-1]
+		// capped, so that try statements within the finally block don't append over
+		// the finally blocks enclosingFinallyBlocks holds
+		last := len(c.finallyBlocks) - 1
+		c.finallyBlocks = c.finallyBlocks[:last:last]
+		start := len(c.code)
+		c.compileBlockStmt(finallyBlock)
+		// an exception raised by the finally block is no business of its try
+		// and of tries nested in it, all of which are being left
+		for idx, scope := range c.tries {
+			if scope.finally == finallyBlock {
+				for _, nested := range c.tries[idx:] {
+					nested.holes = append(nested.holes, handler{start: start, end: len(c.code)})
+				}
+				break
+			}
+		}
+	}
+	c.finallyBlocks = enclosingFinallyBlocks
+	if valueName != "" {
+		c.code = append(c.code, &InstrLoadRef{RefName: valueName})
+	}
 	c.code = append(c.code, &InstrReturn{})
 }
+
+func (c *compiler) compileThrowStmt(stmt syntax.Stmt) {
+	throwStmt := stmt.(*syntax.ThrowStmt)
+	c.compileExpr(throwStmt.Value)
+	c.code = append(c.code, &InstrThrow{})
+}
+
+// compileTryStmt lays out a try statement as follows:
+//
+//	body                      <- covered by the catch handler and the finally handler
+//	finally block
+//	jmp exit
+//	catch cases               <- the catch handler, covered by the finally handler
+//	finally block
+//	jmp exit
+//	finally block             <- the finally handler, rethrowing once done
+//	throw
+//	exit:
+//
+// A catch case tests the kind of the exception and falls through to the next case
+// on mismatch, an exception matched by none of them goes to the finally handler,
+// or is rethrown right away if there's no finally block. Copies of the finally block
+// made by the catch cases or by return statements within the try are left out of
+// the handlers' ranges, an exception raised by them propagates past the try
+func (c *compiler) compileTryStmt(stmt syntax.Stmt) {
+	tryStmt := stmt.(*syntax.TryStmt)
+	var exitJmps []*InstrJmp
+	jmpToExit := func() {
+		jmpInstr := &InstrJmp{}
+		c.code = append(c.code, jmpInstr)
+		// temporarily holds the position the jump is made from
+		jmpInstr.Offset = len(c.code)
+		exitJmps = append(exitJmps, jmpInstr)
+	}
+	compileFinally := func() {
+		if tryStmt.Finally != nil {
+			c.compileBlockStmt(tryStmt.Finally)
+		}
+	}
+
+	scope := &tryScope{finally: tryStmt.Finally}
+	c.tries = append(c.tries, scope)
+	if tryStmt.Finally != nil {
+		c.finallyBlocks = append(c.finallyBlocks, tryStmt.Finally)
+	}
+	bodyStart := len(c.code)
+	c.compileBlockStmt(tryStmt.Body)
+	bodyEnd := len(c.code)
+	var handlers []handler
+	if len(tryStmt.Cases) > 0 {
+		handlers = append(handlers, handler{start: bodyStart, end: bodyEnd, target: -1})
+	}
+	var catchStart, catchEnd int
+	if len(tryStmt.Cases) > 0 {
+		// the normal path goes around the catch cases
+		if tryStmt.Finally != nil {
+			c.finallyBlocks = c.finallyBlocks[:len(c.finallyBlocks)-1]
+			compileFinally()
+			c.finallyBlocks = append(c.finallyBlocks, tryStmt.Finally)
+		}
+		jmpToExit()
+		catchStart = len(c.code)
+		handlers[0].target = catchStart
+		var noMatchJmp *InstrJmpIfFalse
+		for _, catchClause := range tryStmt.Cases {
+			if noMatchJmp != nil {
+				noMatchJmp.Offset = len(c.code) - noMatchJmp.Offset
+			}
+			kind := ""
+			if catchClause.Type != nil {
+				kind = catchClause.Type.Value
+			}
+			c.code = append(c.code, &InstrMatchException{Kind: kind})
+			noMatchJmp = &InstrJmpIfFalse{}
+			c.code = append(c.code, noMatchJmp)
+			// temporarily holds the position the jump is made from
+			noMatchJmp.Offset = len(c.code)
+			c.code = append(c.code, &InstrSetLocal{
+				Name:       c.slot(catchClause, catchClause.Name.Value),
+				StoringCtx: backing.Declare,
+				Immutable:  true,
+			})
+			c.compileBlockStmt(catchClause.Body)
+			if tryStmt.Finally != nil {
+				c.finallyBlocks = c.finallyBlocks[:len(c.finallyBlocks)-1]
+				// the catch case is over, so the finally handler doesn't cover the finally block
+				finallyStart := len(c.code)
+				compileFinally()
+				scope.holes = append(scope.holes, handler{start: finallyStart, end: len(c.code)})
+				c.finallyBlocks = append(c.finallyBlocks, tryStmt.Finally)
+			}
+			jmpToExit()
+		}
+		noMatchJmp.Offset = len(c.code) - noMatchJmp.Offset
+		if tryStmt.Finally == nil {
+			c.code = append(c.code, &InstrThrow{})
+		}
+		catchEnd = len(c.code)
+	}
+	if tryStmt.Finally != nil {
+		c.finallyBlocks = c.finallyBlocks[:len(c.finallyBlocks)-1]
+		if len(tryStmt.Cases) == 0 {
+			compileFinally()
+			jmpToExit()
+		}
+		// the exception is kept in a local while the finally block runs
+		finallyTarget := len(c.code)
+		exceptionName := "$exception" + strconv.Itoa(finallyTarget)
+		handlers = append(handlers, handler{start: bodyStart, end: bodyEnd, target: finallyTarget})
+		if len(tryStmt.Cases) > 0 {
+			handlers = append(handlers, handler{start: catchStart, end: catchEnd, target: finallyTarget})
+		}
+		c.code = append(c.code, &InstrSetLocal{
+			Name:       exceptionName,
+			StoringCtx: backing.Declare,
+			Immutable:  true,
+		})
+		compileFinally()
+		c.code = append(c.code, &InstrLoadRef{RefName: exceptionName})
+		c.code = append(c.code, &InstrThrow{})
+	}
+	for _, jmpInstr := range exitJmps {
+		jmpInstr.Offset = len(c.code) - jmpInstr.Offset
+	}
+	c.tries = c.tries[:len(c.tries)-1]
+	// handlers of try statements nested in this one have been added already
+	c.handlers = append(c.handlers, scope.cover(handlers)...)
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Disassemble writes a listing of the function's bytecode to w,
+// returns false if no function with such name was compiled
+func (vm *VM) Disassemble(funcName string, w io.Writer) bool {
+	chunk, ok := vm.chunks[funcName]
+	if !ok || (chunk.instrStream == nil && backing.IsRuntimeCall(funcName)) {
+		return false
+	}
+	disassemble(chunk, w)
+	return true
+}
+
+// FuncNames returns names of the compiled functions in alphabetical order
+func (vm *VM) FuncNames() []string {
+	var names []string
+	for name, chunk := range vm.chunks {
+		if chunk.instrStream != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func disassemble(chunk Chunk, w io.Writer) {
+	fmt.Fprintf(w, "%s(%s):\n", chunk.funcName, strings.Join(chunk.argNames, ", "))
+	for idx, instruction := range chunk.instrStream {
+		fmt.Fprintf(w, "%6d  %s\n", idx, formatInstr(idx, instruction))
+	}
+	if len(chunk.handlers) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "handlers:")
+	for _, h := range chunk.handlers {
+		fmt.Fprintf(w, "  [%d, %d) -> %d\n", h.start, h.end, h.target)
+	}
+}
+
+// formatInstr renders the instruction at idx as its name followed by operands.
+// Jumps additionally show the index they lead to
+func formatInstr(idx int, instruction Instruction) string {
+	switch instruction.(type) {
+	case *InstrJmp:
+		offset := instruction.(*InstrJmp).Offset
+		return fmt.Sprintf("Jmp %+d (-> %d)", offset, idx+1+offset)
+	case *InstrJmpIfFalse:
+		offset := instruction.(*InstrJmpIfFalse).Offset
+		return fmt.Sprintf("JmpIfFalse %+d (-> %d)", offset, idx+1+offset)
+	case *InstrCompareIntJmpIfFalse:
+		compareJmp := instruction.(*InstrCompareIntJmpIfFalse)
+		return fmt.Sprintf("CompareIntJmpIfFalse %s %+d (-> %d)",
+			syntax.OperatorToString(compareJmp.Op), compareJmp.Offset, idx+1+compareJmp.Offset)
+	case *InstrSetLocal:
+		setLocal := instruction.(*InstrSetLocal)
+		if setLocal.StoringCtx == backing.Assign {
+			return fmt.Sprintf("SetLocal %s", setLocal.Name)
+		}
+		if setLocal.Immutable {
+			return fmt.Sprintf("SetLocal %s (val)", setLocal.Name)
+		}
+		return fmt.Sprintf("SetLocal %s (var)", setLocal.Name)
+	case *InstrMatchException:
+		kind := instruction.(*InstrMatchException).Kind
+		if kind == "" {
+			return "MatchException (any)"
+		}
+		return fmt.Sprintf("MatchException %s", kind)
+	}
+
+	instrValue := reflect.ValueOf(instruction).Elem()
+	instrType := instrValue.Type()
+	parts := []string{strings.TrimPrefix(instrType.Name(), "Instr")}
+	for i := 0; i < instrType.NumField(); i++ {
+		field := instrType.Field(i)
+		// the instr marker, unlike backing.Value of LoadImm, isn't an operand
+		if field.Anonymous && !field.IsExported() {
+			continue
+		}
+		// slots are numbered after names of locals, which read better
+		if field.Name == "Slot" {
+			continue
+		}
+		parts = append(parts, formatOperand(instrValue.Field(i).Interface()))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatOperand(operand interface{}) string {
+	switch operand.(type) {
+	case backing.ValueType:
+		return backing.ValueTypeToStr(operand.(backing.ValueType))
+	case backing.Value:
+		value := operand.(backing.Value)
+		if value.ValueType == backing.String {
+			return fmt.Sprintf("%q", value.AsString())
+		}
+		return fmt.Sprintf("%v", value.Value)
+	}
+	return fmt.Sprintf("%v", operand)
+}
@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzVM checks that well-typed programs run without breaking down the vm, that is
+// they either finish, raise an exception or run out of steps
+func FuzzVM(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("..", "sources", "*.miniscala"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		program, errors := syntax.ParseErrors(strings.NewReader(src))
+		if len(errors) > 0 {
+			t.Skip()
+		}
+		info := typecheck.NewChecker().Check(program)
+		if info.HadErrors() || !hasMain(program) {
+			t.Skip()
+		}
+		vm := NewVM(program, info)
+		vm.SetOutput(io.Discard)
+		vm.SetStepLimit(100000)
+		vm.Run()
+	})
+}
+
+func hasMain(program *syntax.Program) bool {
+	for _, stmt := range program.StmtList {
+		if defDeclStmt, ok := stmt.(*syntax.DefDeclStmt); ok && defDeclStmt.Name.Value == "main" {
+			return len(defDeclStmt.ParamList) == 0
+		}
+	}
+	return false
+}
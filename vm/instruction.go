@@ -2,6 +2,7 @@ package vm
 
 import (
 	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
 )
 
 type (
@@ -29,6 +30,56 @@ type (
 		instr
 	}
 
+	// instructions specialized for operands known to be of type Int
+	InstrAddInt struct {
+		instr
+	}
+
+	InstrSubInt struct {
+		instr
+	}
+
+	InstrMulInt struct {
+		instr
+	}
+
+	InstrGreaterThanInt struct {
+		instr
+	}
+
+	InstrGreaterThanOrEqualInt struct {
+		instr
+	}
+
+	InstrLessThanInt struct {
+		instr
+	}
+
+	InstrLessThanOrEqualInt struct {
+		instr
+	}
+
+	InstrEqualInt struct {
+		instr
+	}
+
+	// instructions specialized for operands known to be of type Float
+	InstrAddFloat struct {
+		instr
+	}
+
+	InstrSubFloat struct {
+		instr
+	}
+
+	InstrMulFloat struct {
+		instr
+	}
+
+	InstrDivFloat struct {
+		instr
+	}
+
 	InstrLogicalAnd struct {
 		instr
 	}
@@ -46,8 +97,10 @@ type (
 		instr
 	}
 
+	// InstrLoadRef pushes the value of the local or the argument named RefName, kept in Slot
 	InstrLoadRef struct {
 		RefName string
+		Slot    int
 		instr
 	}
 
@@ -71,6 +124,10 @@ type (
 		instr
 	}
 
+	InstrNotEqual struct {
+		instr
+	}
+
 	InstrTrue struct {
 		instr
 	}
@@ -93,17 +150,72 @@ type (
 		instr
 	}
 
+	// InstrLoadGlobal pushes the value of the global variable named Name
+	InstrLoadGlobal struct {
+		Name string
+		instr
+	}
+
+	// InstrSetGlobal pops the value on top of the stack into the global variable named Name
+	InstrSetGlobal struct {
+		Name string
+		instr
+	}
+
+	// InstrSetLocal pops the value on top of the stack into the local named Name, kept in Slot
 	InstrSetLocal struct {
 		Name       string
+		Slot       int
 		Type       string
 		StoringCtx backing.StoringContext
 		Immutable  bool
 		instr
 	}
 
+	// superinstructions the peephole pass fuses common sequences into
+
+	// InstrIncLocal adds Delta to the Int variable named Name, kept in Slot,
+	// it stands for LoadRef Name; LoadImm Delta; AddInt; SetLocal Name
+	InstrIncLocal struct {
+		Name  string
+		Slot  int
+		Delta int64
+		instr
+	}
+
+	// InstrCompareIntJmpIfFalse pops two Ints and jumps by Offset unless they compare
+	// as the operator Op tells, it stands for e.g LessThanInt; JmpIfFalse Offset
+	InstrCompareIntJmpIfFalse struct {
+		Op     syntax.Operator
+		Offset int
+		instr
+	}
+
+	// InstrCast raises ClassCastException unless the value on top
+	// of the stack is of type Type
+	InstrCast struct {
+		Type backing.ValueType
+		instr
+	}
+
+	// InstrInstanceOf replaces the value on top of the stack with
+	// a Bool telling whether the value is of type Type
+	InstrInstanceOf struct {
+		Type backing.ValueType
+		instr
+	}
+
 	InstrCall struct {
 		FuncName string
-		ArgNames []string
+		ArgCount int
+		instr
+	}
+
+	// InstrTailCall calls the function named FuncName in place of the one making the call,
+	// whose frame it takes over. The callee then returns to the caller of the latter
+	InstrTailCall struct {
+		FuncName string
+		ArgCount int
 		instr
 	}
 
@@ -111,6 +223,23 @@ type (
 		instr
 	}
 
+	// InstrPop discards the value on top of the stack
+	InstrPop struct {
+		instr
+	}
+
+	// InstrThrow raises the exception on top of the stack
+	InstrThrow struct {
+		instr
+	}
+
+	// InstrMatchException pushes a Bool telling whether the exception on top
+	// of the stack, which is left in place, is of kind Kind. Empty Kind matches any exception
+	InstrMatchException struct {
+		Kind string
+		instr
+	}
+
 	instr struct {
 		text string
 	}
@@ -0,0 +1,413 @@
+package vm
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/ir"
+	"strconv"
+	"text/scanner"
+)
+
+// NewVMFromIR prepares the program translated to the IR for execution, starting at
+// the function with the given name, which must take no arguments. Top-level statements
+// of the program run first
+func NewVMFromIR(program *ir.Program, entry string) *VM {
+	vm := NewInteractiveVM()
+	for _, f := range program.Funcs {
+		vm.chunks[f.Name] = lower(f, "", false)
+	}
+	if program.Init != nil {
+		entryChunk := vm.lookupChunk(entry)
+		vm.chunks[ir.InitName] = lower(program.Init, entry, entryChunk.doesReturn)
+		entry = ir.InitName
+	}
+	vm.chunk = vm.lookupChunk(entry)
+	vm.chunk.locals = make([]backing.Value, vm.chunk.localCount)
+	return vm
+}
+
+type (
+	// lowering translates a function in the IR to a chunk. Values are kept in locals,
+	// named after them, unless a value is used once, by an instruction following it
+	// right away or after other operands of that instruction, which makes for an
+	// expression tree evaluated on the stack the way the compiler does it.
+	// Constants and parameters are loaded wherever they're used. Phis are locals
+	// assigned by edges leading to their blocks
+	lowering struct {
+		f     *ir.Func
+		code  []Instruction
+		lines []lineEntry
+		pos   scanner.Position
+		// values evaluated as operands of the instruction using them
+		folded map[*ir.Value]bool
+		// index of the first instruction of the expression tree rooted at a value
+		treeStart  map[*ir.Value]int
+		blockStart map[*ir.Block]int
+		jumps      []jumpFixup
+		// handlers of blocks which may raise exceptions, targets are set once the code is laid out
+		handlers []handlerFixup
+		// function the init function calls once it's done, and whether it returns something
+		entry       string
+		entryResult bool
+	}
+
+	// jumpFixup is a jump to the start of a block, whose offset is set once the code is laid out
+	jumpFixup struct {
+		at     int
+		target *ir.Block
+	}
+
+	handlerFixup struct {
+		block      *ir.Block
+		start, end int
+	}
+)
+
+// lower translates the function to a chunk. The init function, which entry is given for,
+// calls it on return
+func lower(f *ir.Func, entry string, entryResult bool) Chunk {
+	l := &lowering{
+		f:           f,
+		folded:      make(map[*ir.Value]bool),
+		treeStart:   make(map[*ir.Value]int),
+		blockStart:  make(map[*ir.Block]int),
+		entry:       entry,
+		entryResult: entryResult,
+	}
+	for idx, b := range f.Blocks {
+		var next *ir.Block
+		if idx+1 < len(f.Blocks) {
+			next = f.Blocks[idx+1]
+		}
+		l.block(b, next)
+	}
+
+	var handlers []handler
+	for _, h := range l.handlers {
+		target := l.blockStart[h.block.Catch]
+		if l.hasCopies(h.block, h.block.Catch) {
+			// phis of the handler are assigned on the way to it, the exception stays on the stack meanwhile
+			target = len(l.code)
+			l.edge(h.block, h.block.Catch)
+			l.jump(h.block.Catch)
+		}
+		handlers = append(handlers, handler{start: h.start, end: h.end, target: target})
+	}
+	for _, jump := range l.jumps {
+		offset := l.blockStart[jump.target] - (jump.at + 1)
+		switch instr := l.code[jump.at].(type) {
+		case *InstrJmp:
+			instr.Offset = offset
+		case *InstrJmpIfFalse:
+			instr.Offset = offset
+		}
+	}
+
+	chunk := newChunk(l.code, f.Name)
+	for _, param := range f.Params {
+		chunk.argNames = append(chunk.argNames, param.Aux.(string))
+	}
+	chunk.doesReturn = f.ResultType != backing.Unit
+	chunk.handlers = handlers
+	chunk.lines = l.lines
+	allocateLocals(&chunk)
+	peephole(&chunk)
+	return chunk
+}
+
+// phis returns phis of the block
+func phis(b *ir.Block) []*ir.Value {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == ir.OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// localName returns the name of the local holding the value, which can't be taken by a variable
+func localName(v *ir.Value) string {
+	return "%v" + strconv.Itoa(v.ID)
+}
+
+func (l *lowering) emit(instr Instruction) {
+	l.code = append(l.code, instr)
+}
+
+// at attributes instructions emitted from now on to the statement at pos
+func (l *lowering) at(pos scanner.Position) {
+	if len(l.lines) == 0 || pos != l.pos {
+		l.lines = append(l.lines, lineEntry{start: len(l.code), pos: pos})
+		l.pos = pos
+	}
+}
+
+// jump emits a jump to the start of the block
+func (l *lowering) jump(target *ir.Block) {
+	l.jumps = append(l.jumps, jumpFixup{at: len(l.code), target: target})
+	l.emit(&InstrJmp{})
+}
+
+func (l *lowering) block(b *ir.Block, next *ir.Block) {
+	start := len(l.code)
+	l.blockStart[b] = start
+	l.fold(b)
+	for _, v := range b.Instrs {
+		if v.Op == ir.OpPhi || v.Op == ir.OpConst || l.folded[v] {
+			continue
+		}
+		l.at(v.Pos)
+		l.tree(v)
+		if !v.HasResult() {
+			continue
+		}
+		if v.Uses == 0 {
+			l.emit(&InstrPop{})
+			continue
+		}
+		l.emit(&InstrSetLocal{Name: localName(v), StoringCtx: backing.Declare})
+	}
+
+	l.at(b.Pos)
+	switch b.Kind {
+	case ir.BlockPlain:
+		succ := b.Succs[0]
+		l.edge(b, succ)
+		if succ != next {
+			l.jump(succ)
+		}
+	case ir.BlockIf:
+		then, els := b.Succs[0], b.Succs[1]
+		l.operand(b.Control)
+		jmpIfFalse := &InstrJmpIfFalse{}
+		if !l.hasCopies(b, els) {
+			l.jumps = append(l.jumps, jumpFixup{at: len(l.code), target: els})
+			l.emit(jmpIfFalse)
+			l.edge(b, then)
+			if then != next {
+				l.jump(then)
+			}
+			break
+		}
+		l.emit(jmpIfFalse)
+		from := len(l.code)
+		l.edge(b, then)
+		l.jump(then)
+		jmpIfFalse.Offset = len(l.code) - from
+		l.edge(b, els)
+		if els != next {
+			l.jump(els)
+		}
+	case ir.BlockReturn:
+		if l.entry != "" {
+			l.emit(&InstrCall{FuncName: l.entry})
+			if l.entryResult {
+				l.emit(&InstrPop{})
+			}
+		}
+		if b.Control != nil {
+			l.operand(b.Control)
+		}
+		l.emit(&InstrReturn{})
+	case ir.BlockThrow:
+		l.operand(b.Control)
+		l.emit(&InstrThrow{})
+	}
+	if b.Catch != nil {
+		l.handlers = append(l.handlers, handlerFixup{block: b, start: start, end: len(l.code)})
+	}
+}
+
+// fold finds values of the block which are evaluated as operands of the instruction
+// using them. Such a value is used once, and nothing but operands of the user following
+// it, which are folded as well, lies between the value and its user, so that
+// the order of evaluation is kept
+func (l *lowering) fold(b *ir.Block) {
+	for idx, v := range b.Instrs {
+		if v.Op != ir.OpPhi && v.Op != ir.OpConst {
+			l.treeStart[v] = l.foldArgs(b, idx, v.Args)
+		}
+	}
+	if b.Control != nil {
+		l.foldArgs(b, len(b.Instrs), []*ir.Value{b.Control})
+	}
+}
+
+// foldArgs folds arguments of the instruction at idx, last ones first,
+// and returns the index the instruction's expression tree starts at
+func (l *lowering) foldArgs(b *ir.Block, idx int, args []*ir.Value) int {
+	pos := idx - 1
+	for argIdx := len(args) - 1; argIdx >= 0; argIdx-- {
+		// constants and phis take no code where they're placed
+		for pos >= 0 && (b.Instrs[pos].Op == ir.OpConst || b.Instrs[pos].Op == ir.OpPhi) {
+			pos--
+		}
+		arg := args[argIdx]
+		if arg.Op == ir.OpConst || arg.Op == ir.OpParam {
+			continue
+		}
+		if pos < 0 || b.Instrs[pos] != arg || arg.Uses != 1 {
+			break
+		}
+		l.folded[arg] = true
+		pos = l.treeStart[arg] - 1
+	}
+	return pos + 1
+}
+
+// operand pushes the value
+func (l *lowering) operand(v *ir.Value) {
+	switch {
+	case l.folded[v]:
+		l.tree(v)
+	case v.Op == ir.OpConst:
+		l.emit(&InstrLoadImm{Value: v.Aux.(backing.Value)})
+	case v.Op == ir.OpParam:
+		l.emit(&InstrLoadRef{RefName: v.Aux.(string)})
+	default:
+		l.emit(&InstrLoadRef{RefName: localName(v)})
+	}
+}
+
+// tree pushes operands of the instruction and carries it out
+func (l *lowering) tree(v *ir.Value) {
+	for _, arg := range v.Args {
+		l.operand(arg)
+	}
+	// a tree may take in instructions of preceding statements
+	l.at(v.Pos)
+	l.instr(v)
+}
+
+// hasCopies reports whether the edge assigns phis
+func (l *lowering) hasCopies(from, to *ir.Block) bool {
+	idx := to.PredIndex(from)
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			return true
+		}
+	}
+	return false
+}
+
+// edge assigns phis of the block control is passed to their arguments coming
+// from the block it's passed from. All of the arguments are pushed before any
+// of the phis is assigned, as a phi may be an argument of another one
+func (l *lowering) edge(from, to *ir.Block) {
+	idx := to.PredIndex(from)
+	var assigned []*ir.Value
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			l.operand(phi.Args[idx])
+			assigned = append(assigned, phi)
+		}
+	}
+	for i := len(assigned) - 1; i >= 0; i-- {
+		l.emit(&InstrSetLocal{Name: localName(assigned[i]), StoringCtx: backing.Declare})
+	}
+}
+
+// instr emits instructions carrying out the instruction in the IR, its operands being on the stack
+func (l *lowering) instr(v *ir.Value) {
+	operandType := backing.Undefined
+	if len(v.Args) > 0 {
+		operandType = v.Args[0].Type
+	}
+	switch v.Op {
+	case ir.OpCatch:
+		// the exception is pushed by the vm on the way to the handler
+	case ir.OpConst:
+		l.emit(&InstrLoadImm{Value: v.Aux.(backing.Value)})
+	case ir.OpLoadGlobal:
+		l.emit(&InstrLoadGlobal{Name: v.Aux.(string)})
+	case ir.OpStoreGlobal:
+		l.emit(&InstrSetGlobal{Name: v.Aux.(string)})
+	case ir.OpAdd:
+		switch v.Type {
+		case backing.Int:
+			l.emit(&InstrAddInt{})
+		case backing.Float:
+			l.emit(&InstrAddFloat{})
+		default:
+			l.emit(&InstrAdd{})
+		}
+	case ir.OpSub:
+		if v.Type == backing.Int {
+			l.emit(&InstrSubInt{})
+		} else {
+			l.emit(&InstrSubFloat{})
+		}
+	case ir.OpMul:
+		if v.Type == backing.Int {
+			l.emit(&InstrMulInt{})
+		} else {
+			l.emit(&InstrMulFloat{})
+		}
+	case ir.OpDiv:
+		if v.Type == backing.Int {
+			l.emit(&InstrDiv{})
+		} else {
+			l.emit(&InstrDivFloat{})
+		}
+	case ir.OpMod:
+		l.emit(&InstrMod{})
+	case ir.OpNeg:
+		if v.Type == backing.Int {
+			l.emit(&InstrLoadImm{Value: backing.Value{Value: int64(-1), ValueType: backing.Int}})
+			l.emit(&InstrMulInt{})
+		} else {
+			l.emit(&InstrLoadImm{Value: backing.Value{Value: float64(-1), ValueType: backing.Float}})
+			l.emit(&InstrMulFloat{})
+		}
+	case ir.OpEq:
+		if operandType == backing.Int {
+			l.emit(&InstrEqualInt{})
+		} else {
+			l.emit(&InstrEqual{})
+		}
+	case ir.OpNe:
+		l.emit(&InstrNotEqual{})
+	case ir.OpLt:
+		if operandType == backing.Int {
+			l.emit(&InstrLessThanInt{})
+		} else {
+			l.emit(&InstrLessThan{})
+		}
+	case ir.OpLe:
+		if operandType == backing.Int {
+			l.emit(&InstrLessThanOrEqualInt{})
+		} else {
+			l.emit(&InstrLessThanOrEqual{})
+		}
+	case ir.OpGt:
+		if operandType == backing.Int {
+			l.emit(&InstrGreaterThanInt{})
+		} else {
+			l.emit(&InstrGreaterThan{})
+		}
+	case ir.OpGe:
+		if operandType == backing.Int {
+			l.emit(&InstrGreaterThanOrEqualInt{})
+		} else {
+			l.emit(&InstrGreaterThanOrEqual{})
+		}
+	case ir.OpAnd:
+		l.emit(&InstrLogicalAnd{})
+	case ir.OpOr:
+		l.emit(&InstrLogicalOr{})
+	case ir.OpNot:
+		l.emit(&InstrLogicalNot{})
+	case ir.OpToFloat:
+		l.emit(&InstrCall{FuncName: "toFloat", ArgCount: 1})
+	case ir.OpCast:
+		l.emit(&InstrCast{Type: v.Aux.(backing.ValueType)})
+	case ir.OpInstanceOf:
+		l.emit(&InstrInstanceOf{Type: v.Aux.(backing.ValueType)})
+	case ir.OpCall:
+		if v.TailCall() {
+			l.emit(&InstrTailCall{FuncName: v.Callee(), ArgCount: len(v.Args)})
+			break
+		}
+		l.emit(&InstrCall{FuncName: v.Callee(), ArgCount: len(v.Args)})
+	default:
+		panic("unexpected instruction " + v.LongString())
+	}
+}
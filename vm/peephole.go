@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/syntax"
+)
+
+// peephole fuses common sequences of the chunk's instructions into superinstructions,
+// i.e increments of variables into InstrIncLocal and comparisons of Ints followed by
+// a conditional jump into InstrCompareIntJmpIfFalse. Sequences which jumps, handlers
+// or line entries refer into are left alone, the ones they refer to are remapped
+func peephole(chunk *Chunk) {
+	code := chunk.instrStream
+	// boundaries[idx] tells whether something refers to the instruction at idx,
+	// so that it must stay the first one of whatever it's fused into
+	boundaries := make([]bool, len(code)+1)
+	for idx, instruction := range code {
+		if offset, ok := jumpOffset(instruction); ok {
+			boundaries[idx+1+offset] = true
+		}
+	}
+	for _, h := range chunk.handlers {
+		boundaries[h.start] = true
+		boundaries[h.end] = true
+		boundaries[h.target] = true
+	}
+	for _, entry := range chunk.lines {
+		boundaries[entry.start] = true
+	}
+
+	var fused []Instruction
+	// newIndex maps indices of the instructions to indices of the ones they're fused into
+	newIndex := make([]int, len(code)+1)
+	// oldJumps holds indices of the jumps the fused instructions originate from
+	oldJumps := make(map[int]int)
+	for idx := 0; idx < len(code); {
+		instruction, n := fuse(code[idx:])
+		for _, b := range boundaries[idx+1 : idx+n] {
+			if b {
+				instruction, n = code[idx], 1
+				break
+			}
+		}
+		for k := 0; k < n; k++ {
+			newIndex[idx+k] = len(fused)
+		}
+		if _, ok := jumpOffset(instruction); ok {
+			oldJumps[len(fused)] = idx + n - 1
+		}
+		fused = append(fused, instruction)
+		idx += n
+	}
+	newIndex[len(code)] = len(fused)
+
+	for at, oldAt := range oldJumps {
+		offset, _ := jumpOffset(code[oldAt])
+		offset = newIndex[oldAt+1+offset] - (at + 1)
+		switch instruction := fused[at].(type) {
+		case *InstrJmp:
+			fused[at] = &InstrJmp{Offset: offset}
+		case *InstrJmpIfFalse:
+			fused[at] = &InstrJmpIfFalse{Offset: offset}
+		case *InstrCompareIntJmpIfFalse:
+			instruction.Offset = offset
+		}
+	}
+	handlers := make([]handler, len(chunk.handlers))
+	for idx, h := range chunk.handlers {
+		handlers[idx] = handler{start: newIndex[h.start], end: newIndex[h.end], target: newIndex[h.target]}
+	}
+	lines := make([]lineEntry, len(chunk.lines))
+	for idx, entry := range chunk.lines {
+		lines[idx] = lineEntry{start: newIndex[entry.start], pos: entry.pos}
+	}
+	chunk.instrStream = fused
+	chunk.handlers = handlers
+	chunk.lines = lines
+}
+
+// fuse returns the superinstruction the sequence at the start of code is fused into
+// and the number of instructions it stands for, or the first instruction and 1
+func fuse(code []Instruction) (Instruction, int) {
+	if len(code) >= 4 {
+		loadRef, ok1 := code[0].(*InstrLoadRef)
+		loadImm, ok2 := code[1].(*InstrLoadImm)
+		setLocal, ok3 := code[3].(*InstrSetLocal)
+		if ok1 && ok2 && ok3 && loadImm.ValueType == backing.Int &&
+			setLocal.StoringCtx == backing.Assign && setLocal.Name == loadRef.RefName {
+			switch code[2].(type) {
+			case *InstrAddInt:
+				return &InstrIncLocal{Name: loadRef.RefName, Slot: loadRef.Slot, Delta: loadImm.AsInt()}, 4
+			case *InstrSubInt:
+				return &InstrIncLocal{Name: loadRef.RefName, Slot: loadRef.Slot, Delta: -loadImm.AsInt()}, 4
+			}
+		}
+	}
+	if len(code) >= 2 {
+		if jmpIfFalse, ok := code[1].(*InstrJmpIfFalse); ok {
+			if op, ok := intComparison(code[0]); ok {
+				return &InstrCompareIntJmpIfFalse{Op: op, Offset: jmpIfFalse.Offset}, 2
+			}
+		}
+	}
+	return code[0], 1
+}
+
+// intComparison returns the operator of an instruction comparing Ints
+func intComparison(instruction Instruction) (syntax.Operator, bool) {
+	switch instruction.(type) {
+	case *InstrGreaterThanInt:
+		return syntax.GreaterThan, true
+	case *InstrGreaterThanOrEqualInt:
+		return syntax.GreaterThanOrEqual, true
+	case *InstrLessThanInt:
+		return syntax.LessThan, true
+	case *InstrLessThanOrEqualInt:
+		return syntax.LessThanOrEqual, true
+	case *InstrEqualInt:
+		return syntax.Equal, true
+	}
+	return syntax.InvalidOperator, false
+}
+
+// jumpOffset returns the offset of a jump, ok is false for other instructions
+func jumpOffset(instruction Instruction) (offset int, ok bool) {
+	switch instruction := instruction.(type) {
+	case *InstrJmp:
+		return instruction.Offset, true
+	case *InstrJmpIfFalse:
+		return instruction.Offset, true
+	case *InstrCompareIntJmpIfFalse:
+		return instruction.Offset, true
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"github.com/ThreadedStream/miniscala/diff"
+	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPeephole checks the listing of a function whose increments and comparisons are fused,
+// with jumps and handlers remapped
+func TestPeephole(t *testing.T) {
+	src := `def count(n: Int): Int {
+    var i = 0
+    var sum = 0
+    while (i < n) {
+        try {
+            sum = sum + 10 / i
+        } catch {
+            case e: ArithmeticException =>
+                sum = sum - 1
+        }
+        i = i + 1
+    }
+    return sum
+}
+`
+	expected := `count(n):
+     0  LoadImm 0
+     1  SetLocal i (var)
+     2  LoadImm 0
+     3  SetLocal sum (var)
+     4  LoadRef i
+     5  LoadRef n
+     6  CompareIntJmpIfFalse < +15 (-> 22)
+     7  LoadRef sum
+     8  LoadImm 10
+     9  LoadRef i
+    10  Div
+    11  AddInt
+    12  SetLocal sum
+    13  Jmp +6 (-> 20)
+    14  MatchException ArithmeticException
+    15  JmpIfFalse +3 (-> 19)
+    16  SetLocal e (val)
+    17  IncLocal sum -1
+    18  Jmp +1 (-> 20)
+    19  Throw
+    20  IncLocal i 1
+    21  Jmp -18 (-> 4)
+    22  LoadRef sum
+    23  Return
+handlers:
+  [7, 13) -> 14
+`
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(src))
+	if len(syntaxErrors) > 0 {
+		t.Fatalf("syntax errors: %v", syntaxErrors)
+	}
+	info := typecheck.NewChecker().Check(program)
+	if info.HadErrors() {
+		t.Fatalf("type errors: %v", info.Errors)
+	}
+	var b strings.Builder
+	NewVMWithEntry(program, info, "count").Disassemble("count", &b)
+	if d := diff.Unified("expected", "actual", expected, b.String()); d != "" {
+		t.Error(d)
+	}
+}
+
+// BenchmarkSort runs sources/sort.miniscala with and without the peephole pass
+func BenchmarkSort(b *testing.B) {
+	src, err := os.ReadFile(filepath.Join("..", "sources", "sort.miniscala"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	program, syntaxErrors := syntax.ParseErrors(strings.NewReader(string(src)))
+	if len(syntaxErrors) > 0 {
+		b.Fatalf("syntax errors: %v", syntaxErrors)
+	}
+	info := typecheck.NewChecker().Check(program)
+	for _, disabled := range []bool{true, false} {
+		name := "peephole"
+		if disabled {
+			name = "plain"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vm := newVMWithEntry(program, info, "main", !disabled)
+				vm.SetOutput(io.Discard)
+				b.StartTimer()
+				if err := vm.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
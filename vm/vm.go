@@ -1,37 +1,131 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/ThreadedStream/miniscala/backing"
 	"github.com/ThreadedStream/miniscala/syntax"
+	"github.com/ThreadedStream/miniscala/typecheck"
+	"io"
 	"os"
+	"time"
 )
 
-type Stack [256]backing.Value
+// Stack holds operands of all the calls in progress, it's sized so that calls
+// run out of depth well before the stack runs out of room
+type Stack [backing.MaxCallDepth * 16]backing.Value
 
 type ChainEntry struct {
-	chunk Chunk
-	ip    int
+	chunk     Chunk
+	ip        int
+	frameBase int
 }
 
 type VM struct {
-	chunk        Chunk
-	ip           int
-	stack        Stack
-	stackPtr     int
+	chunk    Chunk
+	ip       int
+	stack    Stack
+	stackPtr int
+	// stack pointer at the time the current chunk was entered, everything
+	// above it belongs to the current call
+	frameBase    int
 	nestingLevel int
-	callChain    [256]ChainEntry
+	callChain    [backing.MaxCallDepth]ChainEntry
+	// compiled functions, keyed by name
+	chunks map[string]Chunk
+	// values and variables declared at the top level by programs given to Eval
+	globals map[string]backing.Value
+	// where the program prints to
+	out io.Writer
+	// instructions executed so far, and how many may be executed, zero for no limit
+	steps     int
+	stepLimit int
+	// when Run gives up on the program, zero for never, and whether it did
+	deadline time.Time
+	expired  bool
 }
 
-func NewVM(program *syntax.Program) *VM {
-	comp := newCompiler()
-	comp.compile(program)
+// ErrStepLimit is returned by Run when the program executes more instructions than
+// allowed by SetStepLimit
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// ErrDeadline is returned by Run when the program is still running at the time set by SetDeadline
+var ErrDeadline = errors.New("deadline exceeded")
+
+// deadlineCheckMask makes the clock be read once in that many instructions plus one
+const deadlineCheckMask = 1<<12 - 1
+
+// NewVM compiles the program, making use of types resolved
+// by the typechecker, and prepares it for execution. Top-level
+// statements of the program run first, then main is called
+func NewVM(program *syntax.Program, info *typecheck.Result) *VM {
+	return NewVMWithEntry(program, info, "main")
+}
+
+// NewVMWithEntry is like NewVM, but execution starts at the function with the given
+// name rather than at main. The function must take no arguments
+func NewVMWithEntry(program *syntax.Program, info *typecheck.Result, entry string) *VM {
+	return newVMWithEntry(program, info, entry, true)
+}
+
+// newVMWithEntry is NewVMWithEntry, which leaves out the peephole pass unless fuse is set,
+// so that benchmarks measure what the pass gains
+func newVMWithEntry(program *syntax.Program, info *typecheck.Result, entry string, fuse bool) *VM {
+	vm := NewInteractiveVM()
+	comp := newCompiler(info, vm.chunks, fuse)
+	if comp.compile(program, entry) {
+		entry = initChunkName
+	}
+	vm.chunk = vm.lookupChunk(entry)
+	vm.chunk.locals = make([]backing.Value, vm.chunk.localCount)
+	return vm
+}
+
+// NewInteractiveVM returns a VM with no program loaded. Programs are then given
+// to Eval one by one, e.g. as they're typed into the REPL
+func NewInteractiveVM() *VM {
 	vm := new(VM)
-	vm.chunk = lookupChunk("main", true, vm.abort)
-	vm.chunk.localVars = make(map[string]backing.Value)
+	vm.chunks = make(map[string]Chunk)
+	vm.globals = make(map[string]backing.Value)
+	vm.out = os.Stdout
+	return vm
+}
+
+// SetOutput redirects whatever the program prints to out, which is stdout by default
+func (vm *VM) SetOutput(out io.Writer) {
+	vm.out = out
+}
+
+// SetStepLimit makes Run stop with ErrStepLimit once the program executes n instructions,
+// which keeps programs that never finish from running forever. Zero means no limit
+func (vm *VM) SetStepLimit(n int) {
+	vm.stepLimit = n
+}
+
+// SetDeadline makes Run stop with ErrDeadline once the program runs past t, which keeps
+// programs that never finish from running forever. The zero time means no deadline
+func (vm *VM) SetDeadline(t time.Time) {
+	vm.deadline = t
+}
+
+// Eval compiles the program and executes its top-level statements right away. Functions,
+// values and variables it declares are visible to programs evaluated afterwards.
+// An exception raised and not handled by the program is returned as *backing.ExceptionValue
+func (vm *VM) Eval(program *syntax.Program, info *typecheck.Result) error {
+	comp := newCompiler(info, vm.chunks, true)
+	vm.chunk = comp.compileInput(program, vm.globals)
+	vm.chunk.locals = make([]backing.Value, vm.chunk.localCount)
 	vm.ip = 0
+	vm.stackPtr = 0
+	vm.frameBase = 0
 	vm.nestingLevel = 0
-	return vm
+	return vm.Run()
+}
+
+// Global returns the value of a name declared at the top level of a program given to Eval
+func (vm *VM) Global(name string) (backing.Value, bool) {
+	value, ok := vm.globals[name]
+	return value, ok
 }
 
 func (vm *VM) resetStack() {
@@ -39,14 +133,13 @@ func (vm *VM) resetStack() {
 }
 
 func (vm *VM) abort(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args))
-}
-
-func (vm *VM) normalexit() {
-	os.Exit(1)
+	panic(fmt.Errorf(format, args...))
 }
 
 func (vm *VM) push(v backing.Value) {
+	if vm.stackPtr == len(vm.stack) {
+		backing.Throw(backing.StackOverflowError, "operand stack exhausted")
+	}
 	vm.stack[vm.stackPtr] = v
 	vm.stackPtr++
 }
@@ -56,13 +149,92 @@ func (vm *VM) pop() backing.Value {
 	return vm.stack[vm.stackPtr]
 }
 
-func (vm *VM) Run() {
+// Run executes the program until main returns. An exception raised
+// and not handled by the program is returned as *backing.ExceptionValue,
+// with its Pos set to the statement which raised it. ErrStepLimit is returned
+// if the program runs out of steps set by SetStepLimit, ErrDeadline if it runs
+// past the time set by SetDeadline
+func (vm *VM) Run() error {
+	for {
+		exception := vm.runUntilException()
+		if exception == nil {
+			if vm.expired {
+				return ErrDeadline
+			}
+			if vm.stepLimit > 0 && vm.steps >= vm.stepLimit {
+				return ErrStepLimit
+			}
+			return nil
+		}
+		if !vm.unwind(exception) {
+			return exception
+		}
+	}
+}
+
+// runUntilException runs the program, returning the exception
+// which stopped it, or nil if main returned normally
+func (vm *VM) runUntilException() (exception *backing.ExceptionValue) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			exception, ok = r.(*backing.ExceptionValue)
+			if !ok {
+				panic(r)
+			}
+		}
+	}()
+	vm.run()
+	return nil
+}
+
+// unwind looks for a handler of the exception, walking up the call chain. On success,
+// execution is set to resume at the handler with the exception on top of the stack
+func (vm *VM) unwind(exception *backing.ExceptionValue) bool {
+	for {
+		// ip has already moved past the instruction that raised the exception,
+		// or past the call instruction in case of callers
+		raisedAt := vm.ip - 1
+		if exception.Pos.Line == 0 {
+			exception.Pos = vm.chunk.positionAt(raisedAt)
+		}
+		for _, h := range vm.chunk.handlers {
+			if raisedAt >= h.start && raisedAt < h.end {
+				vm.stackPtr = vm.frameBase
+				vm.push(backing.Value{
+					Value:     exception,
+					ValueType: backing.Exception,
+				})
+				vm.ip = h.target
+				return true
+			}
+		}
+		if vm.nestingLevel <= 0 {
+			return false
+		}
+		vm.nestingLevel--
+		vm.chunk = vm.callChain[vm.nestingLevel].chunk
+		vm.ip = vm.callChain[vm.nestingLevel].ip
+		vm.frameBase = vm.callChain[vm.nestingLevel].frameBase
+		vm.callChain[vm.nestingLevel] = ChainEntry{}
+	}
+}
+
+func (vm *VM) run() {
 	for vm.ip < len(vm.chunk.instrStream) {
+		if vm.stepLimit > 0 && vm.steps >= vm.stepLimit {
+			return
+		}
+		if vm.steps&deadlineCheckMask == 0 && !vm.deadline.IsZero() && time.Now().After(vm.deadline) {
+			vm.expired = true
+			return
+		}
+		vm.steps++
 		oldIp := vm.ip
 		vm.ip++
 		switch vm.chunk.instrStream[oldIp].(type) {
 		default:
-			vm.abort("unknown instruction %v", vm.chunk.instrStream[vm.ip])
+			vm.abort("unknown instruction %v", vm.chunk.instrStream[oldIp])
 		case *InstrAdd:
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
@@ -83,6 +255,54 @@ func (vm *VM) Run() {
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
 			vm.push(backing.Mod(firstOperand, secondOperand, nil, backing.Vm))
+		case *InstrAddInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() + secondOperand.AsInt(), ValueType: backing.Int})
+		case *InstrSubInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() - secondOperand.AsInt(), ValueType: backing.Int})
+		case *InstrMulInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() * secondOperand.AsInt(), ValueType: backing.Int})
+		case *InstrGreaterThanInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() > secondOperand.AsInt(), ValueType: backing.Bool})
+		case *InstrGreaterThanOrEqualInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() >= secondOperand.AsInt(), ValueType: backing.Bool})
+		case *InstrLessThanInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() < secondOperand.AsInt(), ValueType: backing.Bool})
+		case *InstrLessThanOrEqualInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() <= secondOperand.AsInt(), ValueType: backing.Bool})
+		case *InstrEqualInt:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsInt() == secondOperand.AsInt(), ValueType: backing.Bool})
+		case *InstrAddFloat:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsFloat() + secondOperand.AsFloat(), ValueType: backing.Float})
+		case *InstrSubFloat:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsFloat() - secondOperand.AsFloat(), ValueType: backing.Float})
+		case *InstrMulFloat:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsFloat() * secondOperand.AsFloat(), ValueType: backing.Float})
+		case *InstrDivFloat:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Value{Value: firstOperand.AsFloat() / secondOperand.AsFloat(), ValueType: backing.Float})
 		case *InstrLogicalAnd:
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
@@ -91,184 +311,49 @@ func (vm *VM) Run() {
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
 			vm.push(backing.LogicalOr(firstOperand, secondOperand))
+		case *InstrLogicalNot:
+			operand := vm.pop()
+			vm.push(backing.Value{Value: !operand.AsBool(), ValueType: backing.Bool})
 		case *InstrLoadImm:
 			load := vm.chunk.instrStream[oldIp].(*InstrLoadImm)
 			vm.push(load.Value)
 		case *InstrLoadRef:
 			loadArg := vm.chunk.instrStream[oldIp].(*InstrLoadRef)
-			// TODO(threadedstream): there's a huge hole in scoping. Consider fixing it
-			value, ok := vm.chunk.localVars[loadArg.RefName]
+			vm.push(vm.chunk.locals[loadArg.Slot])
+		case *InstrLoadGlobal:
+			loadGlobal := vm.chunk.instrStream[oldIp].(*InstrLoadGlobal)
+			value, ok := vm.globals[loadGlobal.Name]
 			if !ok {
-				// very likely that the desired value resides in argument pool, just pull that out of there
-				value, ok := vm.chunk.argPool[loadArg.RefName]
-				if !ok {
-					vm.abort("undefined reference to name %s", loadArg.RefName)
-				}
-				vm.push(value)
-				continue
+				vm.abort("undefined reference to global %s", loadGlobal.Name)
 			}
 			vm.push(value)
+		case *InstrSetGlobal:
+			setGlobal := vm.chunk.instrStream[oldIp].(*InstrSetGlobal)
+			vm.globals[setGlobal.Name] = vm.pop()
 		case *InstrGreaterThan:
-			var boolValue backing.Value
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
-			switch {
-			case firstOperand.IsString() && secondOperand.IsString():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsString() > secondOperand.AsString(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() > secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsInt() > secondOperand.AsInt(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     float64(firstOperand.AsInt()) > secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() > float64(secondOperand.AsInt()),
-					ValueType: backing.Bool,
-				}
-			}
-			vm.push(boolValue)
+			vm.push(backing.Compare(syntax.GreaterThan, firstOperand, secondOperand))
 		case *InstrLessThan:
-			var boolValue backing.Value
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
-			switch {
-			case firstOperand.IsString() && secondOperand.IsString():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsString() < secondOperand.AsString(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() < secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsInt() < secondOperand.AsInt(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     float64(firstOperand.AsInt()) < secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() < float64(secondOperand.AsInt()),
-					ValueType: backing.Bool,
-				}
-			}
-			vm.push(boolValue)
+			vm.push(backing.Compare(syntax.LessThan, firstOperand, secondOperand))
 		case *InstrGreaterThanOrEqual:
-			var boolValue backing.Value
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
-			switch {
-			case firstOperand.IsString() && secondOperand.IsString():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsString() >= secondOperand.AsString(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() >= secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsInt() >= secondOperand.AsInt(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     float64(firstOperand.AsInt()) >= secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() >= float64(secondOperand.AsInt()),
-					ValueType: backing.Bool,
-				}
-			}
-			vm.push(boolValue)
+			vm.push(backing.Compare(syntax.GreaterThanOrEqual, firstOperand, secondOperand))
 		case *InstrLessThanOrEqual:
-			var boolValue backing.Value
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
-			switch {
-			case firstOperand.IsString() && secondOperand.IsString():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsString() <= secondOperand.AsString(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() <= secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsInt() <= secondOperand.AsInt(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     float64(firstOperand.AsInt()) <= secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() <= float64(secondOperand.AsInt()),
-					ValueType: backing.Bool,
-				}
-			}
-			vm.push(boolValue)
+			vm.push(backing.Compare(syntax.LessThanOrEqual, firstOperand, secondOperand))
 		case *InstrEqual:
-			var boolValue backing.Value
 			secondOperand := vm.pop()
 			firstOperand := vm.pop()
-
-			switch {
-			case firstOperand.IsString() && secondOperand.IsString():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsString() == secondOperand.AsString(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() == secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsInt() == secondOperand.AsInt(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsInt() && secondOperand.IsFloat():
-				boolValue = backing.Value{
-					Value:     float64(firstOperand.AsInt()) == secondOperand.AsFloat(),
-					ValueType: backing.Bool,
-				}
-			case firstOperand.IsFloat() && secondOperand.IsInt():
-				boolValue = backing.Value{
-					Value:     firstOperand.AsFloat() == float64(secondOperand.AsInt()),
-					ValueType: backing.Bool,
-				}
-			}
-			vm.push(boolValue)
+			vm.push(backing.Compare(syntax.Equal, firstOperand, secondOperand))
+		case *InstrNotEqual:
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			vm.push(backing.Compare(syntax.NotEqual, firstOperand, secondOperand))
 		case *InstrTrue:
 			boolValue := backing.Value{
 				Value:     true,
@@ -292,55 +377,124 @@ func (vm *VM) Run() {
 			if !operand.AsBool() {
 				vm.ip = vm.ip + jmpIfFalse.Offset
 			}
+		case *InstrCast:
+			cast := vm.chunk.instrStream[oldIp].(*InstrCast)
+			operand := vm.pop()
+			if !backing.IsAssignable(cast.Type, operand.ValueType) {
+				backing.Throw(backing.ClassCastException, "%s cannot be cast to %s",
+					backing.ValueTypeToStr(operand.ValueType),
+					backing.ValueTypeToStr(cast.Type))
+			}
+			vm.push(operand)
+		case *InstrInstanceOf:
+			instanceOf := vm.chunk.instrStream[oldIp].(*InstrInstanceOf)
+			operand := vm.pop()
+			vm.push(backing.Value{
+				Value:     backing.IsAssignable(instanceOf.Type, operand.ValueType),
+				ValueType: backing.Bool,
+			})
 		case *InstrCall:
 			call := vm.chunk.instrStream[oldIp].(*InstrCall)
 			if backing.IsRuntimeCall(call.FuncName) {
-				reservedFuncInfo := backing.SLook(backing.Venv, backing.SSymbol(call.FuncName)).(*backing.EnvEntry)
-				var arguments = make([]backing.Value, len(reservedFuncInfo.ParamTypes))
-				for idx, _ := range reservedFuncInfo.ParamTypes {
+				var arguments = make([]backing.Value, call.ArgCount)
+				for idx := 0; idx < call.ArgCount; idx++ {
 					val := vm.pop()
-					arguments[len(reservedFuncInfo.ParamTypes)-idx-1] = val
+					arguments[call.ArgCount-idx-1] = val
 				}
-				val := backing.DispatchRuntimeFuncCall(call.FuncName, arguments...)
+				val := backing.DispatchRuntimeFuncCall(vm.out, call.FuncName, arguments...)
 				if val.ValueType != backing.Unit {
 					vm.push(val)
 				}
 				continue
 			}
-			chunk := lookupChunk(call.FuncName, true, vm.abort)
+			chunk := vm.lookupChunk(call.FuncName)
+			if vm.nestingLevel == len(vm.callChain) {
+				backing.Throw(backing.StackOverflowError, "calls nested deeper than %d", backing.MaxCallDepth)
+			}
 			vm.callChain[vm.nestingLevel] = ChainEntry{
-				chunk: vm.chunk,
-				ip:    vm.ip,
+				chunk:     vm.chunk,
+				ip:        vm.ip,
+				frameBase: vm.frameBase,
 			}
 			vm.chunk = chunk
 			vm.nestingLevel++
 			vm.ip = 0
-			vm.chunk.localVars = make(map[string]backing.Value)
-			vm.chunk.argPool = make(map[string]backing.Value)
-			for i := 0; i < len(call.ArgNames); i++ {
-				value := vm.pop()
-				vm.chunk.argPool[call.ArgNames[len(call.ArgNames)-i-1]] = value
-				//backing.SEnter(backing.Venv, backing.SSymbol(call.ArgNames[i]), value)
+			vm.chunk.locals = make([]backing.Value, vm.chunk.localCount)
+			for i := call.ArgCount - 1; i >= 0; i-- {
+				vm.chunk.locals[i] = vm.pop()
 			}
+			vm.frameBase = vm.stackPtr
+		case *InstrTailCall:
+			tailCall := vm.chunk.instrStream[oldIp].(*InstrTailCall)
+			vm.chunk = vm.lookupChunk(tailCall.FuncName)
+			vm.ip = 0
+			vm.chunk.locals = make([]backing.Value, vm.chunk.localCount)
+			for i := tailCall.ArgCount - 1; i >= 0; i-- {
+				vm.chunk.locals[i] = vm.pop()
+			}
+			// drop whatever the caller left behind
+			vm.stackPtr = vm.frameBase
 		case *InstrReturn:
 			var returnValue backing.Value
 			if vm.nestingLevel <= 0 {
-				vm.normalexit()
+				// returning from main
+				return
 			}
 			vm.callChain[vm.nestingLevel] = ChainEntry{}
-			vm.chunk.localVars = nil
+			vm.chunk.locals = nil
 			vm.nestingLevel--
 			if vm.chunk.doesReturn {
 				returnValue = vm.pop()
+			}
+			// drop whatever the callee left behind
+			vm.stackPtr = vm.frameBase
+			if vm.chunk.doesReturn {
 				vm.push(returnValue)
 			}
 			vm.chunk = vm.callChain[vm.nestingLevel].chunk
 			vm.ip = vm.callChain[vm.nestingLevel].ip
+			vm.frameBase = vm.callChain[vm.nestingLevel].frameBase
+		case *InstrPop:
+			vm.pop()
+		case *InstrThrow:
+			operand := vm.pop()
+			backing.Raise(operand.AsException())
+		case *InstrMatchException:
+			matchException := vm.chunk.instrStream[oldIp].(*InstrMatchException)
+			exception := vm.stack[vm.stackPtr-1].AsException()
+			vm.push(backing.Value{
+				Value:     matchException.Kind == "" || matchException.Kind == exception.Kind,
+				ValueType: backing.Bool,
+			})
 		case *InstrSetLocal:
 			setLocalInstr := vm.chunk.instrStream[oldIp].(*InstrSetLocal)
-			valueToAssign := vm.pop()
-			vm.chunk.localVars[setLocalInstr.Name] = valueToAssign
-			//backing.SEnter(backing.Venv, backing.SSymbol(setLocalInstr.Name), valueToAssign)
+			vm.chunk.locals[setLocalInstr.Slot] = vm.pop()
+		case *InstrIncLocal:
+			incLocal := vm.chunk.instrStream[oldIp].(*InstrIncLocal)
+			value := vm.chunk.locals[incLocal.Slot]
+			vm.chunk.locals[incLocal.Slot] = backing.Value{Value: value.AsInt() + incLocal.Delta, ValueType: backing.Int}
+		case *InstrCompareIntJmpIfFalse:
+			compareJmp := vm.chunk.instrStream[oldIp].(*InstrCompareIntJmpIfFalse)
+			secondOperand := vm.pop()
+			firstOperand := vm.pop()
+			if !compareInts(compareJmp.Op, firstOperand.AsInt(), secondOperand.AsInt()) {
+				vm.ip += compareJmp.Offset
+			}
 		}
 	}
 }
+
+// compareInts applies the comparison operator the way the instructions specialized for Ints do
+func compareInts(op syntax.Operator, x, y int64) bool {
+	switch op {
+	case syntax.GreaterThan:
+		return x > y
+	case syntax.GreaterThanOrEqual:
+		return x >= y
+	case syntax.LessThan:
+		return x < y
+	case syntax.LessThanOrEqual:
+		return x <= y
+	}
+	return x == y
+}
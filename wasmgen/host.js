@@ -0,0 +1,171 @@
+// Host of miniscala programs compiled to WebAssembly by 'miniscala build -backend wasm'.
+//
+//     node host.js prog.wasm
+//
+// runs the program, exiting with the exit code of the program. In a browser, run(bytes,
+// write, writeError) instantiates the module, calling write and writeError with the bytes
+// the program prints, and resolves to the exit code.
+'use strict';
+
+// Types as numbered by the runtime, see backing.ValueType
+const FLOAT = 0, INT = 1, STRING = 2, BOOL = 4, ARRAY = 5, EXCEPTION = 11;
+
+const encoder = new TextEncoder();
+
+async function run(bytes, write, writeError) {
+  let exports;
+  const view = () => new DataView(exports.memory.buffer);
+
+  // strings are [len i32][bytes]
+  const readString = (ptr) => {
+    const len = view().getInt32(ptr, true);
+    return new Uint8Array(exports.memory.buffer, ptr + 4, len).slice();
+  };
+  const newString = (bytes) => {
+    const ptr = exports.alloc(4 + bytes.length);
+    view().setInt32(ptr, bytes.length, true);
+    new Uint8Array(exports.memory.buffer, ptr + 4, bytes.length).set(bytes);
+    return ptr;
+  };
+
+  // format renders a value of type Any as bytes, like Go's %v renders backing.Value
+  const format = (box) => {
+    const v = view();
+    const type = v.getInt32(box, true);
+    switch (type) {
+      case INT:
+        return encoder.encode(v.getBigInt64(box + 8, true).toString());
+      case FLOAT:
+        return encoder.encode(formatFloat(v.getFloat64(box + 8, true)));
+      case BOOL:
+        return encoder.encode(v.getInt32(box + 8, true) ? 'true' : 'false');
+      case STRING:
+        return readString(v.getInt32(box + 8, true));
+      case ARRAY:
+        return formatArray(v.getInt32(box + 8, true));
+      case EXCEPTION: {
+        const e = v.getInt32(box + 8, true);
+        return concat([readString(v.getInt32(e, true)), encoder.encode(': '), readString(v.getInt32(e + 4, true))]);
+      }
+    }
+    return encoder.encode('<nil>');
+  };
+
+  // formatArray renders the layout of backing.ArrayValue, arrays are [element type i32][len i32][Any i32]...
+  const formatArray = (a) => {
+    const v = view();
+    const parts = [encoder.encode('{[')];
+    const len = v.getInt32(a + 4, true);
+    for (let i = 0; i < len; i++) {
+      const item = v.getInt32(a + 8 + 4 * i, true);
+      parts.push(encoder.encode(i > 0 ? ' {' : '{'), format(item), encoder.encode(` ${v.getInt32(item, true)} false}`));
+    }
+    parts.push(encoder.encode(`] ${v.getInt32(a, true)}}`));
+    return concat(parts);
+  };
+
+  const env = {
+    print: (s) => write(readString(s)),
+    print_error: (s) => writeError(readString(s)),
+    to_string: (box) => newString(format(box)),
+    quote: (s) => newString(quote(readString(s))),
+    fmod: (x, y) => x % y,
+  };
+  const { instance } = await WebAssembly.instantiate(bytes, { env });
+  exports = instance.exports;
+  return exports.main();
+}
+
+function concat(parts) {
+  const out = new Uint8Array(parts.reduce((n, part) => n + part.length, 0));
+  let offset = 0;
+  for (const part of parts) {
+    out.set(part, offset);
+    offset += part.length;
+  }
+  return out;
+}
+
+// formatFloat renders x like Go's %v: the shortest representation which reads back
+// as x, in exponent form if the exponent is less than -4 or at least 6
+function formatFloat(x) {
+  if (Number.isNaN(x)) {
+    return 'NaN';
+  }
+  if (!Number.isFinite(x)) {
+    return x > 0 ? '+Inf' : '-Inf';
+  }
+  if (x === 0) {
+    return Object.is(x, -0) ? '-0' : '0';
+  }
+  const sign = x < 0 ? '-' : '';
+  // toExponential picks the shortest digits which read back as x
+  const [mantissa, exponent] = Math.abs(x).toExponential().split('e');
+  const digits = mantissa.replace('.', '');
+  const exp = Number(exponent);
+  if (exp < -4 || exp >= 6) {
+    const abs = Math.abs(exp);
+    const frac = digits.length > 1 ? '.' + digits.slice(1) : '';
+    return `${sign}${digits[0]}${frac}e${exp < 0 ? '-' : '+'}${abs < 10 ? '0' : ''}${abs}`;
+  }
+  if (exp < 0) {
+    return `${sign}0.${'0'.repeat(-exp - 1)}${digits}`;
+  }
+  if (digits.length <= exp + 1) {
+    return sign + digits + '0'.repeat(exp + 1 - digits.length);
+  }
+  return `${sign}${digits.slice(0, exp + 1)}.${digits.slice(exp + 1)}`;
+}
+
+// quote quotes a string the way Go's strconv.Quote does for ASCII
+function quote(bytes) {
+  const escapes = { 7: '\\a', 8: '\\b', 12: '\\f', 10: '\\n', 13: '\\r', 9: '\\t', 11: '\\v', 92: '\\\\', 34: '\\"' };
+  const parts = [encoder.encode('"')];
+  for (const c of bytes) {
+    if (escapes[c] !== undefined) {
+      parts.push(encoder.encode(escapes[c]));
+    } else if (c < 0x20 || c === 0x7f) {
+      parts.push(encoder.encode('\\x' + c.toString(16).padStart(2, '0')));
+    } else {
+      parts.push(Uint8Array.of(c));
+    }
+  }
+  parts.push(encoder.encode('"'));
+  return concat(parts);
+}
+
+if (typeof module !== 'undefined' && require.main === module) {
+  const fs = require('fs');
+  if (process.argv.length !== 3) {
+    process.stderr.write('usage: node host.js prog.wasm\n');
+    process.exit(2);
+  }
+  // output is buffered, stdout is flushed before anything is written to stderr
+  let buffered = [];
+  const flush = () => {
+    for (const chunk of buffered) {
+      fs.writeSync(1, chunk);
+    }
+    buffered = [];
+  };
+  const write = (bytes) => {
+    buffered.push(bytes);
+    if (buffered.length >= 1024) {
+      flush();
+    }
+  };
+  const writeError = (bytes) => {
+    flush();
+    fs.writeSync(2, bytes);
+  };
+  run(fs.readFileSync(process.argv[2]), write, writeError).then((code) => {
+    flush();
+    process.exitCode = code;
+  }, (err) => {
+    flush();
+    process.stderr.write(`${err}\n`);
+    process.exitCode = 1;
+  });
+} else if (typeof module !== 'undefined') {
+  module.exports = { run };
+}
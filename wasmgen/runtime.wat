@@ -0,0 +1,458 @@
+{{/* This is a text/template: str "..." stands for the address of the string
+       in the data segment, type "..." for the number of the type */}}
+  ;; Runtime of miniscala programs compiled to WebAssembly, put in front of every
+  ;; generated module.
+  ;;
+  ;; Values live in linear memory, which is never reclaimed:
+  ;;   String    [len i32][bytes]
+  ;;   Any       [type i32][unused i32][payload, i64, f64 or i32]
+  ;;   Array     [element type i32][len i32][Any i32]...
+  ;;   Exception [kind String][message String][line i32][col i32]
+  ;; An exception being raised is kept in $exception until a try statement takes it,
+  ;; the code checks it after every call that may throw, unwinding by plain branches.
+
+  (import "env" "print" (func $print (param i32)))
+  (import "env" "print_error" (func $print_error (param i32)))
+  ;; to_string renders a value of type Any the way the other backends do
+  (import "env" "to_string" (func $to_string (param i32) (result i32)))
+  ;; quote quotes a string like Go's strconv.Quote
+  (import "env" "quote" (func $quote (param i32) (result i32)))
+  (import "env" "fmod" (func $fmod (param f64 f64) (result f64)))
+
+  (memory (export "memory") 1)
+
+  (global $exception (mut i32) (i32.const 0))
+  (global $depth (mut i32) (i32.const 0))
+
+  ;; alloc returns zeroed memory aligned to 8 bytes, the host allocates strings with it
+  (func $alloc (export "alloc") (param $size i32) (result i32)
+    (local $p i32) (local $end i32) (local $limit i32)
+    (local.set $p (global.get $heap))
+    (local.set $end (i32.and (i32.add (i32.add (local.get $p) (local.get $size)) (i32.const 7)) (i32.const -8)))
+    (local.set $limit (i32.shl (memory.size) (i32.const 16)))
+    block $fits
+      (i32.le_u (local.get $end) (local.get $limit))
+      br_if $fits
+      (i32.shr_u (i32.add (i32.sub (local.get $end) (local.get $limit)) (i32.const 65535)) (i32.const 16))
+      memory.grow
+      (i32.const -1)
+      i32.ne
+      br_if $fits
+      unreachable
+    end
+    (global.set $heap (local.get $end))
+    (local.get $p)
+  )
+
+  ;; strings
+
+  (func $concat (param $x i32) (param $y i32) (result i32)
+    (local $xlen i32) (local $ylen i32) (local $s i32)
+    (local.set $xlen (i32.load (local.get $x)))
+    (local.set $ylen (i32.load (local.get $y)))
+    (local.set $s (call $alloc (i32.add (i32.add (local.get $xlen) (local.get $ylen)) (i32.const 4))))
+    (i32.store (local.get $s) (i32.add (local.get $xlen) (local.get $ylen)))
+    (memory.copy (i32.add (local.get $s) (i32.const 4)) (i32.add (local.get $x) (i32.const 4)) (local.get $xlen))
+    (memory.copy
+      (i32.add (i32.add (local.get $s) (i32.const 4)) (local.get $xlen))
+      (i32.add (local.get $y) (i32.const 4))
+      (local.get $ylen))
+    (local.get $s)
+  )
+
+  ;; compare returns a negative number, zero or a positive number as x is less than,
+  ;; equal to or greater than y, comparing bytes
+  (func $compare (param $x i32) (param $y i32) (result i32)
+    (local $xlen i32) (local $ylen i32) (local $i i32) (local $d i32)
+    (local.set $xlen (i32.load (local.get $x)))
+    (local.set $ylen (i32.load (local.get $y)))
+    block $done
+      loop $next
+        (i32.ge_u (local.get $i) (local.get $xlen))
+        br_if $done
+        (i32.ge_u (local.get $i) (local.get $ylen))
+        br_if $done
+        (local.set $d (i32.sub
+          (i32.load8_u offset=4 (i32.add (local.get $x) (local.get $i)))
+          (i32.load8_u offset=4 (i32.add (local.get $y) (local.get $i)))))
+        (local.get $d)
+        if
+          (return (local.get $d))
+        end
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        br $next
+      end
+    end
+    (i32.sub (local.get $xlen) (local.get $ylen))
+  )
+
+  (func $strings_equal (param $x i32) (param $y i32) (result i32)
+    (i32.eqz (call $compare (local.get $x) (local.get $y)))
+  )
+
+  (func $type_name (param $type i32) (result i32)
+    (if (i32.eq (local.get $type) (i32.const {{type "Float"}})) (then (return (i32.const {{str "Float"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Int"}})) (then (return (i32.const {{str "Int"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "String"}})) (then (return (i32.const {{str "String"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Bool"}})) (then (return (i32.const {{str "Bool"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Unit"}})) (then (return (i32.const {{str "Unit"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Null"}})) (then (return (i32.const {{str "Null"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Array"}})) (then (return (i32.const {{str "Array"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Any"}})) (then (return (i32.const {{str "Any"}}))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Exception"}})) (then (return (i32.const {{str "Exception"}}))))
+    (i32.const {{str "Undefined"}})
+  )
+
+  ;; type_of_name returns the type named by a string, as array_new takes it
+  (func $type_of_name (param $name i32) (result i32)
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Float"}})) (then (return (i32.const {{type "Float"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Int"}})) (then (return (i32.const {{type "Int"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "String"}})) (then (return (i32.const {{type "String"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Unit"}})) (then (return (i32.const {{type "Unit"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Bool"}})) (then (return (i32.const {{type "Bool"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Array"}})) (then (return (i32.const {{type "Array"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Any"}})) (then (return (i32.const {{type "Any"}}))))
+    (if (call $strings_equal (local.get $name) (i32.const {{str "Exception"}})) (then (return (i32.const {{type "Exception"}}))))
+    (i32.const {{type "Undefined"}})
+  )
+
+  ;; boxing into values of type Any
+
+  (func $box (param $type i32) (result i32)
+    (local $v i32)
+    (local.set $v (call $alloc (i32.const 16)))
+    (i32.store (local.get $v) (local.get $type))
+    (local.get $v)
+  )
+
+  (func $box_int (param $x i64) (result i32)
+    (local $v i32)
+    (local.set $v (call $box (i32.const {{type "Int"}})))
+    (i64.store offset=8 (local.get $v) (local.get $x))
+    (local.get $v)
+  )
+
+  (func $box_float (param $x f64) (result i32)
+    (local $v i32)
+    (local.set $v (call $box (i32.const {{type "Float"}})))
+    (f64.store offset=8 (local.get $v) (local.get $x))
+    (local.get $v)
+  )
+
+  ;; box_ref boxes Bools, Strings, Arrays and Exceptions, i.e values held in an i32
+  (func $box_ref (param $x i32) (param $type i32) (result i32)
+    (local $v i32)
+    (local.set $v (call $box (local.get $type)))
+    (i32.store offset=8 (local.get $v) (local.get $x))
+    (local.get $v)
+  )
+
+  ;; format renders an Int
+  (func $format (param $x i64) (result i32)
+    (call $to_string (call $box_int (local.get $x)))
+  )
+
+  ;; exceptions
+
+  (func $exception_new (param $kind i32) (param $message i32) (result i32)
+    (local $e i32)
+    (local.set $e (call $alloc (i32.const 16)))
+    (i32.store (local.get $e) (local.get $kind))
+    (i32.store offset=4 (local.get $e) (local.get $message))
+    (local.get $e)
+  )
+
+  ;; raise makes the exception the one being raised, the position
+  ;; is that of the statement raising it, unless it's known already
+  (func $raise (param $e i32) (param $line i32) (param $col i32)
+    (if (i32.eqz (i32.load offset=8 (local.get $e)))
+      (then
+        (i32.store offset=8 (local.get $e) (local.get $line))
+        (i32.store offset=12 (local.get $e) (local.get $col))))
+    (global.set $exception (local.get $e))
+  )
+
+  (func $throw (param $kind i32) (param $message i32) (param $line i32) (param $col i32)
+    (call $raise (call $exception_new (local.get $kind) (local.get $message)) (local.get $line) (local.get $col))
+  )
+
+  ;; caught takes the exception being raised
+  (func $caught (result i32)
+    (local $e i32)
+    (local.set $e (global.get $exception))
+    (global.set $exception (i32.const 0))
+    (local.get $e)
+  )
+
+  (func $enter (param $line i32) (param $col i32)
+    (if (i32.gt_s (global.get $depth) (i32.const 256))
+      (then
+        (call $throw (i32.const {{str "StackOverflowError"}}) (i32.const {{str "calls nested deeper than 256"}})
+          (local.get $line) (local.get $col))
+        (return)))
+    (global.set $depth (i32.add (global.get $depth) (i32.const 1)))
+  )
+
+  (func $leave
+    (global.set $depth (i32.sub (global.get $depth) (i32.const 1)))
+  )
+
+  (func $cast (param $v i32) (param $type i32) (param $line i32) (param $col i32) (result i32)
+    (if (i32.and
+          (i32.ne (local.get $type) (i32.const {{type "Any"}}))
+          (i32.ne (i32.load (local.get $v)) (local.get $type)))
+      (then
+        (call $throw (i32.const {{str "ClassCastException"}})
+          (call $concat
+            (call $concat (call $type_name (i32.load (local.get $v))) (i32.const {{str " cannot be cast to "}}))
+            (call $type_name (local.get $type)))
+          (local.get $line) (local.get $col))))
+    (local.get $v)
+  )
+
+  (func $instance_of (param $v i32) (param $type i32) (result i32)
+    (i32.or
+      (i32.eq (local.get $type) (i32.const {{type "Any"}}))
+      (i32.eq (i32.load (local.get $v)) (local.get $type)))
+  )
+
+  ;; arithmetic, Ints wrap around on overflow
+
+  (func $div_int (param $x i64) (param $y i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $y))
+      (then
+        (call $throw (i32.const {{str "ArithmeticException"}}) (i32.const {{str "/ by zero"}}) (local.get $line) (local.get $col))
+        (return (i64.const 0))))
+    (if (i64.eq (local.get $y) (i64.const -1))
+      (then (return (i64.sub (i64.const 0) (local.get $x)))))
+    (i64.div_s (local.get $x) (local.get $y))
+  )
+
+  (func $mod_int (param $x i64) (param $y i64) (param $line i32) (param $col i32) (result i64)
+    (if (i64.eqz (local.get $y))
+      (then
+        (call $throw (i32.const {{str "ArithmeticException"}}) (i32.const {{str "% by zero"}}) (local.get $line) (local.get $col))
+        (return (i64.const 0))))
+    (if (i64.eq (local.get $y) (i64.const -1))
+      (then (return (i64.const 0))))
+    (i64.rem_s (local.get $x) (local.get $y))
+  )
+
+  ;; runtime functions callable by programs
+
+  (func $to_int (param $x f64) (param $line i32) (param $col i32) (result i64)
+    (if (i32.or
+          (f64.ne (local.get $x) (local.get $x))
+          (i32.or
+            (f64.ge (local.get $x) (f64.const 9223372036854775808))
+            (f64.lt (local.get $x) (f64.const -9223372036854775808))))
+      (then
+        (call $throw (i32.const {{str "ArithmeticException"}})
+          (call $concat (call $to_string (call $box_float (local.get $x))) (i32.const {{str " is out of Int range"}}))
+          (local.get $line) (local.get $col))
+        (return (i64.const 0))))
+    (i64.trunc_f64_s (local.get $x))
+  )
+
+  (func $zero_value (param $type i32) (result i32)
+    (if (i32.eq (local.get $type) (i32.const {{type "Float"}}))
+      (then (return (call $box_float (f64.const 0)))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Int"}}))
+      (then (return (call $box_int (i64.const 0)))))
+    (if (i32.eq (local.get $type) (i32.const {{type "String"}}))
+      (then (return (call $box_ref (i32.const {{str ""}}) (i32.const {{type "String"}})))))
+    (if (i32.eq (local.get $type) (i32.const {{type "Bool"}}))
+      (then (return (call $box_ref (i32.const 0) (i32.const {{type "Bool"}})))))
+    (call $box (i32.const {{type "Null"}}))
+  )
+
+  (func $array_new (param $len i64) (param $name i32) (param $line i32) (param $col i32) (result i32)
+    (local $a i32) (local $type i32) (local $i i32)
+    (if (i64.lt_s (local.get $len) (i64.const 0))
+      (then
+        (call $throw (i32.const {{str "NegativeArraySizeException"}}) (call $format (local.get $len))
+          (local.get $line) (local.get $col))
+        (return (i32.const 0))))
+    (local.set $type (call $type_of_name (local.get $name)))
+    (local.set $a (call $alloc (i32.add (i32.const 8) (i32.shl (i32.wrap_i64 (local.get $len)) (i32.const 2)))))
+    (i32.store (local.get $a) (local.get $type))
+    (i32.store offset=4 (local.get $a) (i32.wrap_i64 (local.get $len)))
+    block $done
+      loop $next
+        (i64.ge_s (i64.extend_i32_u (local.get $i)) (local.get $len))
+        br_if $done
+        (i32.store offset=8
+          (i32.add (local.get $a) (i32.shl (local.get $i) (i32.const 2)))
+          (call $zero_value (local.get $type)))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        br $next
+      end
+    end
+    (local.get $a)
+  )
+
+  ;; check_index returns the address of the element, or 0 if the index is out of bounds
+  (func $check_index (param $a i32) (param $idx i64) (param $line i32) (param $col i32) (result i32)
+    (if (i32.or
+          (i64.lt_s (local.get $idx) (i64.const 0))
+          (i64.ge_s (local.get $idx) (i64.extend_i32_u (i32.load offset=4 (local.get $a)))))
+      (then
+        (call $throw (i32.const {{str "IndexOutOfBoundsException"}})
+          (call $concat
+            (call $concat
+              (call $concat (i32.const {{str "index "}}) (call $format (local.get $idx)))
+              (i32.const {{str " out of bounds for length "}}))
+            (call $format (i64.extend_i32_u (i32.load offset=4 (local.get $a)))))
+          (local.get $line) (local.get $col))
+        (return (i32.const 0))))
+    (i32.add (i32.add (local.get $a) (i32.const 8)) (i32.shl (i32.wrap_i64 (local.get $idx)) (i32.const 2)))
+  )
+
+  (func $array_set (param $a i32) (param $idx i64) (param $v i32) (param $line i32) (param $col i32)
+    (local $item i32)
+    (local.set $item (call $check_index (local.get $a) (local.get $idx) (local.get $line) (local.get $col)))
+    (if (i32.eqz (local.get $item))
+      (then (return)))
+    (if (i32.and
+          (i32.ne (i32.load (local.get $a)) (i32.const {{type "Any"}}))
+          (i32.ne (i32.load (local.get $a)) (i32.load (local.get $v))))
+      (then
+        (call $throw (i32.const {{str "ArrayStoreException"}})
+          (call $concat
+            (call $concat
+              (call $concat (i32.const {{str "array expected type "}}) (call $type_name (i32.load (local.get $a))))
+              (i32.const {{str ", but got "}}))
+            (call $type_name (i32.load (local.get $v))))
+          (local.get $line) (local.get $col))
+        (return)))
+    (i32.store (local.get $item) (local.get $v))
+  )
+
+  (func $array_get (param $a i32) (param $idx i64) (param $line i32) (param $col i32) (result i32)
+    (local $item i32)
+    (local.set $item (call $check_index (local.get $a) (local.get $idx) (local.get $line) (local.get $col)))
+    (if (i32.eqz (local.get $item))
+      (then (return (i32.const 0))))
+    (i32.load (local.get $item))
+  )
+
+  (func $is_numeric (param $type i32) (result i32)
+    (i32.or
+      (i32.eq (local.get $type) (i32.const {{type "Int"}}))
+      (i32.eq (local.get $type) (i32.const {{type "Float"}})))
+  )
+
+  (func $as_float (param $v i32) (result f64)
+    (if (i32.eq (i32.load (local.get $v)) (i32.const {{type "Int"}}))
+      (then (return (f64.convert_i64_s (i64.load offset=8 (local.get $v))))))
+    (f64.load offset=8 (local.get $v))
+  )
+
+  (func $equals (param $x i32) (param $y i32) (result i32)
+    (local $xtype i32) (local $ytype i32) (local $len i32) (local $i i32)
+    (local.set $xtype (i32.load (local.get $x)))
+    (local.set $ytype (i32.load (local.get $y)))
+    (if (i32.or
+          (i32.eq (local.get $xtype) (i32.const {{type "Null"}}))
+          (i32.eq (local.get $ytype) (i32.const {{type "Null"}})))
+      (then (return (i32.eq (local.get $xtype) (local.get $ytype)))))
+    (if (i32.and (call $is_numeric (local.get $xtype)) (call $is_numeric (local.get $ytype)))
+      (then
+        (if (i32.and
+              (i32.eq (local.get $xtype) (i32.const {{type "Int"}}))
+              (i32.eq (local.get $ytype) (i32.const {{type "Int"}})))
+          (then (return (i64.eq (i64.load offset=8 (local.get $x)) (i64.load offset=8 (local.get $y))))))
+        (return (f64.eq (call $as_float (local.get $x)) (call $as_float (local.get $y))))))
+    (if (i32.ne (local.get $xtype) (local.get $ytype))
+      (then (return (i32.const 0))))
+    (if (i32.eq (local.get $xtype) (i32.const {{type "String"}}))
+      (then (return (call $strings_equal (i32.load offset=8 (local.get $x)) (i32.load offset=8 (local.get $y))))))
+    (if (i32.eq (local.get $xtype) (i32.const {{type "Bool"}}))
+      (then (return (i32.eq (i32.load offset=8 (local.get $x)) (i32.load offset=8 (local.get $y))))))
+    (if (i32.eq (local.get $xtype) (i32.const {{type "Exception"}}))
+      (then
+        (return (i32.and
+          (call $strings_equal (i32.load (i32.load offset=8 (local.get $x))) (i32.load (i32.load offset=8 (local.get $y))))
+          (call $strings_equal
+            (i32.load offset=4 (i32.load offset=8 (local.get $x)))
+            (i32.load offset=4 (i32.load offset=8 (local.get $y))))))))
+    (if (i32.ne (local.get $xtype) (i32.const {{type "Array"}}))
+      (then (return (i32.const 0))))
+    ;; arrays are equal if their elements are
+    (local.set $x (i32.load offset=8 (local.get $x)))
+    (local.set $y (i32.load offset=8 (local.get $y)))
+    (local.set $len (i32.load offset=4 (local.get $x)))
+    (if (i32.ne (local.get $len) (i32.load offset=4 (local.get $y)))
+      (then (return (i32.const 0))))
+    block $done
+      loop $next
+        (i32.ge_u (local.get $i) (local.get $len))
+        br_if $done
+        (call $equals
+          (i32.load offset=8 (i32.add (local.get $x) (i32.shl (local.get $i) (i32.const 2))))
+          (i32.load offset=8 (i32.add (local.get $y) (i32.shl (local.get $i) (i32.const 2)))))
+        i32.eqz
+        if
+          (return (i32.const 0))
+        end
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        br $next
+      end
+    end
+    (i32.const 1)
+  )
+
+  ;; describe renders the value for a failure message
+  (func $describe (param $v i32) (result i32)
+    (if (i32.eq (i32.load (local.get $v)) (i32.const {{type "String"}}))
+      (then (return (call $quote (i32.load offset=8 (local.get $v))))))
+    (call $concat
+      (call $concat
+        (call $concat (call $to_string (local.get $v)) (i32.const {{str " ("}}))
+        (call $type_name (i32.load (local.get $v))))
+      (i32.const {{str ")"}}))
+  )
+
+  (func $assert (param $cond i32) (param $message i32) (param $line i32) (param $col i32)
+    (if (i32.eqz (local.get $cond))
+      (then
+        (call $throw (i32.const {{str "AssertionError"}}) (local.get $message) (local.get $line) (local.get $col))))
+  )
+
+  (func $assert_equals (param $expected i32) (param $actual i32) (param $line i32) (param $col i32)
+    (if (i32.eqz (call $equals (local.get $expected) (local.get $actual)))
+      (then
+        (call $throw (i32.const {{str "AssertionError"}})
+          (call $concat
+            (call $concat
+              (call $concat (i32.const {{str "expected "}}) (call $describe (local.get $expected)))
+              (i32.const {{str ", but got "}}))
+            (call $describe (local.get $actual)))
+          (local.get $line) (local.get $col))))
+  )
+
+  ;; main runs the program and returns its exit code, reporting an uncaught exception
+  (func $main (export "main") (result i32)
+    (local $e i32)
+    (call $miniscala_main)
+    (local.set $e (global.get $exception))
+    (if (i32.eqz (local.get $e))
+      (then (return (i32.const 0))))
+    (call $print_error
+      (call $concat
+        (call $concat
+          (call $concat
+            (call $concat
+              (call $concat
+                (call $concat
+                  (call $concat
+                    (call $concat (i32.const {{str "["}}) (call $format (i64.extend_i32_u (i32.load offset=8 (local.get $e)))))
+                    (i32.const {{str ":"}}))
+                  (call $format (i64.extend_i32_u (i32.load offset=12 (local.get $e)))))
+                (i32.const {{str "] exception in main: "}}))
+              (i32.load (local.get $e)))
+            (i32.const {{str ": "}}))
+          (i32.load offset=4 (local.get $e)))
+        (i32.const {{str "\n"}})))
+    (i32.const 1)
+  )
@@ -0,0 +1,724 @@
+// Package wasmgen translates programs to WebAssembly, in the text format (WAT) or,
+// through Assemble, in the binary one. Ints, Floats and Bools are wasm's i64, f64 and i32,
+// while strings, arrays, exceptions and values of type Any live in linear memory and are
+// referred to by address. The module imports a few host functions from "env", printing
+// among them, host.js provides them on Node.js and can be embedded into a web page.
+//
+// Programs come in the IR. Every value is a local of the wasm function, and as wasm has
+// no goto, blocks of a function are laid out within a loop which dispatches on the local
+// $block to the one control is passed to.
+//
+// WebAssembly has no way of unwinding the stack, so a raised exception is kept in a global
+// of the runtime and the code checks it after every instruction that may throw: a function
+// returns as soon as it's set, unless a block of its own handles the exception
+package wasmgen
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/ThreadedStream/miniscala/backing"
+	"github.com/ThreadedStream/miniscala/ir"
+	"math"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"text/template"
+)
+
+//go:embed runtime.wat
+var runtimeSource string
+
+var runtimeTemplate = template.Must(template.New("runtime.wat").Funcs(template.FuncMap{
+	// placeholders, Generate binds them to the module being generated
+	"str":  func(string) int { return 0 },
+	"type": func(string) int { return 0 },
+}).Parse(runtimeSource))
+
+// typeNumbers maps names the runtime uses to types
+var typeNumbers = map[string]backing.ValueType{
+	"Float":     backing.Float,
+	"Int":       backing.Int,
+	"String":    backing.String,
+	"Unit":      backing.Unit,
+	"Bool":      backing.Bool,
+	"Array":     backing.Array,
+	"Any":       backing.Any,
+	"Null":      backing.Null,
+	"Undefined": backing.Undefined,
+	"Exception": backing.Exception,
+}
+
+// dataStart is the address of the first string, 0 stays a null reference
+const dataStart = 8
+
+type (
+	generator struct {
+		// functions of the program by name, calls convert arguments to types of their parameters
+		funcs   map[string]*ir.Func
+		globals map[string]backing.ValueType
+		// addresses of strings in the data segment
+		strings map[string]int
+		data    strings.Builder
+		dataEnd int
+		fn      *function
+		err     error
+	}
+
+	// function is a wasm function being generated
+	function struct {
+		f *ir.Func
+		// function the init function calls once it's done, empty for the rest of them
+		entry  string
+		body   strings.Builder
+		indent int
+		// indexes of blocks, which $block holds to pass control to them
+		index map[*ir.Block]int
+	}
+)
+
+// dispatchLabel labels the loop around blocks of a function, jumps branch to it
+const dispatchLabel = "$dispatch"
+
+// Generate translates the program to a module in the text format. It fails on values
+// the WebAssembly backend can't represent, which the typechecker rejects, e.g the ones of type Unit
+func Generate(program *ir.Program) ([]byte, error) {
+	g := &generator{
+		funcs:   make(map[string]*ir.Func),
+		globals: make(map[string]backing.ValueType),
+		strings: make(map[string]int),
+		dataEnd: dataStart,
+	}
+	for _, f := range program.Funcs {
+		g.funcs[f.Name] = f
+	}
+	var out strings.Builder
+	out.WriteString("(module\n")
+	runtime := template.Must(runtimeTemplate.Clone()).Funcs(template.FuncMap{
+		"str": g.stringAddr,
+		"type": func(name string) int {
+			return int(typeNumbers[name])
+		},
+	})
+	if err := runtime.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+
+	out.WriteString("\n  ;; program\n")
+	if len(program.Globals) > 0 {
+		out.WriteString("\n")
+	}
+	for _, global := range program.Globals {
+		g.globals[global.Name] = global.Type
+		valueType := g.wasmType(scanner.Position{}, global.Type)
+		fmt.Fprintf(&out, "  (global %s (mut %s) (%s.const 0))\n", globalName(global.Name), valueType, valueType)
+	}
+	// top-level statements run first, then main
+	out.WriteString("\n  (func $miniscala_main\n")
+	if program.Init != nil {
+		out.WriteString(g.function(program.Init, "main"))
+	} else {
+		g.fn = &function{indent: 2}
+		g.callEntry("main")
+		out.WriteString(g.fn.body.String())
+		g.fn = nil
+	}
+	out.WriteString("  )\n")
+	for _, f := range program.Funcs {
+		fmt.Fprintf(&out, "\n  (func %s%s\n%s  )\n", funcName(f.Name), g.signature(f), g.function(f, ""))
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	out.WriteString("\n")
+	out.WriteString(g.data.String())
+	heap := (g.dataEnd + 7) &^ 7
+	fmt.Fprintf(&out, "\n  (global $heap (mut i32) (i32.const %d))\n)\n", heap)
+	return []byte(out.String()), nil
+}
+
+func (g *generator) errorf(pos scanner.Position, format string, args ...interface{}) {
+	if g.err == nil {
+		g.err = fmt.Errorf("[%d:%d] %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))
+	}
+}
+
+func (g *generator) line(format string, args ...interface{}) {
+	g.fn.body.WriteString(strings.Repeat("  ", g.fn.indent))
+	fmt.Fprintf(&g.fn.body, format, args...)
+	g.fn.body.WriteString("\n")
+}
+
+// signature returns parameters and the result of the function. Besides parameters of its own,
+// it takes the position of the call, which is where a StackOverflowError is raised
+func (g *generator) signature(f *ir.Func) string {
+	var b strings.Builder
+	for _, param := range f.Params {
+		fmt.Fprintf(&b, " (param %s %s)", valueName(param), g.wasmType(param.Pos, param.Type))
+	}
+	b.WriteString(" (param $line i32) (param $col i32)")
+	if f.ResultType != backing.Unit {
+		fmt.Fprintf(&b, " (result %s)", g.wasmType(scanner.Position{}, f.ResultType))
+	}
+	return b.String()
+}
+
+// function returns the body of the wasm function carrying out f, locals first. The init
+// function calls entry once it's done
+func (g *generator) function(f *ir.Func, entry string) string {
+	g.fn = &function{f: f, entry: entry, indent: 2, index: make(map[*ir.Block]int)}
+	defer func() {
+		g.fn = nil
+	}()
+	var out strings.Builder
+	for idx, b := range f.Blocks {
+		g.fn.index[b] = idx
+		for _, v := range b.Instrs {
+			if v.HasResult() && v.Op != ir.OpConst {
+				fmt.Fprintf(&out, "    (local %s %s)\n", valueName(v), g.wasmType(v.Pos, v.Type))
+			}
+		}
+	}
+	dispatch := len(f.Blocks) > 1
+	if dispatch {
+		out.WriteString("    (local $block i32)\n")
+	}
+	if entry == "" {
+		g.line("local.get $line")
+		g.line("local.get $col")
+		g.line("call $enter")
+		g.line("global.get $exception")
+		g.line("if")
+		g.fn.indent++
+		g.zero(f.ResultType)
+		g.line("return")
+		g.fn.indent--
+		g.line("end")
+	}
+	if !dispatch {
+		g.block(f.Blocks[0], nil)
+		out.WriteString(g.fn.body.String())
+		return out.String()
+	}
+
+	// block i is entered by branching out of the i-th innermost wasm block,
+	// br_table picks the one $block refers to
+	g.line("loop %s", dispatchLabel)
+	for idx := len(f.Blocks) - 1; idx >= 0; idx-- {
+		g.line("block %s", blockName(f.Blocks[idx]))
+	}
+	g.line("  local.get $block")
+	var labels []string
+	for _, b := range f.Blocks {
+		labels = append(labels, blockName(b))
+	}
+	g.line("  br_table %s", strings.Join(labels, " "))
+	for idx, b := range f.Blocks {
+		var next *ir.Block
+		if idx+1 < len(f.Blocks) {
+			next = f.Blocks[idx+1]
+		}
+		g.line("end")
+		g.fn.indent++
+		g.block(b, next)
+		g.fn.indent--
+	}
+	g.line("end")
+	// every block passes control on, so the loop is never left
+	g.line("unreachable")
+	out.WriteString(g.fn.body.String())
+	return out.String()
+}
+
+func (g *generator) block(b *ir.Block, next *ir.Block) {
+	for _, v := range b.Instrs {
+		switch v.Op {
+		case ir.OpPhi, ir.OpConst, ir.OpCatch:
+			// phis are assigned by edges leading to the block and the caught exception
+			// on the way to the handler, constants are pushed where they're used
+			continue
+		}
+		g.instr(v)
+		if v.HasResult() {
+			g.line("local.set %s", valueName(v))
+		}
+		if v.MayThrow() {
+			g.line("global.get $exception")
+			g.line("if")
+			g.fn.indent++
+			g.unwind(b)
+			g.fn.indent--
+			g.line("end")
+		}
+	}
+
+	switch b.Kind {
+	case ir.BlockPlain:
+		g.jump(b, b.Succs[0], next)
+	case ir.BlockIf:
+		then, els := b.Succs[0], b.Succs[1]
+		g.operand(b.Control)
+		if then == next && !g.hasCopies(b, then) {
+			g.line("i32.eqz")
+			then, els = els, then
+		}
+		g.line("if")
+		g.fn.indent++
+		g.jump(b, then, nil)
+		g.fn.indent--
+		g.line("end")
+		g.jump(b, els, next)
+	case ir.BlockReturn:
+		if g.fn.entry != "" {
+			g.callEntry(g.fn.entry)
+			g.line("return")
+			break
+		}
+		if b.Control != nil {
+			g.convert(b.Control, g.fn.f.ResultType)
+		}
+		g.line("call $leave")
+		g.line("return")
+	case ir.BlockThrow:
+		g.operand(b.Control)
+		g.position(b.Pos)
+		g.line("call $raise")
+		g.unwind(b)
+	}
+}
+
+// callEntry calls the function the init function runs once it's done
+func (g *generator) callEntry(entry string) {
+	g.line("i32.const 0")
+	g.line("i32.const 0")
+	g.line("call %s", funcName(entry))
+	if f, ok := g.funcs[entry]; ok && f.ResultType != backing.Unit {
+		g.line("drop")
+	}
+}
+
+// unwind passes the exception being raised by b on to the block handling it,
+// or returns from the function if there's none
+func (g *generator) unwind(b *ir.Block) {
+	if b.Catch != nil {
+		for _, v := range b.Catch.Instrs {
+			if v.Op == ir.OpCatch {
+				g.line("call $caught")
+				g.line("local.set %s", valueName(v))
+			}
+		}
+		g.jump(b, b.Catch, nil)
+		return
+	}
+	if g.fn.entry != "" {
+		// main reports the exception
+		g.line("return")
+		return
+	}
+	g.line("call $leave")
+	g.zero(g.fn.f.ResultType)
+	g.line("return")
+}
+
+// zero pushes the zero value of the type, which a function returns along with an exception
+func (g *generator) zero(valueType backing.ValueType) {
+	if valueType != backing.Unit {
+		g.line("%s.const 0", g.wasmType(scanner.Position{}, valueType))
+	}
+}
+
+// jump passes control from a block to its successor, which follows it unless it's next
+func (g *generator) jump(from, to *ir.Block, next *ir.Block) {
+	g.edge(from, to)
+	if to != next {
+		g.line("i32.const %d", g.fn.index[to])
+		g.line("local.set $block")
+		g.line("br %s", dispatchLabel)
+	}
+}
+
+// phis returns phis of the block
+func phis(b *ir.Block) []*ir.Value {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == ir.OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// hasCopies reports whether the edge assigns phis
+func (g *generator) hasCopies(from, to *ir.Block) bool {
+	idx := to.PredIndex(from)
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			return true
+		}
+	}
+	return false
+}
+
+// edge assigns phis of the block control is passed to their arguments coming from the block
+// it's passed from. Arguments are all pushed before any phi is assigned, so that every phi
+// gets the value its argument had before the edge
+func (g *generator) edge(from, to *ir.Block) {
+	idx := to.PredIndex(from)
+	var assigned []*ir.Value
+	for _, phi := range phis(to) {
+		if phi.Args[idx] != phi {
+			assigned = append(assigned, phi)
+			g.convert(phi.Args[idx], phi.Type)
+		}
+	}
+	for i := len(assigned) - 1; i >= 0; i-- {
+		g.line("local.set %s", valueName(assigned[i]))
+	}
+}
+
+// valueName returns the name of the wasm local holding the value
+func valueName(v *ir.Value) string {
+	return "$v" + strconv.Itoa(v.ID)
+}
+
+func blockName(b *ir.Block) string {
+	return "$b" + strconv.Itoa(b.ID)
+}
+
+// globalName returns the wasm name of the global variable
+func globalName(name string) string {
+	return "$g_" + mangle(name)
+}
+
+// stringAddr returns the address of the string in the data segment, adding it if it's new
+func (g *generator) stringAddr(s string) int {
+	if addr, ok := g.strings[s]; ok {
+		return addr
+	}
+	addr := g.dataEnd
+	g.strings[s] = addr
+	fmt.Fprintf(&g.data, "  (data (i32.const %d) \"", addr)
+	var header [4]byte
+	for idx := range header {
+		header[idx] = byte(len(s) >> (8 * idx))
+	}
+	writeString(&g.data, string(header[:])+s)
+	g.data.WriteString("\")\n")
+	// lengths are loaded as i32
+	g.dataEnd = (addr + 4 + len(s) + 3) &^ 3
+	return addr
+}
+
+// writeString writes s escaped for a string literal of the text format
+func writeString(b *strings.Builder, s string) {
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "\\%02x", c)
+		}
+	}
+}
+
+// funcName returns the name of the function defined by the program
+func funcName(name string) string {
+	return "$f_" + mangle(name)
+}
+
+// mangle turns a name into an identifier, names may contain characters such as - and $
+func mangle(name string) string {
+	var b strings.Builder
+	for idx := 0; idx < len(name); idx++ {
+		c := name[idx]
+		switch {
+		case c == '_':
+			b.WriteString("__")
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// wasmType returns the wasm type values of the given type are represented with,
+// values of type Unit aren't represented at all
+func (g *generator) wasmType(pos scanner.Position, valueType backing.ValueType) string {
+	switch valueType {
+	case backing.Int:
+		return "i64"
+	case backing.Float:
+		return "f64"
+	case backing.Unit:
+		g.errorf(pos, "values of type Unit aren't supported by the WebAssembly backend")
+		return "i32"
+	}
+	return "i32"
+}
+
+// position pushes the position, which is how runtime functions that may throw
+// are told where they're called from
+func (g *generator) position(pos scanner.Position) {
+	g.line("i32.const %d", pos.Line)
+	g.line("i32.const %d", pos.Column)
+}
+
+// operand pushes the value, constants are written out
+func (g *generator) operand(v *ir.Value) {
+	if v.Op != ir.OpConst {
+		g.line("local.get %s", valueName(v))
+		return
+	}
+	value := v.Aux.(backing.Value)
+	switch value.ValueType {
+	case backing.String:
+		g.line("i32.const %d", g.stringAddr(value.Value.(string)))
+	case backing.Int:
+		g.line("i64.const %d", value.Value.(int64))
+	case backing.Float:
+		g.line("f64.const %s", floatLit(value.Value.(float64)))
+	case backing.Bool:
+		result := 0
+		if value.Value.(bool) {
+			result = 1
+		}
+		g.line("i32.const %d", result)
+	default:
+		g.errorf(v.Pos, "constants of type %s aren't supported by the WebAssembly backend", backing.ValueTypeToStr(value.ValueType))
+	}
+}
+
+// convert pushes the value converted to the target type,
+// a value is boxed if it's passed where a value of type Any is expected
+func (g *generator) convert(v *ir.Value, target backing.ValueType) {
+	g.operand(v)
+	if target == backing.Any && v.Type != backing.Any {
+		g.box(v.Pos, v.Type)
+	}
+}
+
+// box turns the value on top of the stack into a value of type Any
+func (g *generator) box(pos scanner.Position, valueType backing.ValueType) {
+	switch valueType {
+	case backing.Int:
+		g.line("call $box_int")
+	case backing.Float:
+		g.line("call $box_float")
+	case backing.Unit:
+		g.errorf(pos, "values of type Unit aren't supported by the WebAssembly backend")
+	default:
+		g.line("i32.const %d", valueType)
+		g.line("call $box_ref")
+	}
+}
+
+// floatLit returns a literal of the text format for x
+func floatLit(x float64) string {
+	switch {
+	case math.IsNaN(x):
+		return "nan"
+	case math.IsInf(x, 1):
+		return "inf"
+	case math.IsInf(x, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// comparisons holds instructions comparing Ints and Floats,
+// strings are compared by comparing the result of $compare with 0
+var comparisons = map[ir.Op][2]string{
+	ir.OpEq: {"eq", "eq"},
+	ir.OpNe: {"ne", "ne"},
+	ir.OpLt: {"lt_s", "lt"},
+	ir.OpLe: {"le_s", "le"},
+	ir.OpGt: {"gt_s", "gt"},
+	ir.OpGe: {"ge_s", "ge"},
+}
+
+var arithmetic = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "mul",
+	ir.OpDiv: "div",
+}
+
+// instr pushes the result of the instruction, if any, positions of instructions which
+// may throw are passed on to the runtime, so that the exception is located the way the vm does
+func (g *generator) instr(v *ir.Value) {
+	switch v.Op {
+	case ir.OpLoadGlobal:
+		g.line("global.get %s", globalName(v.Aux.(string)))
+		return
+	case ir.OpStoreGlobal:
+		name := v.Aux.(string)
+		g.convert(v.Args[0], g.globals[name])
+		g.line("global.set %s", globalName(name))
+		return
+	case ir.OpNeg:
+		if v.Type == backing.Int {
+			g.line("i64.const 0")
+			g.operand(v.Args[0])
+			g.line("i64.sub")
+		} else {
+			g.operand(v.Args[0])
+			g.line("f64.neg")
+		}
+		return
+	case ir.OpCast:
+		g.cast(v)
+		return
+	case ir.OpInstanceOf:
+		testType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+		if operandType != backing.Any {
+			result := 0
+			if backing.IsAssignable(testType, operandType) {
+				result = 1
+			}
+			g.line("i32.const %d", result)
+			return
+		}
+		g.operand(v.Args[0])
+		g.line("i32.const %d", testType)
+		g.line("call $instance_of")
+		return
+	case ir.OpCall:
+		g.call(v)
+		return
+	}
+
+	for _, arg := range v.Args {
+		g.operand(arg)
+	}
+	switch v.Op {
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpDiv, ir.OpMod:
+		switch {
+		case v.Type == backing.String:
+			g.line("call $concat")
+		case v.Type == backing.Int && (v.Op == ir.OpDiv || v.Op == ir.OpMod):
+			// division by zero throws, while the quotient of the smallest Int and -1 wraps around
+			g.position(v.Pos)
+			if v.Op == ir.OpDiv {
+				g.line("call $div_int")
+			} else {
+				g.line("call $mod_int")
+			}
+		case v.Type == backing.Int:
+			g.line("i64.%s", arithmetic[v.Op])
+		case v.Op == ir.OpMod:
+			g.line("call $fmod")
+		default:
+			g.line("f64.%s", arithmetic[v.Op])
+		}
+	case ir.OpEq, ir.OpNe, ir.OpLt, ir.OpLe, ir.OpGt, ir.OpGe:
+		switch v.Args[0].Type {
+		case backing.String:
+			g.line("call $compare")
+			g.line("i32.const 0")
+			g.line("i32.%s", comparisons[v.Op][0])
+		case backing.Int:
+			g.line("i64.%s", comparisons[v.Op][0])
+		case backing.Float:
+			g.line("f64.%s", comparisons[v.Op][1])
+		default:
+			g.line("i32.%s", comparisons[v.Op][1])
+		}
+	case ir.OpAnd:
+		g.line("i32.and")
+	case ir.OpOr:
+		g.line("i32.or")
+	case ir.OpNot:
+		g.line("i32.eqz")
+	case ir.OpToFloat:
+		g.line("f64.convert_i64_s")
+	default:
+		g.errorf(v.Pos, "instruction %s isn't supported by the WebAssembly backend", v.Op)
+	}
+}
+
+// cast pushes the operand of the cast converted to its type, $cast raises
+// ClassCastException unless a value of type Any holds a value of that type
+func (g *generator) cast(v *ir.Value) {
+	castType, operandType := v.Aux.(backing.ValueType), v.Args[0].Type
+	switch {
+	case castType == operandType:
+		g.operand(v.Args[0])
+	case castType == backing.Any:
+		g.convert(v.Args[0], backing.Any)
+	default:
+		g.convert(v.Args[0], backing.Any)
+		g.line("i32.const %d", castType)
+		g.position(v.Pos)
+		g.line("call $cast")
+		// the value is checked once it's loaded, which $cast failing leaves harmless
+		g.line("%s.load offset=8", g.wasmType(v.Pos, castType))
+	}
+}
+
+// call pushes the result of the call, if any, arguments are converted to types of parameters
+func (g *generator) call(v *ir.Value) {
+	name := v.Callee()
+	var paramTypes []backing.ValueType
+	runtimeCall := backing.IsRuntimeCall(name)
+	if runtimeCall {
+		paramTypes = backing.RuntimeFuncEntry(name).ParamTypes
+	} else {
+		f, ok := g.funcs[name]
+		if !ok {
+			g.errorf(v.Pos, "no function with name %s was found", name)
+			return
+		}
+		for _, param := range f.Params {
+			paramTypes = append(paramTypes, param.Type)
+		}
+	}
+	for idx, arg := range v.Args {
+		g.convert(arg, paramTypes[idx])
+	}
+	if !runtimeCall {
+		g.position(v.Pos)
+		g.line("call %s", funcName(name))
+		return
+	}
+
+	switch name {
+	default:
+		g.errorf(v.Pos, "runtime function %s isn't supported by the WebAssembly backend", name)
+	case "print":
+		g.line("call $print")
+	case "to_string":
+		g.line("call $to_string")
+	case "toInt":
+		g.position(v.Pos)
+		g.line("call $to_int")
+	case "toFloat":
+		g.line("f64.convert_i64_s")
+	case "array_new":
+		g.position(v.Pos)
+		g.line("call $array_new")
+	case "array_set":
+		g.position(v.Pos)
+		g.line("call $array_set")
+	case "array_get":
+		g.position(v.Pos)
+		g.line("call $array_get")
+	case "array_size":
+		g.line("i32.load offset=4")
+		g.line("i64.extend_i32_u")
+	case "exception_new":
+		g.line("call $exception_new")
+	case "exception_kind":
+		g.line("i32.load")
+	case "exception_message":
+		g.line("i32.load offset=4")
+	case "assert":
+		g.position(v.Pos)
+		g.line("call $assert")
+	case "assertEquals":
+		g.position(v.Pos)
+		g.line("call $assert_equals")
+	}
+}
@@ -0,0 +1,55 @@
+package wasmgen
+
+import (
+	"github.com/ThreadedStream/miniscala/backendtest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestDifferential checks that modules translated from generated programs, run by
+// Node.js with host.js, behave like the interpreter running the same programs
+func TestDifferential(t *testing.T) {
+	backendtest.Differential(t, backend(t), 40)
+}
+
+// TestScopes checks that variables declared in blocks, sharing names with others, are kept apart
+func TestScopes(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.Scopes)
+}
+
+// TestTailCalls checks that functions calling themselves in tail position run as deep as loops
+func TestTailCalls(t *testing.T) {
+	backendtest.Compare(t, backend(t), backendtest.TailCalls)
+}
+
+// TestFloatFormat checks that the host renders floats the way Go's %v does
+func TestFloatFormat(t *testing.T) {
+	backendtest.FloatFormat(t, backend(t))
+}
+
+// backend assembles programs to modules and runs them with Node.js and host.js,
+// skipping the test if there's no Node.js
+func backend(t *testing.T) backendtest.Backend {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skipf("no Node.js: %v", err)
+	}
+	return backendtest.OneByOne("wasm", func(t *testing.T, dir string, program backendtest.Program) backendtest.Output {
+		t.Helper()
+		wat, err := Generate(program.IR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wasm, err := Assemble(wat)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, wat)
+		}
+		output := filepath.Join(dir, "prog.wasm")
+		if err := os.WriteFile(output, wasm, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return backendtest.Exec(t, exec.Command(node, "host.js", output))
+	})
+}
@@ -0,0 +1,959 @@
+package wasmgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Assemble translates a module in the text format to the binary format. It knows
+// the part of the text format Generate and the runtime use: functions, imported ones
+// among them, globals, a memory, exports and active data segments. Instructions may be
+// written either plainly or folded into S-expressions
+func Assemble(wat []byte) ([]byte, error) {
+	nodes, err := parseSexprs(string(wat))
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) != 1 || !nodes[0].isHead("module") {
+		return nil, fmt.Errorf("expected a single module")
+	}
+	a := &assembler{funcs: make(map[string]int), globals: make(map[string]int)}
+	if err := a.collect(nodes[0].list[1:]); err != nil {
+		return nil, err
+	}
+	return a.encode()
+}
+
+type (
+	// sexpr is either an atom, a string literal, or a list
+	sexpr struct {
+		atom   string
+		str    bool
+		list   []*sexpr
+		isList bool
+		line   int
+	}
+
+	assembler struct {
+		imports []*funcDef
+		defs    []*funcDef
+		// indexes of functions and globals by name
+		funcs       map[string]int
+		globals     map[string]int
+		globalDefs  []*sexpr
+		types       []string
+		memoryPages int
+		exports     []export
+		data        []dataSegment
+	}
+
+	funcDef struct {
+		name, module, field string
+		params, results     []byte
+		// names of parameters and locals, by index
+		localNames []string
+		locals     []byte
+		body       []*sexpr
+	}
+
+	// export is a function exported by name, or the memory
+	export struct {
+		name     string
+		kind     byte
+		funcName string
+	}
+
+	dataSegment struct {
+		offset *sexpr
+		bytes  []byte
+	}
+)
+
+func (s *sexpr) isHead(head string) bool {
+	return s.isList && len(s.list) > 0 && !s.list[0].isList && !s.list[0].str && s.list[0].atom == head
+}
+
+func (s *sexpr) String() string {
+	if s.isList {
+		return "(...)"
+	}
+	return s.atom
+}
+
+// parseSexprs splits the text into S-expressions, skipping comments
+func parseSexprs(text string) ([]*sexpr, error) {
+	var stack [][]*sexpr
+	var top []*sexpr
+	line := 1
+	for idx := 0; idx < len(text); {
+		c := text[idx]
+		switch {
+		case c == '\n':
+			line++
+			idx++
+		case c == ' ' || c == '\t' || c == '\r':
+			idx++
+		case strings.HasPrefix(text[idx:], ";;"):
+			for idx < len(text) && text[idx] != '\n' {
+				idx++
+			}
+		case strings.HasPrefix(text[idx:], "(;"):
+			end := strings.Index(text[idx:], ";)")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(text[idx:idx+end], "\n")
+			idx += end + 2
+		case c == '(':
+			stack = append(stack, top)
+			top = nil
+			idx++
+		case c == ')':
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: unexpected )", line)
+			}
+			list := &sexpr{list: top, isList: true, line: line}
+			top = append(stack[len(stack)-1], list)
+			stack = stack[:len(stack)-1]
+			idx++
+		case c == '"':
+			value, n, err := unquote(text[idx:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			top = append(top, &sexpr{atom: value, str: true, line: line})
+			idx += n
+		default:
+			start := idx
+			for idx < len(text) && !strings.ContainsRune(" \t\r\n();\"", rune(text[idx])) {
+				idx++
+			}
+			top = append(top, &sexpr{atom: text[start:idx], line: line})
+		}
+	}
+	if len(stack) != 0 {
+		return nil, fmt.Errorf("line %d: missing )", line)
+	}
+	return top, nil
+}
+
+// unquote reads the string literal s starts with, returning its value and length
+func unquote(s string) (string, int, error) {
+	var b strings.Builder
+	for idx := 1; idx < len(s); idx++ {
+		switch c := s[idx]; c {
+		case '"':
+			return b.String(), idx + 1, nil
+		case '\\':
+			if idx+1 >= len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			idx++
+			switch e := s[idx]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\'', '\\':
+				b.WriteByte(e)
+			default:
+				if idx+1 >= len(s) {
+					return "", 0, fmt.Errorf("unterminated string")
+				}
+				value, err := strconv.ParseUint(s[idx:idx+2], 16, 8)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad escape \\%s", s[idx:idx+2])
+				}
+				b.WriteByte(byte(value))
+				idx++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// kinds of exports
+const (
+	exportFunc   byte = 0x00
+	exportMemory byte = 0x02
+)
+
+var valueTypes = map[string]byte{
+	"i32": 0x7f,
+	"i64": 0x7e,
+	"f32": 0x7d,
+	"f64": 0x7c,
+}
+
+// collect goes through fields of the module, assigning indexes to functions and globals
+func (a *assembler) collect(fields []*sexpr) error {
+	for _, field := range fields {
+		if !field.isList || len(field.list) == 0 {
+			return fmt.Errorf("line %d: unexpected %s in module", field.line, field)
+		}
+		switch head := field.list[0].atom; head {
+		case "import":
+			if len(field.list) != 4 || !field.list[1].str || !field.list[2].str || !field.list[3].isHead("func") {
+				return fmt.Errorf("line %d: only functions can be imported", field.line)
+			}
+			def, err := a.funcDef(field.list[3])
+			if err != nil {
+				return err
+			}
+			def.module, def.field = field.list[1].atom, field.list[2].atom
+			if len(def.body) > 0 {
+				return fmt.Errorf("line %d: imported function with a body", field.line)
+			}
+			a.imports = append(a.imports, def)
+		case "func":
+			def, err := a.funcDef(field)
+			if err != nil {
+				return err
+			}
+			a.defs = append(a.defs, def)
+		case "memory":
+			rest := a.inlineExports(field.list[1:], exportMemory, "")
+			if len(rest) != 1 {
+				return fmt.Errorf("line %d: expected the number of pages of the memory", field.line)
+			}
+			pages, err := strconv.Atoi(rest[0].atom)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", field.line, err)
+			}
+			a.memoryPages = pages
+		case "global":
+			if len(field.list) != 4 {
+				return fmt.Errorf("line %d: expected the name, the type and the value of the global", field.line)
+			}
+			a.globals[field.list[1].atom] = len(a.globalDefs)
+			a.globalDefs = append(a.globalDefs, field)
+		case "export":
+			if len(field.list) != 3 || !field.list[1].str || !field.list[2].isHead("func") || len(field.list[2].list) != 2 {
+				return fmt.Errorf("line %d: only functions can be exported", field.line)
+			}
+			a.exports = append(a.exports, export{name: field.list[1].atom, kind: exportFunc, funcName: field.list[2].list[1].atom})
+		case "data":
+			if len(field.list) < 2 || !field.list[1].isList {
+				return fmt.Errorf("line %d: expected the offset of the data", field.line)
+			}
+			segment := dataSegment{offset: field.list[1]}
+			for _, s := range field.list[2:] {
+				if !s.str {
+					return fmt.Errorf("line %d: expected a string", s.line)
+				}
+				segment.bytes = append(segment.bytes, s.atom...)
+			}
+			a.data = append(a.data, segment)
+		default:
+			return fmt.Errorf("line %d: unsupported field %s", field.line, head)
+		}
+	}
+	for idx, def := range a.imports {
+		a.funcs[def.name] = idx
+	}
+	for idx, def := range a.defs {
+		a.funcs[def.name] = len(a.imports) + idx
+	}
+	return nil
+}
+
+// inlineExports records (export "name") abbreviations among fields, returning the rest of them
+func (a *assembler) inlineExports(fields []*sexpr, kind byte, funcName string) []*sexpr {
+	var rest []*sexpr
+	for _, field := range fields {
+		if field.isHead("export") && len(field.list) == 2 && field.list[1].str {
+			a.exports = append(a.exports, export{name: field.list[1].atom, kind: kind, funcName: funcName})
+			continue
+		}
+		rest = append(rest, field)
+	}
+	return rest
+}
+
+func (a *assembler) funcDef(field *sexpr) (*funcDef, error) {
+	def := &funcDef{}
+	fields := field.list[1:]
+	if len(fields) > 0 && !fields[0].isList && strings.HasPrefix(fields[0].atom, "$") {
+		def.name = fields[0].atom
+		fields = fields[1:]
+	}
+	fields = a.inlineExports(fields, exportFunc, def.name)
+	var rest []*sexpr
+	for idx, f := range fields {
+		switch {
+		case f.isHead("param"), f.isHead("local"):
+			types := f.list[1:]
+			name := ""
+			if len(types) > 0 && strings.HasPrefix(types[0].atom, "$") {
+				name, types = types[0].atom, types[1:]
+				if len(types) != 1 {
+					return nil, fmt.Errorf("line %d: a named %s has a single type", f.line, f.list[0].atom)
+				}
+			}
+			for _, t := range types {
+				valueType, ok := valueTypes[t.atom]
+				if !ok {
+					return nil, fmt.Errorf("line %d: unknown type %s", t.line, t)
+				}
+				def.localNames = append(def.localNames, name)
+				if f.isHead("param") {
+					def.params = append(def.params, valueType)
+				} else {
+					def.locals = append(def.locals, valueType)
+				}
+			}
+		case f.isHead("result"):
+			for _, t := range f.list[1:] {
+				valueType, ok := valueTypes[t.atom]
+				if !ok {
+					return nil, fmt.Errorf("line %d: unknown type %s", t.line, t)
+				}
+				def.results = append(def.results, valueType)
+			}
+		default:
+			rest = fields[idx:]
+		}
+		if rest != nil {
+			break
+		}
+	}
+	def.body = rest
+	return def, nil
+}
+
+// typeIndex returns the index of the function type, adding it to the type section if it's new
+func (a *assembler) typeIndex(params, results []byte) int {
+	signature := string(params) + "->" + string(results)
+	for idx, t := range a.types {
+		if t == signature {
+			return idx
+		}
+	}
+	a.types = append(a.types, signature)
+	return len(a.types) - 1
+}
+
+func (a *assembler) encode() ([]byte, error) {
+	var out bytes.Buffer
+	out.Write([]byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00})
+
+	var imports, funcs, code bytes.Buffer
+	writeU32(&imports, len(a.imports))
+	for _, def := range a.imports {
+		writeName(&imports, def.module)
+		writeName(&imports, def.field)
+		imports.WriteByte(0x00)
+		writeU32(&imports, a.typeIndex(def.params, def.results))
+	}
+	writeU32(&funcs, len(a.defs))
+	writeU32(&code, len(a.defs))
+	for _, def := range a.defs {
+		writeU32(&funcs, a.typeIndex(def.params, def.results))
+		body, err := a.funcBody(def)
+		if err != nil {
+			return nil, fmt.Errorf("function %s: %v", def.name, err)
+		}
+		writeU32(&code, len(body))
+		code.Write(body)
+	}
+
+	var types bytes.Buffer
+	writeU32(&types, len(a.types))
+	for _, t := range a.types {
+		signature := strings.SplitN(t, "->", 2)
+		types.WriteByte(0x60)
+		writeU32(&types, len(signature[0]))
+		types.WriteString(signature[0])
+		writeU32(&types, len(signature[1]))
+		types.WriteString(signature[1])
+	}
+
+	var memory bytes.Buffer
+	writeU32(&memory, 1)
+	memory.WriteByte(0x00)
+	writeU32(&memory, a.memoryPages)
+
+	var globals bytes.Buffer
+	writeU32(&globals, len(a.globalDefs))
+	for _, field := range a.globalDefs {
+		globalType := field.list[2]
+		mutable := byte(0)
+		if globalType.isHead("mut") && len(globalType.list) == 2 {
+			mutable, globalType = 1, globalType.list[1]
+		}
+		valueType, ok := valueTypes[globalType.atom]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown type %s", globalType.line, globalType)
+		}
+		globals.WriteByte(valueType)
+		globals.WriteByte(mutable)
+		if err := a.constExpr(&globals, field.list[3]); err != nil {
+			return nil, err
+		}
+	}
+
+	var exports bytes.Buffer
+	writeU32(&exports, len(a.exports))
+	for _, e := range a.exports {
+		writeName(&exports, e.name)
+		exports.WriteByte(e.kind)
+		index := 0
+		if e.kind == exportFunc {
+			var ok bool
+			if index, ok = a.funcs[e.funcName]; !ok {
+				return nil, fmt.Errorf("unknown exported function %s", e.funcName)
+			}
+		}
+		writeU32(&exports, index)
+	}
+
+	var data bytes.Buffer
+	writeU32(&data, len(a.data))
+	for _, segment := range a.data {
+		data.WriteByte(0x00)
+		if err := a.constExpr(&data, segment.offset); err != nil {
+			return nil, err
+		}
+		writeU32(&data, len(segment.bytes))
+		data.Write(segment.bytes)
+	}
+
+	for _, section := range []struct {
+		id      byte
+		content *bytes.Buffer
+	}{{1, &types}, {2, &imports}, {3, &funcs}, {5, &memory}, {6, &globals}, {7, &exports}, {10, &code}, {11, &data}} {
+		out.WriteByte(section.id)
+		writeU32(&out, section.content.Len())
+		out.Write(section.content.Bytes())
+	}
+	return out.Bytes(), nil
+}
+
+// constExpr encodes the initializer of a global or the offset of a data segment
+func (a *assembler) constExpr(out *bytes.Buffer, expr *sexpr) error {
+	f := &funcAssembler{assembler: a, out: out}
+	if err := f.instrs([]*sexpr{expr}); err != nil {
+		return err
+	}
+	out.WriteByte(0x0b)
+	return nil
+}
+
+func (a *assembler) funcBody(def *funcDef) ([]byte, error) {
+	var body bytes.Buffer
+	// locals are declared in runs of the same type
+	var runs []struct {
+		count     int
+		valueType byte
+	}
+	for _, valueType := range def.locals {
+		if len(runs) > 0 && runs[len(runs)-1].valueType == valueType {
+			runs[len(runs)-1].count++
+			continue
+		}
+		runs = append(runs, struct {
+			count     int
+			valueType byte
+		}{1, valueType})
+	}
+	writeU32(&body, len(runs))
+	for _, run := range runs {
+		writeU32(&body, run.count)
+		body.WriteByte(run.valueType)
+	}
+	f := &funcAssembler{assembler: a, out: &body, locals: make(map[string]int)}
+	for idx, name := range def.localNames {
+		if name != "" {
+			f.locals[name] = idx
+		}
+	}
+	// the body of the function is a block of its own, which branches may refer to by depth
+	f.labels = []string{""}
+	if err := f.instrs(def.body); err != nil {
+		return nil, err
+	}
+	body.WriteByte(0x0b)
+	return body.Bytes(), nil
+}
+
+type (
+	// funcAssembler encodes instructions of a function
+	funcAssembler struct {
+		*assembler
+		out    *bytes.Buffer
+		locals map[string]int
+		// labels of enclosing blocks, innermost last
+		labels []string
+	}
+
+	immediate int
+
+	opcode struct {
+		code      []byte
+		immediate immediate
+		// alignment of memory accesses, as a power of 2
+		align int
+	}
+)
+
+const (
+	noImmediate immediate = iota
+	blockImmediate
+	labelImmediate
+	// branch targets of br_table, the default one last
+	labelsImmediate
+	funcImmediate
+	localImmediate
+	globalImmediate
+	memoryImmediate
+	i32Immediate
+	i64Immediate
+	f64Immediate
+	// memory index of memory.size and memory.grow, memory indexes of memory.copy
+	memory1Immediate
+	memory2Immediate
+)
+
+var opcodes = map[string]opcode{
+	"unreachable": {code: []byte{0x00}},
+	"nop":         {code: []byte{0x01}},
+	"block":       {code: []byte{0x02}, immediate: blockImmediate},
+	"loop":        {code: []byte{0x03}, immediate: blockImmediate},
+	"if":          {code: []byte{0x04}, immediate: blockImmediate},
+	"else":        {code: []byte{0x05}},
+	"end":         {code: []byte{0x0b}},
+	"br":          {code: []byte{0x0c}, immediate: labelImmediate},
+	"br_if":       {code: []byte{0x0d}, immediate: labelImmediate},
+	"br_table":    {code: []byte{0x0e}, immediate: labelsImmediate},
+	"return":      {code: []byte{0x0f}},
+	"call":        {code: []byte{0x10}, immediate: funcImmediate},
+	"drop":        {code: []byte{0x1a}},
+	"select":      {code: []byte{0x1b}},
+
+	"local.get":  {code: []byte{0x20}, immediate: localImmediate},
+	"local.set":  {code: []byte{0x21}, immediate: localImmediate},
+	"local.tee":  {code: []byte{0x22}, immediate: localImmediate},
+	"global.get": {code: []byte{0x23}, immediate: globalImmediate},
+	"global.set": {code: []byte{0x24}, immediate: globalImmediate},
+
+	"i32.load":    {code: []byte{0x28}, immediate: memoryImmediate, align: 2},
+	"i64.load":    {code: []byte{0x29}, immediate: memoryImmediate, align: 3},
+	"f64.load":    {code: []byte{0x2b}, immediate: memoryImmediate, align: 3},
+	"i32.load8_u": {code: []byte{0x2d}, immediate: memoryImmediate, align: 0},
+	"i32.store":   {code: []byte{0x36}, immediate: memoryImmediate, align: 2},
+	"i64.store":   {code: []byte{0x37}, immediate: memoryImmediate, align: 3},
+	"f64.store":   {code: []byte{0x39}, immediate: memoryImmediate, align: 3},
+	"i32.store8":  {code: []byte{0x3a}, immediate: memoryImmediate, align: 0},
+	"memory.size": {code: []byte{0x3f}, immediate: memory1Immediate},
+	"memory.grow": {code: []byte{0x40}, immediate: memory1Immediate},
+	"memory.copy": {code: []byte{0xfc, 0x0a}, immediate: memory2Immediate},
+
+	"i32.const": {code: []byte{0x41}, immediate: i32Immediate},
+	"i64.const": {code: []byte{0x42}, immediate: i64Immediate},
+	"f64.const": {code: []byte{0x44}, immediate: f64Immediate},
+
+	"i32.eqz":  {code: []byte{0x45}},
+	"i32.eq":   {code: []byte{0x46}},
+	"i32.ne":   {code: []byte{0x47}},
+	"i32.lt_s": {code: []byte{0x48}},
+	"i32.lt_u": {code: []byte{0x49}},
+	"i32.gt_s": {code: []byte{0x4a}},
+	"i32.gt_u": {code: []byte{0x4b}},
+	"i32.le_s": {code: []byte{0x4c}},
+	"i32.le_u": {code: []byte{0x4d}},
+	"i32.ge_s": {code: []byte{0x4e}},
+	"i32.ge_u": {code: []byte{0x4f}},
+
+	"i64.eqz":  {code: []byte{0x50}},
+	"i64.eq":   {code: []byte{0x51}},
+	"i64.ne":   {code: []byte{0x52}},
+	"i64.lt_s": {code: []byte{0x53}},
+	"i64.lt_u": {code: []byte{0x54}},
+	"i64.gt_s": {code: []byte{0x55}},
+	"i64.gt_u": {code: []byte{0x56}},
+	"i64.le_s": {code: []byte{0x57}},
+	"i64.le_u": {code: []byte{0x58}},
+	"i64.ge_s": {code: []byte{0x59}},
+	"i64.ge_u": {code: []byte{0x5a}},
+
+	"f64.eq": {code: []byte{0x61}},
+	"f64.ne": {code: []byte{0x62}},
+	"f64.lt": {code: []byte{0x63}},
+	"f64.gt": {code: []byte{0x64}},
+	"f64.le": {code: []byte{0x65}},
+	"f64.ge": {code: []byte{0x66}},
+
+	"i32.add":   {code: []byte{0x6a}},
+	"i32.sub":   {code: []byte{0x6b}},
+	"i32.mul":   {code: []byte{0x6c}},
+	"i32.div_s": {code: []byte{0x6d}},
+	"i32.div_u": {code: []byte{0x6e}},
+	"i32.rem_s": {code: []byte{0x6f}},
+	"i32.rem_u": {code: []byte{0x70}},
+	"i32.and":   {code: []byte{0x71}},
+	"i32.or":    {code: []byte{0x72}},
+	"i32.xor":   {code: []byte{0x73}},
+	"i32.shl":   {code: []byte{0x74}},
+	"i32.shr_s": {code: []byte{0x75}},
+	"i32.shr_u": {code: []byte{0x76}},
+
+	"i64.add":   {code: []byte{0x7c}},
+	"i64.sub":   {code: []byte{0x7d}},
+	"i64.mul":   {code: []byte{0x7e}},
+	"i64.div_s": {code: []byte{0x7f}},
+	"i64.div_u": {code: []byte{0x80}},
+	"i64.rem_s": {code: []byte{0x81}},
+	"i64.rem_u": {code: []byte{0x82}},
+	"i64.and":   {code: []byte{0x83}},
+	"i64.or":    {code: []byte{0x84}},
+	"i64.xor":   {code: []byte{0x85}},
+
+	"f64.abs":   {code: []byte{0x99}},
+	"f64.neg":   {code: []byte{0x9a}},
+	"f64.trunc": {code: []byte{0x9d}},
+	"f64.sqrt":  {code: []byte{0x9f}},
+	"f64.add":   {code: []byte{0xa0}},
+	"f64.sub":   {code: []byte{0xa1}},
+	"f64.mul":   {code: []byte{0xa2}},
+	"f64.div":   {code: []byte{0xa3}},
+
+	"i32.wrap_i64":        {code: []byte{0xa7}},
+	"i64.extend_i32_s":    {code: []byte{0xac}},
+	"i64.extend_i32_u":    {code: []byte{0xad}},
+	"i64.trunc_f64_s":     {code: []byte{0xb0}},
+	"f64.convert_i32_s":   {code: []byte{0xb7}},
+	"f64.convert_i64_s":   {code: []byte{0xb9}},
+	"i64.reinterpret_f64": {code: []byte{0xbd}},
+	"f64.reinterpret_i64": {code: []byte{0xbf}},
+}
+
+// instrs encodes a sequence of instructions, plain or folded
+func (f *funcAssembler) instrs(nodes []*sexpr) error {
+	for idx := 0; idx < len(nodes); idx++ {
+		node := nodes[idx]
+		if node.isList {
+			if err := f.folded(node); err != nil {
+				return err
+			}
+			continue
+		}
+		op, ok := opcodes[node.atom]
+		if !ok {
+			return fmt.Errorf("line %d: unknown instruction %s", node.line, node)
+		}
+		// immediates of a plain instruction follow it
+		var args []*sexpr
+		for idx+1 < len(nodes) && f.isImmediate(op, args, nodes[idx+1]) {
+			idx++
+			args = append(args, nodes[idx])
+		}
+		if err := f.instr(node, op, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isImmediate tells whether the node is the next immediate of the instruction with args read so far
+func (f *funcAssembler) isImmediate(op opcode, args []*sexpr, node *sexpr) bool {
+	switch op.immediate {
+	case blockImmediate:
+		// an optional label, then an optional result type
+		if node.isList {
+			return node.isHead("result")
+		}
+		return len(args) == 0 && strings.HasPrefix(node.atom, "$")
+	case labelsImmediate:
+		return !node.isList && !node.str && node.atom != "" &&
+			(strings.HasPrefix(node.atom, "$") || node.atom[0] >= '0' && node.atom[0] <= '9')
+	case memoryImmediate:
+		return !node.isList && (strings.HasPrefix(node.atom, "offset=") || strings.HasPrefix(node.atom, "align="))
+	case noImmediate, memory1Immediate, memory2Immediate:
+		return false
+	}
+	return len(args) == 0 && !node.isList
+}
+
+// folded encodes an instruction written as an S-expression, its operands first
+func (f *funcAssembler) folded(node *sexpr) error {
+	if len(node.list) == 0 || node.list[0].isList {
+		return fmt.Errorf("line %d: expected an instruction", node.line)
+	}
+	head := node.list[0]
+	op, ok := opcodes[head.atom]
+	if !ok {
+		return fmt.Errorf("line %d: unknown instruction %s", head.line, head)
+	}
+	rest := node.list[1:]
+	var args []*sexpr
+	for len(rest) > 0 && f.isImmediate(op, args, rest[0]) {
+		args = append(args, rest[0])
+		rest = rest[1:]
+	}
+	switch head.atom {
+	case "block", "loop":
+		if err := f.instr(head, op, args); err != nil {
+			return err
+		}
+		if err := f.instrs(rest); err != nil {
+			return err
+		}
+		return f.instr(head, opcodes["end"], nil)
+	case "if":
+		// (if cond... (then ...) (else ...))
+		var then, els *sexpr
+		var cond []*sexpr
+		for _, n := range rest {
+			switch {
+			case n.isHead("then"):
+				then = n
+			case n.isHead("else"):
+				els = n
+			default:
+				cond = append(cond, n)
+			}
+		}
+		if then == nil {
+			return fmt.Errorf("line %d: if without then", node.line)
+		}
+		if err := f.instrs(cond); err != nil {
+			return err
+		}
+		if err := f.instr(head, op, args); err != nil {
+			return err
+		}
+		if err := f.instrs(then.list[1:]); err != nil {
+			return err
+		}
+		if els != nil {
+			if err := f.instr(head, opcodes["else"], nil); err != nil {
+				return err
+			}
+			if err := f.instrs(els.list[1:]); err != nil {
+				return err
+			}
+		}
+		return f.instr(head, opcodes["end"], nil)
+	}
+	for _, operand := range rest {
+		if !operand.isList {
+			return fmt.Errorf("line %d: unexpected %s", operand.line, operand)
+		}
+		if err := f.folded(operand); err != nil {
+			return err
+		}
+	}
+	return f.instr(head, op, args)
+}
+
+// instr encodes a single instruction along with its immediates
+func (f *funcAssembler) instr(node *sexpr, op opcode, args []*sexpr) error {
+	f.out.Write(op.code)
+	if op.code[0] == opcodes["end"].code[0] {
+		if len(f.labels) == 0 {
+			return fmt.Errorf("line %d: end without a block", node.line)
+		}
+		f.labels = f.labels[:len(f.labels)-1]
+	}
+	arg := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("line %d: %s takes an immediate", node.line, node)
+		}
+		return args[0].atom, nil
+	}
+	switch op.immediate {
+	case blockImmediate:
+		label := ""
+		blockType := byte(0x40)
+		for _, a := range args {
+			if a.isList {
+				if len(a.list) != 2 {
+					return fmt.Errorf("line %d: blocks have a single result", a.line)
+				}
+				valueType, ok := valueTypes[a.list[1].atom]
+				if !ok {
+					return fmt.Errorf("line %d: unknown type %s", a.line, a.list[1])
+				}
+				blockType = valueType
+			} else {
+				label = a.atom
+			}
+		}
+		f.out.WriteByte(blockType)
+		f.labels = append(f.labels, label)
+	case labelImmediate:
+		label, err := arg()
+		if err != nil {
+			return err
+		}
+		depth, err := f.depth(label)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.line, err)
+		}
+		writeU32(f.out, depth)
+	case labelsImmediate:
+		if len(args) == 0 {
+			return fmt.Errorf("line %d: %s takes a default label", node.line, node)
+		}
+		writeU32(f.out, len(args)-1)
+		for _, a := range args {
+			depth, err := f.depth(a.atom)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", node.line, err)
+			}
+			writeU32(f.out, depth)
+		}
+	case funcImmediate, localImmediate, globalImmediate:
+		name, err := arg()
+		if err != nil {
+			return err
+		}
+		index, err := f.index(op.immediate, name)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.line, err)
+		}
+		writeU32(f.out, index)
+	case memoryImmediate:
+		align, offset := op.align, 0
+		for _, a := range args {
+			key, value := strings.SplitN(a.atom, "=", 2)[0], strings.SplitN(a.atom, "=", 2)[1]
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", a.line, err)
+			}
+			if key == "offset" {
+				offset = n
+			} else {
+				align = 0
+				for 1<<align < n {
+					align++
+				}
+			}
+		}
+		writeU32(f.out, align)
+		writeU32(f.out, offset)
+	case i32Immediate:
+		literal, err := arg()
+		if err != nil {
+			return err
+		}
+		value, err := parseInt(literal, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.line, err)
+		}
+		writeS64(f.out, int64(int32(value)))
+	case i64Immediate:
+		literal, err := arg()
+		if err != nil {
+			return err
+		}
+		value, err := parseInt(literal, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.line, err)
+		}
+		writeS64(f.out, value)
+	case f64Immediate:
+		literal, err := arg()
+		if err != nil {
+			return err
+		}
+		value, err := parseFloat(literal)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.line, err)
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		f.out.Write(b[:])
+	case memory1Immediate:
+		f.out.WriteByte(0x00)
+	case memory2Immediate:
+		f.out.Write([]byte{0x00, 0x00})
+	}
+	return nil
+}
+
+// depth returns the depth of the block a branch refers to
+func (f *funcAssembler) depth(label string) (int, error) {
+	if !strings.HasPrefix(label, "$") {
+		return strconv.Atoi(label)
+	}
+	for idx := len(f.labels) - 1; idx >= 0; idx-- {
+		if f.labels[idx] == label {
+			return len(f.labels) - 1 - idx, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown label %s", label)
+}
+
+func (f *funcAssembler) index(immediate immediate, name string) (int, error) {
+	if !strings.HasPrefix(name, "$") {
+		return strconv.Atoi(name)
+	}
+	var indexes map[string]int
+	switch immediate {
+	case funcImmediate:
+		indexes = f.funcs
+	case localImmediate:
+		indexes = f.locals
+	case globalImmediate:
+		indexes = f.globals
+	}
+	index, ok := indexes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown name %s", name)
+	}
+	return index, nil
+}
+
+// parseInt parses an integer literal, which may be written unsigned or in hex
+func parseInt(literal string, bits int) (int64, error) {
+	literal = strings.ReplaceAll(literal, "_", "")
+	if value, err := strconv.ParseInt(literal, 0, bits); err == nil {
+		return value, nil
+	}
+	value, err := strconv.ParseUint(literal, 0, bits)
+	return int64(value), err
+}
+
+func parseFloat(literal string) (float64, error) {
+	switch strings.TrimPrefix(literal, "+") {
+	case "nan":
+		return math.NaN(), nil
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(strings.ReplaceAll(literal, "_", ""), 64)
+}
+
+func writeU32(out *bytes.Buffer, value int) {
+	var b [binary.MaxVarintLen64]byte
+	out.Write(b[:binary.PutUvarint(b[:], uint64(value))])
+}
+
+// writeS64 writes the value in signed LEB128, which isn't what binary.PutVarint does
+func writeS64(out *bytes.Buffer, value int64) {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			out.WriteByte(b)
+			return
+		}
+		out.WriteByte(b | 0x80)
+	}
+}
+
+func writeName(out *bytes.Buffer, name string) {
+	writeU32(out, len(name))
+	out.WriteString(name)
+}